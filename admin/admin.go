@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("admin")
+
+var mux = http.NewServeMux()
+
+// Handle registers a debug endpoint, served once Listen is called
+func Handle(path string, handler http.Handler) {
+	mux.Handle(path, handler)
+}
+
+// HandleJSON registers a debug endpoint that serves the result of f as JSON
+func HandleJSON(path string, f func() interface{}) {
+	Handle(path, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		content, err := json.MarshalIndent(f(), "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(append(content, '\n'))
+	}))
+}
+
+// Listen serves the debug endpoints on addr in the background
+func Listen(addr string) {
+	go func() {
+		log.Infof("Listening for admin requests on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Failed to serve admin requests on %s: %v", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// EnablePprof registers the runtime profiling endpoints under
+// /debug/pprof/. Unless allowRemote is set they only answer loopback
+// clients, even when the admin listener is bound to other addresses.
+func EnablePprof(allowRemote bool) {
+	guard := func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !allowRemote && !isLoopback(req.RemoteAddr) {
+				http.Error(rw, "profiling is only available from loopback", http.StatusForbidden)
+				return
+			}
+			h(rw, req)
+		})
+	}
+
+	Handle("/debug/pprof/", guard(pprof.Index))
+	Handle("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	Handle("/debug/pprof/profile", guard(pprof.Profile))
+	Handle("/debug/pprof/symbol", guard(pprof.Symbol))
+	Handle("/debug/pprof/trace", guard(pprof.Trace))
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rancher/plugin-manager/health"
+)
+
+var (
+	reconcileLock sync.Mutex
+	reconcilers   = map[string]func() error{}
+)
+
+// Pass makes one pass of subsystem name with lock held and reports its
+// result to health. The subsystem's metadata loop and admin triggered
+// passes all go through it, so they take turns
+func Pass(name string, lock sync.Locker, pass func() error) error {
+	lock.Lock()
+	defer lock.Unlock()
+	done := health.Begin(name)
+	err := pass()
+	done(err)
+	return err
+}
+
+// RegisterReconcile lets an operator run f, a full pass of subsystem name
+// that applies everything again even if nothing changed
+func RegisterReconcile(name string, f func() error) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+	reconcilers[name] = f
+}
+
+// Reconcile runs the pass of subsystem name, or of every subsystem with
+// "all", and returns each one's result, "ok" or its error
+func Reconcile(name string) (map[string]string, error) {
+	reconcileLock.Lock()
+	run := map[string]func() error{}
+	var names []string
+	for n, f := range reconcilers {
+		if name == "all" || name == n {
+			run[n] = f
+		}
+		names = append(names, n)
+	}
+	reconcileLock.Unlock()
+	if len(run) == 0 {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown subsystem %q, expected all or one of %s", name, strings.Join(names, ", "))
+	}
+
+	results := map[string]string{}
+	for n, f := range run {
+		log.Infof("Reconciling %s on request", n)
+		if err := f(); err != nil {
+			log.WithError(err).Errorf("Requested reconcile of %s failed", n)
+			results[n] = err.Error()
+		} else {
+			results[n] = "ok"
+		}
+	}
+	return results, nil
+}
+
+// ReconcileHandler runs the passes on POST /reconcile/<subsystem|all>. It
+// answers each subsystem's result, with a 500 if any failed.
+func ReconcileHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/reconcile"), "/")
+		if name == "" {
+			name = "all"
+		}
+		results, err := Reconcile(name)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		content, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		for _, result := range results {
+			if result != "ok" {
+				rw.WriteHeader(http.StatusInternalServerError)
+				break
+			}
+		}
+		rw.Write(append(content, '\n'))
+	})
+}
@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rancher/plugin-manager/atomicfile"
+)
+
+var (
+	stateLock      sync.Mutex
+	stateProviders = map[string]func() interface{}{}
+)
+
+// RegisterState adds f's result under name to state dumps
+func RegisterState(name string, f func() interface{}) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateProviders[name] = f
+}
+
+// State collects every registered subsystem's state along with the
+// goroutine stacks
+func State() map[string]interface{} {
+	stateLock.Lock()
+	providers := map[string]func() interface{}{}
+	for name, f := range stateProviders {
+		providers[name] = f
+	}
+	stateLock.Unlock()
+
+	state := map[string]interface{}{
+		"time": time.Now(),
+		"pid":  os.Getpid(),
+	}
+	for name, f := range providers {
+		state[name] = f()
+	}
+
+	stacks := &bytes.Buffer{}
+	if err := pprof.Lookup("goroutine").WriteTo(stacks, 2); err == nil {
+		state["goroutines"] = stacks.String()
+	}
+	return state
+}
+
+// DumpState writes State to a new file in dir and returns its path
+func DumpState(dir string) (string, error) {
+	content, err := json.MarshalIndent(State(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, fmt.Sprintf("plugin-manager-state-%s.json", time.Now().UTC().Format("20060102T150405.000")))
+	if err := atomicfile.WriteFile(p, append(content, '\n'), 0600); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// WatchDumpSignal dumps state to dir on SIGQUIT instead of exiting with a
+// stack trace
+func WatchDumpSignal(dir string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGQUIT)
+	go func() {
+		for range c {
+			p, err := DumpState(dir)
+			if err != nil {
+				log.WithError(err).Error("Failed to dump state")
+				continue
+			}
+			log.Infof("Dumped state to %s", p)
+		}
+	}()
+}
+
+// StateHandler serves the state on GET, and writes a dump to dir and
+// answers its path on POST
+func StateHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var result interface{}
+		switch req.Method {
+		case "GET":
+			result = State()
+		case "POST":
+			p, err := DumpState(dir)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Dumped state to %s", p)
+			result = map[string]string{"path": p}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		content, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(append(content, '\n'))
+	})
+}
@@ -0,0 +1,145 @@
+package alerts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/watchdog"
+)
+
+var log = logging.Subsystem("alerts")
+
+// threshold is how many failures in a row raise an alert for a subsystem,
+// guarded by lock
+var threshold = 3
+
+var active = metrics.NewGauge("plugin_manager_alerts_active",
+	"1 while a subsystem has failed the threshold number of times in a row", "subsystem")
+
+var (
+	lock     sync.Mutex
+	failures = map[string]*Alert{}
+)
+
+// Alert is a subsystem that keeps failing
+type Alert struct {
+	Subsystem string    `json:"subsystem"`
+	Message   string    `json:"message"`
+	Count     int       `json:"count"`
+	Since     time.Time `json:"since"`
+}
+
+// String leaves out the count, the summary reported to the host label
+// only changes when the failure does. Rewriting the label changes metadata
+// and triggers every subsystem again.
+func (a Alert) String() string {
+	return fmt.Sprintf("%s failing: %s", a.Subsystem, a.Message)
+}
+
+// SetThreshold changes how many failures in a row raise an alert
+func SetThreshold(n int) {
+	lock.Lock()
+	defer lock.Unlock()
+	threshold = n
+}
+
+// Failed counts a failure against subsystem, raising an alert once it has
+// failed the threshold number of times without a success in between
+func Failed(subsystem string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	a, ok := failures[subsystem]
+	if !ok {
+		a = &Alert{Subsystem: subsystem, Since: time.Now()}
+		failures[subsystem] = a
+	}
+	a.Count++
+	a.Message = err.Error()
+	if a.Count == threshold {
+		log.Warnf("Raising alert, %s failed %d times: %s", subsystem, a.Count, a.Message)
+		active.Set(1, subsystem)
+	}
+}
+
+// Succeeded clears the failures counted against subsystem
+func Succeeded(subsystem string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if a, ok := failures[subsystem]; ok {
+		if a.Count >= threshold {
+			log.Infof("Clearing alert for %s", subsystem)
+			active.Set(0, subsystem)
+		}
+		delete(failures, subsystem)
+	}
+}
+
+// Record calls Failed or Succeeded depending on err
+func Record(subsystem string, err error) {
+	if err != nil {
+		Failed(subsystem, err)
+	} else {
+		Succeeded(subsystem)
+	}
+}
+
+// Active returns the raised alerts sorted by subsystem
+func Active() []Alert {
+	lock.Lock()
+	defer lock.Unlock()
+	result := []Alert{}
+	for _, a := range failures {
+		if a.Count >= threshold {
+			result = append(result, *a)
+		}
+	}
+	sort.Sort(bySubsystem(result))
+	return result
+}
+
+type bySubsystem []Alert
+
+func (b bySubsystem) Len() int           { return len(b) }
+func (b bySubsystem) Less(i, j int) bool { return b[i].Subsystem < b[j].Subsystem }
+func (b bySubsystem) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Summary joins alerts into one line
+func Summary(alerts []Alert) string {
+	var parts []string
+	for _, a := range alerts {
+		parts = append(parts, a.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Reporter publishes the active alerts somewhere operators will see them.
+// It is called with an empty list once every alert has cleared.
+type Reporter interface {
+	Report(alerts []Alert) error
+}
+
+// Start reports the active alerts through r every interval whenever they
+// differ from what was last reported successfully
+func Start(r Reporter, interval time.Duration) {
+	watchdog.Go("alerts.report", func() {
+		reported := ""
+		for {
+			health.Heartbeat("alerts.report", interval+30*time.Second)
+			alerts := Active()
+			if summary := Summary(alerts); summary != reported {
+				if err := r.Report(alerts); err != nil {
+					log.WithError(err).Error("Failed to report alerts")
+				} else {
+					reported = summary
+				}
+			}
+			time.Sleep(interval)
+		}
+	})
+}
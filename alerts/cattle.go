@@ -0,0 +1,137 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/plugin-manager/source"
+)
+
+// HostLabel carries the active alerts on the host, where the Rancher UI
+// shows them
+const HostLabel = "io.rancher.network.alerts"
+
+// maxLabelLength keeps the summary within what the API accepts for a label
+const maxLabelLength = 1024
+
+type cattleReporter struct {
+	url       string
+	accessKey string
+	secretKey string
+	c         source.MetadataSource
+	client    *http.Client
+}
+
+type cattleHost struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Links  map[string]string `json:"links"`
+}
+
+// NewCattleReporter reports alerts by setting HostLabel on this host
+// through the Rancher API at apiURL. The host is looked up by the UUID
+// metadata reports for self.
+func NewCattleReporter(apiURL, accessKey, secretKey string, c source.MetadataSource) Reporter {
+	return &cattleReporter{
+		url:       strings.TrimSuffix(apiURL, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		c:         c,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (r *cattleReporter) Report(alerts []Alert) error {
+	self, err := r.c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+
+	host, err := r.host(self.UUID)
+	if err != nil {
+		return err
+	}
+
+	summary := Summary(alerts)
+	if len(summary) > maxLabelLength {
+		summary = summary[:maxLabelLength]
+	}
+	if host.Labels[HostLabel] == summary {
+		return nil
+	}
+
+	labels := map[string]string{}
+	for k, v := range host.Labels {
+		labels[k] = v
+	}
+	if summary == "" {
+		delete(labels, HostLabel)
+	} else {
+		labels[HostLabel] = summary
+	}
+
+	content, err := json.Marshal(map[string]interface{}{"labels": labels})
+	if err != nil {
+		return err
+	}
+	return r.do("PUT", host.Links["self"], bytes.NewReader(content), nil)
+}
+
+func (r *cattleReporter) host(uuid string) (cattleHost, error) {
+	var collection struct {
+		Data []cattleHost `json:"data"`
+	}
+	if err := r.do("GET", r.url+"/hosts?uuid="+url.QueryEscape(uuid), nil, &collection); err != nil {
+		return cattleHost{}, err
+	}
+	if len(collection.Data) == 0 {
+		return cattleHost{}, fmt.Errorf("host %s not found in the Rancher API", uuid)
+	}
+	host := collection.Data[0]
+	if host.Links["self"] == "" {
+		host.Links = map[string]string{"self": r.url + "/hosts/" + host.ID}
+	}
+	return host, nil
+}
+
+func (r *cattleReporter) do(method, u string, body *bytes.Reader, into interface{}) error {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, u, body)
+	} else {
+		req, err = http.NewRequest(method, u, nil)
+	}
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(r.accessKey, r.secretKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, bytes.TrimSpace(content))
+	}
+	if into == nil {
+		return nil
+	}
+	return json.Unmarshal(content, into)
+}
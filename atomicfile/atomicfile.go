@@ -0,0 +1,106 @@
+package atomicfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("atomicfile")
+
+// WriteFile writes content next to p, syncs it and renames it into place so
+// readers see either the old or new file and never a partial one
+func WriteFile(p string, content []byte, mode os.FileMode) error {
+	return Write(p, bytes.NewReader(content), mode)
+}
+
+// CopyFile atomically replaces dst with the contents of src
+func CopyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return Write(dst, in, mode)
+}
+
+// Write stages r in a uniquely named temp file in the same directory as p
+// and renames it over p. Processes already executing the old file keep
+// running it, new execs only ever see the complete new file.
+func Write(p string, r io.Reader, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		if !isTextBusy(err) {
+			return err
+		}
+		if err := stage(tmp.Name(), p); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(filepath.Dir(p))
+}
+
+// stage handles filesystems that refuse to replace a running executable by
+// moving the busy file aside first. The old file is unlinked once the new
+// one is in place; running processes keep their reference to it.
+func stage(tmp, p string) error {
+	old := fmt.Sprintf("%s.old.%d", filepath.Join(filepath.Dir(p), "."+filepath.Base(p)), time.Now().UnixNano())
+	log.Debugf("%s is busy, moving it to %s before replacing", p, old)
+	if err := os.Rename(p, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		// Put the old file back rather than leave nothing at p
+		os.Rename(old, p)
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		log.Errorf("Failed to remove %s: %v", old, err)
+	}
+	return nil
+}
+
+func isTextBusy(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err == syscall.ETXTBSY
+	}
+	return false
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,177 @@
+// Package audit records every change plugin-manager makes to the host as
+// JSON lines, for compliance on shared hosts, and in a dry run logs the
+// changes it would make instead
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("audit")
+
+var wouldCount = metrics.NewCounter("plugin_manager_dry_run_skipped_total",
+	"Changes skipped in a dry run, by subsystem and action", "subsystem", "action")
+
+var (
+	lock   sync.Mutex
+	out    io.Writer
+	dryRun bool
+)
+
+// Event is one change to the host
+type Event struct {
+	Time      time.Time   `json:"time"`
+	Subsystem string      `json:"subsystem"`
+	Action    string      `json:"action"`
+	Object    string      `json:"object"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Open appends events to the file at path, creating it if needed
+func Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	out = f
+	return nil
+}
+
+// Enabled reports whether events are being recorded, so callers can skip
+// gathering expensive before and after context
+func Enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return out != nil
+}
+
+// SetDryRun turns dry-run mode on or off. Subsystems still work out every
+// change but report it with Would rather than make it.
+func SetDryRun(on bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	dryRun = on
+}
+
+// DryRun reports whether changes to the host are being skipped
+func DryRun() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return dryRun
+}
+
+// Would reports whether this is a dry run, logging the change to object
+// with a WOULD prefix when it is. Callers skip making the change when it
+// returns true.
+func Would(subsystem, action, object string, after interface{}) bool {
+	if !DryRun() {
+		return false
+	}
+	msg := fmt.Sprintf("WOULD %s %s", action, object)
+	if after != nil {
+		msg = fmt.Sprintf("%s: %v", msg, after)
+	}
+	logging.Subsystem(subsystem).WithField("dryRun", true).Info(msg)
+	wouldCount.Inc(subsystem, action)
+	return true
+}
+
+// Record writes an event for a change to object, err being the result of
+// making it. Nothing is recorded in a dry run, where no change is made.
+func Record(subsystem, action, object string, before, after interface{}, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if out == nil || dryRun {
+		return
+	}
+
+	event := Event{
+		Time:      time.Now().UTC(),
+		Subsystem: subsystem,
+		Action:    action,
+		Object:    object,
+		Before:    before,
+		After:     after,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	content, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		log.WithError(jsonErr).Errorf("Failed to encode audit event for %s %s", action, object)
+		return
+	}
+	if _, writeErr := out.Write(append(content, '\n')); writeErr != nil {
+		log.WithError(writeErr).Error("Failed to write audit event")
+	}
+}
+
+// FileState identifies a file's content without recording it
+type FileState struct {
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+func fileState(path string) *FileState {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil
+	}
+	return &FileState{
+		Size:   info.Size(),
+		Mode:   info.Mode(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// File runs change, which writes or removes path, and records the file's
+// state before and after it. Rewrites that leave the file as it was aren't
+// recorded. In a dry run change isn't run.
+func File(subsystem, action, path string, change func() error) error {
+	if Would(subsystem, action, path, nil) {
+		return nil
+	}
+	if !Enabled() {
+		return change()
+	}
+	before := fileState(path)
+	err := change()
+	after := fileState(path)
+	if err == nil && (before == nil && after == nil || before != nil && after != nil && *before == *after) {
+		return nil
+	}
+	// Interfaces holding nil pointers aren't omitted from the JSON
+	var b, a interface{}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	Record(subsystem, action, path, b, a, err)
+	return err
+}
@@ -0,0 +1,65 @@
+package binexec
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// elfMachines maps GOARCH to the ELF machine binaries for it are built for
+var elfMachines = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"386":     elf.EM_386,
+	"arm64":   elf.EM_AARCH64,
+	"arm":     elf.EM_ARM,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+}
+
+// archVariants are the file names checked, in order, for a binary built for
+// the host architecture before falling back to the plain name
+func archVariants(name string) []string {
+	return []string{
+		name + "-" + runtime.GOARCH,
+		name + "_" + runtime.GOARCH,
+		name,
+	}
+}
+
+// resolveArch returns the file in the plugin container to run for name on
+// this host's architecture
+func resolveArch(pid int, name string) string {
+	for _, file := range archVariants(name) {
+		if _, err := os.Stat(containerBinaryPath(pid, file)); err == nil {
+			return file
+		}
+	}
+	return name
+}
+
+// checkArch refuses ELF binaries built for another architecture. Anything
+// that isn't ELF, such as a script, is allowed through.
+func checkArch(name string, r io.ReaderAt) error {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	want, ok := elfMachines[runtime.GOARCH]
+	if !ok || f.Machine == want {
+		return nil
+	}
+	return fmt.Errorf("%s is built for %s, host is %s", name, f.Machine, runtime.GOARCH)
+}
+
+func checkFileArch(name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkArch(name, f)
+}
@@ -0,0 +1,122 @@
+package binexec
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rancher/plugin-manager/atomicfile"
+)
+
+// digestCache maps an image ID and binary name to the digest of that binary,
+// so every container started from the same plugin image shares one hash,
+// verification and copy into the version store. Shims run that copy, so a
+// container modifying its binary after start changes nothing.
+type digestCache struct {
+	sync.Mutex
+	path    string
+	entries map[string]string
+}
+
+func loadDigestCache() *digestCache {
+	c := &digestCache{
+		path:    filepath.Join(versionDir, "digests.json"),
+		entries: map[string]string{},
+	}
+
+	content, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c
+	} else if err != nil {
+		log.Errorf("Failed to read %s: %v", c.path, err)
+		return c
+	}
+
+	if err := json.Unmarshal(content, &c.entries); err != nil {
+		log.Errorf("Ignoring corrupt digest cache %s: %v", c.path, err)
+		c.entries = map[string]string{}
+	}
+	return c
+}
+
+func cacheKey(image, name string) string {
+	return image + "/" + name
+}
+
+func (c *digestCache) get(image, name string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	digest, ok := c.entries[cacheKey(image, name)]
+	return digest, ok
+}
+
+func (c *digestCache) set(image, name, digest string) {
+	c.Lock()
+	defer c.Unlock()
+	key := cacheKey(image, name)
+	if c.entries[key] == digest {
+		return
+	}
+	c.entries[key] = digest
+	if err := c.save(); err != nil {
+		log.WithError(err).Error("Failed to save digest cache")
+	}
+}
+
+// forget drops the digest of a binary found modified so it is hashed again
+func (c *digestCache) forget(image, name string) {
+	c.Lock()
+	defer c.Unlock()
+	key := cacheKey(image, name)
+	if _, ok := c.entries[key]; !ok {
+		return
+	}
+	delete(c.entries, key)
+	if err := c.save(); err != nil {
+		log.WithError(err).Error("Failed to save digest cache")
+	}
+}
+
+// prune forgets images no plugin container uses anymore
+func (c *digestCache) prune(keep map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+	changed := false
+	for key := range c.entries {
+		if !keep[key] {
+			delete(c.entries, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := c.save(); err != nil {
+			log.WithError(err).Error("Failed to save digest cache")
+		}
+	}
+}
+
+func (c *digestCache) save() error {
+	content, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, content, 0600)
+}
+
+// digest returns the digest of the binary's copy in the version store,
+// copying it out of the container only the first time its image is seen or
+// when the copy is gone
+func (w *Watcher) digest(image string, pid int, b binary) (string, bool, error) {
+	if digest, ok := w.cache.get(image, b.Name); ok {
+		if _, err := os.Stat(versionPath(b.Name, digest)); err == nil {
+			return digest, true, nil
+		}
+	}
+	digest, err := w.saveVersion(pid, b)
+	return digest, false, err
+}
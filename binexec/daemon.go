@@ -0,0 +1,166 @@
+package binexec
+
+import (
+	"bytes"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/sandbox"
+)
+
+var (
+	daemonBackoff    = time.Second
+	maxDaemonBackoff = time.Minute
+	daemonStopWait   = 10 * time.Second
+)
+
+var daemonRestarts = metrics.NewCounter("plugin_manager_binexec_daemon_restarts_total",
+	"Times a downloaded daemon, such as flanneld, exited and was started again", "binary")
+
+// daemon is a downloaded binary kept running, restarted with a growing
+// backoff whenever it exits. It runs the verified copy in the version store
+// through the sandbox like the shims do.
+type daemon struct {
+	name    string
+	sha256  string
+	args    []string
+	path    string
+	sandbox *sandbox.Config
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// superviseDaemons starts the daemons remote declares once their download
+// is installed, restarts those whose binary or args changed and stops the
+// ones no longer declared
+func (w *Watcher) superviseDaemons(remote map[string]remoteBinary) {
+	for name, d := range w.daemons {
+		if b, ok := remote[name]; ok && b.Daemon && b.SHA256 == d.sha256 && reflect.DeepEqual(b.Args, d.args) {
+			continue
+		}
+		log.Infof("Stopping %s", name)
+		d.shutdown()
+		delete(w.daemons, name)
+	}
+
+	for name, b := range remote {
+		if _, running := w.daemons[name]; running || !b.Daemon {
+			continue
+		}
+		if i, ok := w.installs[name]; !ok || i.Source != "url" || i.Digest != b.SHA256 {
+			continue
+		}
+		config, err := w.sandboxConfig(binary{Name: name})
+		if err != nil {
+			log.Errorf("Not starting %s: %v", name, err)
+			continue
+		}
+		if audit.Would("binexec", "daemon.start", name, b.Args) {
+			continue
+		}
+		d := &daemon{
+			name:    name,
+			sha256:  b.SHA256,
+			args:    b.Args,
+			path:    versionPath(name, b.SHA256),
+			sandbox: config,
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		log.Infof("Starting %s %v", name, b.Args)
+		w.daemons[name] = d
+		go d.run()
+	}
+}
+
+func (d *daemon) run() {
+	defer close(d.done)
+	backoff := daemonBackoff
+	for {
+		started := time.Now()
+		err := d.runOnce()
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		if time.Now().Sub(started) > maxDaemonBackoff {
+			backoff = daemonBackoff
+		}
+		if err != nil {
+			log.Errorf("%s exited, starting it again in %v: %v", d.name, backoff, err)
+		} else {
+			log.Warnf("%s exited, starting it again in %v", d.name, backoff)
+		}
+		daemonRestarts.Inc(d.name)
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxDaemonBackoff {
+			backoff = maxDaemonBackoff
+		}
+	}
+}
+
+// runOnce runs the daemon until it exits or is stopped. It is killed with
+// plugin-manager rather than left running unsupervised.
+func (d *daemon) runOnce() error {
+	argv := append([]string{d.path}, d.args...)
+	if d.sandbox != nil {
+		argv = append(append(append([]string{selfPath(), "sandbox"}, sandboxArgs(d.sandbox)...), "--"), argv...)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	output := &daemonOutput{name: d.name}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return err
+	case <-d.stop:
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(daemonStopWait):
+			cmd.Process.Kill()
+			<-exited
+		}
+		return nil
+	}
+}
+
+// daemonOutput logs what a daemon writes, line by line
+type daemonOutput struct {
+	name string
+	buf  bytes.Buffer
+}
+
+func (o *daemonOutput) Write(p []byte) (int, error) {
+	o.buf.Write(p)
+	for {
+		i := bytes.IndexByte(o.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(o.buf.Next(i + 1))
+		log.WithField("daemon", o.name).Info(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (d *daemon) shutdown() {
+	close(d.stop)
+	<-d.done
+}
@@ -0,0 +1,66 @@
+package binexec
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+var (
+	envMetadataKey = "cniEnvironment"
+	hostEnvPrefix  = "io.rancher.network.cni.env."
+
+	envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// pluginEnv is the environment passed to a plugin's binary. Services declare
+// it in their "cniEnvironment" metadata and hosts override it with
+// io.rancher.network.cni.env.<NAME> labels. The CNI_ variables the runtime
+// passes can't be overridden.
+func pluginEnv(service metadata.Service, host metadata.Host) map[string]string {
+	env := map[string]string{}
+
+	declared, _ := service.Metadata[envMetadataKey].(map[string]interface{})
+	for k, v := range declared {
+		env[k] = fmt.Sprint(v)
+	}
+	for k, v := range host.Labels {
+		if strings.HasPrefix(k, hostEnvPrefix) {
+			env[strings.TrimPrefix(k, hostEnvPrefix)] = v
+		}
+	}
+
+	for k := range env {
+		if !envName.MatchString(k) || strings.HasPrefix(k, "CNI_") {
+			log.Errorf("Ignoring invalid plugin environment variable %q for service %s", k, service.Name)
+			delete(env, k)
+		}
+	}
+
+	if len(env) == 0 {
+		return nil
+	}
+	return env
+}
+
+// shellQuote single quotes s for /bin/sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+func renderEnv(env map[string]string) string {
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("export %s=%s\n", k, shellQuote(env[k])))
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,106 @@
+package binexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/source"
+)
+
+var (
+	gcEvery        = time.Hour
+	orphanedMarker = ".orphaned"
+	lastRunMarker  = ".last-run"
+)
+
+// touch creates or updates a marker file in the binary's version dir, the
+// markers keep GC state across restarts
+func touch(name, marker string) {
+	dir := filepath.Join(versionDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	p := filepath.Join(dir, marker)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); os.IsNotExist(err) {
+		ioutil.WriteFile(p, nil, 0600)
+	}
+}
+
+func markerTime(name, marker string) (time.Time, bool) {
+	info, err := os.Stat(filepath.Join(versionDir, name, marker))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// managedNames are the binaries binexec has installed or downloaded,
+// including ones from before a restart that only have a version dir left
+func (w *Watcher) managedNames() map[string]bool {
+	names := map[string]bool{}
+	for name := range w.installs {
+		names[name] = true
+	}
+	for name := range w.appliedRemote {
+		names[name] = true
+	}
+	dirs, _ := ioutil.ReadDir(versionDir)
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			names[dir.Name()] = true
+		}
+	}
+	return names
+}
+
+// gc removes binaries whose source is gone when neither the source went away
+// nor the binary last ran within the retention period
+func (w *Watcher) gc(active map[string]bool) {
+	if w.opts.Retention <= 0 || time.Now().Sub(w.lastGC) < gcEvery || source.IsStale(w.c) {
+		return
+	}
+	w.lastGC = time.Now()
+
+	for name := range w.managedNames() {
+		if active[name] {
+			os.Remove(filepath.Join(versionDir, name, orphanedMarker))
+			continue
+		}
+
+		orphaned, ok := markerTime(name, orphanedMarker)
+		if !ok {
+			log.Infof("Source of plugin binary %s is gone, removing it after %v unused", name, w.opts.Retention)
+			touch(name, orphanedMarker)
+			continue
+		}
+
+		lastUsed := orphaned
+		if lastRun, ok := markerTime(name, lastRunMarker); ok && lastRun.After(lastUsed) {
+			lastUsed = lastRun
+		}
+		if time.Now().Sub(lastUsed) < w.opts.Retention {
+			continue
+		}
+
+		if audit.Would("binexec", "file.remove", filepath.Join(binDir, name), "unused since "+lastUsed.String()) {
+			continue
+		}
+		log.Infof("Removing plugin binary %s, unused since %v", name, lastUsed)
+		p := filepath.Join(binDir, name)
+		if err := removeBinary(p); err != nil {
+			log.Errorf("Failed to remove %s: %v", p, err)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(versionDir, name)); err != nil {
+			log.Errorf("Failed to remove saved versions of %s: %v", name, err)
+		}
+		delete(w.installs, name)
+		delete(w.digests, name)
+		delete(w.pinned, name)
+		delete(w.health, name)
+	}
+}
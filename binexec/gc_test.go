@@ -0,0 +1,65 @@
+package binexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGCRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldBinDir, oldVersionDir := binDir, versionDir
+	defer func() { binDir, versionDir = oldBinDir, oldVersionDir }()
+	binDir, versionDir = filepath.Join(dir, "bin"), filepath.Join(dir, "versions")
+	os.MkdirAll(binDir, 0700)
+
+	w := &Watcher{
+		opts:     Options{Retention: time.Hour},
+		digests:  map[string]string{},
+		pinned:   map[string]pin{},
+		installs: map[string]install{},
+		health:   map[string]Health{},
+	}
+	for _, name := range []string{"flanneld", "bridge"} {
+		content := []byte(name)
+		digest := contentSHA256(content)
+		os.MkdirAll(filepath.Join(versionDir, name), 0700)
+		if err := ioutil.WriteFile(versionPath(name, digest), content, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.download(remoteBinary{Name: name, URL: "https://example.com/" + name, SHA256: digest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bridge is known by its install and version dir, flanneld only as
+	// applied since its version dir couldn't be created
+	w.appliedRemote = map[string]remoteBinary{"flanneld": {Name: "flanneld"}}
+	delete(w.installs, "flanneld")
+	os.RemoveAll(filepath.Join(versionDir, "flanneld"))
+
+	active := map[string]bool{"bridge": true}
+	w.gc(active)
+	if _, err := os.Stat(filepath.Join(binDir, "flanneld")); err != nil {
+		t.Fatalf("removed before the retention period: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(versionDir, "flanneld", orphanedMarker), old, old)
+	w.lastGC = time.Time{}
+	w.gc(active)
+	if _, err := os.Stat(filepath.Join(binDir, "flanneld")); !os.IsNotExist(err) {
+		t.Errorf("flanneld: expected it removed, got %v", err)
+	}
+	if _, ok := w.installs["flanneld"]; ok {
+		t.Errorf("flanneld: still listed as installed")
+	}
+	if _, err := os.Stat(filepath.Join(binDir, "bridge")); err != nil {
+		t.Errorf("bridge: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package binexec
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var (
+	healthCheckLabel   = "io.rancher.network.cni.binary.health_check"
+	healthCheckTimeout = 30 * time.Second
+
+	healthy = metrics.NewGauge("plugin_manager_binexec_healthy",
+		"Whether the last health check of a plugin binary passed", "binary")
+	healthFailures = metrics.NewCounter("plugin_manager_binexec_health_check_failures_total",
+		"Failed plugin binary health checks", "binary")
+)
+
+// Health is the result of the last health check of a plugin binary
+type Health struct {
+	Time    time.Time
+	Healthy bool
+	Output  string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+func (w *Watcher) checkHealth() {
+	for range time.Tick(w.opts.HealthInterval) {
+		health.Heartbeat("binexec.health", w.opts.HealthInterval)
+		w.runHealthChecks()
+	}
+}
+
+func (w *Watcher) runHealthChecks() {
+	w.Lock()
+	checks := map[string]string{}
+	for name, b := range w.applied {
+		if _, ok := w.installs[name]; ok && b.HealthCheck != "" {
+			checks[name] = b.HealthCheck
+		}
+	}
+	w.Unlock()
+
+	for name, args := range checks {
+		result := runHealthCheck(name, args)
+
+		w.Lock()
+		prev, seen := w.health[name]
+		w.health[name] = result
+		w.Unlock()
+
+		if result.Healthy {
+			healthy.Set(1, name)
+			if seen && !prev.Healthy {
+				log.Infof("Plugin binary %s is healthy again", name)
+			}
+			continue
+		}
+
+		healthy.Set(0, name)
+		healthFailures.Inc(name)
+		log.WithField("output", result.Output).Errorf("Health check of plugin binary %s failed: %s", name, result.Error)
+	}
+}
+
+// runHealthCheck runs the installed binary with the arguments the plugin
+// declared, going through the shim like the container runtime would
+func runHealthCheck(name, args string) Health {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	output := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, name), strings.Fields(args)...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+
+	result := Health{
+		Time:    time.Now(),
+		Healthy: err == nil,
+		Output:  strings.TrimSpace(output.String()),
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Error = "timed out after " + healthCheckTimeout.String()
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package binexec
+
+import (
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	inotifyMask = uint32(syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CREATE)
+	// inotifySettle batches events so a burst of changes is checked once
+	inotifySettle = time.Second
+)
+
+var inotifyMaskNames = []struct {
+	mask uint32
+	name string
+}{
+	{syscall.IN_CREATE, "create"},
+	{syscall.IN_CLOSE_WRITE, "write"},
+	{syscall.IN_ATTRIB, "attrib"},
+	{syscall.IN_DELETE, "delete"},
+	{syscall.IN_MOVED_FROM, "moved_from"},
+	{syscall.IN_MOVED_TO, "moved_to"},
+}
+
+func describeMask(mask uint32) string {
+	var names []string
+	for _, m := range inotifyMaskNames {
+		if mask&m.mask != 0 {
+			names = append(names, m.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// watchBinDir checks managed binaries as soon as anything in the bin dir
+// changes rather than waiting for the next periodic scan. Changes binexec
+// makes itself pass the check since the digests are recorded under the same
+// lock the check takes.
+func (w *Watcher) watchBinDir() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, binDir, inotifyMask); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	events := make(chan [2]string, 100)
+	go readInotify(fd, events)
+	go w.handleInotify(events)
+	return nil
+}
+
+func readInotify(fd int, events chan<- [2]string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			log.Errorf("Stopped watching %s for changes: %v", binDir, err)
+			close(events)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if name != "" && !strings.HasPrefix(name, ".") {
+				events <- [2]string{name, describeMask(event.Mask)}
+			}
+		}
+	}
+}
+
+func (w *Watcher) handleInotify(events <-chan [2]string) {
+	pending := map[string]string{}
+	var settle <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if prev := pending[event[0]]; prev != "" {
+				event[1] = prev + "," + event[1]
+			}
+			pending[event[0]] = event[1]
+			if settle == nil {
+				settle = time.After(inotifySettle)
+			}
+		case <-settle:
+			settle = nil
+			w.Lock()
+			reinstall := w.verifyInstalls(pending)
+			w.Unlock()
+			pending = map[string]string{}
+
+			if reinstall {
+				if err := w.onChange(""); err != nil {
+					log.WithError(err).Error("Failed to repair plugin binaries")
+				}
+			}
+		}
+	}
+}
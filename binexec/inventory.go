@@ -0,0 +1,111 @@
+package binexec
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// BinaryInfo describes a binary installed in the CNI bin dir by binexec
+type BinaryInfo struct {
+	Name        string
+	Path        string
+	Source      string
+	ContainerID string `json:",omitempty"`
+	Image       string `json:",omitempty"`
+	URL         string `json:",omitempty"`
+	File        string `json:",omitempty"`
+	Digest      string
+	Installed   time.Time
+	RolledBack  *RollbackInfo `json:",omitempty"`
+	Versions    []Version
+	LastRun     *Execution `json:",omitempty"`
+	Health      *Health    `json:",omitempty"`
+}
+
+// RollbackInfo is set while a binary is rolled back to a saved version
+type RollbackInfo struct {
+	Digest string
+	From   string
+}
+
+// Execution is the result of the last invocation of a plugin binary
+type Execution struct {
+	Time        time.Time
+	ContainerID string
+	ExitCode    int
+	// Failures are the exit codes of attempts that were retried
+	Failures []int `json:",omitempty"`
+}
+
+// install records where an installed binary came from
+type install struct {
+	Source      string
+	ContainerID string
+	Image       string
+	URL         string
+	File        string
+	Digest      string
+	// FileDigest is the digest of what was written to the bin dir, which
+	// for container binaries is the shim rather than the binary itself
+	FileDigest string
+	// Exec is the saved copy a shim runs, which is hashed against Digest
+	// along with the shim
+	Exec      string
+	Installed time.Time
+}
+
+func (w *Watcher) recordInstall(name string, i install) {
+	if prev, ok := w.installs[name]; ok && prev.Digest == i.Digest && prev.Source == i.Source {
+		i.Installed = prev.Installed
+	} else {
+		i.Installed = time.Now()
+	}
+	w.installs[name] = i
+}
+
+// Binaries lists every binary binexec has installed, sorted by name
+func (w *Watcher) Binaries() []BinaryInfo {
+	w.Lock()
+	defer w.Unlock()
+
+	lastRuns := w.output.lastRuns()
+
+	var result []BinaryInfo
+	for name, i := range w.installs {
+		info := BinaryInfo{
+			Name:        name,
+			Path:        filepath.Join(binDir, name),
+			Source:      i.Source,
+			ContainerID: i.ContainerID,
+			Image:       i.Image,
+			URL:         i.URL,
+			File:        i.File,
+			Digest:      i.Digest,
+			Installed:   i.Installed,
+		}
+		if p, ok := w.pinned[name]; ok {
+			info.RolledBack = &RollbackInfo{
+				Digest: p.Digest,
+				From:   p.From,
+			}
+		}
+		if run, ok := lastRuns[name]; ok {
+			info.LastRun = &run
+		}
+		if health, ok := w.health[name]; ok {
+			info.Health = &health
+		}
+		info.Versions, _ = versions(name)
+		result = append(result, info)
+	}
+
+	sort.Sort(byName(result))
+	return result
+}
+
+type byName []BinaryInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
@@ -0,0 +1,16 @@
+package binexec
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/plugin-manager/hostlock"
+)
+
+var lockFile = ".binexec.lock"
+
+// lockBinDir takes an advisory lock so only one plugin-manager on the host
+// manages the bin dir. The lock is released when the process exits.
+func lockBinDir() (*os.File, error) {
+	return hostlock.Acquire(filepath.Join(binDir, lockFile), 0)
+}
@@ -0,0 +1,206 @@
+package binexec
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/plugin-manager/health"
+)
+
+var (
+	collectEvery   = 2 * time.Second
+	outputRingSize = 1000
+)
+
+// OutputLine is a line a plugin binary wrote to stdout or stderr
+type OutputLine struct {
+	Time        time.Time
+	Plugin      string
+	ContainerID string
+	Invocation  string
+	Stream      string
+	Line        string
+	ExitCode    int
+}
+
+// outputRing keeps the most recent plugin output for debugging
+type outputRing struct {
+	sync.Mutex
+	lines []OutputLine
+	next  int
+	last  map[string]Execution
+}
+
+func (r *outputRing) finished(plugin string, e Execution) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.last == nil {
+		r.last = map[string]Execution{}
+	}
+	r.last[plugin] = e
+}
+
+func (r *outputRing) lastRuns() map[string]Execution {
+	r.Lock()
+	defer r.Unlock()
+
+	result := map[string]Execution{}
+	for k, v := range r.last {
+		result[k] = v
+	}
+	return result
+}
+
+func (r *outputRing) add(line OutputLine) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.lines) < outputRingSize {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % outputRingSize
+}
+
+func (r *outputRing) get() []OutputLine {
+	r.Lock()
+	defer r.Unlock()
+
+	result := make([]OutputLine, 0, len(r.lines))
+	result = append(result, r.lines[r.next:]...)
+	return append(result, r.lines[:r.next]...)
+}
+
+// Output returns the most recent lines written by plugin binaries, oldest first
+func (w *Watcher) Output() []OutputLine {
+	return w.output.get()
+}
+
+func (w *Watcher) collectOutput() {
+	for range time.Tick(collectEvery) {
+		health.Heartbeat("binexec.output", collectEvery)
+		if err := w.collect(); err != nil {
+			log.WithError(err).Error("Failed to collect plugin binary output")
+		}
+	}
+}
+
+// collect forwards the output of every finished invocation through the logger
+// and removes its files. An invocation is finished once its .rc file exists.
+func (w *Watcher) collect() error {
+	finished, err := filepath.Glob(filepath.Join(w.opts.OutputDir, "*.rc"))
+	if err != nil {
+		return err
+	}
+
+	for _, rcFile := range finished {
+		invocation := strings.TrimSuffix(rcFile, ".rc")
+		if err := w.collectInvocation(invocation); err != nil {
+			log.Errorf("Failed to read output of %s: %v", invocation, err)
+		}
+		for _, suffix := range []string{".rc", ".stdout", ".stderr"} {
+			os.Remove(invocation + suffix)
+		}
+	}
+
+	return nil
+}
+
+func (w *Watcher) collectInvocation(invocation string) error {
+	content, err := ioutil.ReadFile(invocation + ".rc")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("missing exit code")
+	}
+	rc, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("parsing exit code %q: %v", content, err)
+	}
+	containerID := ""
+	if len(fields) > 1 && fields[1] != "-" {
+		containerID = fields[1]
+	}
+	var failures []int
+	if len(fields) > 2 {
+		for _, field := range fields[2:] {
+			if code, err := strconv.Atoi(field); err == nil {
+				failures = append(failures, code)
+			}
+		}
+	}
+
+	base := filepath.Base(invocation)
+	plugin := base
+	if i := strings.Index(base, "."); i > 0 {
+		plugin = base[:i]
+	}
+
+	log := log.WithFields(logrus.Fields{
+		"plugin":      plugin,
+		"containerId": containerID,
+		"invocation":  base,
+		"exitCode":    rc,
+		"failures":    failures,
+	})
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		f, err := os.Open(invocation + "." + stream)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := OutputLine{
+				Time:        time.Now(),
+				Plugin:      plugin,
+				ContainerID: containerID,
+				Invocation:  base,
+				Stream:      stream,
+				Line:        scanner.Text(),
+				ExitCode:    rc,
+			}
+			w.output.add(line)
+			if stream == "stderr" {
+				log.WithField("stream", stream).Info(line.Line)
+			} else {
+				log.WithField("stream", stream).Debug(line.Line)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	touch(plugin, lastRunMarker)
+	w.output.finished(plugin, Execution{
+		Time:        time.Now(),
+		ContainerID: containerID,
+		ExitCode:    rc,
+		Failures:    failures,
+	})
+
+	if rc != 0 {
+		log.Errorf("Plugin %s exited with %d after %d attempts", plugin, rc, len(failures))
+	} else if len(failures) > 0 {
+		log.Infof("Plugin %s succeeded after %d failed attempts", plugin, len(failures))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package binexec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cniconf"
+)
+
+var (
+	maxDownloadSize = int64(256 << 20)
+	httpClient      = &http.Client{Timeout: 5 * time.Minute}
+)
+
+// remoteBinary is a plugin binary downloaded from a file server rather than
+// run out of a plugin container, declared in the network's "cniBinaries"
+// metadata as a list of {"name", "url", "sha256", "signature"}. A Calico
+// or flannel network lists its own, such as calico-node or flanneld, under
+// "calico" or "flannel" as "binaries". An entry with "daemon" set is kept
+// running with its "args", as are flanneld and, unless "daemon" is false,
+// calico-node.
+type remoteBinary struct {
+	Name      string
+	Arch      string
+	URL       string
+	SHA256    string
+	Signature string
+	Daemon    bool
+	Args      []string
+}
+
+func remoteBinaries(networks []metadata.Network) map[string]remoteBinary {
+	result := map[string]remoteBinary{}
+	for _, network := range networks {
+		entries, _ := network.Metadata["cniBinaries"].([]interface{})
+		for _, key := range []string{"calico", "flannel"} {
+			if settings, ok := network.Metadata[key].(map[string]interface{}); ok {
+				binaries, _ := settings["binaries"].([]interface{})
+				// Copied so the cached metadata's list is never appended to
+				entries = append(append([]interface{}(nil), entries...), binaries...)
+			}
+		}
+		for _, entry := range entries {
+			props, _ := entry.(map[string]interface{})
+			b := remoteBinary{}
+			b.Name, _ = props["name"].(string)
+			b.URL, _ = props["url"].(string)
+			b.SHA256, _ = props["sha256"].(string)
+			b.Signature, _ = props["signature"].(string)
+			b.Arch, _ = props["arch"].(string)
+			b.Daemon, _ = props["daemon"].(bool)
+			args, _ := props["args"].([]interface{})
+			for _, arg := range args {
+				if arg, ok := arg.(string); ok {
+					b.Args = append(b.Args, arg)
+				}
+			}
+			b.SHA256 = strings.ToLower(strings.TrimPrefix(b.SHA256, "sha256:"))
+
+			if b.Name == "" || b.URL == "" || b.SHA256 == "" || strings.Contains(b.Name, "/") {
+				log.Errorf("Ignoring invalid cniBinaries entry in network %s: %v", network.Name, props)
+				continue
+			}
+			// Entries for other architectures are skipped, an entry without
+			// an arch is used only if there's no arch specific one
+			if b.Arch != "" && b.Arch != runtime.GOARCH {
+				continue
+			}
+			if existing, ok := result[b.Name]; ok && existing.Arch != "" && b.Arch == "" {
+				continue
+			}
+			if b.Name == "flanneld" {
+				b.Daemon = true
+				b.Args = flanneldArgs(network, b.Args)
+			}
+			// calico-node runs under binexec unless its entry says otherwise
+			if _, given := props["daemon"]; b.Name == "calico-node" && !given {
+				b.Daemon = true
+			}
+			result[b.Name] = b
+		}
+	}
+	return result
+}
+
+// flanneldArgs points flanneld at the network config cniconf writes and the
+// subnet.env the flannel plugin reads, unless its args already do. flanneld
+// leases the subnet and writes the file, cniconf leaves it alone.
+func flanneldArgs(network metadata.Network, args []string) []string {
+	subnetFile, netConfFile, ok := cniconf.FlannelPaths(network)
+	if !ok {
+		return args
+	}
+	result := append([]string(nil), args...)
+	for flag, value := range map[string]string{
+		"--subnet-file":     subnetFile,
+		"--net-config-path": netConfFile,
+	} {
+		given := false
+		for _, arg := range args {
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				given = true
+			}
+		}
+		if !given {
+			result = append(result, flag+"="+value)
+		}
+	}
+	sort.Strings(result[len(args):])
+	return result
+}
+
+func (w *Watcher) applyRemote(remote map[string]remoteBinary, binaries map[string]binary) error {
+	if !reflect.DeepEqual(remote, w.appliedRemote) {
+		log.Infof("Setting up downloaded binaries for: %v", remote)
+	}
+
+	var lastErr error
+	for name, b := range remote {
+		if _, ok := binaries[name]; ok {
+			log.Errorf("Not downloading %s from %s, it is provided by a plugin container", name, b.URL)
+			continue
+		}
+		if err := w.download(b); err != nil {
+			log.Errorf("Failed to download %s: %v", name, err)
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		w.appliedRemote = remote
+	}
+	return lastErr
+}
+
+// download fetches the binary into the version store unless the saved copy
+// already matches its checksum, then installs a shim running it on the
+// host. Nothing is written until the checksum matches.
+func (w *Watcher) download(b remoteBinary) error {
+	if _, err := w.sandboxConfig(binary{Name: b.Name}); err != nil {
+		return err
+	}
+
+	saved := versionPath(b.Name, b.SHA256)
+	if current, err := fileSHA256(saved); err != nil || current != b.SHA256 {
+		if err := w.fetch(b, saved); err != nil {
+			return err
+		}
+	}
+
+	p := filepath.Join(binDir, b.Name)
+	s := w.newShim(binary{Name: b.Name}, 0)
+	s.Version = saved
+	content := s.render()
+	if current, err := ioutil.ReadFile(p); err != nil || !bytes.Equal(current, content) {
+		log.Debugf("Writing %s:\n%s", p, content)
+		if err := os.MkdirAll(binDir, 0700); err != nil {
+			return err
+		}
+		if err := audit.File("binexec", "file.write", p, func() error {
+			return atomicfile.WriteFile(p, content, 0700)
+		}); err != nil {
+			return err
+		}
+	}
+
+	w.recordInstall(b.Name, install{
+		Source:     "url",
+		URL:        b.URL,
+		Digest:     b.SHA256,
+		FileDigest: contentSHA256(content),
+		Exec:       saved,
+	})
+	return nil
+}
+
+// fetch downloads and verifies the binary and saves it to saved
+func (w *Watcher) fetch(b remoteBinary, saved string) error {
+	log.Infof("Downloading %s from %s", b.Name, b.URL)
+	resp, err := httpClient.Get(b.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", b.URL, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > maxDownloadSize {
+		return fmt.Errorf("%s is larger than %d bytes", b.URL, maxDownloadSize)
+	}
+
+	sum := sha256.Sum256(content)
+	actual := hex.EncodeToString(sum[:])
+	if actual != b.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s from %s: expected %s, got %s", b.Name, b.URL, b.SHA256, actual)
+	}
+
+	if err := checkArch(b.Name, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	if err := w.checkSignature(b.Name, b.URL, actual, b.Signature); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(saved), 0700); err != nil {
+		return err
+	}
+	if err := audit.File("binexec", "file.write", saved, func() error {
+		return atomicfile.WriteFile(saved, content, 0700)
+	}); err != nil {
+		return err
+	}
+	w.pruneVersions(b.Name, actual)
+	return nil
+}
@@ -0,0 +1,64 @@
+package binexec
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadInstallsShim(t *testing.T) {
+	defer withDirs(t)()
+
+	content := []byte("#!/bin/sh\n")
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetched++
+		rw.Write(content)
+	}))
+	defer server.Close()
+
+	w := &Watcher{
+		opts:     Options{KeepVersions: 2, User: "1000"},
+		pinned:   map[string]pin{},
+		installs: map[string]install{},
+	}
+	b := remoteBinary{Name: "flanneld", URL: server.URL, SHA256: contentSHA256(content)}
+
+	for i := 0; i < 2; i++ {
+		if err := w.download(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("fetched %d times, want once", fetched)
+	}
+
+	saved := versionPath("flanneld", b.SHA256)
+	info, err := os.Stat(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("saved copy has mode %v, want 0700", info.Mode().Perm())
+	}
+
+	shim, err := ioutil.ReadFile(filepath.Join(binDir, "flanneld"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"exec 8< " + saved, "sandbox --close-fd 9 --user 1000:1000"} {
+		if !strings.Contains(string(shim), want) {
+			t.Errorf("shim doesn't contain %q:\n%s", want, shim)
+		}
+	}
+	if strings.Contains(string(shim), "nsenter") {
+		t.Errorf("shim of a downloaded binary enters namespaces:\n%s", shim)
+	}
+	if i := w.installs["flanneld"]; i.Exec != saved || i.FileDigest != contentSHA256(shim) {
+		t.Errorf("unexpected install %+v", i)
+	}
+}
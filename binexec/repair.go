@@ -0,0 +1,139 @@
+package binexec
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var repairs = metrics.NewCounter("plugin_manager_binexec_repairs_total",
+	"Installed plugin binaries found missing or modified and repaired", "binary")
+
+func (w *Watcher) verifyInstalled() {
+	for range time.Tick(w.opts.VerifyInterval) {
+		health.Heartbeat("binexec.verify", w.opts.VerifyInterval)
+		if w.verify() {
+			if err := w.onChange(""); err != nil {
+				log.WithError(err).Error("Failed to repair plugin binaries")
+			}
+		}
+	}
+}
+
+// verify re-hashes every installed binary, the binaries the shims exec and
+// the saved versions, returning true if any need to be reinstalled
+func (w *Watcher) verify() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	reinstall := w.verifyInstalls(nil)
+	w.verifyVersions()
+	return reinstall
+}
+
+// verifyInstalls checks the installed binaries, or only those in events when
+// it's not nil. Events describe the filesystem change that triggered the
+// check and are logged with any damage found.
+func (w *Watcher) verifyInstalls(events map[string]string) bool {
+	reinstall := false
+	for name, i := range w.installs {
+		event, ok := events[name]
+		if events != nil && !ok {
+			continue
+		}
+
+		p := filepath.Join(binDir, name)
+		actual, err := fileSHA256(p)
+		if err == nil && actual == i.FileDigest {
+			if w.verifyExec(name, i, event) {
+				reinstall = true
+			}
+			continue
+		}
+
+		log := log.WithField("binary", p)
+		if event != "" {
+			log = log.WithField("event", event)
+		}
+		if os.IsNotExist(err) {
+			log.Errorf("Installed binary %s is missing, repairing", p)
+		} else if err != nil {
+			log.Errorf("Failed to hash installed binary %s, repairing: %v", p, err)
+		} else {
+			log.Errorf("Installed binary %s was modified, expected %s got %s, repairing", p, i.FileDigest, actual)
+		}
+		repairs.Inc(name)
+
+		reinstall = true
+		if i.Source == "url" {
+			delete(w.appliedRemote, name)
+		}
+	}
+
+	if reinstall {
+		w.lastApplied = time.Time{}
+	}
+	return reinstall
+}
+
+// verifyExec checks the saved copy the shim for name execs still has the
+// digest it was installed with. A damaged copy of the container's binary is
+// copied out and verified again, a downloaded one fetched again and a rolled
+// back one is no longer used.
+func (w *Watcher) verifyExec(name string, i install, event string) bool {
+	if i.Exec == "" {
+		return false
+	}
+	actual, err := fileSHA256(i.Exec)
+	if err == nil && actual == i.Digest {
+		return false
+	}
+
+	log := log.WithField("binary", i.Exec)
+	if event != "" {
+		log = log.WithField("event", event)
+	}
+	if err != nil {
+		log.Errorf("Failed to hash %s run by the %s shim, reinstalling: %v", i.Exec, name, err)
+	} else {
+		log.Errorf("%s run by the %s shim was modified, expected %s got %s, reinstalling", i.Exec, name, i.Digest, actual)
+	}
+	repairs.Inc(name)
+
+	switch i.Source {
+	case "rollback":
+		delete(w.pinned, name)
+	case "url":
+		delete(w.appliedRemote, name)
+	default:
+		w.cache.forget(i.Image, name)
+	}
+	return true
+}
+
+// verifyVersions drops saved versions whose content no longer matches the
+// digest they are named by so a rollback never installs a corrupt binary
+func (w *Watcher) verifyVersions() {
+	dirs, err := filepath.Glob(filepath.Join(versionDir, "*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		saved, err := versions(name)
+		if err != nil {
+			continue
+		}
+		for _, v := range saved {
+			p := filepath.Join(dir, v.Digest)
+			if actual, err := fileSHA256(p); err == nil && actual != v.Digest {
+				log.Errorf("Saved version %s of %s is corrupt, removing it", v.Digest, name)
+				removeVersion(name, v.Digest)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package binexec
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rancher/plugin-manager/sandbox"
+)
+
+var (
+	sandboxLabel      = "io.rancher.network.cni.binary.sandbox"
+	capabilitiesLabel = "io.rancher.network.cni.binary.capabilities"
+	userLabel         = "io.rancher.network.cni.binary.user"
+
+	sandboxFD = 9
+)
+
+// sandboxConfig returns how the binary should be confined, or nil if it runs
+// with the full privileges of the shim. Plugins opt in or out with the
+// sandbox label and can narrow or widen the kept capabilities. Running as a
+// non-root user only needs the kept capabilities, not the seccomp filter.
+func (w *Watcher) sandboxConfig(b binary) (*sandbox.Config, error) {
+	enabled := w.opts.Sandbox
+	switch b.Sandbox {
+	case "true":
+		enabled = true
+	case "false":
+		enabled = false
+	case "":
+	default:
+		return nil, fmt.Errorf("invalid %s %q for %s", sandboxLabel, b.Sandbox, b.Name)
+	}
+
+	user := w.opts.User
+	if b.User != "" {
+		user = b.User
+	}
+	uid, gid := -1, -1
+	if user != "" && user != "root" {
+		var err error
+		if uid, gid, err = sandbox.ParseUser(user); err != nil {
+			return nil, fmt.Errorf("invalid user for %s: %v", b.Name, err)
+		}
+	}
+
+	if !enabled && uid < 0 {
+		return nil, nil
+	}
+
+	value := w.opts.Capabilities
+	if b.Capabilities != "" {
+		value = b.Capabilities
+	}
+	caps, err := sandbox.ParseCapabilities(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capabilities for %s: %v", b.Name, err)
+	}
+
+	return &sandbox.Config{
+		Capabilities: caps,
+		NoNewPrivs:   enabled,
+		Seccomp:      enabled,
+		UID:          uid,
+		GID:          gid,
+	}, nil
+}
+
+// sandboxArgs are the flags of the sandbox command that apply config
+func sandboxArgs(config *sandbox.Config) []string {
+	var args []string
+	if config.NoNewPrivs {
+		args = append(args, "--no-new-privs")
+	}
+	if config.Seccomp {
+		args = append(args, "--seccomp")
+	}
+	if config.UID >= 0 {
+		args = append(args, "--user", fmt.Sprintf("%d:%d", config.UID, config.GID))
+	}
+	if len(config.Capabilities) > 0 {
+		args = append(args, "--capabilities", strings.Join(config.Capabilities, ","))
+	}
+	return args
+}
+
+func selfPath() string {
+	if p, err := os.Readlink("/proc/self/exe"); err == nil {
+		return p
+	}
+	return "/usr/bin/plugin-manager"
+}
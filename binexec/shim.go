@@ -0,0 +1,235 @@
+package binexec
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/plugin-manager/sandbox"
+)
+
+var (
+	cgroupRoot   = "/sys/fs/cgroup"
+	retriesLabel = "io.rancher.network.cni.binary.retries"
+)
+
+// shim is the script installed in the CNI bin dir that runs a plugin binary
+// inside the plugin container's namespaces, or on the host for a downloaded
+// one
+type shim struct {
+	Name        string
+	ContainerID string
+	// Pid is the plugin container's process, 0 for a downloaded binary
+	Pid int
+	// Version is the verified copy saved on the host that is run, the
+	// container's own binary or a saved version after a rollback
+	Version     string
+	Timeout     time.Duration
+	MemoryLimit int64
+	CPUQuota    int
+	OutputDir   string
+	Sandbox     *sandbox.Config
+	Env         map[string]string
+	// Retries is how many times a failed DEL or CHECK is retried, waiting
+	// RetryBackoff and then twice as long each time. ADD isn't idempotent,
+	// retrying it leaks IPAM allocations.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+func (w *Watcher) newShim(target binary, pid int) shim {
+	sandboxConfig, _ := w.sandboxConfig(target)
+	return shim{
+		Name:         target.Name,
+		ContainerID:  target.ContainerID,
+		Pid:          pid,
+		Timeout:      w.opts.Timeout,
+		MemoryLimit:  w.opts.MemoryLimit,
+		CPUQuota:     w.opts.CPUQuota,
+		OutputDir:    w.opts.OutputDir,
+		Sandbox:      sandboxConfig,
+		Env:          target.Env,
+		Retries:      w.retries(target),
+		RetryBackoff: w.opts.RetryBackoff,
+	}
+}
+
+func (s shim) limited() bool {
+	return s.Timeout > 0 || s.MemoryLimit > 0 || s.CPUQuota > 0
+}
+
+func (s shim) captured() bool {
+	return s.OutputDir != ""
+}
+
+// cniError prints a CNI error result so the runtime reports why the plugin
+// was killed instead of failing on empty output
+func (s shim) cniError(msg string) string {
+	out := ""
+	if s.captured() {
+		out = ` >> "$out.stdout"`
+	}
+	return fmt.Sprintf(`echo '{"cniVersion":"0.2.0","code":100,"msg":"%s %s"}'%s`, s.Name, msg, out)
+}
+
+func (s shim) render() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("#!/bin/sh\n")
+	buf.WriteString(renderEnv(s.Env))
+
+	// Saved versions aren't visible in the plugin container's mount
+	// namespace, so it's opened before entering and exec'd by fd
+	fmt.Fprintf(buf, "exec %d< %s\n", versionFD, s.Version)
+	exec := fmt.Sprintf("/proc/self/fd/%d", versionFD)
+	if s.Sandbox != nil {
+		// plugin-manager isn't visible in the plugin container's mount
+		// namespace, so it's opened before entering and exec'd by fd
+		fmt.Fprintf(buf, "exec %d< %s\n", sandboxFD, selfPath())
+		exec = fmt.Sprintf("/proc/self/fd/%d sandbox --close-fd %d %s -- %s", sandboxFD, sandboxFD, s.sandboxArgs(), exec)
+	}
+	// A downloaded binary has no container, it runs on the host
+	command := fmt.Sprintf(`%s "$@"`, exec)
+	if s.Pid != 0 {
+		command = fmt.Sprintf(`/usr/bin/nsenter -m -u -i -n -p -t %d -- %s "$@"`, s.Pid, exec)
+	}
+
+	if !s.limited() && !s.captured() && s.Retries == 0 {
+		fmt.Fprintf(buf, "exec %s\n", command)
+		return buf.Bytes()
+	}
+
+	run := command
+	if s.limited() {
+		run = s.renderLimits(buf, command)
+	}
+
+	if s.captured() {
+		// Output is written to files the watcher collects, then replayed so
+		// the runtime still sees the plugin's result
+		fmt.Fprintf(buf, "mkdir -p %s\n", s.OutputDir)
+		fmt.Fprintf(buf, "out=%s/%s.$$.$(date +%%s%%N)\n", s.OutputDir, s.Name)
+		if s.Retries > 0 {
+			// stderr of every attempt is kept, only the last result matters
+			run += ` > "$out.stdout" 2>> "$out.stderr"`
+		} else {
+			run += ` > "$out.stdout" 2> "$out.stderr"`
+		}
+	}
+
+	if s.Retries > 0 {
+		s.renderRetries(buf, run)
+	} else {
+		fmt.Fprintf(buf, "%s\nrc=$?\n", run)
+	}
+
+	if s.limited() {
+		fmt.Fprintf(buf, "rmdir %[1]s/memory/$cg %[1]s/cpu/$cg 2>/dev/null\n", cgroupRoot)
+	}
+	if s.Timeout > 0 {
+		buf.WriteString("if [ $rc -eq 124 ]; then\n    " + s.cniError(fmt.Sprintf("timed out after %v and was killed", s.Timeout)) + "\n")
+		buf.WriteString("elif [ $rc -eq 137 ]; then\n    " + s.cniError("was killed, it may have exceeded its resource limits") + "\n")
+		buf.WriteString("fi\n")
+	}
+
+	if s.captured() {
+		buf.WriteString(`cat "$out.stdout"
+cat "$out.stderr" >&2
+`)
+		containerID := s.ContainerID
+		if containerID == "" {
+			containerID = "-"
+		}
+		fmt.Fprintf(buf, `echo "$rc %s$failures" > "$out.tmp" && mv "$out.tmp" "$out.rc"
+`, containerID)
+	}
+
+	buf.WriteString("exit $rc\n")
+	return buf.Bytes()
+}
+
+// renderLimits writes the cgroup setup and returns the command that runs the
+// plugin under the limits. The child joins the cgroups rather than the shim
+// so the cgroups can be removed once it exits.
+func (s shim) renderLimits(buf *bytes.Buffer, command string) string {
+	fmt.Fprintf(buf, "cg=rancher-cni/%s.$$\n", s.Name)
+	buf.WriteString("procs=\n")
+	if s.MemoryLimit > 0 {
+		fmt.Fprintf(buf, `if mkdir -p %[1]s/memory/$cg 2>/dev/null && echo %[2]d > %[1]s/memory/$cg/memory.limit_in_bytes; then
+    procs="$procs %[1]s/memory/$cg/cgroup.procs"
+fi
+`, cgroupRoot, s.MemoryLimit)
+	}
+	if s.CPUQuota > 0 {
+		fmt.Fprintf(buf, `if mkdir -p %[1]s/cpu/$cg 2>/dev/null && echo 100000 > %[1]s/cpu/$cg/cpu.cfs_period_us && echo %[2]d > %[1]s/cpu/$cg/cpu.cfs_quota_us; then
+    procs="$procs %[1]s/cpu/$cg/cgroup.procs"
+fi
+`, cgroupRoot, s.CPUQuota*1000)
+	}
+
+	run := command
+	if s.Timeout > 0 {
+		secs := int(s.Timeout / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		run = fmt.Sprintf("/usr/bin/timeout -k 5 %d %s", secs, command)
+	}
+	return fmt.Sprintf(`/bin/sh -c 'for p in '"$procs"'; do echo $$ > $p; done; exec "$@"' shim %s`, run)
+}
+
+func (s shim) sandboxArgs() string {
+	return strings.Join(sandboxArgs(s.Sandbox), " ")
+}
+
+// renderRetries runs the plugin until it succeeds or runs out of retries,
+// only DEL and CHECK being retried. The plugin's config arrives on stdin so
+// it's saved for each attempt, the exit code of every failed attempt is
+// kept in $failures.
+func (s shim) renderRetries(buf *bytes.Buffer, run string) {
+	stderr := ">&2"
+	if s.captured() {
+		stderr = `>> "$out.stderr"`
+	}
+
+	backoff := int(s.RetryBackoff / time.Second)
+	if backoff < 1 {
+		backoff = 1
+	}
+
+	fmt.Fprintf(buf, `stdin=$(mktemp)
+cat > "$stdin"
+attempt=0
+delay=%[1]d
+failures=
+while :; do
+    %[2]s < "$stdin"
+    rc=$?
+    [ $rc -eq 0 ] && break
+    failures="$failures $rc"
+    case "$CNI_COMMAND" in
+        DEL|CHECK) ;;
+        *) break ;;
+    esac
+    attempt=$((attempt + 1))
+    [ $attempt -gt %[3]d ] && break
+    echo "%[4]s failed with exit code $rc, retry $attempt of %[3]d in ${delay}s" %[5]s
+    sleep $delay
+    delay=$((delay * 2))
+done
+rm -f "$stdin"
+`, backoff, run, s.Retries, s.Name, stderr)
+}
+
+func (w *Watcher) retries(b binary) int {
+	if b.Retries == "" {
+		return w.opts.Retries
+	}
+	n, err := strconv.Atoi(b.Retries)
+	if err != nil || n < 0 {
+		log.Errorf("Ignoring invalid %s %q for %s", retriesLabel, b.Retries, b.Name)
+		return w.opts.Retries
+	}
+	return n
+}
@@ -0,0 +1,166 @@
+package binexec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/plugin-manager/atomicfile"
+)
+
+var signatureLabel = "io.rancher.network.cni.binary.signature"
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// loadTrustedKeys reads every PEM encoded public key in dir
+func loadTrustedKeys(dir string) ([]crypto.PublicKey, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "PUBLIC KEY" {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key in %s: %v", file.Name(), err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	log.Infof("Loaded %d trusted plugin signing keys from %s", len(keys), dir)
+	return keys, nil
+}
+
+// signature returns the base64 detached signature declared on the
+// container label or shipped next to the binary as <name>.sig
+func signature(pid int, b binary) (string, error) {
+	if b.Signature != "" {
+		return b.Signature, nil
+	}
+
+	content, err := ioutil.ReadFile(containerBinaryPath(pid, b.File) + ".sig")
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+// verifySignature checks the binary's detached signature, in the cosign
+// style of a signature over the SHA256 digest of the file, against the
+// trusted keys. A good signature is kept with the saved copy it covers.
+func (w *Watcher) verifySignature(pid int, b binary, digest string) error {
+	if len(w.trustedKeys) == 0 {
+		return nil
+	}
+
+	sig, err := signature(pid, b)
+	if err != nil {
+		return err
+	}
+
+	if err := w.checkSignature(b.Name, "container "+b.ContainerID, digest, sig); err != nil {
+		return err
+	}
+	if sig != "" {
+		return atomicfile.WriteFile(signaturePath(b.Name, digest), []byte(sig+"\n"), 0600)
+	}
+	return nil
+}
+
+// signaturePath is where the signature of a saved version is kept, hidden
+// from the version list
+func signaturePath(name, digest string) string {
+	return filepath.Join(versionDir, name, "."+digest+".sig")
+}
+
+// verifySaved checks a saved version's kept signature against the trusted
+// keys, which may have changed since it was saved
+func (w *Watcher) verifySaved(name, digest string) error {
+	if len(w.trustedKeys) == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(signaturePath(name, digest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return w.checkSignature(name, "saved version "+digest, digest, strings.TrimSpace(string(content)))
+}
+
+// checkSignature verifies sig over the hex encoded digest of the binary name
+// obtained from source
+func (w *Watcher) checkSignature(name, source, digestHex, sig string) error {
+	if len(w.trustedKeys) == 0 {
+		return nil
+	}
+
+	if sig == "" {
+		if w.opts.RequireSignature {
+			return fmt.Errorf("%s from %s is not signed", name, source)
+		}
+		return nil
+	}
+
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("decoding signature for %s: %v", name, err)
+	}
+
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range w.trustedKeys {
+		if verifyDigest(key, digest, rawSig) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature for %s from %s does not match any trusted key", name, source)
+}
+
+func verifyDigest(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var parsed ecdsaSignature
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			return false
+		}
+		return ecdsa.Verify(k, digest, parsed.R, parsed.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	}
+	return false
+}
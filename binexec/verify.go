@@ -0,0 +1,53 @@
+package binexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var sha256Label = "io.rancher.network.cni.binary.sha256"
+
+func contentSHA256(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// containerBinaryPath is where the shim's target binary lives when viewed
+// from the host through the plugin container's root filesystem
+func containerBinaryPath(pid int, name string) string {
+	return filepath.Join(fmt.Sprintf("/proc/%d/root", pid), binDir, name)
+}
+
+// verifyBinary checks the digest of the binary the shim will exec against the
+// checksum declared by the plugin container, if any
+func verifyBinary(b binary, digest string) error {
+	if b.SHA256 == "" {
+		return nil
+	}
+
+	if !strings.EqualFold(digest, strings.TrimPrefix(b.SHA256, "sha256:")) {
+		return fmt.Errorf("checksum mismatch for %s from container %s: expected %s, got %s",
+			b.Name, b.ContainerID, b.SHA256, digest)
+	}
+
+	return nil
+}
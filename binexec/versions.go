@@ -0,0 +1,187 @@
+package binexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/atomicfile"
+)
+
+var (
+	versionDir    = "/var/lib/rancher/plugin-manager/binexec"
+	rollbackLabel = "io.rancher.network.cni.binary.rollback"
+
+	versionFD = 8
+)
+
+// Version is a copy of a plugin binary kept on disk so it can be rolled back to
+type Version struct {
+	Digest    string
+	Installed time.Time
+}
+
+type byInstalled []Version
+
+func (v byInstalled) Len() int           { return len(v) }
+func (v byInstalled) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byInstalled) Less(i, j int) bool { return v[i].Installed.After(v[j].Installed) }
+
+// pin records that a binary was rolled back, from is the digest of the
+// release that was rolled away from
+type pin struct {
+	Digest string
+	From   string
+}
+
+// versions lists the saved copies of a binary, newest first
+func versions(name string) ([]Version, error) {
+	files, err := ioutil.ReadDir(filepath.Join(versionDir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []Version
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		result = append(result, Version{
+			Digest:    file.Name(),
+			Installed: file.ModTime(),
+		})
+	}
+	sort.Sort(byInstalled(result))
+	return result, nil
+}
+
+// versionPath is where the saved copy of name with digest is kept
+func versionPath(name, digest string) string {
+	return filepath.Join(versionDir, name, digest)
+}
+
+// saveVersion copies the binary out of the plugin container into the version
+// store and returns its digest. The copy is hashed rather than the
+// container's file, which the container can still rewrite, so the digest
+// verified is that of the copy the shim runs.
+func (w *Watcher) saveVersion(pid int, b binary) (string, error) {
+	dir := filepath.Join(versionDir, b.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	in, err := os.Open(containerBinaryPath(pid, b.File))
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	incoming := filepath.Join(dir, ".incoming")
+	h := sha256.New()
+	if err := atomicfile.Write(incoming, io.TeeReader(in, h), 0700); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	dst := versionPath(b.Name, digest)
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		log.Infof("Saving version %s of %s", digest, b.Name)
+	}
+	if err := os.Rename(incoming, dst); err != nil {
+		os.Remove(incoming)
+		return "", err
+	}
+
+	w.pruneVersions(b.Name, digest)
+	return digest, nil
+}
+
+// pruneVersions keeps the newest saved versions of name, never removing
+// the current one or one it is rolled back to
+func (w *Watcher) pruneVersions(name, current string) {
+	saved, err := versions(name)
+	if err != nil {
+		log.Errorf("Failed to list saved versions of %s: %v", name, err)
+		return
+	}
+	for i := w.opts.KeepVersions; i < len(saved); i++ {
+		digest := saved[i].Digest
+		if digest == current || digest == w.pinned[name].Digest {
+			continue
+		}
+		log.Infof("Removing old version %s of %s", digest, name)
+		if err := removeVersion(name, digest); err != nil {
+			log.Errorf("Failed to remove old version %s of %s: %v", digest, name, err)
+		}
+	}
+}
+
+// removeVersion removes a saved version along with its signature
+func removeVersion(name, digest string) error {
+	os.Remove(signaturePath(name, digest))
+	return os.Remove(versionPath(name, digest))
+}
+
+// Versions returns the saved versions of a managed binary, newest first
+func (w *Watcher) Versions(name string) ([]Version, error) {
+	return versions(name)
+}
+
+// Rollback points the shim for name at the newest saved version that
+// differs from what the plugin container currently ships. The rollback stays
+// in place until the container ships a different binary.
+func (w *Watcher) Rollback(name string) error {
+	w.Lock()
+	defer w.Unlock()
+
+	current, ok := w.digests[name]
+	if !ok {
+		return fmt.Errorf("%s is not a managed binary", name)
+	}
+	if err := w.rollback(name, current); err != nil {
+		return err
+	}
+	return w.apply(metadata.Host{}, w.applied)
+}
+
+// rollback pins name to the newest saved version other than current, apply
+// then installs a shim running it
+func (w *Watcher) rollback(name, current string) error {
+	if p, ok := w.pinned[name]; ok && p.From == current {
+		return nil
+	}
+
+	saved, err := versions(name)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range saved {
+		if v.Digest == current {
+			continue
+		}
+		// A rollback must not get around the signature check
+		if err := w.verifySaved(name, v.Digest); err != nil {
+			log.Warnf("Not rolling back %s to %s: %v", name, v.Digest, err)
+			continue
+		}
+
+		log.Infof("Rolling back %s from %s to %s", name, current, v.Digest)
+		w.pinned[name] = pin{
+			Digest: v.Digest,
+			From:   current,
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no previous version of %s to roll back to", name)
+}
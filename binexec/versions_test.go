@@ -0,0 +1,119 @@
+package binexec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withDirs points the bin dir and version store at a temp dir, the bin dir
+// standing in for the plugin container's through this process' own root
+func withDirs(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "binexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBinDir, oldVersionDir := binDir, versionDir
+	binDir, versionDir = filepath.Join(dir, "bin"), filepath.Join(dir, "versions")
+	os.MkdirAll(binDir, 0700)
+	return func() {
+		binDir, versionDir = oldBinDir, oldVersionDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSaveVersion(t *testing.T) {
+	defer withDirs(t)()
+	w := &Watcher{opts: Options{KeepVersions: 2}, pinned: map[string]pin{}}
+	b := binary{Name: "bridge", File: "bridge"}
+
+	var digests []string
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, "bridge"), []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := w.saveVersion(os.Getpid(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := contentSHA256([]byte(content)); digest != want {
+			t.Errorf("%s: got digest %s, want %s", content, digest, want)
+		}
+		saved, err := ioutil.ReadFile(versionPath("bridge", digest))
+		if err != nil || string(saved) != content {
+			t.Errorf("%s: saved %q, %v", content, saved, err)
+		}
+		digests = append(digests, digest)
+		if len(digests) == 1 {
+			w.pinned["bridge"] = pin{Digest: digest}
+		}
+		// Saved versions are ordered by their modification time
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The pinned version is kept along with the newest two
+	for i, digest := range digests {
+		_, err := os.Stat(versionPath("bridge", digest))
+		if kept := i != 1; kept != (err == nil) {
+			t.Errorf("version %d: kept %v, got %v", i, kept, err)
+		}
+	}
+}
+
+func TestRollbackVerifiesSignature(t *testing.T) {
+	defer withDirs(t)()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Watcher{
+		opts:        Options{KeepVersions: 5, RequireSignature: true},
+		pinned:      map[string]pin{},
+		trustedKeys: []crypto.PublicKey{&key.PublicKey},
+	}
+	b := binary{Name: "bridge", File: "bridge"}
+
+	save := func(content string, signed bool) string {
+		if err := ioutil.WriteFile(filepath.Join(binDir, "bridge"), []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := w.saveVersion(os.Getpid(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signed {
+			raw, _ := hex.DecodeString(digest)
+			r, s, err := ecdsa.Sign(rand.Reader, key, raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, _ := asn1.Marshal(ecdsaSignature{R: r, S: s})
+			b.Signature = base64.StdEncoding.EncodeToString(sig)
+			if err := w.verifySignature(os.Getpid(), b, digest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return digest
+	}
+	signed := save("one", true)
+	// Saved before the keys were trusted
+	save("two", false)
+	current := save("three", true)
+
+	if err := w.rollback("bridge", current); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.pinned["bridge"].Digest; got != signed {
+		t.Errorf("rolled back to %s, want the signed %s", got, signed)
+	}
+}
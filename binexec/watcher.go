@@ -2,8 +2,8 @@ package binexec
 
 import (
 	"context"
+	"crypto"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -11,48 +11,186 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
+	"github.com/docker/docker/pkg/locker"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/rancher/cniglue"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/watchdog"
 )
 
+var log = logging.Subsystem("binexec")
+
 var (
-	reapplyEvery = 5 * time.Minute
+	// ReapplyEvery is how often binaries are installed again when nothing
+	// changed
+	ReapplyEvery = config.NewDuration(5 * time.Minute)
 	binDir       = glue.CniPath[0]
 )
 
-func Watch(c metadata.Client, dc *client.Client) *Watcher {
+// Options configures how binexec verifies the binaries it installs
+type Options struct {
+	// TrustedKeysDir holds PEM public keys that plugin signatures are
+	// verified against. Signatures aren't checked if empty.
+	TrustedKeysDir string
+	// RequireSignature refuses unsigned binaries when trusted keys are set
+	RequireSignature bool
+	// KeepVersions is how many versions of each binary are kept for rollback
+	KeepVersions int
+	// Timeout kills plugin invocations that run longer, 0 disables it
+	Timeout time.Duration
+	// MemoryLimit is the memory cgroup limit in bytes, 0 disables it
+	MemoryLimit int64
+	// CPUQuota is the CPU cgroup quota in percent of one CPU, 0 disables it
+	CPUQuota int
+	// OutputDir is where shims write plugin output for the watcher to
+	// forward to the log, output isn't captured if empty
+	OutputDir string
+	// VerifyInterval is how often installed binaries are re-hashed and
+	// repaired, 0 disables it
+	VerifyInterval time.Duration
+	// Workers is how many plugin containers are processed at once
+	Workers int
+	// Sandbox confines plugin binaries unless their container opts out
+	Sandbox bool
+	// Capabilities are kept by sandboxed binaries that don't declare their own
+	Capabilities string
+	// User is the numeric uid[:gid] plugin binaries and downloaded daemons
+	// run as unless they declare their own, "root" or empty keeps them
+	// running as root. Installed files stay root's either way.
+	User string
+	// HealthInterval is how often declared health checks run, 0 disables them
+	HealthInterval time.Duration
+	// Retention is how long a binary whose source is gone is kept after it
+	// last ran, 0 keeps them forever
+	Retention time.Duration
+	// Retries is how many times a failed plugin DEL or CHECK is retried
+	// unless the plugin declares its own limit
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling each time
+	RetryBackoff time.Duration
+}
+
+func Watch(c store.Store, opts Options) (*Watcher, error) {
+	lock, err := lockBinDir()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := loadTrustedKeys(opts.TrustedKeysDir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
 	w := &Watcher{
-		c:       c,
-		dc:      dc,
-		applied: map[string]string{},
+		c:           c,
+		opts:        opts,
+		lock:        lock,
+		trustedKeys: keys,
+		applied:     map[string]binary{},
+		digests:     map[string]string{},
+		pinned:      map[string]pin{},
+		installs:    map[string]install{},
+		health:      map[string]Health{},
+		cache:       loadDigestCache(),
+		imageLocks:  locker.New(),
+		daemons:     map[string]*daemon{},
+	}
+	if w.opts.KeepVersions < 2 {
+		w.opts.KeepVersions = 2
+	}
+	// The first pass reports to health so startup can wait for it
+	health.Register("binexec")
+	w.onChangeNoError("")
+	admin.RegisterReconcile("binexec", w.reconcile)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	if opts.OutputDir != "" {
+		watchdog.Go("binexec.output", w.collectOutput)
+	}
+	if opts.VerifyInterval > 0 {
+		watchdog.Go("binexec.verify", w.verifyInstalled)
 	}
-	w.onChange("")
-	go c.OnChange(5, w.onChangeNoError)
-	return w
+	if err := w.watchBinDir(); err != nil {
+		log.Errorf("Failed to watch %s for changes, relying on periodic checks: %v", binDir, err)
+	}
+	if opts.HealthInterval > 0 {
+		watchdog.Go("binexec.health", w.checkHealth)
+	}
+	return w, nil
 }
 
 type Watcher struct {
 	sync.Mutex
-	c           metadata.Client
-	dc          *client.Client
-	applied     map[string]string
-	lastApplied time.Time
+	c             store.Store
+	opts          Options
+	lock          *os.File
+	trustedKeys   []crypto.PublicKey
+	applied       map[string]binary
+	appliedRemote map[string]remoteBinary
+	digests       map[string]string
+	pinned        map[string]pin
+	installs      map[string]install
+	health        map[string]Health
+	output        outputRing
+	cache         *digestCache
+	imageLocks    *locker.Locker
+	daemons       map[string]*daemon
+	lastApplied   time.Time
+	lastGC        time.Time
+}
+
+type binary struct {
+	Name        string
+	ContainerID string
+	SHA256      string
+	Signature   string
+	Rollback    bool
+	// File is the architecture specific variant of Name in the container
+	File         string
+	Sandbox      string
+	Capabilities string
+	HealthCheck  string
+	Env          map[string]string
+	Retries      string
+	User         string
 }
 
 func (w *Watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply cni conf: %v", err)
+	done := health.Begin("binexec")
+	err := w.onChange(version)
+	done(err)
+	if err != nil {
+		log.WithError(err).Error("Failed to apply cni conf")
 	}
 }
 
-func (w *Watcher) Handle(event *docker.APIEvents) error {
+// reconcile installs every plugin binary again now, whether or not
+// anything changed
+func (w *Watcher) reconcile() error {
+	w.Lock()
+	w.lastApplied = time.Time{}
+	w.Unlock()
+
+	done := health.Begin("binexec")
+	err := w.onChange("")
+	done(err)
+	return err
+}
+
+func (w *Watcher) Handle(ctx context.Context, event *docker.APIEvents) error {
 	w.Lock()
 
 	changed := false
 	for _, v := range w.applied {
-		if v == event.ID {
+		if v.ContainerID == event.ID {
 			changed = true
 			break
 		}
@@ -71,7 +209,7 @@ func (w *Watcher) onChange(version string) error {
 	w.Lock()
 	defer w.Unlock()
 
-	binaries := map[string]string{}
+	binaries := map[string]binary{}
 	driverServices := map[string]metadata.Service{}
 
 	services, err := w.c.GetServices()
@@ -100,7 +238,7 @@ func (w *Watcher) onChange(version string) error {
 
 	for _, service := range driverServices {
 		for _, container := range service.Containers {
-			logrus.WithFields(logrus.Fields{
+			log.WithFields(logrus.Fields{
 				"serviceKind":         service.Kind,
 				"serviceName":         service.Name,
 				"containerName":       container.Name,
@@ -111,58 +249,239 @@ func (w *Watcher) onChange(version string) error {
 			if container.ExternalId != "" && container.HostUUID == host.UUID && hasDriverLabel(container) {
 				binName := getBinaryName(container)
 				if binName != "" {
-					binaries[binName] = container.ExternalId
+					binaries[binName] = binary{
+						Name:         binName,
+						ContainerID:  container.ExternalId,
+						SHA256:       container.Labels[sha256Label],
+						Signature:    container.Labels[signatureLabel],
+						Rollback:     container.Labels[rollbackLabel] == "true",
+						Sandbox:      container.Labels[sandboxLabel],
+						Capabilities: container.Labels[capabilitiesLabel],
+						HealthCheck:  container.Labels[healthCheckLabel],
+						Env:          pluginEnv(service, host),
+						Retries:      container.Labels[retriesLabel],
+						User:         container.Labels[userLabel],
+					}
 				}
 			}
 		}
 	}
 
-	if time.Now().Sub(w.lastApplied) > reapplyEvery || !reflect.DeepEqual(binaries, w.applied) {
+	networks, err := w.c.GetNetworks()
+	if err != nil {
+		return err
+	}
+	remote := remoteBinaries(networks)
+
+	reapply := time.Now().Sub(w.lastApplied) > ReapplyEvery.Get()
+	if reapply || !reflect.DeepEqual(remote, w.appliedRemote) {
+		if err := w.applyRemote(remote, binaries); err != nil {
+			log.WithError(err).Error("Failed to set up downloaded binaries")
+		}
+	}
+	w.superviseDaemons(remote)
+
+	active := map[string]bool{}
+	for name := range binaries {
+		active[name] = true
+	}
+	for name := range remote {
+		active[name] = true
+	}
+	w.gc(active)
+
+	if reapply || !reflect.DeepEqual(binaries, w.applied) {
 		return w.apply(host, binaries)
 	}
 
 	return nil
 }
 
-func (w *Watcher) apply(host metadata.Host, binaries map[string]string) error {
-	if !reflect.DeepEqual(binaries, w.applied) {
-		logrus.Infof("Setting up binaries for: %v", binaries)
+// prepared is a plugin container's binary after it has been hashed, verified
+// and saved, ready for its shim to be installed
+type prepared struct {
+	Name    string
+	Target  binary
+	Pid     int
+	Image   string
+	Digest  string
+	Refused bool
+	Err     error
+}
+
+// prepare does the expensive per binary work. It runs for several binaries at
+// once, binaries from the same image are prepared one at a time so an image
+// is only hashed once.
+func (w *Watcher) prepare(name string, target binary) prepared {
+	result := prepared{
+		Name:   name,
+		Target: target,
+	}
+
+	container, err := w.c.Inspect(target.ContainerID)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if container.State == nil || container.State.Pid == 0 {
+		result.Err = fmt.Errorf("container is not running")
+		return result
+	}
+
+	pid := container.State.Pid
+	result.Pid = pid
+	result.Image = container.Image
+
+	if _, err := w.sandboxConfig(target); err != nil {
+		result.Err = err
+		return result
+	}
+
+	w.imageLocks.Lock(container.Image)
+	defer w.imageLocks.Unlock(container.Image)
+
+	result.Target.File = resolveArch(pid, name)
+	digest, cached, err := w.digest(container.Image, pid, result.Target)
+	if err != nil {
+		result.Err = fmt.Errorf("saving %s: %v", name, err)
+		return result
+	}
+	if !cached {
+		err = checkFileArch(result.Target.File, versionPath(name, digest))
+	}
+	if err == nil {
+		err = verifyBinary(result.Target, digest)
+	}
+	if err == nil {
+		err = w.verifySignature(pid, result.Target, digest)
+	}
+	if err != nil {
+		// A copy that failed verification must never be run or rolled
+		// back to
+		if !cached {
+			removeVersion(name, digest)
+		}
+		result.Refused = true
+		result.Err = err
+		return result
 	}
 
-	script := `#!/bin/sh
-exec /usr/bin/nsenter -m -u -i -n -p -t %d -- $0 "$@"
-`
+	result.Digest = digest
+	if !cached {
+		w.cache.set(container.Image, name, digest)
+	}
+
+	return result
+}
+
+func (w *Watcher) prepareAll(binaries map[string]binary) []prepared {
+	workers := w.opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, workers)
+		results = make(chan prepared, len(binaries))
+	)
+	for name, target := range binaries {
+		wg.Add(1)
+		go func(name string, target binary) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results <- w.prepare(name, target)
+		}(name, target)
+	}
+	wg.Wait()
+	close(results)
+
+	var all []prepared
+	for result := range results {
+		all = append(all, result)
+	}
+	return all
+}
+
+func (w *Watcher) apply(host metadata.Host, binaries map[string]binary) error {
+	if !reflect.DeepEqual(binaries, w.applied) {
+		log.Infof("Setting up binaries for: %v", binaries)
+	}
 
 	os.MkdirAll(binDir, 0700)
 
 	var lastErr error
-	for name, target := range binaries {
-		container, err := w.dc.ContainerInspect(context.Background(), target)
-		if err != nil {
-			lastErr = err
-			break
+	inUse := map[string]bool{}
+	for _, result := range w.prepareAll(binaries) {
+		name, target, digest := result.Name, result.Target, result.Digest
+		p := filepath.Join(binDir, name)
+
+		if result.Image != "" {
+			inUse[cacheKey(result.Image, name)] = true
 		}
 
-		if container.State == nil || container.State.Pid == 0 {
-			lastErr = fmt.Errorf("container is not running")
-			break
+		if result.Refused {
+			// Remove any previously installed shim so the corrupt binary
+			// can't be executed until the container is fixed
+			log.Errorf("Refusing to install %s: %v", name, result.Err)
+			if err := removeBinary(p); err != nil {
+				log.Errorf("Failed to remove %s: %v", p, err)
+			}
+			delete(w.installs, name)
+			lastErr = result.Err
+			continue
+		} else if result.Err != nil {
+			lastErr = result.Err
+			continue
 		}
 
-		ptmp := filepath.Join(binDir, name+".tmp")
-		p := filepath.Join(binDir, name)
-		content := []byte(fmt.Sprintf(script, container.State.Pid))
-		logrus.Debugf("Writing %s:\n%s", p, content)
-		if err := ioutil.WriteFile(ptmp, content, 0700); err != nil {
-			lastErr = err
-			break
+		w.digests[name] = digest
+
+		if target.Rollback {
+			if err := w.rollback(name, digest); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		// The shim runs the verified copy, never the container's file
+		s := w.newShim(target, result.Pid)
+		s.Version = versionPath(name, digest)
+		source, installed := "container", digest
+		if p, ok := w.pinned[name]; ok {
+			if p.From == digest {
+				s.Version = versionPath(name, p.Digest)
+				source, installed = "rollback", p.Digest
+			} else {
+				log.Infof("New release %s of %s, dropping rollback to %s", digest, name, p.Digest)
+				delete(w.pinned, name)
+			}
 		}
 
-		if err := os.Rename(ptmp, p); err != nil {
+		content := s.render()
+		log.Debugf("Writing %s:\n%s", p, content)
+		if err := audit.File("binexec", "file.write", p, func() error {
+			return atomicfile.WriteFile(p, content, 0700)
+		}); err != nil {
 			lastErr = err
+			continue
 		}
+
+		w.recordInstall(name, install{
+			Source:      source,
+			ContainerID: target.ContainerID,
+			Image:       result.Image,
+			File:        target.File,
+			Digest:      installed,
+			FileDigest:  contentSHA256(content),
+			Exec:        s.Version,
+		})
 	}
 
 	if lastErr == nil {
+		w.cache.prune(inUse)
 		w.applied = binaries
 		w.lastApplied = time.Now()
 	}
@@ -177,3 +496,14 @@ func getBinaryName(container metadata.Container) string {
 func hasDriverLabel(container metadata.Container) bool {
 	return "" != container.Labels["io.rancher.network.cni.binary"]
 }
+
+// removeBinary removes an installed binary or shim, a missing one being
+// already removed
+func removeBinary(p string) error {
+	return audit.File("binexec", "file.remove", p, func() error {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,71 @@
+// Package cleanup removes the iptables chains, routes and CNI configs the
+// subsystems own when plugin-manager is stopped with --cleanup-on-exit, for
+// hosts leaving Rancher management
+package cleanup
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/systemd"
+)
+
+var log = logging.Subsystem("cleanup")
+
+type cleaner struct {
+	name string
+	f    func() error
+}
+
+var (
+	lock     sync.Mutex
+	cleaners []cleaner
+)
+
+// Register has f remove what subsystem name programmed on exit. f must
+// also stop the subsystem programming it again.
+func Register(name string, f func() error) {
+	lock.Lock()
+	defer lock.Unlock()
+	cleaners = append(cleaners, cleaner{name: name, f: f})
+}
+
+// Run runs every registered cleanup, the last registered first, and
+// returns the subsystems that failed
+func Run() []string {
+	lock.Lock()
+	run := make([]cleaner, len(cleaners))
+	copy(run, cleaners)
+	lock.Unlock()
+
+	var failed []string
+	for i := len(run) - 1; i >= 0; i-- {
+		log.Infof("Removing what %s programmed", run[i].name)
+		if err := run[i].f(); err != nil {
+			log.WithError(err).Errorf("Failed to clean up %s", run[i].name)
+			failed = append(failed, run[i].name)
+		}
+	}
+	return failed
+}
+
+// OnSignal runs the cleanups and exits on SIGTERM or SIGINT, non-zero if
+// any failed. Without it the process exits and leaves everything in place.
+func OnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-c
+		log.Infof("Got %v, cleaning up before exiting", sig)
+		systemd.Notify("STOPPING=1\nSTATUS=Cleaning up")
+		if failed := Run(); len(failed) > 0 {
+			log.Errorf("Exiting, failed to clean up %v", failed)
+			os.Exit(1)
+		}
+		log.Info("Cleaned up, exiting")
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,107 @@
+package cniconf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	// calicoKey holds a network's Calico settings, from which its CNI
+	// config is generated rather than taken from cniConfig
+	calicoKey = "calico"
+	// calicoFile is the generated config's name in the network's directory
+	calicoFile           = "10-calico.conf"
+	defaultCalicoVersion = "0.3.1"
+	defaultCalicoConfig  = "/etc/cni/net.d/calico-kubeconfig"
+)
+
+// calicoConfig is the calico plugin's config for the network name and its
+// settings, talking to an etcd or Kubernetes datastore
+func calicoConfig(name string, settings map[string]interface{}, host metadata.Host) (map[string]interface{}, error) {
+	str := func(key string) string {
+		v, _ := settings[key].(string)
+		return v
+	}
+	nodeName := str("nodeName")
+	if nodeName == "" {
+		nodeName = host.Hostname
+	}
+	version := str("cniVersion")
+	if version == "" {
+		version = defaultCalicoVersion
+	}
+	ipam := map[string]interface{}{"type": "calico-ipam"}
+	if custom, ok := settings["ipam"].(map[string]interface{}); ok {
+		ipam = custom
+	}
+
+	config := map[string]interface{}{
+		"name":       name,
+		"cniVersion": version,
+		"type":       "calico",
+		"log_level":  "info",
+		"nodename":   nodeName,
+		"ipam":       ipam,
+	}
+	if level := str("logLevel"); level != "" {
+		config["log_level"] = level
+	}
+	if mtu, ok := settings["mtu"].(float64); ok {
+		config["mtu"] = int(mtu)
+	}
+
+	switch datastore := str("datastoreType"); datastore {
+	case "", "etcdv3":
+		endpoints := str("etcdEndpoints")
+		if endpoints == "" {
+			return nil, fmt.Errorf("the etcdv3 datastore needs etcdEndpoints")
+		}
+		config["datastore_type"] = "etcdv3"
+		config["etcd_endpoints"] = endpoints
+		for key, field := range map[string]string{
+			"etcdCAFile":   "etcd_ca_cert_file",
+			"etcdCertFile": "etcd_cert_file",
+			"etcdKeyFile":  "etcd_key_file",
+		} {
+			if v := str(key); v != "" {
+				config[field] = v
+			}
+		}
+		if (str("etcdCertFile") == "") != (str("etcdKeyFile") == "") {
+			return nil, fmt.Errorf("etcdCertFile and etcdKeyFile must be given together")
+		}
+	case "kubernetes":
+		kubeconfig := str("kubeconfig")
+		if kubeconfig == "" {
+			kubeconfig = defaultCalicoConfig
+		}
+		config["datastore_type"] = "kubernetes"
+		config["kubernetes"] = map[string]interface{}{"kubeconfig": kubeconfig}
+		config["policy"] = map[string]interface{}{"type": "k8s"}
+	default:
+		return nil, fmt.Errorf("unknown datastoreType %q, expected etcdv3 or kubernetes", datastore)
+	}
+	return config, nil
+}
+
+// validateCalico checks what the calico plugin needs from its datastore
+func validateCalico(props map[string]interface{}) error {
+	if v, _ := props["nodename"].(string); v == "" {
+		return fmt.Errorf("calico plugin requires nodename, the host's name calico-node registered")
+	}
+	switch props["datastore_type"] {
+	case "etcdv3":
+		endpoints, _ := props["etcd_endpoints"].(string)
+		for _, endpoint := range strings.Split(endpoints, ",") {
+			if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+				return fmt.Errorf("invalid etcd endpoint %q", endpoint)
+			}
+		}
+	case "kubernetes":
+	default:
+		return fmt.Errorf("calico plugin requires datastore_type etcdv3 or kubernetes")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package cniconf
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func settings(t *testing.T, content string) map[string]interface{} {
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCalicoConfig(t *testing.T) {
+	host := metadata.Host{Hostname: "node1", UUID: "host-uuid"}
+	tests := []struct {
+		name     string
+		settings string
+		want     map[string]interface{}
+		err      bool
+	}{
+		{
+			name:     "etcd defaults",
+			settings: `{"etcdEndpoints": "https://etcd:2379"}`,
+			want: map[string]interface{}{
+				"name":           "calico",
+				"cniVersion":     "0.3.1",
+				"type":           "calico",
+				"log_level":      "info",
+				"nodename":       "node1",
+				"ipam":           map[string]interface{}{"type": "calico-ipam"},
+				"datastore_type": "etcdv3",
+				"etcd_endpoints": "https://etcd:2379",
+			},
+		},
+		{
+			name: "etcd with TLS and overrides",
+			settings: `{"etcdEndpoints": "https://etcd:2379", "etcdCAFile": "/ca.pem", "etcdCertFile": "/cert.pem",
+				"etcdKeyFile": "/key.pem", "nodeName": "calico1", "mtu": 1440, "logLevel": "debug", "cniVersion": "0.4.0",
+				"ipam": {"type": "host-local", "subnet": "usePodCidr"}}`,
+			want: map[string]interface{}{
+				"name":              "calico",
+				"cniVersion":        "0.4.0",
+				"type":              "calico",
+				"log_level":         "debug",
+				"nodename":          "calico1",
+				"mtu":               1440,
+				"ipam":              map[string]interface{}{"type": "host-local", "subnet": "usePodCidr"},
+				"datastore_type":    "etcdv3",
+				"etcd_endpoints":    "https://etcd:2379",
+				"etcd_ca_cert_file": "/ca.pem",
+				"etcd_cert_file":    "/cert.pem",
+				"etcd_key_file":     "/key.pem",
+			},
+		},
+		{
+			name:     "kubernetes datastore",
+			settings: `{"datastoreType": "kubernetes"}`,
+			want: map[string]interface{}{
+				"name":           "calico",
+				"cniVersion":     "0.3.1",
+				"type":           "calico",
+				"log_level":      "info",
+				"nodename":       "node1",
+				"ipam":           map[string]interface{}{"type": "calico-ipam"},
+				"datastore_type": "kubernetes",
+				"kubernetes":     map[string]interface{}{"kubeconfig": defaultCalicoConfig},
+				"policy":         map[string]interface{}{"type": "k8s"},
+			},
+		},
+		{
+			name:     "etcd without endpoints",
+			settings: `{}`,
+			err:      true,
+		},
+		{
+			name:     "cert without key",
+			settings: `{"etcdEndpoints": "https://etcd:2379", "etcdCertFile": "/cert.pem"}`,
+			err:      true,
+		},
+		{
+			name:     "unknown datastore",
+			settings: `{"datastoreType": "consul"}`,
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		got, err := calicoConfig("calico", settings(t, test.settings), host)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if err := validateCalico(got); err != nil {
+			t.Errorf("%s: generated config is invalid: %v", test.name, err)
+		}
+	}
+}
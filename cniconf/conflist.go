@@ -0,0 +1,111 @@
+package cniconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/rancher/cniglue"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/audit"
+)
+
+const (
+	conflistVersion = "1.0.0"
+	cniVersionKey   = "cniVersion"
+)
+
+// wantsConflist reports whether the network asked for the 1.0.0 conflist
+// format. Only conflist consumers such as the kubelet read it, the glue
+// bringing up containers reads the per-plugin .conf files.
+func wantsConflist(network metadata.Network) bool {
+	version, _ := network.Metadata[cniVersionKey].(string)
+	return version == conflistVersion
+}
+
+// pluginsSupport checks every plugin in the chain advertises support for
+// version, so a conflist is never handed to binaries that can't parse it
+func pluginsSupport(plugins []map[string]interface{}, version string) error {
+	cninet := &libcni.CNIConfig{Path: glue.CniPath}
+	for _, plugin := range plugins {
+		pluginType, _ := plugin["type"].(string)
+		if pluginType == "" {
+			return fmt.Errorf("plugin config is missing type")
+		}
+
+		info, err := cninet.GetVersionInfo(pluginType)
+		if err != nil {
+			return fmt.Errorf("querying %s for supported versions: %v", pluginType, err)
+		}
+
+		supported := false
+		for _, v := range info.SupportedVersions() {
+			if v == version {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("%s only supports %v", pluginType, info.SupportedVersions())
+		}
+	}
+	return nil
+}
+
+func conflistPlugins(cniConf map[string]interface{}) []map[string]interface{} {
+	var files []string
+	for file := range cniConf {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var plugins []map[string]interface{}
+	for _, file := range files {
+		config, ok := cniConf[file].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		plugin := map[string]interface{}{}
+		for k, v := range config {
+			// name and version live on the list, not on each plugin
+			if k == "name" || k == cniVersionKey {
+				continue
+			}
+			plugin[k] = v
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins
+}
+
+func marshalConflist(name, version string, plugins []map[string]interface{}) ([]byte, error) {
+	content, err := json.Marshal(map[string]interface{}{
+		cniVersionKey:  version,
+		"name":         name,
+		"plugins":      plugins,
+		generatedByKey: generatedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, content, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// removeFile removes a written config, a missing one being already removed
+func removeFile(p string) error {
+	return audit.File("cniconf", "file.remove", p, func() error {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,251 @@
+package cniconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/source"
+)
+
+const (
+	// flannelKey holds a network's flannel settings, from which its CNI
+	// config, subnet.env and net-conf.json are generated
+	flannelKey = "flannel"
+	// flannelFile is the generated config's name in the network's directory
+	flannelFile           = "10-flannel.conf"
+	defaultSubnetFile     = "/run/flannel/subnet.env"
+	defaultFlannelVersion = "0.3.1"
+	defaultHostMTU        = 1500
+	netConfName           = "net-conf.json"
+)
+
+// backendOverhead is what each flannel backend's encapsulation takes off
+// the host MTU
+var backendOverhead = map[string]int{
+	"vxlan":     50,
+	"host-gw":   0,
+	"udp":       28,
+	"ipip":      20,
+	"wireguard": 80,
+}
+
+// lease is the host's share of a flannel network, as flanneld would write
+// it to subnet.env. Subnet is nil when flanneld runs and leases it.
+type lease struct {
+	Network *net.IPNet
+	Subnet  *net.IPNet
+	Backend map[string]interface{}
+	MTU     int
+	IPMasq  bool
+}
+
+// readLease finds the host's subnet in the flannel settings, by its UUID or
+// else its hostname, unless flanneld runs and leases one itself. The
+// host's MTU override is the containers' MTU, or it is the host MTU less the
+// backend's overhead.
+func readLease(settings map[string]interface{}, host metadata.Host, overrides source.HostOverrides) (lease, error) {
+	l := lease{IPMasq: true}
+	cidr, _ := settings["network"].(string)
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return l, fmt.Errorf("invalid network %q", cidr)
+	}
+	l.Network = network
+
+	if !flanneldRuns(settings) {
+		subnets, _ := settings["subnets"].(map[string]interface{})
+		subnet, _ := subnets[host.UUID].(string)
+		if subnet == "" {
+			subnet, _ = subnets[host.Hostname].(string)
+		}
+		if subnet == "" {
+			return l, fmt.Errorf("no subnet for host %s, UUID %s", host.Hostname, host.UUID)
+		}
+		_, l.Subnet, err = net.ParseCIDR(subnet)
+		if err != nil {
+			return l, fmt.Errorf("invalid subnet %q", subnet)
+		}
+		networkOnes, _ := network.Mask.Size()
+		subnetOnes, _ := l.Subnet.Mask.Size()
+		if !network.Contains(l.Subnet.IP) || subnetOnes < networkOnes {
+			return l, fmt.Errorf("subnet %s is not in network %s", l.Subnet, network)
+		}
+	}
+
+	l.Backend = map[string]interface{}{"Type": "vxlan"}
+	if custom, ok := settings["backend"].(map[string]interface{}); ok {
+		l.Backend = custom
+	}
+	backendType, _ := l.Backend["Type"].(string)
+	overhead, ok := backendOverhead[backendType]
+	if !ok {
+		var known []string
+		for name := range backendOverhead {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return l, fmt.Errorf("unsupported backend %q, expected one of %s", backendType, strings.Join(known, ", "))
+	}
+	hostMTU := defaultHostMTU
+	if mtu, ok := settings["mtu"].(float64); ok {
+		hostMTU = int(mtu)
+	}
+	l.MTU = hostMTU - overhead
+	if overrides.MTU != 0 {
+		l.MTU = overrides.MTU
+	}
+	if ipMasq, ok := settings["ipMasq"].(bool); ok {
+		l.IPMasq = ipMasq
+	}
+	return l, nil
+}
+
+// subnetEnv renders the lease in flanneld's subnet.env format, the gateway
+// being the subnet's first address
+func (l lease) subnetEnv() []byte {
+	gateway := make(net.IP, len(l.Subnet.IP))
+	copy(gateway, l.Subnet.IP)
+	gateway[len(gateway)-1]++
+	ones, _ := l.Subnet.Mask.Size()
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "FLANNEL_NETWORK=%s\n", l.Network)
+	fmt.Fprintf(buf, "FLANNEL_SUBNET=%s/%d\n", gateway, ones)
+	fmt.Fprintf(buf, "FLANNEL_MTU=%d\n", l.MTU)
+	fmt.Fprintf(buf, "FLANNEL_IPMASQ=%v\n", l.IPMasq)
+	return buf.Bytes()
+}
+
+// netConf renders the network in the net-conf.json format flanneld reads
+// with --net-config-path
+func (l lease) netConf() ([]byte, error) {
+	return json.MarshalIndent(map[string]interface{}{
+		"Network": l.Network.String(),
+		"Backend": l.Backend,
+	}, "", "  ")
+}
+
+// flanneldRuns reports whether binexec runs flanneld for the network, which
+// then writes subnet.env with the subnet it leased
+func flanneldRuns(settings map[string]interface{}) bool {
+	binaries, _ := settings["binaries"].([]interface{})
+	for _, entry := range binaries {
+		props, _ := entry.(map[string]interface{})
+		if name, _ := props["name"].(string); name == "flanneld" {
+			return true
+		}
+	}
+	return false
+}
+
+// FlannelPaths returns where the network's subnet.env and net-conf.json are
+// written, false if it isn't a flannel network
+func FlannelPaths(network metadata.Network) (string, string, bool) {
+	settings, ok := network.Metadata[flannelKey].(map[string]interface{})
+	if !ok {
+		return "", "", false
+	}
+	subnetFile := flannelSubnetFile(settings)
+	return subnetFile, filepath.Join(filepath.Dir(subnetFile), netConfName), true
+}
+
+func flannelSubnetFile(settings map[string]interface{}) string {
+	if subnetFile, _ := settings["subnetFile"].(string); subnetFile != "" {
+		return subnetFile
+	}
+	return defaultSubnetFile
+}
+
+// flannelConfig is the flannel plugin's config for the network name and its
+// settings, delegating to the bridge plugin with the host's lease
+func flannelConfig(name string, settings map[string]interface{}, host metadata.Host) (map[string]interface{}, error) {
+	if _, err := readLease(settings, host, source.HostOverrides{}); err != nil {
+		return nil, err
+	}
+	version, _ := settings["cniVersion"].(string)
+	if version == "" {
+		version = defaultFlannelVersion
+	}
+	delegate := map[string]interface{}{
+		"isDefaultGateway": true,
+		"hairpinMode":      true,
+	}
+	if custom, ok := settings["delegate"].(map[string]interface{}); ok {
+		delegate = custom
+	}
+	return map[string]interface{}{
+		"name":       name,
+		"cniVersion": version,
+		"type":       "flannel",
+		"subnetFile": flannelSubnetFile(settings),
+		"delegate":   delegate,
+	}, nil
+}
+
+// flannelFiles renders the network's net-conf.json and, unless flanneld
+// writes it, subnet.env by path, none if it isn't a flannel network
+func flannelFiles(network metadata.Network, host metadata.Host, overrides source.HostOverrides) (map[string][]byte, error) {
+	subnetFile, netConfFile, ok := FlannelPaths(network)
+	if !ok {
+		return nil, nil
+	}
+	l, err := readLease(network.Metadata[flannelKey].(map[string]interface{}), host, overrides)
+	if err != nil {
+		return nil, err
+	}
+	netConf, err := l.netConf()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{netConfFile: netConf}
+	if l.Subnet != nil {
+		files[subnetFile] = l.subnetEnv()
+	}
+	return files, nil
+}
+
+// flannelOwnFiles are the paths applyFlannel writes for the network, for
+// cleanup. flanneld's subnet.env is left to it.
+func flannelOwnFiles(network metadata.Network) []string {
+	subnetFile, netConfFile, ok := FlannelPaths(network)
+	if !ok {
+		return nil
+	}
+	if flanneldRuns(network.Metadata[flannelKey].(map[string]interface{})) {
+		return []string{netConfFile}
+	}
+	return []string{subnetFile, netConfFile}
+}
+
+// applyFlannel writes the network config for flanneld and, without it, the
+// host's lease for the flannel plugin before the network's CNI config refers
+// to it
+func (w *watcher) applyFlannel(network metadata.Network, host metadata.Host, overrides source.HostOverrides) error {
+	files, err := flannelFiles(network, host, overrides)
+	if err != nil {
+		return err
+	}
+	for p, content := range files {
+		if !audit.DryRun() {
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+		}
+		log.Debugf("Writing %s: %s", p, content)
+		if err := audit.File("cniconf", "file.write", p, func() error {
+			return atomicfile.WriteFile(p, content, 0644)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package cniconf
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+)
+
+func TestReadLease(t *testing.T) {
+	host := metadata.Host{Hostname: "node1", UUID: "host-uuid"}
+	tests := []struct {
+		name      string
+		settings  string
+		overrides source.HostOverrides
+		subnet    string
+		backend   string
+		mtu       int
+		ipMasq    bool
+		err       bool
+	}{
+		{
+			name:     "subnet by UUID",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"host-uuid": "10.244.1.0/24", "node1": "10.244.2.0/24"}}`,
+			subnet:   "10.244.1.0/24",
+			backend:  "vxlan",
+			mtu:      1450,
+			ipMasq:   true,
+		},
+		{
+			name:     "subnet by hostname",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}, "backend": {"Type": "host-gw"}, "ipMasq": false}`,
+			subnet:   "10.244.2.0/24",
+			backend:  "host-gw",
+			mtu:      1500,
+		},
+		{
+			name:     "host MTU less the overhead",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}, "backend": {"Type": "wireguard"}, "mtu": 9000}`,
+			subnet:   "10.244.2.0/24",
+			backend:  "wireguard",
+			mtu:      8920,
+			ipMasq:   true,
+		},
+		{
+			name:      "host MTU override",
+			settings:  `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}}`,
+			overrides: source.HostOverrides{MTU: 1400},
+			subnet:    "10.244.2.0/24",
+			backend:   "vxlan",
+			mtu:       1400,
+			ipMasq:    true,
+		},
+		{
+			name:     "flanneld leases the subnet",
+			settings: `{"network": "10.244.0.0/16", "binaries": [{"name": "flanneld"}]}`,
+			backend:  "vxlan",
+			mtu:      1450,
+			ipMasq:   true,
+		},
+		{
+			name:     "no subnet for the host",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node2": "10.244.2.0/24"}}`,
+			err:      true,
+		},
+		{
+			name:     "subnet outside the network",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.245.2.0/24"}}`,
+			err:      true,
+		},
+		{
+			name:     "subnet larger than the network",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.0.0.0/8"}}`,
+			err:      true,
+		},
+		{
+			name:     "invalid network",
+			settings: `{"network": "10.244.0.0"}`,
+			err:      true,
+		},
+		{
+			name:     "unsupported backend",
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}, "backend": {"Type": "aws-vpc"}}`,
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		l, err := readLease(settings(t, test.settings), host, test.overrides)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, l)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		subnet := ""
+		if l.Subnet != nil {
+			subnet = l.Subnet.String()
+		}
+		if subnet != test.subnet || l.Backend["Type"] != test.backend || l.MTU != test.mtu || l.IPMasq != test.ipMasq {
+			t.Errorf("%s: got subnet %q, backend %v, MTU %d, ipMasq %v, want %q, %s, %d, %v", test.name,
+				subnet, l.Backend["Type"], l.MTU, l.IPMasq, test.subnet, test.backend, test.mtu, test.ipMasq)
+		}
+	}
+}
+
+func TestSubnetEnv(t *testing.T) {
+	tests := []struct {
+		settings string
+		want     string
+	}{
+		{
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}}`,
+			want:     "FLANNEL_NETWORK=10.244.0.0/16\nFLANNEL_SUBNET=10.244.2.1/24\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=true\n",
+		},
+		{
+			settings: `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.3.128/25"}, "backend": {"Type": "host-gw"}, "ipMasq": false}`,
+			want:     "FLANNEL_NETWORK=10.244.0.0/16\nFLANNEL_SUBNET=10.244.3.129/25\nFLANNEL_MTU=1500\nFLANNEL_IPMASQ=false\n",
+		},
+	}
+	for _, test := range tests {
+		l, err := readLease(settings(t, test.settings), metadata.Host{Hostname: "node1"}, source.HostOverrides{})
+		if err != nil {
+			t.Errorf("%s: %v", test.settings, err)
+			continue
+		}
+		if got := string(l.subnetEnv()); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.settings, got, test.want)
+		}
+	}
+}
+
+func TestFlannelFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		want     []string
+	}{
+		{"plugin-manager writes the lease", `{"network": "10.244.0.0/16", "subnets": {"node1": "10.244.2.0/24"}}`,
+			[]string{"/run/flannel/net-conf.json", "/run/flannel/subnet.env"}},
+		{"flanneld writes the lease", `{"network": "10.244.0.0/16", "subnetFile": "/run/f/subnet.env", "binaries": [{"name": "flanneld"}]}`,
+			[]string{"/run/f/net-conf.json"}},
+	}
+	for _, test := range tests {
+		network := metadata.Network{Name: "flannel", Metadata: map[string]interface{}{flannelKey: settings(t, test.settings)}}
+		files, err := flannelFiles(network, metadata.Host{Hostname: "node1"}, source.HostOverrides{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(files) != len(test.want) {
+			t.Errorf("%s: got %d files, want %v", test.name, len(files), test.want)
+		}
+		for _, p := range test.want {
+			if _, ok := files[p]; !ok {
+				t.Errorf("%s: %s not written", test.name, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package cniconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/audit"
+)
+
+const (
+	// legacyListVersion is the kubelet conflist's version when the plugins
+	// don't name one, the oldest chaining plugins through prevResult
+	legacyListVersion = "0.3.1"
+	// generatedByKey marks the conflists plugin-manager wrote so ones left
+	// under an earlier name are found after a restart. The kubelet ignores
+	// keys it doesn't know.
+	generatedByKey = "generatedBy"
+	generatedBy    = "rancher-plugin-manager"
+)
+
+var (
+	kubeletDir      string
+	kubeletPriority = 10
+)
+
+// SetKubeletDir has the default network's CNI config also written to dir
+// as one conflist for the kubelet, empty to stop. The kubelet uses the
+// first config in name order, the file is named
+// <priority>-<network>.conflist to sort it among other providers'.
+func SetKubeletDir(dir string, priority int) {
+	kubeletDir = dir
+	kubeletPriority = priority
+}
+
+func kubeletPath(network metadata.Network) string {
+	return filepath.Join(kubeletDir, fmt.Sprintf("%02d-%s.conflist", kubeletPriority, network.Name))
+}
+
+// listVersion is the version the kubelet conflist declares, 1.0.0 when the
+// network asked for it and the plugins support it, otherwise the version
+// the plugins are configured with
+func listVersion(network metadata.Network, cniConf map[string]interface{}, plugins []map[string]interface{}) (string, error) {
+	if wantsConflist(network) && pluginsSupport(plugins, conflistVersion) == nil {
+		return conflistVersion, nil
+	}
+	var files []string
+	for file := range cniConf {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	version := ""
+	for _, file := range files {
+		props, _ := cniConf[file].(map[string]interface{})
+		v, _ := props[cniVersionKey].(string)
+		if v == "" {
+			continue
+		}
+		if version != "" && v != version {
+			return "", fmt.Errorf("%s is version %s, the plugins before it %s", file, v, version)
+		}
+		version = v
+	}
+	if version == "" {
+		version = legacyListVersion
+	}
+	return version, nil
+}
+
+// renderKubeletConflist builds the network's plugin chain as the conflist
+// the kubelet reads
+func renderKubeletConflist(network metadata.Network, cniConf map[string]interface{}) ([]byte, error) {
+	plugins := conflistPlugins(cniConf)
+	version, err := listVersion(network, cniConf, plugins)
+	if err != nil {
+		return nil, err
+	}
+	if err := pluginsSupport(plugins, version); err != nil {
+		return nil, err
+	}
+	return marshalConflist(network.Name, version, plugins)
+}
+
+// applyKubelet writes the kubelet conflist for the default network and
+// removes those written before under another name
+func (w *watcher) applyKubelet(network metadata.Network, cniConf map[string]interface{}) error {
+	p := kubeletPath(network)
+	content, err := renderKubeletConflist(network, cniConf)
+	if err != nil {
+		log.Errorf("Refusing to replace %s with an unusable config, keeping the last good version: %v", p, err)
+		return err
+	}
+	if !audit.DryRun() {
+		if err := os.MkdirAll(kubeletDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Writing %s: %s", p, content)
+	if err := audit.File("cniconf", "file.write", p, func() error {
+		return atomicfile.WriteFile(p, content, 0600)
+	}); err != nil {
+		return err
+	}
+	return removeKubeletConflists(p)
+}
+
+// removeKubeletConflists removes the conflists plugin-manager wrote to the
+// kubelet's directory other than keep, such as one named for another
+// priority or network before a restart
+func removeKubeletConflists(keep string) error {
+	paths, err := filepath.Glob(filepath.Join(kubeletDir, "*-*.conflist"))
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, p := range paths {
+		if p == keep || !generated(p) {
+			continue
+		}
+		if err := removeFile(p); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// generated reports whether plugin-manager wrote the conflist at p
+func generated(p string) bool {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	var list map[string]interface{}
+	if err := json.Unmarshal(content, &list); err != nil {
+		return false
+	}
+	return list[generatedByKey] == generatedBy
+}
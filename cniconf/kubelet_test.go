@@ -0,0 +1,57 @@
+package cniconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestRemoveKubeletConflists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetKubeletDir("", 10)
+	SetKubeletDir(dir, 20)
+
+	ours, err := marshalConflist("ipsec", "0.3.1", []map[string]interface{}{{"type": "rancher-bridge"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"10-ipsec.conflist":  string(ours),
+		"10-old.conflist":    string(ours),
+		"20-ipsec.conflist":  string(ours),
+		"10-calico.conflist": `{"name": "k8s-pod-network", "cniVersion": "0.3.1", "plugins": []}`,
+		"99-broken.conflist": `{`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := kubeletPath(metadata.Network{Name: "ipsec"})
+	if err := removeKubeletConflists(keep); err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range left {
+		left[i] = filepath.Base(left[i])
+	}
+	sort.Strings(left)
+	want := []string{"10-calico.conflist", "20-ipsec.conflist", "99-broken.conflist"}
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
@@ -0,0 +1,64 @@
+package cniconf
+
+import (
+	"github.com/rancher/plugin-manager/source"
+)
+
+// interfaceDrivers are the plugin types that create the container interface,
+// the ones host MTU and driver overrides apply to
+var interfaceDrivers = map[string]bool{
+	"rancher-bridge": true,
+	"bridge":         true,
+	"macvlan":        true,
+	"ipvlan":         true,
+	"calico":         true,
+}
+
+// masterDrivers are the interface plugin types that attach to a host
+// interface named by "master"
+var masterDrivers = map[string]bool{
+	"macvlan": true,
+	"ipvlan":  true,
+}
+
+// applyOverrides returns cniConf with the host's MTU, driver and master
+// overrides applied to the interface plugins, leaving the metadata answers
+// untouched
+func applyOverrides(cniConf map[string]interface{}, o source.HostOverrides) map[string]interface{} {
+	if o.MTU == 0 && o.CNIDriver == "" && o.CNIMaster == "" {
+		return cniConf
+	}
+
+	result := map[string]interface{}{}
+	for file, config := range cniConf {
+		props, ok := config.(map[string]interface{})
+		if !ok {
+			result[file] = config
+			continue
+		}
+		if pluginType, _ := props["type"].(string); !interfaceDrivers[pluginType] {
+			result[file] = config
+			continue
+		}
+
+		copied := map[string]interface{}{}
+		for k, v := range props {
+			copied[k] = v
+		}
+		if o.MTU != 0 {
+			copied["mtu"] = o.MTU
+		}
+		if o.CNIDriver != "" {
+			copied["type"] = o.CNIDriver
+		}
+		if pluginType, _ := copied["type"].(string); masterDrivers[pluginType] {
+			if o.CNIMaster != "" {
+				copied["master"] = o.CNIMaster
+			} else if master, _ := copied["master"].(string); master == "" {
+				log.Errorf("%s in %s needs a host interface, set %s", pluginType, file, source.CNIMasterLabel)
+			}
+		}
+		result[file] = copied
+	}
+	return result
+}
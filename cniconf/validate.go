@@ -0,0 +1,99 @@
+package cniconf
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// requiredKeys lists the keys each known plugin type can't work without
+var requiredKeys = map[string][]string{
+	"rancher-bridge": {"bridge"},
+	"bridge":         {"bridge"},
+	"macvlan":        {"master"},
+	"ipvlan":         {"master"},
+	"flannel":        {"subnetFile"},
+}
+
+// validateConfig checks a generated plugin config before it is allowed to
+// replace what is already on disk
+func validateConfig(file string, config interface{}) error {
+	props, ok := config.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: config must be a JSON object", file)
+	}
+
+	pluginType, _ := props["type"].(string)
+	if pluginType == "" {
+		return fmt.Errorf("%s: missing plugin type", file)
+	}
+
+	for _, key := range requiredKeys[pluginType] {
+		if v, _ := props[key].(string); v == "" {
+			return fmt.Errorf("%s: %s plugin requires %s", file, pluginType, key)
+		}
+	}
+
+	if pluginType == "calico" {
+		if err := validateCalico(props); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	if subnet, ok := props["bridgeSubnet"].(string); ok {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return fmt.Errorf("%s: invalid bridgeSubnet: %v", file, err)
+		}
+	}
+
+	if ipam, ok := props["ipam"].(map[string]interface{}); ok {
+		if err := validateIPAM(ipam); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	return nil
+}
+
+func validateIPAM(ipam map[string]interface{}) error {
+	if t, _ := ipam["type"].(string); t == "" {
+		return fmt.Errorf("ipam is missing type")
+	}
+
+	subnetValue, ok := ipam["subnet"].(string)
+	if !ok {
+		return nil
+	}
+
+	_, subnet, err := net.ParseCIDR(subnetValue)
+	if err != nil {
+		return fmt.Errorf("invalid ipam subnet: %v", err)
+	}
+
+	var start, end net.IP
+	for _, key := range []string{"rangeStart", "rangeEnd", "gateway"} {
+		value, ok := ipam[key].(string)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid ipam %s %q", key, value)
+		}
+		if !subnet.Contains(ip) {
+			return fmt.Errorf("ipam %s %s is outside subnet %s", key, ip, subnet)
+		}
+		switch key {
+		case "rangeStart":
+			start = ip
+		case "rangeEnd":
+			end = ip
+		}
+	}
+
+	if start != nil && end != nil && bytes.Compare(start.To16(), end.To16()) > 0 {
+		return fmt.Errorf("ipam rangeStart %s is after rangeEnd %s", start, end)
+	}
+
+	return nil
+}
@@ -4,19 +4,31 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/rancher/cniglue"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cleanup"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
 )
 
+var log = logging.Subsystem("cniconf")
+
 var (
-	reapplyEvery = 5 * time.Minute
+	// ReapplyEvery is how often CNI configs are written again when nothing
+	// changed
+	ReapplyEvery = config.NewDuration(5 * time.Minute)
 	cniDir       = "/etc/cni/%s.d"
 )
 
@@ -24,75 +36,274 @@ func init() {
 	glue.CniDir = cniDir
 }
 
-func Watch(c metadata.Client) error {
-	w := &watcher{
+// SetConfDir moves the network config directories, <dir>/<network>.d, for
+// both the written configs and the plugins reading them
+func SetConfDir(dir string) {
+	cniDir = filepath.Join(dir, "%s.d")
+	glue.CniDir = cniDir
+}
+
+func Watch(c source.MetadataSource) error {
+	w := newWatcher(c)
+	health.Register("cniconf")
+	handoff.RegisterStop("cniconf", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("cniconf", func() error { return w.reconcile("", true) })
+	cleanup.Register("cniconf", w.cleanup)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	return nil
+}
+
+func newWatcher(c source.MetadataSource) *watcher {
+	return &watcher{
 		c:       c,
 		applied: map[string]metadata.Network{},
 	}
-	go c.OnChange(5, w.onChangeNoError)
-	return nil
+}
+
+// cleanup removes the configs written for each network and the managed
+// link, keeping the pass lock so no later pass writes them again.
+// Directories are only removed once empty.
+func (w *watcher) cleanup() error {
+	w.pass.Lock()
+	var lastErr error
+	for _, network := range w.applied {
+		confDir := fmt.Sprintf(cniDir, network.Name)
+		for _, file := range networkFiles(network) {
+			if err := removeFile(filepath.Join(confDir, file)); err != nil {
+				lastErr = err
+			}
+		}
+		for _, p := range flannelOwnFiles(network) {
+			if err := removeFile(p); err != nil {
+				lastErr = err
+			}
+		}
+		if !audit.DryRun() {
+			os.Remove(confDir)
+		}
+
+		managedDir := fmt.Sprintf(cniDir, "managed")
+		if fi, err := os.Lstat(managedDir); network.Default && err == nil && fi.Mode()&os.ModeSymlink != 0 &&
+			!audit.Would("cniconf", "symlink.remove", managedDir, nil) {
+			err := os.Remove(managedDir)
+			audit.Record("cniconf", "symlink.remove", managedDir, network.Name+".d", nil, err)
+			if err != nil {
+				lastErr = err
+			}
+		}
+	}
+	if kubeletDir != "" {
+		if err := removeKubeletConflists(""); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Reconcile programs the CNI configs for the current metadata once, for
+// running without the daemon
+func Reconcile(c source.MetadataSource) error {
+	return newWatcher(c).onChange("")
 }
 
 type watcher struct {
-	c           metadata.Client
-	applied     map[string]metadata.Network
-	lastApplied time.Time
+	pass             sync.Mutex
+	c                source.MetadataSource
+	applied          map[string]metadata.Network
+	appliedOverrides source.HostOverrides
+	lastApplied      time.Time
 }
 
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply cni conf: %v", err)
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply cni conf")
 	}
 }
 
+// reconcile makes one pass, with force set the CNI configs are programmed
+// again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("cniconf", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
 func (w *watcher) onChange(version string) error {
 	networks, err := w.c.GetNetworks()
 	if err != nil {
 		return err
 	}
 
-	forceApply := time.Now().Sub(w.lastApplied) > reapplyEvery
+	self, err := w.c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+	overrides := source.Overrides(self)
+
+	forceApply := time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() || overrides != w.appliedOverrides
 
 	for _, network := range networks {
-		_, ok := network.Metadata["cniConfig"].(map[string]interface{})
+		cniConf, ok := networkConfig(network, self)
 		if !ok {
 			continue
 		}
 
 		if forceApply || !reflect.DeepEqual(w.applied[network.Name], network) {
-			if err := w.apply(network); err != nil {
-				logrus.Errorf("Failed to apply cni conf: %v", err)
+			if err := w.applyFlannel(network, self, overrides); err != nil {
+				log.WithError(err).Errorf("Failed to write the flannel lease of network %s", network.Name)
+				continue
+			}
+			if err := w.apply(network, cniConf, overrides); err != nil {
+				log.WithError(err).Error("Failed to apply cni conf")
 			}
 		}
 	}
 
+	w.appliedOverrides = overrides
 	return nil
 }
 
-func (w *watcher) apply(network metadata.Network) error {
+// Plan returns the CNI config files, by path, that would be written for the
+// current metadata without changing anything on the host
+func Plan(c source.MetadataSource) (map[string][]byte, error) {
+	networks, err := c.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	self, err := c.GetSelfHost()
+	if err != nil {
+		return nil, err
+	}
+	overrides := source.Overrides(self)
+
+	result := map[string][]byte{}
+	for _, network := range networks {
+		cniConf, ok := networkConfig(network, self)
+		if !ok {
+			continue
+		}
+		cniConf = applyOverrides(cniConf, overrides)
+
+		files, err := flannelFiles(network, self, overrides)
+		if err != nil {
+			return nil, err
+		}
+		for p, content := range files {
+			result[p] = content
+		}
+
+		confDir := fmt.Sprintf(cniDir, network.Name)
+		for file, config := range cniConf {
+			content, err := renderConfig(file, config)
+			if err != nil {
+				return nil, err
+			}
+			result[filepath.Join(confDir, file)] = content
+		}
+
+		if network.Default && kubeletDir != "" {
+			content, err := renderKubeletConflist(network, cniConf)
+			if err != nil {
+				return nil, err
+			}
+			result[kubeletPath(network)] = content
+		}
+	}
+
+	return result, nil
+}
+
+// networkConfig returns the network's plugin configs by file name: the
+// cniConfig it carries, or the one generated from its Calico or flannel
+// settings
+func networkConfig(network metadata.Network, host metadata.Host) (map[string]interface{}, bool) {
+	if settings, ok := network.Metadata[calicoKey].(map[string]interface{}); ok {
+		config, err := calicoConfig(network.Name, settings, host)
+		if err != nil {
+			log.Errorf("Ignoring the Calico settings of network %s: %v", network.Name, err)
+			return nil, false
+		}
+		return map[string]interface{}{calicoFile: config}, true
+	}
+	if settings, ok := network.Metadata[flannelKey].(map[string]interface{}); ok {
+		config, err := flannelConfig(network.Name, settings, host)
+		if err != nil {
+			log.Errorf("Ignoring the flannel settings of network %s: %v", network.Name, err)
+			return nil, false
+		}
+		return map[string]interface{}{flannelFile: config}, true
+	}
+	cniConf, ok := network.Metadata["cniConfig"].(map[string]interface{})
+	return cniConf, ok
+}
+
+// networkFiles names the plugin configs written for the network, without
+// rendering them, as generated ones depend on the host
+func networkFiles(network metadata.Network) []string {
+	if _, ok := network.Metadata[calicoKey].(map[string]interface{}); ok {
+		return []string{calicoFile}
+	}
+	if _, ok := network.Metadata[flannelKey].(map[string]interface{}); ok {
+		return []string{flannelFile}
+	}
 	cniConf, _ := network.Metadata["cniConfig"].(map[string]interface{})
+	var files []string
+	for file := range cniConf {
+		files = append(files, file)
+	}
+	return files
+}
+
+func renderConfig(file string, config interface{}) ([]byte, error) {
+	if err := validateConfig(file, config); err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, content, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (w *watcher) apply(network metadata.Network, cniConf map[string]interface{}, overrides source.HostOverrides) error {
+	cniConf = applyOverrides(cniConf, overrides)
 	confDir := fmt.Sprintf(cniDir, network.Name)
-	if err := os.MkdirAll(confDir, 0700); err != nil {
-		return err
+	if !audit.DryRun() {
+		if err := os.MkdirAll(confDir, 0700); err != nil {
+			return err
+		}
 	}
 
 	var lastErr error
 	for file, config := range cniConf {
 		p := filepath.Join(confDir, file)
-		content, err := json.Marshal(config)
+		content, err := renderConfig(file, config)
 		if err != nil {
+			log.Errorf("Refusing to replace %s with an invalid config, keeping the last good version: %v", p, err)
 			lastErr = err
 			continue
 		}
 
-		out := &bytes.Buffer{}
-		if err := json.Indent(out, content, "", "  "); err != nil {
+		log.Debugf("Writing %s: %s", p, content)
+		if err := audit.File("cniconf", "file.write", p, func() error {
+			return atomicfile.WriteFile(p, content, 0600)
+		}); err != nil {
 			lastErr = err
-			continue
 		}
+	}
 
-		logrus.Debugf("Writing %s: %s", p, out)
-		if err := ioutil.WriteFile(p, out.Bytes(), 0600); err != nil {
+	if network.Default && kubeletDir != "" {
+		if err := w.applyKubelet(network, cniConf); err != nil {
 			lastErr = err
 		}
 	}
@@ -101,9 +312,12 @@ func (w *watcher) apply(network metadata.Network) error {
 		managedDir := fmt.Sprintf(cniDir, "managed")
 		managedDirTest, err := os.Stat(managedDir)
 		configDirTest, err1 := os.Stat(confDir)
-		if !(err == nil && err1 == nil && os.SameFile(managedDirTest, configDirTest)) {
+		if !(err == nil && err1 == nil && os.SameFile(managedDirTest, configDirTest)) &&
+			!audit.Would("cniconf", "symlink.create", managedDir, network.Name+".d") {
 			os.Remove(managedDir)
-			if err := os.Symlink(network.Name+".d", managedDir); err != nil {
+			err := os.Symlink(network.Name+".d", managedDir)
+			audit.Record("cniconf", "symlink.create", managedDir, nil, network.Name+".d", err)
+			if err != nil {
 				lastErr = err
 			}
 		}
@@ -0,0 +1,388 @@
+// Package config reads flag values from a file and a directory of drop-in
+// fragments, so hosts can be configured without long command lines, and
+// reloads them on SIGHUP
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+var log = logging.Subsystem("config")
+
+// File is a parsed config file, the arguments of each flag by name
+type File map[string][]string
+
+// Load parses the object in the file at path, JSON unless ToJSON reads it
+// as YAML or TOML. Values are strings, numbers, booleans or, for flags that
+// can repeat, arrays of them.
+func Load(path string) (File, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if content, err = ToJSON(path, content); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s", path)
+	}
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s", path)
+	}
+
+	f := File{}
+	for name, value := range values {
+		args, err := flagArgs(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading %s from %s", name, path)
+		}
+		f[name] = args
+	}
+	return f, nil
+}
+
+// extensions are those of the files in a fragment dir
+var extensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// ToJSON converts the content of the file at path to JSON, parsing it as
+// YAML when it's named .yaml or .yml and as TOML when it's named .toml.
+// Anything else is taken to be JSON already.
+func ToJSON(path string, content []byte) ([]byte, error) {
+	var value interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		table := map[string]interface{}{}
+		if _, err := toml.Decode(string(content), &table); err != nil {
+			return nil, err
+		}
+		value = table
+	default:
+		return content, nil
+	}
+	return json.Marshal(jsonValue(value))
+}
+
+// jsonValue turns the maps YAML decodes, keyed by interface{}, and TOML's
+// arrays of tables into values json can encode
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[key] = jsonValue(item)
+		}
+		return result
+	case []map[string]interface{}:
+		var result []interface{}
+		for _, item := range v {
+			result = append(result, jsonValue(item))
+		}
+		return result
+	case []interface{}:
+		var result []interface{}
+		for _, item := range v {
+			result = append(result, jsonValue(item))
+		}
+		return result
+	}
+	return value
+}
+
+// LoadAll merges the file at path and then every JSON, YAML or TOML fragment
+// in dir in lexical order, a setting in a later one replacing earlier ones.
+// Either may be empty, a missing dir has no fragments.
+func LoadAll(path, dir string) (File, error) {
+	var paths []string
+	if path != "" {
+		paths = append(paths, path)
+	}
+	if dir != "" {
+		var fragments []string
+		for _, ext := range extensions {
+			matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, matches...)
+		}
+		sort.Strings(fragments)
+		paths = append(paths, fragments...)
+	}
+
+	merged := File{}
+	for _, p := range paths {
+		f, err := Load(p)
+		if err != nil {
+			return nil, err
+		}
+		for name, args := range f {
+			merged[name] = args
+		}
+	}
+	return merged, nil
+}
+
+func (f File) names() []string {
+	var names []string
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reloader applies a config file to the flags and later applies changes
+// to it to the settings that can change while running
+type Reloader struct {
+	path string
+	dir  string
+	// live holds the funcs applying new values of settings that don't
+	// need a restart
+	live map[string]func(value string) error
+
+	lock       sync.Mutex
+	current    File
+	defaults   map[string]string
+	overridden map[string]bool
+}
+
+// Changes reports what a reload did with each changed setting
+type Changes struct {
+	Applied     []string          `json:"applied,omitempty"`
+	NeedRestart []string          `json:"needRestart,omitempty"`
+	Overridden  []string          `json:"overridden,omitempty"`
+	Failed      map[string]string `json:"failed,omitempty"`
+}
+
+// Apply sets the flags named in the file at path and the fragments in dir.
+// Flags given on the command line or through their environment variable
+// win over the files.
+func Apply(c *cli.Context, path, dir string) (*Reloader, error) {
+	f, err := LoadAll(path, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reloader{
+		path:       path,
+		dir:        dir,
+		live:       map[string]func(string) error{},
+		current:    f,
+		defaults:   map[string]string{},
+		overridden: map[string]bool{},
+	}
+	known := map[string]bool{}
+	for _, name := range c.GlobalFlagNames() {
+		known[name] = true
+		r.defaults[name] = c.String(name)
+		r.overridden[name] = c.IsSet(name)
+	}
+
+	var unknown []string
+	for _, name := range f.names() {
+		if !known[name] {
+			unknown = append(unknown, name)
+			continue
+		}
+		if r.overridden[name] {
+			continue
+		}
+		for _, arg := range f[name] {
+			if err := c.Set(name, arg); err != nil {
+				return nil, errors.Wrapf(err, "Setting %s from %s", name, r.source())
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown settings in %s: %s", r.source(), strings.Join(unknown, ", "))
+	}
+	return r, nil
+}
+
+// source names where settings are read from for logs and errors
+func (r *Reloader) source() string {
+	switch {
+	case r.dir == "":
+		return r.path
+	case r.path == "":
+		return r.dir
+	}
+	return r.path + " and " + r.dir
+}
+
+// Live registers apply as the way to change setting name without a
+// restart
+func (r *Reloader) Live(name string, apply func(value string) error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.live[name] = apply
+}
+
+// Reload reads the files again and applies every changed setting that can
+// change live. A setting removed from all of them returns to its default.
+func (r *Reloader) Reload() (Changes, error) {
+	changes := Changes{Failed: map[string]string{}}
+	f, err := LoadAll(r.path, r.dir)
+	if err != nil {
+		return changes, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := map[string]bool{}
+	for name := range f {
+		names[name] = true
+	}
+	for name := range r.current {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		args, ok := f[name]
+		if ok && reflect.DeepEqual(args, r.current[name]) {
+			continue
+		}
+		if _, known := r.defaults[name]; !known {
+			changes.Failed[name] = "unknown setting"
+			continue
+		}
+		if r.overridden[name] {
+			changes.Overridden = append(changes.Overridden, name)
+			continue
+		}
+		apply, live := r.live[name]
+		if !live || len(args) > 1 {
+			changes.NeedRestart = append(changes.NeedRestart, name)
+			continue
+		}
+		value := r.defaults[name]
+		if ok && len(args) == 1 {
+			value = args[0]
+		}
+		if err := apply(value); err != nil {
+			changes.Failed[name] = err.Error()
+			continue
+		}
+		changes.Applied = append(changes.Applied, name)
+	}
+
+	// Settings that failed keep their old value so the next reload tries
+	// them again
+	for name := range changes.Failed {
+		if old, ok := r.current[name]; ok {
+			f[name] = old
+		} else {
+			delete(f, name)
+		}
+	}
+	r.current = f
+	if len(changes.Failed) == 0 {
+		changes.Failed = nil
+	}
+	return changes, nil
+}
+
+func (r *Reloader) reloadAndLog() (Changes, error) {
+	changes, err := r.Reload()
+	if err != nil {
+		log.WithError(err).Errorf("Failed to reload %s", r.source())
+		return changes, err
+	}
+	log.Infof("Reloaded %s, applied: %v, need a restart: %v, overridden by flags: %v",
+		r.source(), changes.Applied, changes.NeedRestart, changes.Overridden)
+	for name, reason := range changes.Failed {
+		log.Errorf("Failed to apply %s from %s: %s", name, r.source(), reason)
+	}
+	return changes, nil
+}
+
+// WatchSignal reloads the files on SIGHUP
+func (r *Reloader) WatchSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			r.reloadAndLog()
+		}
+	}()
+}
+
+// Handler reloads the files on POST and answers the changes
+func (r *Reloader) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(rw, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		changes, err := r.reloadAndLog()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(append(content, '\n'))
+	})
+}
+
+func flagArgs(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{fmt.Sprint(v)}, nil
+	case []interface{}:
+		var args []string
+		for _, item := range v {
+			if _, nested := item.([]interface{}); nested {
+				return nil, fmt.Errorf("nested arrays aren't supported")
+			}
+			itemArgs, err := flagArgs(item)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, itemArgs...)
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
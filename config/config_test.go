@@ -0,0 +1,237 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  File
+		err   bool
+	}{
+		{
+			name:  "main file only",
+			files: map[string]string{"main.json": `{"event-workers": 50, "debug": true, "disable": ["shaping", "floatingip"]}`},
+			want:  File{"event-workers": {"50"}, "debug": {"true"}, "disable": {"shaping", "floatingip"}},
+		},
+		{
+			name: "fragments in lexical order",
+			files: map[string]string{
+				"main.json":           `{"event-workers": 50, "reapply-interval": "5m"}`,
+				"conf.d/90-host.json": `{"event-workers": 10}`,
+				"conf.d/10-site.json": `{"event-workers": 20, "debug": false}`,
+			},
+			want: File{"event-workers": {"10"}, "reapply-interval": {"5m"}, "debug": {"false"}},
+		},
+		{
+			name: "only json fragments",
+			files: map[string]string{
+				"main.json":         `{}`,
+				"conf.d/host.json":  `{"debug": true}`,
+				"conf.d/host.json~": `{"debug": false}`,
+			},
+			want: File{"debug": {"true"}},
+		},
+		{
+			name: "yaml and toml fragments",
+			files: map[string]string{
+				"main.json":           `{"event-workers": 50}`,
+				"conf.d/10-site.yaml": "event-workers: 20\ndebug: true\n",
+				"conf.d/20-host.toml": "event-workers = 10\n",
+			},
+			want: File{"event-workers": {"10"}, "debug": {"true"}},
+		},
+		{
+			name:  "nested array",
+			files: map[string]string{"main.json": `{"disable": [["shaping"]]}`},
+			err:   true,
+		},
+		{
+			name:  "object value",
+			files: map[string]string{"main.json": `{"disable": {"shaping": true}}`},
+			err:   true,
+		},
+		{
+			name:  "not json",
+			files: map[string]string{"main.json": `debug: true`},
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, test.files)
+		got, err := LoadAll(filepath.Join(dir, "main.json"), filepath.Join(dir, "conf.d"))
+		os.RemoveAll(dir)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	want := File{"event-workers": {"50"}, "debug": {"true"}, "reapply-interval": {"5m"}, "disable": {"shaping", "floatingip"}}
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"main.json", `{"event-workers": 50, "debug": true, "reapply-interval": "5m", "disable": ["shaping", "floatingip"]}`},
+		{"main.yaml", "event-workers: 50\ndebug: true\nreapply-interval: 5m\ndisable:\n  - shaping\n  - floatingip\n"},
+		{"main.YML", "{event-workers: 50, debug: true, reapply-interval: 5m, disable: [shaping, floatingip]}"},
+		{"main.toml", "event-workers = 50\ndebug = true\nreapply-interval = \"5m\"\ndisable = [\"shaping\", \"floatingip\"]\n"},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, map[string]string{test.name: test.content})
+		got, err := Load(filepath.Join(dir, test.name))
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    string
+		next       string
+		overridden []string
+		want       Changes
+		applied    map[string]string
+	}{
+		{
+			name:    "unchanged",
+			current: `{"debug": true}`,
+			next:    `{"debug": true}`,
+			want:    Changes{},
+		},
+		{
+			name:    "live change",
+			current: `{"debug": false}`,
+			next:    `{"debug": true}`,
+			want:    Changes{Applied: []string{"debug"}},
+			applied: map[string]string{"debug": "true"},
+		},
+		{
+			name:    "removed returns to the default",
+			current: `{"reapply-interval": "10m"}`,
+			next:    `{}`,
+			want:    Changes{Applied: []string{"reapply-interval"}},
+			applied: map[string]string{"reapply-interval": "5m0s"},
+		},
+		{
+			name:    "needs a restart",
+			current: `{}`,
+			next:    `{"event-workers": 10}`,
+			want:    Changes{NeedRestart: []string{"event-workers"}},
+		},
+		{
+			name:       "overridden by a flag",
+			current:    `{}`,
+			next:       `{"debug": true}`,
+			overridden: []string{"debug"},
+			want:       Changes{Overridden: []string{"debug"}},
+		},
+		{
+			name:    "unknown setting",
+			current: `{}`,
+			next:    `{"bogus": 1}`,
+			want:    Changes{Failed: map[string]string{"bogus": "unknown setting"}},
+		},
+		{
+			name:    "failed to apply",
+			current: `{}`,
+			next:    `{"alert-threshold": "many"}`,
+			want:    Changes{Failed: map[string]string{"alert-threshold": "invalid"}},
+		},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, map[string]string{"main.json": test.current})
+		path := filepath.Join(dir, "main.json")
+		current, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Reloader{
+			path:    path,
+			live:    map[string]func(string) error{},
+			current: current,
+			defaults: map[string]string{
+				"debug":            "false",
+				"reapply-interval": "5m0s",
+				"event-workers":    "50",
+				"alert-threshold":  "3",
+			},
+			overridden: map[string]bool{},
+		}
+		for _, name := range test.overridden {
+			r.overridden[name] = true
+		}
+		applied := map[string]string{}
+		for _, name := range []string{"debug", "reapply-interval", "alert-threshold"} {
+			name := name
+			r.Live(name, func(value string) error {
+				if value == "many" {
+					return errors.New("invalid")
+				}
+				applied[name] = value
+				return nil
+			})
+		}
+
+		if err := ioutil.WriteFile(path, []byte(test.next), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changes, err := r.Reload()
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(changes, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, changes, test.want)
+		}
+		if test.applied == nil {
+			test.applied = map[string]string{}
+		}
+		if !reflect.DeepEqual(applied, test.applied) {
+			t.Errorf("%s: applied %v, want %v", test.name, applied, test.applied)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"sync"
+	"time"
+)
+
+// Duration is a setting a reload can change while subsystems read it
+type Duration struct {
+	lock  sync.Mutex
+	value time.Duration
+}
+
+// NewDuration starts out as value
+func NewDuration(value time.Duration) *Duration {
+	return &Duration{value: value}
+}
+
+// Get returns the current value
+func (d *Duration) Get() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.value
+}
+
+// Set changes the value for the next Get
+func (d *Duration) Set(value time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.value = value
+}
@@ -0,0 +1,116 @@
+// Package crash persists the stack traces and recent log lines of a
+// process that panics or fails fatally, so post-mortems don't depend on
+// journald still holding the output
+package crash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/plugin-manager/atomicfile"
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("crash")
+
+// maxReports is how many crash files are kept, older ones are removed
+const maxReports = 10
+
+var (
+	lock sync.Mutex
+	dir  string
+	// panicking is set once a panic is reported, outer Recovers on the same
+	// stack then leave it alone
+	panicking bool
+)
+
+// Configure writes crash reports to dir and reports fatal log entries
+func Configure(reportDir string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if dir == "" && reportDir != "" {
+		logrus.AddHook(fatalHook{})
+	}
+	dir = reportDir
+}
+
+// Recover writes a report for a panic and lets it carry on unwinding. It
+// must be deferred directly at the top of a goroutine.
+func Recover() {
+	if r := recover(); r != nil {
+		lock.Lock()
+		first := !panicking
+		panicking = true
+		lock.Unlock()
+		if first {
+			if p, err := Write(fmt.Sprintf("panic: %v", r), debug.Stack()); err == nil {
+				fmt.Fprintf(os.Stderr, "Wrote crash report to %s\n", p)
+			}
+		}
+		panic(r)
+	}
+}
+
+// fatalHook reports entries logged at fatal level, logrus exits straight
+// after firing hooks
+type fatalHook struct{}
+
+func (fatalHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel}
+}
+
+func (fatalHook) Fire(entry *logrus.Entry) error {
+	Write("fatal: "+entry.Message, debug.Stack())
+	return nil
+}
+
+// Write saves a report with reason, the stack of the failing goroutine,
+// every other goroutine and the recent log lines, and returns its path
+func Write(reason string, stack []byte) (string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if dir == "" {
+		return "", fmt.Errorf("no crash report directory configured")
+	}
+
+	buf := &bytes.Buffer{}
+	now := time.Now().UTC()
+	fmt.Fprintf(buf, "%s\n\ntime: %s\npid: %d\nargs: %q\n", reason, now.Format(time.RFC3339Nano), os.Getpid(), os.Args)
+	fmt.Fprintf(buf, "\n== failing goroutine ==\n%s", stack)
+	buf.WriteString("\n== all goroutines ==\n")
+	pprof.Lookup("goroutine").WriteTo(buf, 2)
+	buf.WriteString("\n== recent log lines ==\n")
+	for _, line := range logging.Recent() {
+		buf.WriteString(line)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, fmt.Sprintf("plugin-manager-crash-%s.log", now.Format("20060102T150405.000")))
+	if err := atomicfile.WriteFile(p, buf.Bytes(), 0600); err != nil {
+		log.WithError(err).Errorf("Failed to write crash report %s", p)
+		return "", err
+	}
+	prune()
+	return p, nil
+}
+
+func prune() {
+	reports, err := filepath.Glob(filepath.Join(dir, "plugin-manager-crash-*.log"))
+	if err != nil || len(reports) <= maxReports {
+		return
+	}
+	sort.Strings(reports)
+	for _, p := range reports[:len(reports)-maxReports] {
+		os.Remove(p)
+	}
+}
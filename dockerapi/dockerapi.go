@@ -0,0 +1,231 @@
+// Package dockerapi measures the requests plugin-manager makes to the
+// Docker daemon, so a slow daemon shows up as such rather than as slow
+// plugin-manager subsystems
+package dockerapi
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var (
+	requestSeconds = metrics.NewHistogram("plugin_manager_docker_request_seconds",
+		"Time from sending a Docker API request to the first byte of its response, by client and endpoint", "client", "endpoint")
+	requests = metrics.NewCounter("plugin_manager_docker_requests_total",
+		"Docker API requests by client, endpoint and result, the status class or error when no response came", "client", "endpoint", "result")
+)
+
+// Dialer opens connections to the daemon, as used by go-dockerclient
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+type dialFunc func(network, address string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
+
+// WrapDialer measures the requests sent over connections from d, name is
+// the client label
+func WrapDialer(name string, d Dialer) Dialer {
+	return dialFunc(func(network, address string) (net.Conn, error) {
+		c, err := d.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &conn{Conn: c, client: name}, nil
+	})
+}
+
+// remoteTLS is the TLS config SetTLS gave, nil to use DOCKER_CERT_PATH's
+var remoteTLS *tls.Config
+
+// SetTLS has the clients created afterwards talk to a TCP daemon over TLS
+// with config rather than the certificates in DOCKER_CERT_PATH
+func SetTLS(config *tls.Config) {
+	remoteTLS = config
+}
+
+// RemoteTLS returns the config SetTLS gave, nil if there is none
+func RemoteTLS() *tls.Config {
+	return remoteTLS
+}
+
+// DialTLS dials TLS connections with config for an http.Transport, their
+// requests measured inside the TLS connection where they can be read
+func DialTLS(name string, config *tls.Config) func(network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return WrapDialer(name, dialFunc(func(network, address string) (net.Conn, error) {
+		return tls.DialWithDialer(dialer, network, address, config)
+	})).Dial
+}
+
+// NewEnvClient is client.NewEnvClient with its requests measured, using
+// SetTLS's config for TCP daemons when it's given
+func NewEnvClient() (*client.Client, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = client.DefaultDockerHost
+	}
+	version := os.Getenv("DOCKER_API_VERSION")
+	if version == "" {
+		version = client.DefaultVersion
+	}
+
+	proto, addr, _, err := client.ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+	tr := &http.Transport{}
+	if err := sockets.ConfigureTransport(tr, proto, addr); err != nil {
+		return nil, err
+	}
+	if remoteTLS != nil && proto == "tcp" {
+		tr.TLSClientConfig = remoteTLS
+	} else if dockerCertPath := os.Getenv("DOCKER_CERT_PATH"); dockerCertPath != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(dockerCertPath, "ca.pem"),
+			CertFile:           filepath.Join(dockerCertPath, "cert.pem"),
+			KeyFile:            filepath.Join(dockerCertPath, "key.pem"),
+			InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == "",
+		})
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsc
+	}
+	tr.Dial = WrapDialer("engine-api", dialFunc(tr.Dial)).Dial
+	if config := tr.TLSClientConfig; config != nil {
+		tr.DialTLS = DialTLS("engine-api", config)
+	}
+
+	return client.NewClient(host, version, &http.Client{Transport: tr}, nil)
+}
+
+// conn times each request written to it until the response starts. HTTP/1
+// clients wait for a response before reusing a connection, so only one
+// request is outstanding at a time.
+type conn struct {
+	net.Conn
+	client string
+
+	lock     sync.Mutex
+	endpoint string
+	sent     time.Time
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	if c.endpoint == "" {
+		if endpoint, ok := parseRequestLine(p); ok {
+			c.endpoint = endpoint
+			c.sent = time.Now()
+		}
+	}
+	c.lock.Unlock()
+
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.done("error")
+	}
+	return n, err
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.done(statusClass(p[:n]))
+	} else if err != nil {
+		c.done("error")
+	}
+	return n, err
+}
+
+func (c *conn) done(result string) {
+	c.lock.Lock()
+	endpoint, sent := c.endpoint, c.sent
+	c.endpoint = ""
+	c.lock.Unlock()
+	if endpoint == "" {
+		return
+	}
+	requestSeconds.Observe(metrics.Since(sent), c.client, endpoint)
+	requests.Inc(c.client, endpoint, result)
+}
+
+func parseRequestLine(p []byte) (string, bool) {
+	line := p
+	if i := bytes.IndexByte(p, '\r'); i >= 0 {
+		line = p[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", false
+	}
+	return endpoint(fields[0], fields[1]), true
+}
+
+func statusClass(p []byte) string {
+	// The response starts "HTTP/1.1 200 OK"
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		p = p[:i]
+	}
+	fields := bytes.Fields(p)
+	if len(fields) < 2 || len(fields[1]) != 3 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return "error"
+	}
+	return string(fields[1][0]) + "xx"
+}
+
+// endpoint names a request after the API call it makes, with IDs and query
+// strings left out so the label stays bounded
+func endpoint(method, uri string) string {
+	path := strings.SplitN(uri, "?", 2)[0]
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 0 && strings.HasPrefix(segments[0], "v") && strings.Contains(segments[0], ".") {
+		segments = segments[1:]
+	}
+	if len(segments) == 0 || segments[0] == "" {
+		return method + " /"
+	}
+
+	resource := segments[0]
+	switch {
+	case len(segments) == 1:
+		return method + " /" + resource
+	case segments[1] == "json" || segments[1] == "create":
+		if resource == "containers" && segments[1] == "json" && method == "GET" {
+			return "list"
+		}
+		return method + " /" + resource + "/" + segments[1]
+	}
+
+	if resource == "containers" {
+		switch {
+		case len(segments) == 2 && method == "DELETE":
+			return "remove"
+		case len(segments) == 3 && segments[2] == "json" && method == "GET":
+			return "inspect"
+		case len(segments) == 3:
+			return segments[2]
+		}
+	}
+	if len(segments) == 2 {
+		return method + " /" + resource + "/{id}"
+	}
+	// Image names can hold slashes, only the final verb is kept
+	return method + " /" + resource + "/{id}/" + segments[len(segments)-1]
+}
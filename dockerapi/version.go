@@ -0,0 +1,124 @@
+package dockerapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types/versions"
+)
+
+// required is the oldest API each subsystem talking to Docker works with.
+// Newer features it uses are in features, and only used when negotiated.
+var required = map[string]string{
+	// Inspected through engine-api, whose container JSON is Docker 1.9's
+	"network":    "1.21",
+	"binexec":    "1.21",
+	"shaping":    "1.21",
+	"floatingip": "1.21",
+	// go-dockerclient's event stream, read by its status before actions
+	// and actors were added
+	"events": "1.18",
+	// Listing, inspecting, stopping and removing, events.filters and
+	// list.state when the daemon has them
+	"reaper": "1.18",
+}
+
+// features are the newer API behaviors used when the negotiated version
+// has them, by the version adding them
+var features = map[string]string{
+	// The daemon filtering the reaper's event stream by type and event
+	"events.filters": "1.22",
+	// Container lists reporting each container's state
+	"list.state": "1.23",
+}
+
+// TooOld returns those of subsystems that need a newer API than server,
+// each with the version it needs
+func TooOld(server string, subsystems []string) []string {
+	var old []string
+	for _, name := range subsystems {
+		if version, ok := required[name]; ok && versions.LessThan(server, version) {
+			old = append(old, fmt.Sprintf("%s needs %s", name, version))
+		}
+	}
+	return old
+}
+
+var (
+	lock       sync.Mutex
+	negotiated string
+)
+
+// Negotiated is the API version agreed with the daemon and the version the
+// daemon itself supports
+type Negotiated struct {
+	Version string
+	Server  string
+}
+
+// Negotiate asks the daemon, retrying until ctx is done, for the newest API
+// it supports and agrees the newest both it and the client support, or
+// DOCKER_API_VERSION when that's set. c is switched to the agreed version
+// and clients created afterwards use it.
+func Negotiate(ctx context.Context, c *client.Client) (Negotiated, error) {
+	wanted := os.Getenv("DOCKER_API_VERSION")
+	// The version endpoint answers without a version prefix on any daemon
+	c.UpdateClientVersion("")
+	var server string
+	for {
+		v, err := c.ServerVersion(ctx)
+		if err == nil {
+			server = v.APIVersion
+			break
+		}
+		select {
+		case <-ctx.Done():
+			c.UpdateClientVersion(versionOr(wanted))
+			return Negotiated{}, fmt.Errorf("asking Docker for its API version: %v", err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	version := choose(wanted, server)
+	c.UpdateClientVersion(version)
+	os.Setenv("DOCKER_API_VERSION", version)
+	lock.Lock()
+	negotiated = version
+	lock.Unlock()
+	return Negotiated{Version: version, Server: server}, nil
+}
+
+// choose is wanted when it's set, otherwise the newest version both the
+// client and server support
+func choose(wanted, server string) string {
+	if wanted != "" {
+		return wanted
+	}
+	if versions.LessThan(server, client.DefaultVersion) {
+		return server
+	}
+	return client.DefaultVersion
+}
+
+func versionOr(version string) string {
+	if version == "" {
+		return client.DefaultVersion
+	}
+	return version
+}
+
+// Supports reports whether the negotiated API version has the feature,
+// before negotiating it's judged by the version the clients default to
+func Supports(feature string) bool {
+	lock.Lock()
+	version := negotiated
+	lock.Unlock()
+	if version == "" {
+		version = versionOr(os.Getenv("DOCKER_API_VERSION"))
+	}
+	return versions.GreaterThanOrEqualTo(version, features[feature])
+}
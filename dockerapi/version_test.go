@@ -0,0 +1,100 @@
+package dockerapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/client"
+)
+
+func TestChoose(t *testing.T) {
+	tests := []struct {
+		name   string
+		wanted string
+		server string
+		want   string
+	}{
+		{"older daemon", "", "1.21", "1.21"},
+		{"same as the client", "", client.DefaultVersion, client.DefaultVersion},
+		{"newer daemon", "", "1.41", client.DefaultVersion},
+		{"DOCKER_API_VERSION", "1.22", "1.41", "1.22"},
+		{"DOCKER_API_VERSION newer than the daemon", "1.24", "1.21", "1.24"},
+	}
+	for _, test := range tests {
+		if got := choose(test.wanted, test.server); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTooOld(t *testing.T) {
+	tests := []struct {
+		server     string
+		subsystems []string
+		want       []string
+	}{
+		{"1.23", []string{"reaper", "network", "events"}, nil},
+		{"1.20", []string{"reaper", "network", "events"}, []string{"network needs 1.21"}},
+		{"1.17", []string{"reaper", "shaping"}, []string{"reaper needs 1.18", "shaping needs 1.21"}},
+		{"1.17", []string{"hostports"}, nil},
+	}
+	for _, test := range tests {
+		if got := TooOld(test.server, test.subsystems); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("TooOld(%s, %v) = %v, want %v", test.server, test.subsystems, got, test.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	defer os.Setenv("DOCKER_API_VERSION", os.Getenv("DOCKER_API_VERSION"))
+	tests := []struct {
+		server   string
+		wanted   string
+		want     string
+		features map[string]bool
+	}{
+		{"1.21", "", "1.21", map[string]bool{"events.filters": false, "list.state": false}},
+		{"1.22", "", "1.22", map[string]bool{"events.filters": true, "list.state": false}},
+		{"1.30", "", client.DefaultVersion, map[string]bool{"events.filters": true, "list.state": true}},
+		{"1.30", "1.22", "1.22", map[string]bool{"events.filters": true, "list.state": false}},
+	}
+	for _, test := range tests {
+		var paths []string
+		daemon := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			paths = append(paths, req.URL.Path)
+			fmt.Fprintf(rw, `{"ApiVersion": %q}`, test.server)
+		}))
+		c, err := client.NewClient("tcp://"+strings.TrimPrefix(daemon.URL, "http://"), "1.18", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("DOCKER_API_VERSION", test.wanted)
+		v, err := Negotiate(context.Background(), c)
+		daemon.Close()
+		if err != nil {
+			t.Errorf("server %s: %v", test.server, err)
+			continue
+		}
+		if v.Version != test.want || v.Server != test.server {
+			t.Errorf("server %s, wanted %q: got %+v, want version %s", test.server, test.wanted, v, test.want)
+		}
+		if len(paths) != 1 || paths[0] != "/version" {
+			t.Errorf("server %s: asked %v, want an unversioned /version", test.server, paths)
+		}
+		if c.ClientVersion() != test.want || os.Getenv("DOCKER_API_VERSION") != test.want {
+			t.Errorf("server %s: client uses %s and DOCKER_API_VERSION is %s, want %s",
+				test.server, c.ClientVersion(), os.Getenv("DOCKER_API_VERSION"), test.want)
+		}
+		for feature, want := range test.features {
+			if got := Supports(feature); got != want {
+				t.Errorf("server %s: Supports(%s) = %v, want %v", test.server, feature, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/dockerapi"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/exitcode"
+	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/kmod"
+	"github.com/urfave/cli"
+)
+
+func doctorCommand() cli.Command {
+	return cli.Command{
+		Name:   "doctor",
+		Usage:  "Check the kernel modules, sysctls, tools and Docker API the enabled subsystems need, printing how to fix each problem",
+		Action: doctor,
+	}
+}
+
+func doctor(c *cli.Context) error {
+	g := c.Parent()
+	if p, dir := g.String("config"), g.String("config-dir"); p != "" || dir != "" {
+		if _, err := config.Apply(g, p, dir); err != nil {
+			return cli.NewExitError(err.Error(), exitcode.Config)
+		}
+	}
+	disabled, err := disabledSubsystems(g)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Config)
+	}
+
+	if err := runtimeEnv(g); err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Config)
+	}
+	if dockerAPI(g.String("runtime")) && !remoteDocker(g) {
+		if dClient, err := dockerapi.NewEnvClient(); err == nil {
+			if err := adaptRootless(g, dClient, disabled); err != nil {
+				return cli.NewExitError(err.Error(), exitcode.Prerequisite)
+			}
+		}
+		// rootlesskit publishes the ports, needing none of the host's tools
+		if hostports.PortDriver != nil {
+			disabled["hostports"] = true
+		}
+	}
+
+	d := &doctorChecks{disabled: disabled}
+	modules, neededBy := moduleUsers(nil, nil)
+	for _, name := range modules {
+		var err error
+		if !kmod.Loaded(name) {
+			err = fmt.Errorf("not loaded")
+		}
+		d.check("kernel module "+name, neededBy[name], true, err, "modprobe "+name)
+	}
+
+	for _, s := range []struct {
+		key      string
+		neededBy []string
+	}{
+		{"net.ipv4.ip_forward", []string{"network", "hostroutes"}},
+		{"net.bridge.bridge-nf-call-iptables", []string{"hostports"}},
+	} {
+		fix := "sysctl -w " + s.key + "=1"
+		if strings.HasPrefix(s.key, "net.bridge.") {
+			fix = "modprobe br_netfilter && " + fix
+		}
+		d.check("sysctl "+s.key, s.neededBy, true, sysctlIs(s.key, "1"), fix)
+	}
+
+	iptablesUsers := []string{"hostports", "hostnat"}
+	for _, tool := range []string{"iptables", "iptables-save", "iptables-restore"} {
+		d.check(tool, iptablesUsers, true, onPath(tool), "install iptables")
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		d.check("iptables nat table", iptablesUsers, true, runs("iptables", "-w", "-t", "nat", "-S", "POSTROUTING"),
+			"run as root, and load iptable_nat if the table is missing")
+	}
+	for _, t := range []struct {
+		tool     string
+		neededBy []string
+		required bool
+		fix      string
+	}{
+		{"sysctl", []string{"hostnat"}, true, "install procps"},
+		{"tc", []string{"shaping"}, true, "install iproute2"},
+		{"ip", []string{"hostroutes"}, true, "install iproute2"},
+		{"nsenter", []string{"floatingip"}, true, "install util-linux"},
+		{"arping", []string{"floatingip"}, true, "install iputils-arping"},
+		{"conntrack", []string{"network"}, false, "install conntrack, without it flows of released IPs aren't flushed"},
+	} {
+		d.check(t.tool, t.neededBy, t.required, onPath(t.tool), t.fix)
+	}
+
+	users := append([]string(nil), dockerSubsystems...)
+	if g.String("runtime") == "containerd" {
+		rt := engine.NewContainerd(g.String("containerd-address"), g.String("containerd-namespace"))
+		d.check("containerd", append([]string{"reaper"}, runtimeSubsystems...), true, runtimeReachable(rt),
+			"start containerd, or point --containerd-address at it")
+	} else if g.String("runtime") == "cri" {
+		rt := engine.NewCRI(g.String("cri-endpoint"))
+		d.check("CRI runtime", append([]string{"reaper"}, runtimeSubsystems...), true, runtimeReachable(rt),
+			"start the CRI runtime, or point --cri-endpoint at it")
+	} else {
+		users = dockerUsers(nil)
+	}
+	fix := "start Docker, or point DOCKER_HOST at it"
+	if remoteDocker(g) {
+		fix = "check --docker-host is listening for TLS and accepts --docker-tls-cert"
+	} else if g.String("runtime") == "podman" {
+		fix = "systemctl enable --now podman.socket, or point DOCKER_HOST at Podman's socket"
+	}
+	d.check("Docker API", users, true, dockerReachable(), fix)
+
+	if d.failed == 1 {
+		return cli.NewExitError("1 problem found", exitcode.Prerequisite)
+	} else if d.failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problems found", d.failed), exitcode.Prerequisite)
+	}
+	fmt.Println("Host is ready")
+	return nil
+}
+
+// doctorChecks prints each check's result and counts the failures, leaving
+// out checks that only disabled subsystems need
+type doctorChecks struct {
+	disabled map[string]bool
+	failed   int
+}
+
+func (d *doctorChecks) check(name string, neededBy []string, required bool, err error, fix string) {
+	var enabled []string
+	for _, subsystem := range neededBy {
+		if !d.disabled[subsystem] {
+			enabled = append(enabled, subsystem)
+		}
+	}
+	if len(enabled) == 0 {
+		return
+	}
+	if err == nil {
+		fmt.Printf("ok    %s\n", name)
+		return
+	}
+	status := "warn"
+	if required {
+		status = "FAIL"
+		d.failed++
+	}
+	fmt.Printf("%s  %s: %v, needed by %s\n      fix: %s\n", status, name, err, strings.Join(enabled, ", "), fix)
+}
+
+func sysctlIs(key, want string) error {
+	content, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1)))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("not available")
+	} else if err != nil {
+		return err
+	}
+	if got := strings.TrimSpace(string(content)); got != want {
+		return fmt.Errorf("is %s, want %s", got, want)
+	}
+	return nil
+}
+
+func onPath(tool string) error {
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("not found in PATH")
+	}
+	return nil
+}
+
+func runs(args ...string) error {
+	if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runtimeReachable lists the runtime's containers
+func runtimeReachable(rt engine.Runtime) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := rt.List(ctx); err != nil {
+		return fmt.Errorf("not reachable: %v", err)
+	}
+	return nil
+}
+
+func dockerReachable() error {
+	dClient, err := dockerapi.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Unversioned so an older daemon still answers
+	dClient.UpdateClientVersion("")
+	v, err := dClient.ServerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("not reachable: %v", err)
+	}
+	if old := dockerapi.TooOld(v.APIVersion, dockerUsers(nil)); len(old) > 0 {
+		return fmt.Errorf("API %s is too old, %s", v.APIVersion, strings.Join(old, ", "))
+	}
+	return nil
+}
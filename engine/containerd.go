@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// containerd talks to containerd's gRPC API. Containers are its container
+// records, running while their task is.
+type containerd struct {
+	conn      *grpcConn
+	namespace string
+}
+
+const (
+	containersService = "/containerd.services.containers.v1.Containers/"
+	tasksService      = "/containerd.services.tasks.v1.Tasks/"
+	eventsService     = "/containerd.services.events.v1.Events/"
+
+	// taskRunning is containerd.v1.types.Status RUNNING
+	taskRunning = 2
+	// defaultContainerd is where containerd listens by default
+	defaultContainerd = "unix:///run/containerd/containerd.sock"
+)
+
+// stopPoll is how often a stopping task is checked until its timeout
+var stopPoll = 500 * time.Millisecond
+
+// NewContainerd talks to the containerd listening on address, empty for
+// its default socket, managing the containers in namespace
+func NewContainerd(address, namespace string) Runtime {
+	if address == "" {
+		address = defaultContainerd
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &containerd{
+		conn:      newGRPC(address, http.Header{"Containerd-Namespace": {namespace}}),
+		namespace: namespace,
+	}
+}
+
+func (c *containerd) Name() string {
+	return "containerd"
+}
+
+// task is the state of a container's task
+type task struct {
+	pid    int
+	status int
+}
+
+// readContainer decodes a containerd.services.containers.v1.Container
+func readContainer(b []byte) (Container, error) {
+	fs, err := fields(b)
+	if err != nil {
+		return Container{}, err
+	}
+	var container Container
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			container.ID = string(f.bytes)
+		case 2:
+			if container.Labels, err = stringMap(container.Labels, f.bytes); err != nil {
+				return Container{}, err
+			}
+		case 3:
+			container.Image = string(f.bytes)
+		}
+	}
+	container.Name = container.Labels["io.kubernetes.container.name"]
+	if container.Name == "" {
+		container.Name = container.ID
+	}
+	return container, nil
+}
+
+// readProcess decodes a containerd.v1.types.Process, returning its
+// container's ID
+func readProcess(b []byte) (string, task, error) {
+	fs, err := fields(b)
+	if err != nil {
+		return "", task{}, err
+	}
+	var id string
+	var t task
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			id = string(f.bytes)
+		case 3:
+			t.pid = int(f.value)
+		case 4:
+			t.status = int(f.value)
+		}
+	}
+	return id, t, nil
+}
+
+// tasks returns the task of each container that has one
+func (c *containerd) tasks(ctx context.Context) (map[string]task, error) {
+	reply, err := c.conn.call(ctx, tasksService+"List", nil)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return nil, err
+	}
+	tasks := map[string]task{}
+	for _, f := range fs {
+		if f.num != 1 {
+			continue
+		}
+		id, t, err := readProcess(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		tasks[id] = t
+	}
+	return tasks, nil
+}
+
+// task returns the container's task, ErrNotFound when it has none
+func (c *containerd) task(ctx context.Context, id string) (task, error) {
+	reply, err := c.conn.call(ctx, tasksService+"Get", message(nil).stringField(1, id))
+	if err != nil {
+		return task{}, notFound(err)
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return task{}, err
+	}
+	for _, f := range fs {
+		if f.num == 1 {
+			_, t, err := readProcess(f.bytes)
+			return t, err
+		}
+	}
+	return task{}, ErrNotFound
+}
+
+func (c *containerd) List(ctx context.Context) ([]Container, error) {
+	reply, err := c.conn.call(ctx, containersService+"List", nil)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []Container
+	for _, f := range fs {
+		if f.num != 1 {
+			continue
+		}
+		container, err := readContainer(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		t := tasks[container.ID]
+		container.Running = t.status == taskRunning
+		container.Pid = t.pid
+		result = append(result, container)
+	}
+	return result, nil
+}
+
+func (c *containerd) Inspect(ctx context.Context, id string) (Container, error) {
+	reply, err := c.conn.call(ctx, containersService+"Get", message(nil).stringField(1, id))
+	if err != nil {
+		return Container{}, notFound(err)
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return Container{}, err
+	}
+	var container Container
+	for _, f := range fs {
+		if f.num == 1 {
+			if container, err = readContainer(f.bytes); err != nil {
+				return Container{}, err
+			}
+		}
+	}
+	if container.ID == "" {
+		return Container{}, ErrNotFound
+	}
+	t, err := c.task(ctx, id)
+	if err != nil && err != ErrNotFound {
+		return Container{}, err
+	}
+	container.Running = t.status == taskRunning
+	container.Pid = t.pid
+	// Tasks have no start time, a restarted task gets a new pid
+	if t.pid != 0 {
+		container.Started = strconv.Itoa(t.pid)
+	}
+	return container, nil
+}
+
+func (c *containerd) kill(ctx context.Context, id string, signal syscall.Signal) error {
+	_, err := c.conn.call(ctx, tasksService+"Kill", message(nil).
+		stringField(1, id).
+		varintField(3, uint64(signal)).
+		boolField(4, true))
+	return notFound(err)
+}
+
+// wait checks the task every stopPoll until it isn't running or timeout
+// passes, reporting whether it stopped
+func (c *containerd) wait(ctx context.Context, id string, timeout time.Duration) (bool, error) {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(stopPoll) {
+		t, err := c.task(ctx, id)
+		if err == ErrNotFound {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if t.status != taskRunning {
+			return true, nil
+		}
+		if !time.Now().Before(deadline) {
+			return false, nil
+		}
+	}
+}
+
+func (c *containerd) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := c.kill(ctx, id, syscall.SIGTERM); err != nil {
+			return err
+		}
+		if stopped, err := c.wait(ctx, id, timeout); err != nil || stopped {
+			return err
+		}
+	}
+	return c.kill(ctx, id, syscall.SIGKILL)
+}
+
+func (c *containerd) Remove(ctx context.Context, id string) error {
+	// A container with a task, even a stopped one, can't be deleted
+	t, err := c.task(ctx, id)
+	if err == nil {
+		if t.status == taskRunning {
+			if err := c.kill(ctx, id, syscall.SIGKILL); err != nil && err != ErrNotFound {
+				return err
+			}
+			if stopped, err := c.wait(ctx, id, 10*time.Second); err != nil {
+				return err
+			} else if !stopped {
+				return errors.New("task didn't stop after SIGKILL")
+			}
+		}
+		if _, err := c.conn.call(ctx, tasksService+"Delete", message(nil).stringField(1, id)); notFound(err) != ErrNotFound && err != nil {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+	_, err = c.conn.call(ctx, containersService+"Delete", message(nil).stringField(1, id))
+	return notFound(err)
+}
+
+// Events subscribes to the namespace's task starts and exits
+func (c *containerd) Events(ctx context.Context) (<-chan Event, error) {
+	filter := "namespace==" + c.namespace + ",topic==\"/tasks/"
+	stream, err := c.conn.stream(ctx, eventsService+"Subscribe", message(nil).
+		stringField(1, filter+"start\"").
+		stringField(1, filter+"exit\""))
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer stream.Close()
+		for {
+			envelope, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.WithError(err).Error("containerd event stream broke")
+				}
+				return
+			}
+			event, ok := c.readEvent(envelope)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// readEvent decodes a containerd.services.events.v1.Envelope. Only the
+// container's own task starting and exiting is reported, not exec'd
+// processes.
+func (c *containerd) readEvent(envelope []byte) (Event, bool) {
+	fs, err := fields(envelope)
+	if err != nil {
+		return Event{}, false
+	}
+	var namespace, topic string
+	var value []byte
+	for _, f := range fs {
+		switch f.num {
+		case 2:
+			namespace = string(f.bytes)
+		case 3:
+			topic = string(f.bytes)
+		case 4:
+			// A google.protobuf.Any, the event is its value
+			any, err := fields(f.bytes)
+			if err != nil {
+				return Event{}, false
+			}
+			for _, a := range any {
+				if a.num == 2 {
+					value = a.bytes
+				}
+			}
+		}
+	}
+	if namespace != c.namespace {
+		return Event{}, false
+	}
+
+	var status string
+	switch topic {
+	case "/tasks/start":
+		status = "start"
+	case "/tasks/exit":
+		status = "die"
+	default:
+		return Event{}, false
+	}
+	fs, err = fields(value)
+	if err != nil {
+		return Event{}, false
+	}
+	// TaskStart and TaskExit both start with the container_id, TaskExit's
+	// id is the exec'd process or the container's own
+	var containerID, processID string
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			containerID = string(f.bytes)
+		case 2:
+			if topic == "/tasks/exit" {
+				processID = string(f.bytes)
+			}
+		}
+	}
+	if containerID == "" || processID != "" && processID != containerID {
+		return Event{}, false
+	}
+	return Event{ID: containerID, Status: status}, true
+}
@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeContainerd serves containers and their tasks, a killed task stops
+type fakeContainerd struct {
+	lock   sync.Mutex
+	labels map[string]map[string]string
+	tasks  map[string]task
+	events []message
+}
+
+func (f *fakeContainerd) methods(t *testing.T) map[string]method {
+	process := func(id string, tk task) message {
+		return message(nil).stringField(1, id).varintField(3, uint64(tk.pid)).varintField(4, uint64(tk.status))
+	}
+	container := func(id string) message {
+		m := message(nil).stringField(1, id)
+		for k, v := range f.labels[id] {
+			m = m.bytesField(2, mapEntry(k, v))
+		}
+		return m.stringField(3, "docker.io/library/"+id)
+	}
+	id := func(request []byte) string {
+		fs, _ := fields(request)
+		for _, field := range fs {
+			if field.num == 1 {
+				return string(field.bytes)
+			}
+		}
+		return ""
+	}
+	namespaced := func(m method) method {
+		return func(header http.Header, request []byte) ([]message, int) {
+			if ns := header.Get("Containerd-Namespace"); ns != "rancher" {
+				t.Errorf("call in namespace %q", ns)
+			}
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			return m(header, request)
+		}
+	}
+	return map[string]method{
+		containersService + "List": namespaced(func(http.Header, []byte) ([]message, int) {
+			reply := message(nil)
+			for _, id := range []string{"db", "web"} {
+				if _, ok := f.labels[id]; ok {
+					reply = reply.bytesField(1, container(id))
+				}
+			}
+			return []message{reply}, 0
+		}),
+		containersService + "Get": namespaced(func(_ http.Header, request []byte) ([]message, int) {
+			if _, ok := f.labels[id(request)]; !ok {
+				return nil, grpcNotFound
+			}
+			return []message{message(nil).bytesField(1, container(id(request)))}, 0
+		}),
+		containersService + "Delete": namespaced(func(_ http.Header, request []byte) ([]message, int) {
+			delete(f.labels, id(request))
+			return []message{nil}, 0
+		}),
+		tasksService + "List": namespaced(func(http.Header, []byte) ([]message, int) {
+			reply := message(nil)
+			for id, tk := range f.tasks {
+				reply = reply.bytesField(1, process(id, tk))
+			}
+			return []message{reply}, 0
+		}),
+		tasksService + "Get": namespaced(func(_ http.Header, request []byte) ([]message, int) {
+			tk, ok := f.tasks[id(request)]
+			if !ok {
+				return nil, grpcNotFound
+			}
+			return []message{message(nil).bytesField(1, process(id(request), tk))}, 0
+		}),
+		tasksService + "Kill": namespaced(func(_ http.Header, request []byte) ([]message, int) {
+			tk, ok := f.tasks[id(request)]
+			if !ok {
+				return nil, grpcNotFound
+			}
+			tk.status = 3
+			f.tasks[id(request)] = tk
+			return []message{nil}, 0
+		}),
+		tasksService + "Delete": namespaced(func(_ http.Header, request []byte) ([]message, int) {
+			delete(f.tasks, id(request))
+			return []message{nil}, 0
+		}),
+		eventsService + "Subscribe": func(_ http.Header, request []byte) ([]message, int) {
+			return f.events, 0
+		},
+	}
+}
+
+func TestContainerd(t *testing.T) {
+	f := &fakeContainerd{
+		labels: map[string]map[string]string{
+			"web": {"io.kubernetes.container.name": "nginx"},
+			"db":  {"tier": "data"},
+		},
+		tasks: map[string]task{"web": {pid: 42, status: taskRunning}, "db": {pid: 43, status: 3}},
+	}
+	server := newGRPCServer(t, f.methods(t))
+	defer server.Close()
+	rt := NewContainerd(server.address, "rancher")
+	ctx := context.Background()
+
+	containers, err := rt.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Container{
+		{ID: "db", Name: "db", Image: "docker.io/library/db", Labels: map[string]string{"tier": "data"}, Pid: 43},
+		{ID: "web", Name: "nginx", Image: "docker.io/library/web", Labels: map[string]string{"io.kubernetes.container.name": "nginx"}, Running: true, Pid: 42},
+	}
+	if !reflect.DeepEqual(containers, want) {
+		t.Errorf("listed %+v, want %+v", containers, want)
+	}
+	web := want[1]
+	web.Started = "42"
+	if c, err := rt.Inspect(ctx, "web"); err != nil || !reflect.DeepEqual(c, web) {
+		t.Errorf("inspected %+v, %v, want %+v", c, err, web)
+	}
+	if _, err := rt.Inspect(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("inspecting a missing container got %v", err)
+	}
+
+	// The task stops at SIGTERM, no SIGKILL follows
+	if err := rt.Stop(ctx, "web", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Remove(ctx, "web"); err != nil {
+		t.Fatal(err)
+	}
+	calls := strings.Join(server.Calls()[5:], " ")
+	if want := "Kill Get Get Delete Delete"; calls != want {
+		t.Errorf("stopped and removed with %s, want %s", calls, want)
+	}
+	if _, err := rt.Inspect(ctx, "web"); err != ErrNotFound {
+		t.Errorf("removed container inspected with %v", err)
+	}
+}
+
+func TestContainerdEvents(t *testing.T) {
+	envelope := func(namespace, topic string, event message) message {
+		any := message(nil).stringField(1, "types.containerd.io/containerd.events."+topic).bytesField(2, event)
+		return message(nil).stringField(2, namespace).stringField(3, topic).bytesField(4, any)
+	}
+	f := &fakeContainerd{events: []message{
+		envelope("rancher", "/tasks/start", message(nil).stringField(1, "web").varintField(2, 4242)),
+		envelope("rancher", "/tasks/exit", message(nil).stringField(1, "web").stringField(2, "exec-1").varintField(3, 4300)),
+		envelope("k8s.io", "/tasks/start", message(nil).stringField(1, "pod")),
+		envelope("rancher", "/containers/create", message(nil).stringField(1, "db")),
+		envelope("rancher", "/tasks/exit", message(nil).stringField(1, "web").stringField(2, "web").varintField(3, 4242)),
+		message("\xff"),
+	}}
+	server := newGRPCServer(t, f.methods(t))
+	defer server.Close()
+
+	events, err := NewContainerd(server.address, "rancher").Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	want := []Event{{ID: "web", Status: "start"}, {ID: "web", Status: "die"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+}
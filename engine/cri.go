@@ -0,0 +1,278 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cri talks to a Kubernetes CRI runtime, such as CRI-O or containerd's CRI
+// plugin, over the CRI gRPC API
+type cri struct {
+	conn *grpcConn
+
+	lock sync.Mutex
+	// service is runtime.v1's until the runtime turns out to only serve
+	// v1alpha2, whose messages are the same
+	service string
+}
+
+const (
+	criService      = "/runtime.v1.RuntimeService/"
+	criAlphaService = "/runtime.v1alpha2.RuntimeService/"
+
+	// criRunning is runtime.v1.ContainerState CONTAINER_RUNNING
+	criRunning = 1
+)
+
+// criEndpoints are where CRI runtimes listen by default, in the order
+// crictl tries them
+var criEndpoints = []string{
+	"unix:///run/containerd/containerd.sock",
+	"unix:///run/crio/crio.sock",
+	"unix:///var/run/cri-dockerd.sock",
+}
+
+// criPoll is how often containers are listed to find starts and deaths,
+// the CRI API has no event stream every runtime serves
+var criPoll = time.Second
+
+// NewCRI talks to the CRI runtime listening on endpoint, such as
+// unix:///var/run/crio/crio.sock, empty for the first default socket that
+// exists
+func NewCRI(endpoint string) Runtime {
+	if endpoint == "" {
+		endpoint = criEndpoints[0]
+		for _, e := range criEndpoints {
+			if _, path := dialAddress(e); exists(path) {
+				endpoint = e
+				break
+			}
+		}
+	}
+	return &cri{conn: newGRPC(endpoint, nil), service: criService}
+}
+
+// exists reports whether there is a file at path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (c *cri) Name() string {
+	return "cri"
+}
+
+// call calls a RuntimeService method, falling back to v1alpha2 for
+// runtimes older than Kubernetes 1.23
+func (c *cri) call(ctx context.Context, method string, request message) ([]byte, error) {
+	c.lock.Lock()
+	service := c.service
+	c.lock.Unlock()
+	reply, err := c.conn.call(ctx, service+method, request)
+	if e, ok := err.(*grpcError); ok && e.code == grpcUnimplemented && service == criService {
+		reply, err = c.conn.call(ctx, criAlphaService+method, request)
+		if err == nil {
+			log.Info("CRI runtime only serves runtime.v1alpha2, using it")
+			c.lock.Lock()
+			c.service = criAlphaService
+			c.lock.Unlock()
+		}
+	}
+	return reply, notFound(err)
+}
+
+// readCRIContainer decodes a runtime.v1.Container, or the fields of a
+// ContainerStatus, which are numbered differently, given status
+func readCRIContainer(b []byte, status bool) (Container, error) {
+	fs, err := fields(b)
+	if err != nil {
+		return Container{}, err
+	}
+	// Container and ContainerStatus field numbers
+	metadataField, imageField, stateField, labelsField := 3, 4, 6, 8
+	if status {
+		metadataField, imageField, stateField, labelsField = 2, 8, 3, 12
+	}
+	var container Container
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			container.ID = string(f.bytes)
+		case metadataField:
+			if container.Name, err = firstString(f.bytes); err != nil {
+				return Container{}, err
+			}
+		case imageField:
+			if container.Image, err = firstString(f.bytes); err != nil {
+				return Container{}, err
+			}
+		case stateField:
+			container.Running = f.value == criRunning
+		case labelsField:
+			if container.Labels, err = stringMap(container.Labels, f.bytes); err != nil {
+				return Container{}, err
+			}
+		case 5:
+			// ContainerStatus' started_at, a container start's nanoseconds
+			if status && f.value != 0 {
+				container.Started = strconv.FormatUint(f.value, 10)
+			}
+		}
+	}
+	return container, nil
+}
+
+// firstString decodes field 1 of a message, the name of ContainerMetadata
+// and the image of ImageSpec
+func firstString(b []byte) (string, error) {
+	fs, err := fields(b)
+	if err != nil {
+		return "", err
+	}
+	s := ""
+	for _, f := range fs {
+		if f.num == 1 {
+			s = string(f.bytes)
+		}
+	}
+	return s, nil
+}
+
+func (c *cri) List(ctx context.Context) ([]Container, error) {
+	reply, err := c.call(ctx, "ListContainers", nil)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return nil, err
+	}
+	var result []Container
+	for _, f := range fs {
+		if f.num != 1 {
+			continue
+		}
+		container, err := readCRIContainer(f.bytes, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, container)
+	}
+	return result, nil
+}
+
+// Inspect asks for the verbose status, whose info holds the pid as JSON
+func (c *cri) Inspect(ctx context.Context, id string) (Container, error) {
+	reply, err := c.call(ctx, "ContainerStatus", message(nil).stringField(1, id).boolField(2, true))
+	if err != nil {
+		return Container{}, err
+	}
+	fs, err := fields(reply)
+	if err != nil {
+		return Container{}, err
+	}
+	var container Container
+	var info map[string]string
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			if container, err = readCRIContainer(f.bytes, true); err != nil {
+				return Container{}, err
+			}
+		case 2:
+			if info, err = stringMap(info, f.bytes); err != nil {
+				return Container{}, err
+			}
+		}
+	}
+	if container.ID == "" {
+		return Container{}, ErrNotFound
+	}
+	var verbose struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(info["info"]), &verbose); err == nil && container.Running {
+		container.Pid = verbose.Pid
+	}
+	return container, nil
+}
+
+func (c *cri) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	_, err := c.call(ctx, "StopContainer", message(nil).
+		stringField(1, id).
+		varintField(2, uint64(timeout/time.Second)))
+	return err
+}
+
+func (c *cri) Remove(ctx context.Context, id string) error {
+	// Older runtimes can't remove a running container
+	if err := c.Stop(ctx, id, 0); err != nil && err != ErrNotFound {
+		return err
+	}
+	_, err := c.call(ctx, "RemoveContainer", message(nil).stringField(1, id))
+	return err
+}
+
+// Events lists the containers every criPoll and reports those that started
+// or stopped running since the last list. Containers already running when
+// it starts aren't reported.
+func (c *cri) Events(ctx context.Context) (<-chan Event, error) {
+	running, err := c.running(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-time.After(criPoll):
+			case <-ctx.Done():
+				return
+			}
+			now, err := c.running(ctx)
+			if err != nil {
+				log.WithError(err).Error("Failed to list CRI containers for events")
+				continue
+			}
+			var changes []Event
+			for id := range now {
+				if !running[id] {
+					changes = append(changes, Event{ID: id, Status: "start"})
+				}
+			}
+			for id := range running {
+				if !now[id] {
+					changes = append(changes, Event{ID: id, Status: "die"})
+				}
+			}
+			running = now
+			for _, event := range changes {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (c *cri) running(ctx context.Context) (map[string]bool, error) {
+	containers, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	running := map[string]bool{}
+	for _, container := range containers {
+		if container.Running {
+			running[container.ID] = true
+		}
+	}
+	return running, nil
+}
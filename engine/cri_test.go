@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type criState struct {
+	name    string
+	labels  map[string]string
+	running bool
+	pid     int
+}
+
+// fakeCRI serves the RuntimeService of one API version
+type fakeCRI struct {
+	lock       sync.Mutex
+	containers map[string]criState
+}
+
+func (f *fakeCRI) methods(service string) map[string]method {
+	container := func(id string, status bool) message {
+		c := f.containers[id]
+		state := uint64(2)
+		if c.running {
+			state = criRunning
+		}
+		m := message(nil).stringField(1, id)
+		metadata := message(nil).stringField(1, c.name).varintField(2, 1)
+		image := message(nil).stringField(1, "docker.io/library/"+id)
+		if status {
+			m = m.bytesField(2, metadata).varintField(3, state).varintField(4, 100).varintField(5, 200).bytesField(8, image)
+			for k, v := range c.labels {
+				m = m.bytesField(12, mapEntry(k, v))
+			}
+			return m
+		}
+		m = m.stringField(2, "sandbox").bytesField(3, metadata).bytesField(4, image).stringField(5, "sha256:1").varintField(6, state)
+		for k, v := range c.labels {
+			m = m.bytesField(8, mapEntry(k, v))
+		}
+		return m
+	}
+	id := func(request []byte) string {
+		fs, _ := fields(request)
+		for _, field := range fs {
+			if field.num == 1 {
+				return string(field.bytes)
+			}
+		}
+		return ""
+	}
+	locked := func(m method) method {
+		return func(header http.Header, request []byte) ([]message, int) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			return m(header, request)
+		}
+	}
+	return map[string]method{
+		service + "ListContainers": locked(func(http.Header, []byte) ([]message, int) {
+			var ids []string
+			for id := range f.containers {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			reply := message(nil)
+			for _, id := range ids {
+				reply = reply.bytesField(1, container(id, false))
+			}
+			return []message{reply}, 0
+		}),
+		service + "ContainerStatus": locked(func(_ http.Header, request []byte) ([]message, int) {
+			c, ok := f.containers[id(request)]
+			if !ok {
+				return nil, grpcNotFound
+			}
+			info := fmt.Sprintf(`{"pid":%d,"sandboxID":"sandbox"}`, c.pid)
+			return []message{message(nil).
+				bytesField(1, container(id(request), true)).
+				bytesField(2, mapEntry("info", info))}, 0
+		}),
+		service + "StopContainer": locked(func(_ http.Header, request []byte) ([]message, int) {
+			c, ok := f.containers[id(request)]
+			if !ok {
+				return nil, grpcNotFound
+			}
+			c.running = false
+			f.containers[id(request)] = c
+			return []message{nil}, 0
+		}),
+		service + "RemoveContainer": locked(func(_ http.Header, request []byte) ([]message, int) {
+			delete(f.containers, id(request))
+			return []message{nil}, 0
+		}),
+	}
+}
+
+func TestCRI(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		calls   string
+	}{
+		{"v1", criService, "ListContainers ContainerStatus ContainerStatus StopContainer StopContainer RemoveContainer"},
+		{"v1alpha2", criAlphaService, "ListContainers ListContainers ContainerStatus ContainerStatus StopContainer StopContainer RemoveContainer"},
+	}
+	for _, test := range tests {
+		f := &fakeCRI{containers: map[string]criState{
+			"db":  {name: "db", labels: map[string]string{"tier": "data"}, pid: 43},
+			"web": {name: "nginx", labels: map[string]string{"io.kubernetes.container.name": "nginx"}, running: true, pid: 42},
+		}}
+		server := newGRPCServer(t, f.methods(test.service))
+		rt := NewCRI(server.address)
+		ctx := context.Background()
+
+		containers, err := rt.List(ctx)
+		want := []Container{
+			{ID: "db", Name: "db", Image: "docker.io/library/db", Labels: map[string]string{"tier": "data"}},
+			{ID: "web", Name: "nginx", Image: "docker.io/library/web", Labels: map[string]string{"io.kubernetes.container.name": "nginx"}, Running: true},
+		}
+		if err != nil || !reflect.DeepEqual(containers, want) {
+			t.Errorf("%s: listed %+v, %v, want %+v", test.name, containers, err, want)
+		}
+		web := want[1]
+		web.Pid = 42
+		web.Started = "200"
+		if c, err := rt.Inspect(ctx, "web"); err != nil || !reflect.DeepEqual(c, web) {
+			t.Errorf("%s: inspected %+v, %v, want %+v", test.name, c, err, web)
+		}
+		if _, err := rt.Inspect(ctx, "missing"); err != ErrNotFound {
+			t.Errorf("%s: inspecting a missing container got %v", test.name, err)
+		}
+		if err := rt.Stop(ctx, "web", time.Second); err != nil {
+			t.Errorf("%s: stopping: %v", test.name, err)
+		}
+		if err := rt.Remove(ctx, "web"); err != nil {
+			t.Errorf("%s: removing: %v", test.name, err)
+		}
+		if _, ok := f.containers["web"]; ok {
+			t.Errorf("%s: web wasn't removed", test.name)
+		}
+
+		// Under v1alpha2 only the first call tries v1
+		if got := strings.Join(server.Calls(), " "); got != test.calls {
+			t.Errorf("%s: called %s, want %s", test.name, got, test.calls)
+		}
+		server.Close()
+	}
+}
+
+func TestCRIEvents(t *testing.T) {
+	defer func(poll time.Duration) { criPoll = poll }(criPoll)
+	criPoll = 10 * time.Millisecond
+
+	f := &fakeCRI{containers: map[string]criState{
+		"web": {name: "web", running: true},
+		"db":  {name: "db"},
+	}}
+	server := newGRPCServer(t, f.methods(criService))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := NewCRI(server.address).Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(map[string]criState)
+		want   Event
+	}{
+		{"start", func(cs map[string]criState) { cs["db"] = criState{name: "db", running: true} }, Event{ID: "db", Status: "start"}},
+		{"stop", func(cs map[string]criState) { cs["web"] = criState{name: "web"} }, Event{ID: "web", Status: "die"}},
+		{"removed", func(cs map[string]criState) { delete(cs, "db") }, Event{ID: "db", Status: "die"}},
+	}
+	for _, test := range tests {
+		f.lock.Lock()
+		test.change(f.containers)
+		f.lock.Unlock()
+		select {
+		case got := <-events:
+			if got != test.want {
+				t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no event after 1s", test.name)
+		}
+	}
+}
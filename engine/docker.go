@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/rancher/plugin-manager/dockerapi"
+)
+
+type docker struct {
+	c    *client.Client
+	name string
+}
+
+// NewDocker talks to the Docker daemon named by DOCKER_HOST
+func NewDocker() (Runtime, error) {
+	c, err := dockerapi.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	return &docker{c: c, name: "docker"}, nil
+}
+
+// NewDockerClient wraps an existing client
+func NewDockerClient(c *client.Client) Runtime {
+	return &docker{c: c, name: "docker"}
+}
+
+// NewPodmanClient wraps a client of Podman's Docker compatible API
+func NewPodmanClient(c *client.Client) Runtime {
+	return &docker{c: c, name: "podman"}
+}
+
+func (d *docker) Name() string {
+	return d.name
+}
+
+func (d *docker) List(ctx context.Context) ([]Container, error) {
+	containers, err := d.c.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []Container
+	for _, c := range containers {
+		name := ""
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		// Lists only report the state from API 1.23, the status is
+		// human readable, such as Up 2 hours
+		running := c.State == "running"
+		if !dockerapi.Supports("list.state") {
+			running = strings.HasPrefix(c.Status, "Up")
+		}
+		result = append(result, Container{
+			ID:      c.ID,
+			Name:    name,
+			Image:   c.Image,
+			Labels:  labels(c.Labels),
+			Running: running,
+		})
+	}
+	return result, nil
+}
+
+func (d *docker) Inspect(ctx context.Context, id string) (Container, error) {
+	inspect, err := d.c.ContainerInspect(ctx, id)
+	if client.IsErrContainerNotFound(err) {
+		return Container{}, ErrNotFound
+	} else if err != nil {
+		return Container{}, err
+	}
+	c := Container{
+		ID:    inspect.ID,
+		Name:  strings.TrimPrefix(inspect.Name, "/"),
+		Image: inspect.Image,
+	}
+	if inspect.Config != nil {
+		c.Labels = inspect.Config.Labels
+	}
+	c.Labels = labels(c.Labels)
+	if inspect.State != nil {
+		c.Running = inspect.State.Running
+		c.Pid = inspect.State.Pid
+		c.Started = inspect.State.StartedAt
+	}
+	if inspect.HostConfig != nil {
+		c.NetworkContainer = inspect.HostConfig.NetworkMode.ConnectedContainer()
+	}
+	return c, nil
+}
+
+func (d *docker) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	return d.c.ContainerStop(ctx, id, &timeout)
+}
+
+func (d *docker) Remove(ctx context.Context, id string) error {
+	return d.c.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+}
+
+func (d *docker) Events(ctx context.Context) (<-chan Event, error) {
+	options := types.EventsOptions{}
+	// Podman names exits died, which a die filter would drop
+	if d.name == "docker" && dockerapi.Supports("events.filters") {
+		options.Filters = filters.NewArgs()
+		options.Filters.Add("type", "container")
+		options.Filters.Add("event", "start")
+		options.Filters.Add("event", "die")
+	}
+	body, err := d.c.Events(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer body.Close()
+		decoder := json.NewDecoder(body)
+		for {
+			var message struct {
+				ID     string `json:"id"`
+				Status string `json:"status"`
+				Type   string `json:"Type"`
+				Action string `json:"Action"`
+				Actor  struct {
+					ID string `json:"ID"`
+				} `json:"Actor"`
+			}
+			if err := decoder.Decode(&message); err != nil {
+				if ctx.Err() == nil {
+					log.WithError(err).Errorf("%s event stream broke", d.name)
+				}
+				return
+			}
+			// Podman names a container exiting died, and newer API versions
+			// may only set the action and actor
+			status, id := message.Status, message.ID
+			if status == "" {
+				status, id = message.Action, message.Actor.ID
+			}
+			if status == "died" {
+				status = "die"
+			}
+			if message.Type != "" && message.Type != "container" || status != "start" && status != "die" {
+				continue
+			}
+			select {
+			case events <- Event{ID: id, Status: status}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// labels never returns nil, Podman leaves out the labels of containers
+// without any
+func labels(l map[string]string) map[string]string {
+	if l == nil {
+		return map[string]string{}
+	}
+	return l
+}
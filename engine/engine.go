@@ -0,0 +1,58 @@
+// Package engine is the container runtime the subsystems that only list,
+// stop and remove containers talk to, so they run the same on hosts with
+// Docker, containerd or another CRI runtime
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("engine")
+
+// ErrNotFound is returned when the runtime has no such container
+var ErrNotFound = errors.New("no such container")
+
+// Container is what the runtimes share about a container
+type Container struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name,omitempty"`
+	Image   string            `json:"image,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Running bool              `json:"running"`
+	Pid     int               `json:"pid,omitempty"`
+	// Started changes each time the container starts, Docker's start time
+	// or the runtime's equivalent, set by Inspect
+	Started string `json:"started,omitempty"`
+	// NetworkContainer is the container whose network namespace this one
+	// joins, empty when it has its own
+	NetworkContainer string `json:"networkContainer,omitempty"`
+}
+
+// Event is a container starting or dying, Status is "start" or "die" as
+// Docker names them
+type Event struct {
+	ID     string
+	Status string
+}
+
+// Runtime lists, inspects, stops and removes containers and reports their
+// starts and deaths
+type Runtime interface {
+	// Name is the runtime's name for logs, "docker", "containerd" or "cri"
+	Name() string
+	// List returns every container, running or not
+	List(ctx context.Context) ([]Container, error)
+	// Inspect returns ErrNotFound for a container that doesn't exist
+	Inspect(ctx context.Context, id string) (Container, error)
+	// Stop sends SIGTERM and SIGKILL after timeout, straight away for 0
+	Stop(ctx context.Context, id string, timeout time.Duration) error
+	// Remove removes the container, killing it first if it's running
+	Remove(ctx context.Context, id string) error
+	// Events sends each start and death until ctx is done or the stream
+	// breaks, then closes the channel
+	Events(ctx context.Context) (<-chan Event, error)
+}
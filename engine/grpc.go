@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// grpcNotFound is the status code of a call naming a missing object
+	grpcNotFound = 5
+	// grpcUnimplemented is the status code of a call to a method the server
+	// doesn't have
+	grpcUnimplemented = 12
+)
+
+// maxMessage bounds a reply, a list of every container on a busy host stays
+// well under it
+const maxMessage = 64 << 20
+
+// grpcConn calls gRPC methods over HTTP/2 without TLS, the way containerd
+// and CRI runtimes serve their sockets. Messages are encoded by proto.go,
+// each runtime only needs a handful of their fields.
+type grpcConn struct {
+	client *http.Client
+	// header is sent with every call, such as containerd's namespace
+	header http.Header
+}
+
+// grpcError is a call's status other than OK
+type grpcError struct {
+	method  string
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%s: rpc error %d: %s", e.method, e.code, e.message)
+}
+
+// dialAddress splits a unix:// or tcp:// address, a bare path is a socket
+func dialAddress(address string) (string, string) {
+	if strings.HasPrefix(address, "tcp://") {
+		return "tcp", strings.TrimPrefix(address, "tcp://")
+	}
+	return "unix", strings.TrimPrefix(address, "unix://")
+}
+
+func newGRPC(address string, header http.Header) *grpcConn {
+	network, addr := dialAddress(address)
+	return &grpcConn{
+		client: &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(string, string, *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}},
+		header: header,
+	}
+}
+
+// call sends request to method, such as
+// /containerd.services.tasks.v1.Tasks/Get, and returns the one reply
+func (g *grpcConn) call(ctx context.Context, method string, request message) ([]byte, error) {
+	s, err := g.stream(ctx, method, request)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	reply, err := s.Recv()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s: no reply", method)
+	}
+	return reply, err
+}
+
+// stream sends request to a server streaming method, its replies are read
+// with Recv until it returns io.EOF
+func (g *grpcConn) stream(ctx context.Context, method string, request message) (*grpcStream, error) {
+	body := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	body = append(body, request...)
+
+	req, err := http.NewRequest("POST", "http://runtime"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range g.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return &grpcStream{method: method, resp: resp}, nil
+}
+
+// grpcStream is the replies to one call
+type grpcStream struct {
+	method string
+	resp   *http.Response
+}
+
+// Recv returns the next reply, io.EOF once the call ended with OK and its
+// status otherwise
+func (s *grpcStream) Recv() ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(s.resp.Body, prefix[:]); err == io.EOF {
+		return nil, s.status()
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.method, err)
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("%s: compressed reply", s.method)
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessage {
+		return nil, fmt.Errorf("%s: %d byte reply", s.method, n)
+	}
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(s.resp.Body, reply); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.method, err)
+	}
+	return reply, nil
+}
+
+// status is io.EOF for OK or the error the trailers report. A call failing
+// straight away reports its status in the headers.
+func (s *grpcStream) status() error {
+	status, msg := s.resp.Trailer.Get("Grpc-Status"), s.resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = s.resp.Header.Get("Grpc-Status"), s.resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("%s: no status", s.method)
+	}
+	if code == 0 {
+		return io.EOF
+	}
+	// The message is percent encoded, which leaves a + as it is
+	if unescaped, err := url.QueryUnescape(strings.Replace(msg, "+", "%2B", -1)); err == nil {
+		msg = unescaped
+	}
+	return &grpcError{method: s.method, code: code, message: msg}
+}
+
+func (s *grpcStream) Close() error {
+	return s.resp.Body.Close()
+}
+
+// notFound maps a call's NotFound status to ErrNotFound
+func notFound(err error) error {
+	if e, ok := err.(*grpcError); ok && e.code == grpcNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// method answers one call with its replies and status, 0 for OK
+type method func(header http.Header, request []byte) ([]message, int)
+
+// grpcServer serves methods over h2c on a unix socket, like containerd and
+// CRI runtimes do, recording the calls made
+type grpcServer struct {
+	address  string
+	listener net.Listener
+	methods  map[string]method
+	dir      string
+
+	lock  sync.Mutex
+	calls []string
+}
+
+func newGRPCServer(t *testing.T, methods map[string]method) *grpcServer {
+	dir, err := ioutil.TempDir("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "runtime.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &grpcServer{address: "unix://" + path, listener: l, methods: methods, dir: dir}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(s.serve)})
+		}
+	}()
+	return s
+}
+
+func (s *grpcServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Calls returns the methods called so far, without their service
+func (s *grpcServer) Calls() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *grpcServer) serve(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	s.calls = append(s.calls, filepath.Base(req.URL.Path))
+	s.lock.Unlock()
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(req.Body, prefix[:]); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(req.Body, request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/grpc")
+	rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	m, ok := s.methods[req.URL.Path]
+	if !ok {
+		rw.WriteHeader(http.StatusOK)
+		rw.Header().Set("Grpc-Status", "12")
+		rw.Header().Set("Grpc-Message", "unknown method "+req.URL.Path)
+		return
+	}
+	replies, status := m(req.Header, request)
+	rw.WriteHeader(http.StatusOK)
+	for _, reply := range replies {
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(reply)))
+		rw.Write(prefix[:])
+		rw.Write(reply)
+		rw.(http.Flusher).Flush()
+	}
+	rw.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if status != 0 {
+		rw.Header().Set("Grpc-Message", "not found%3A test")
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	m := message(nil).
+		stringField(1, "web").
+		bytesField(2, mapEntry("a", "1")).
+		bytesField(2, mapEntry("b", "")).
+		varintField(3, 300).
+		boolField(4, true).
+		varintField(5, 0)
+	fs, err := fields(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels map[string]string
+	got := map[int]uint64{}
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			if string(f.bytes) != "web" {
+				t.Errorf("got field 1 %q", f.bytes)
+			}
+		case 2:
+			if labels, err = stringMap(labels, f.bytes); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			got[f.num] = f.value
+		}
+	}
+	if len(labels) != 2 || labels["a"] != "1" || labels["b"] != "" {
+		t.Errorf("got labels %v", labels)
+	}
+	if len(got) != 2 || got[3] != 300 || got[4] != 1 {
+		t.Errorf("got varints %v, want 3=300 4=1 and the zero left out", got)
+	}
+	if _, err := fields(m[:len(m)-1]); err == nil {
+		t.Errorf("truncated message decoded")
+	}
+}
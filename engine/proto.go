@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// message is a protobuf message being encoded, fields are appended in order
+type message []byte
+
+func (m message) tag(num, wire int) message {
+	return m.uvarint(uint64(num)<<3 | uint64(wire))
+}
+
+func (m message) uvarint(v uint64) message {
+	var buf [binary.MaxVarintLen64]byte
+	return append(m, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// varintField appends an integer, enum or bool field, left out when zero
+// like proto3 does
+func (m message) varintField(num int, v uint64) message {
+	if v == 0 {
+		return m
+	}
+	return m.tag(num, wireVarint).uvarint(v)
+}
+
+// boolField appends a bool field
+func (m message) boolField(num int, v bool) message {
+	if !v {
+		return m
+	}
+	return m.varintField(num, 1)
+}
+
+// bytesField appends a bytes or embedded message field, left out when
+// empty
+func (m message) bytesField(num int, b []byte) message {
+	if len(b) == 0 {
+		return m
+	}
+	return append(m.tag(num, wireBytes).uvarint(uint64(len(b))), b...)
+}
+
+// stringField appends a string field
+func (m message) stringField(num int, s string) message {
+	return m.bytesField(num, []byte(s))
+}
+
+// field is one decoded field, the last one of a number wins for scalars and
+// repeated fields are every one in order
+type field struct {
+	num   int
+	wire  int
+	value uint64
+	bytes []byte
+}
+
+// fields decodes the fields of a message
+func fields(b []byte) ([]field, error) {
+	var result []field
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		b = b[n:]
+		f := field{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			b = b[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if f.wire == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, errTruncated
+			}
+			b = b[size:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, errTruncated
+			}
+			f.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// stringMap decodes the entries of a map<string, string> field
+func stringMap(m map[string]string, entry []byte) (map[string]string, error) {
+	fs, err := fields(entry)
+	if err != nil {
+		return m, err
+	}
+	if m == nil {
+		m = map[string]string{}
+	}
+	var key, value string
+	for _, f := range fs {
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			value = string(f.bytes)
+		}
+	}
+	m[key] = value
+	return m, nil
+}
+
+// mapEntry encodes a map<string, string> field entry
+func mapEntry(key, value string) message {
+	return message(nil).stringField(1, key).stringField(2, value)
+}
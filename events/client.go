@@ -1,10 +1,13 @@
 package events
 
 import (
+	"net/http"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/rancher/plugin-manager/dockerapi"
 )
 
 const (
@@ -13,8 +16,25 @@ const (
 )
 
 func NewDockerClient() (*docker.Client, error) {
+	if host, ok := remoteHost(); ok {
+		return newTLSClient(host)
+	}
+	c, err := newDockerClient()
+	if err != nil {
+		return nil, err
+	}
+	c.Dialer = dockerapi.WrapDialer("go-dockerclient", c.Dialer)
+	return c, nil
+}
+
+func newDockerClient() (*docker.Client, error) {
 	apiVersion := getenv("DOCKER_API_VERSION", defaultAPIVersion)
 	endpoint := defaultUnixSocket
+	// Such as Podman's socket, TCP daemons are only used with boot2docker
+	// or as a remote daemon
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		endpoint = host
+	}
 
 	if os.Getenv("CATTLE_DOCKER_USE_BOOT2DOCKER") == "true" {
 		endpoint = os.Getenv("DOCKER_HOST")
@@ -32,6 +52,30 @@ func NewDockerClient() (*docker.Client, error) {
 	return docker.NewVersionedClient(endpoint, apiVersion)
 }
 
+// remoteHost returns the --docker-host on another host, reached over the
+// TLS config dockerapi was given
+func remoteHost() (string, bool) {
+	host := os.Getenv("DOCKER_HOST")
+	return host, strings.HasPrefix(host, "tcp://") && dockerapi.RemoteTLS() != nil
+}
+
+// newTLSClient talks to the remote daemon at host with the same TLS config
+// and measured connections as engine-api's client
+func newTLSClient(host string) (*docker.Client, error) {
+	c, err := docker.NewVersionedClient("https://"+strings.TrimPrefix(host, "tcp://"), getenv("DOCKER_API_VERSION", defaultAPIVersion))
+	if err != nil {
+		return nil, err
+	}
+	config := dockerapi.RemoteTLS()
+	c.TLSConfig = config
+	c.HTTPClient = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+		DialTLS:         dockerapi.DialTLS("go-dockerclient", config),
+	}}
+	return c, nil
+}
+
 func getenv(key string, defaultVal string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -1,8 +1,12 @@
 package events
 
 import (
+	"context"
+
 	"github.com/fsouza/go-dockerclient"
+	"github.com/rancher/plugin-manager/admin"
 	"github.com/rancher/plugin-manager/binexec"
+	"github.com/rancher/plugin-manager/engine"
 	"github.com/rancher/plugin-manager/network"
 )
 
@@ -19,6 +23,40 @@ func Watch(poolSize int, nm *network.Manager, bw *binexec.Watcher) error {
 	return dep.Process()
 }
 
+// WatchRuntime handles the events of a runtime without the Docker API. Only
+// the network manager and binexec follow them, resolv.conf is Docker's.
+func WatchRuntime(rt engine.Runtime, poolSize int, nm *network.Manager, bw *binexec.Watcher) error {
+	handlers := map[string][]Handler{}
+	if bw != nil {
+		handlers["start"] = append(handlers["start"], bw)
+	}
+	if nm != nil {
+		nmHandler := &NetworkManagerHandler{nm}
+		handlers["start"] = append(handlers["start"], nmHandler)
+		handlers["die"] = append(handlers["die"], nmHandler)
+	}
+
+	router, err := NewRuntimeEventRouter(poolSize, poolSize, rt, handlers)
+	if err != nil {
+		return err
+	}
+	router.Start()
+	admin.RegisterState("events", router.State)
+
+	containers, err := rt.List(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		router.listener <- &docker.APIEvents{
+			ID:     c.ID,
+			Status: "start",
+			From:   simulatedEvent,
+		}
+	}
+	return nil
+}
+
 type DockerEventsProcessor struct {
 	poolSize int
 	nm       *network.Manager
@@ -31,16 +69,21 @@ func (de *DockerEventsProcessor) Process() error {
 		return err
 	}
 
-	nmHandler := &NetworkManagerHandler{de.nm}
-	handlers := map[string][]Handler{
-		"start": []Handler{
-			de.bw,
-			&StartHandler{dockerClient},
-			nmHandler,
-		},
-		"die": []Handler{
-			nmHandler,
-		},
+	// The network manager and binexec watcher are nil when their subsystem
+	// is disabled
+	handlers := map[string][]Handler{}
+	if de.bw != nil {
+		handlers["start"] = append(handlers["start"], de.bw)
+	}
+	start := &StartHandler{Client: dockerClient}
+	if _, ok := remoteHost(); ok {
+		start.Archive = dockerClient
+	}
+	handlers["start"] = append(handlers["start"], start)
+	if de.nm != nil {
+		nmHandler := &NetworkManagerHandler{de.nm}
+		handlers["start"] = append(handlers["start"], nmHandler)
+		handlers["die"] = append(handlers["die"], nmHandler)
 	}
 
 	router, err := NewEventRouter(de.poolSize, de.poolSize, dockerClient, handlers)
@@ -48,6 +91,7 @@ func (de *DockerEventsProcessor) Process() error {
 		return err
 	}
 	router.Start()
+	admin.RegisterState("events", router.State)
 
 	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
 		All: true,
@@ -1,23 +1,65 @@
 package events
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
 	"github.com/fsouza/go-dockerclient"
+	"github.com/jpillora/backoff"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/tracing"
+	"github.com/rancher/plugin-manager/watchdog"
 	"time"
 )
 
-const workerTimeout = 60 * time.Second
+var log = logging.Subsystem("events")
+
+const (
+	workerTimeout = 60 * time.Second
+	// heartbeatEvery is how often an idle router reports it's alive
+	heartbeatEvery = 30 * time.Second
+)
+
+var (
+	queueDepth = metrics.NewGauge("plugin_manager_events_queue_depth",
+		"Docker events received but not yet handed to a worker")
+	busyWorkers = metrics.NewGauge("plugin_manager_events_busy_workers",
+		"Event workers currently handling an event")
+	handled = metrics.NewCounter("plugin_manager_events_handled_total",
+		"Docker events handled, by status and result", "status", "result")
+)
 
+// Handler reacts to a Docker event. ctx carries the event's trace span.
 type Handler interface {
-	Handle(*docker.APIEvents) error
+	Handle(context.Context, *docker.APIEvents) error
 }
 
 type EventRouter struct {
 	handlers      map[string][]Handler
 	dockerClient  *docker.Client
+	runtime       engine.Runtime
 	listener      chan *docker.APIEvents
 	workers       chan *worker
 	workerTimeout time.Duration
+
+	inflightLock sync.Mutex
+	inflight     map[*docker.APIEvents]time.Time
+}
+
+// EventState is an event being handled, for state dumps
+type EventState struct {
+	ID     string    `json:"id"`
+	Status string    `json:"status"`
+	From   string    `json:"from,omitempty"`
+	Since  time.Time `json:"since"`
 }
 
 func NewEventRouter(bufferSize int, workerPoolSize int, dockerClient *docker.Client,
@@ -33,22 +75,43 @@ func NewEventRouter(bufferSize int, workerPoolSize int, dockerClient *docker.Cli
 		listener:      make(chan *docker.APIEvents, bufferSize),
 		workers:       workers,
 		workerTimeout: workerTimeout,
+		inflight:      map[*docker.APIEvents]time.Time{},
 	}
 
 	return eventRouter, nil
 }
 
+// NewRuntimeEventRouter routes the starts and deaths rt reports, for runtimes
+// without the Docker API
+func NewRuntimeEventRouter(bufferSize int, workerPoolSize int, rt engine.Runtime,
+	handlers map[string][]Handler) (*EventRouter, error) {
+	eventRouter, err := NewEventRouter(bufferSize, workerPoolSize, nil, handlers)
+	if err != nil {
+		return nil, err
+	}
+	eventRouter.runtime = rt
+	return eventRouter, nil
+}
+
 func (e *EventRouter) Start() error {
 	log.Info("Starting event router.")
-	go e.routeEvents()
+	health.Register("events")
+	watchdog.Go("events.router", e.routeEvents)
+	if e.runtime != nil {
+		go e.followRuntime()
+		health.Set("events", nil)
+		return nil
+	}
 	if err := e.dockerClient.AddEventListener(e.listener); err != nil {
+		health.Set("events", err)
 		return err
 	}
+	health.Set("events", nil)
 	return nil
 }
 
 func (e *EventRouter) Stop() error {
-	if e.listener == nil {
+	if e.listener == nil || e.dockerClient == nil {
 		return nil
 	}
 	if err := e.dockerClient.RemoveEventListener(e.listener); err != nil {
@@ -57,15 +120,84 @@ func (e *EventRouter) Stop() error {
 	return nil
 }
 
+// followRuntime sends the runtime's events to the listener as Docker's,
+// following the stream again each time it breaks
+func (e *EventRouter) followRuntime() {
+	defer crash.Recover()
+	b := &backoff.Backoff{
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+		Factor: 2,
+	}
+	for {
+		events, err := e.runtime.Events(context.Background())
+		if err != nil {
+			log.WithError(err).Errorf("Failed to follow %s events", e.runtime.Name())
+			health.Set("events", err)
+		} else {
+			health.Set("events", nil)
+			for event := range events {
+				b.Reset()
+				e.listener <- &docker.APIEvents{ID: event.ID, Status: event.Status}
+			}
+			log.Warnf("%s event stream closed, following it again", e.runtime.Name())
+		}
+		time.Sleep(b.Duration())
+	}
+}
+
+// State reports the events waiting for a worker and the ones being handled
+func (e *EventRouter) State() interface{} {
+	e.inflightLock.Lock()
+	defer e.inflightLock.Unlock()
+	handling := []EventState{}
+	for event, since := range e.inflight {
+		handling = append(handling, EventState{
+			ID:     event.ID,
+			Status: event.Status,
+			From:   event.From,
+			Since:  since,
+		})
+	}
+	return map[string]interface{}{
+		"queued":      len(e.listener),
+		"idleWorkers": len(e.workers),
+		"handling":    handling,
+	}
+}
+
 func (e *EventRouter) routeEvents() {
+	defer crash.Recover()
+	heartbeat := time.NewTicker(heartbeatEvery)
+	defer heartbeat.Stop()
 	for {
-		event := <-e.listener
+		// Not beating while waiting for a worker below means the router
+		// reports dead once every worker is stuck
+		health.Heartbeat("events.router", heartbeatEvery)
+		var event *docker.APIEvents
+		ok := true
+		select {
+		case event, ok = <-e.listener:
+		case <-heartbeat.C:
+			continue
+		}
+		if !ok {
+			// The client closes listeners once it gives up reconnecting
+			log.Error("Docker event stream closed")
+			health.Fatal("events", errors.New("docker event stream closed"))
+			return
+		}
+		if !normalize(event) {
+			continue
+		}
+		received := time.Now()
+		queueDepth.Set(float64(len(e.listener)))
 		timer := time.NewTimer(e.workerTimeout)
 		gotWorker := false
 		for !gotWorker {
 			select {
 			case w := <-e.workers:
-				go w.doWork(event, e)
+				go w.doWork(event, received, e)
 				gotWorker = true
 			case <-timer.C:
 				log.Infof("Timed out waiting for worker. Re-initializing wait.")
@@ -76,17 +208,71 @@ func (e *EventRouter) routeEvents() {
 
 type worker struct{}
 
-func (w *worker) doWork(event *docker.APIEvents, e *EventRouter) {
-	defer func() { e.workers <- w }()
+func (w *worker) doWork(event *docker.APIEvents, received time.Time, e *EventRouter) {
+	defer crash.Recover()
+	busyWorkers.Add(1)
+	defer func() {
+		busyWorkers.Add(-1)
+		e.workers <- w
+	}()
 	if event == nil {
 		return
 	}
+	e.inflightLock.Lock()
+	e.inflight[event] = time.Now()
+	e.inflightLock.Unlock()
+	defer func() {
+		e.inflightLock.Lock()
+		delete(e.inflight, event)
+		e.inflightLock.Unlock()
+	}()
 	if handlers, ok := e.handlers[event.Status]; ok {
 		log.Debugf("Processing event: %#v", event)
+		ctx := context.Background()
+		// Containers found running at startup weren't just started, leave
+		// them out of the start to reachable latency
+		if event.From != simulatedEvent {
+			ctx = network.WithEventReceived(ctx, received)
+		}
+		span, ctx := tracing.Start(ctx, "docker."+event.Status,
+			tracing.ContainerIDKey, event.ID, "docker.event.from", event.From)
+		var lastErr error
 		for _, handler := range handlers {
-			if err := handler.Handle(event); err != nil {
+			handlerSpan, ctx := tracing.Start(ctx, strings.TrimPrefix(fmt.Sprintf("%T", handler), "*"),
+				tracing.ContainerIDKey, event.ID)
+			err := handler.Handle(ctx, event)
+			handlerSpan.End(err)
+			if err != nil {
 				log.Errorf("Error processing event %#v. Error: %v", event, err)
+				handled.Inc(event.Status, "error")
+				lastErr = err
+			} else {
+				handled.Inc(event.Status, "ok")
 			}
 		}
+		span.End(lastErr)
+	}
+}
+
+// normalize smooths over how Docker compatible daemons differ in their
+// events, reporting false for events that aren't about a container. Podman
+// reports a container exiting as died rather than die, and with newer API
+// versions only the action and actor may be set.
+func normalize(event *docker.APIEvents) bool {
+	if event == nil {
+		return true
+	}
+	if event.Type != "" && event.Type != "container" {
+		return false
+	}
+	if event.Status == "" {
+		event.Status = event.Action
+	}
+	if event.ID == "" {
+		event.ID = event.Actor.ID
+	}
+	if event.Status == "died" {
+		event.Status = "die"
 	}
+	return true
 }
@@ -0,0 +1,155 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+// recorder sends the events it handles on its channel
+type recorder chan string
+
+func (r recorder) Handle(ctx context.Context, event *docker.APIEvents) error {
+	r <- event.Status + " " + event.ID
+	return nil
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  docker.APIEvents
+		ok     bool
+		id     string
+		status string
+	}{
+		{"old API", docker.APIEvents{ID: "web", Status: "start"}, true, "web", "start"},
+		{"action and actor", docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "web"}}, true, "web", "die"},
+		{"podman died", docker.APIEvents{Type: "container", Status: "died", ID: "web"}, true, "web", "die"},
+		{"network event", docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "bridge"}}, false, "", ""},
+		{"image event", docker.APIEvents{Type: "image", Action: "pull"}, false, "", ""},
+	}
+	for _, test := range tests {
+		event := test.event
+		ok := normalize(&event)
+		if ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && (event.ID != test.id || event.Status != test.status) {
+			t.Errorf("%s: got %s %s, want %s %s", test.name, event.ID, event.Status, test.id, test.status)
+		}
+	}
+}
+
+func TestRouteEvents(t *testing.T) {
+	self := metadata.Host{UUID: "host1"}
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: self,
+		Containers: []metadata.Container{
+			{Name: "web", ExternalId: "web", HostUUID: self.UUID, State: "running", StartCount: 1},
+			{Name: "db", ExternalId: "db", HostUUID: self.UUID, State: "stopped", StartCount: 1},
+			{Name: "other", ExternalId: "other", HostUUID: "host2", State: "stopped"},
+		},
+	})
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(recorder, 10)
+	router, err := NewEventRouter(10, 2, client, map[string][]Handler{
+		"start": {handled},
+		"die":   {handled},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Stop()
+	// The stream only carries what happens once it's connected
+	for server.Requests("/events") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		update func(*metadatatest.Answers)
+		want   string
+	}{
+		{"start", func(a *metadatatest.Answers) { a.Containers[1].State = "running" }, "start db"},
+		{"restart", func(a *metadatatest.Answers) { a.Containers[0].StartCount++ }, "start web"},
+		{"die", func(a *metadatatest.Answers) { a.Containers[0].State = "stopped" }, "die web"},
+		{"another host", func(a *metadatatest.Answers) { a.Containers[2].State = "running" }, ""},
+	}
+	for _, test := range tests {
+		server.Update(test.update)
+		select {
+		case got := <-handled:
+			if got != test.want {
+				t.Errorf("%s: handled %q, want %q", test.name, got, test.want)
+			}
+		case <-time.After(time.Second):
+			if test.want != "" {
+				t.Errorf("%s: %q not handled after 1s", test.name, test.want)
+			}
+		}
+	}
+}
+
+// streamRuntime reports the events sent on its channel
+type streamRuntime struct {
+	engine.Runtime
+	events chan engine.Event
+}
+
+func (r streamRuntime) Name() string {
+	return "containerd"
+}
+
+func (r streamRuntime) Events(ctx context.Context) (<-chan engine.Event, error) {
+	return r.events, nil
+}
+
+func TestRouteRuntimeEvents(t *testing.T) {
+	rt := streamRuntime{events: make(chan engine.Event)}
+	handled := make(recorder, 10)
+	router, err := NewRuntimeEventRouter(10, 2, rt, map[string][]Handler{
+		"start": {handled},
+		"die":   {handled},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Stop()
+
+	tests := []struct {
+		name  string
+		event engine.Event
+		want  string
+	}{
+		{"start", engine.Event{ID: "web", Status: "start"}, "start web"},
+		{"die", engine.Event{ID: "web", Status: "die"}, "die web"},
+	}
+	for _, test := range tests {
+		rt.events <- test.event
+		select {
+		case got := <-handled:
+			if got != test.want {
+				t.Errorf("%s: handled %q, want %q", test.name, got, test.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: %q not handled after 1s", test.name, test.want)
+		}
+	}
+}
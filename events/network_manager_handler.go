@@ -1,8 +1,11 @@
 package events
 
 import (
-	"github.com/Sirupsen/logrus"
+	"context"
+
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/logging"
 	"github.com/rancher/plugin-manager/network"
 )
 
@@ -10,9 +13,11 @@ type NetworkManagerHandler struct {
 	nm *network.Manager
 }
 
-func (h *NetworkManagerHandler) Handle(event *docker.APIEvents) error {
-	if err := h.nm.Evaluate(event.ID); err != nil {
-		logrus.Errorf("Failed to evaluate network state for %s: %v", event.ID, err)
+func (h *NetworkManagerHandler) Handle(ctx context.Context, event *docker.APIEvents) error {
+	err := h.nm.Evaluate(ctx, event.ID)
+	alerts.Record("cni", err)
+	if err != nil {
+		log.WithField(logging.ContainerIDKey, event.ID).Errorf("Failed to evaluate network state for %s: %v", event.ID, err)
 		return err
 	}
 	return nil
@@ -1,15 +1,18 @@
 package events
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
-	"os"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/rancher/event-subscriber/locks"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/swarm"
 )
 
 const (
@@ -24,6 +27,9 @@ const (
 
 type StartHandler struct {
 	Client SimpleDockerClient
+	// Archive is set when the daemon is remote, its containers' files are
+	// then read and written through it
+	Archive ArchiveClient
 }
 
 func getDNSSearch(container *docker.Container) []string {
@@ -58,7 +64,71 @@ func getDNSSearch(container *docker.Container) []string {
 	return defaultDomains
 }
 
-func setupResolvConf(container *docker.Container) error {
+// resolvConfFiles reads and writes containers' resolv.conf, on this host or
+// through the archive API of a remote daemon
+type resolvConfFiles interface {
+	read(container *docker.Container) ([]byte, error)
+	write(container *docker.Container, content []byte) error
+}
+
+type hostFiles struct{}
+
+func (hostFiles) read(container *docker.Container) ([]byte, error) {
+	return ioutil.ReadFile(container.ResolvConfPath)
+}
+
+func (hostFiles) write(container *docker.Container, content []byte) error {
+	return audit.File("events", "file.write", container.ResolvConfPath, func() error {
+		return ioutil.WriteFile(container.ResolvConfPath, content, 0666)
+	})
+}
+
+// ArchiveClient copies files in and out of containers
+type ArchiveClient interface {
+	DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error
+	UploadToContainer(id string, opts docker.UploadToContainerOptions) error
+}
+
+// archiveFiles goes through the daemon, which writes to the container's
+// resolv.conf bind mount like docker cp does
+type archiveFiles struct {
+	client ArchiveClient
+}
+
+func (a archiveFiles) read(container *docker.Container) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := a.client.DownloadFromContainer(container.ID, docker.DownloadFromContainerOptions{
+		OutputStream: buf,
+		Path:         "/etc/resolv.conf",
+	}); err != nil {
+		return nil, err
+	}
+	r := tar.NewReader(buf)
+	if _, err := r.Next(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (a archiveFiles) write(container *docker.Container, content []byte) error {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	if err := w.WriteHeader(&tar.Header{Name: "resolv.conf", Mode: 0644, Size: int64(len(content))}); err != nil {
+		return err
+	}
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return audit.File("events", "file.write", container.ID+":/etc/resolv.conf", func() error {
+		return a.client.UploadToContainer(container.ID, docker.UploadToContainerOptions{
+			InputStream: buf,
+			Path:        "/etc",
+		})
+	})
+}
+
+func setupResolvConf(container *docker.Container, files resolvConfFiles) error {
 	if _, ok := container.Config.Labels[RancherSystemLabelKey]; ok {
 		return nil
 	}
@@ -68,15 +138,13 @@ func setupResolvConf(container *docker.Container) error {
 		return nil
 	}
 
-	input, err := os.Open(container.ResolvConfPath)
+	input, err := files.read(container)
 	if err != nil {
 		return err
 	}
 
-	defer input.Close()
-
 	var buffer bytes.Buffer
-	scanner := bufio.NewScanner(input)
+	scanner := bufio.NewScanner(bytes.NewReader(input))
 	searchSet := false
 	nameserverSet := false
 	for scanner.Scan() {
@@ -118,15 +186,14 @@ func setupResolvConf(container *docker.Container) error {
 		buffer.Write([]byte("\n"))
 	}
 
-	input.Close()
-	return ioutil.WriteFile(container.ResolvConfPath, buffer.Bytes(), 0666)
+	return files.write(container, buffer.Bytes())
 }
 
-func (h *StartHandler) Handle(event *docker.APIEvents) error {
+func (h *StartHandler) Handle(ctx context.Context, event *docker.APIEvents) error {
 	// Note: event.ID == container's ID
 	lock := locks.Lock("start." + event.ID)
 	if lock == nil {
-		log.Debugf("Container locked. Can't run StartHandler. ID: [%s]", event.ID)
+		log.WithField(logging.ContainerIDKey, event.ID).Debugf("Container locked. Can't run StartHandler. ID: [%s]", event.ID)
 		return nil
 	}
 	defer lock.Unlock()
@@ -137,18 +204,27 @@ func (h *StartHandler) Handle(event *docker.APIEvents) error {
 	}
 
 	if !c.State.Running {
-		log.Infof("Container [%s] not running. Can't setup resolv.conf.", c.ID)
+		log.WithField(logging.ContainerIDKey, c.ID).Infof("Container [%s] not running. Can't setup resolv.conf.", c.ID)
 		return nil
 	}
 
 	if c.Config.Labels[RancherDNS] == "false" {
 		return nil
 	}
+	// Swarm tasks resolve through its embedded DNS server
+	if swarm.Task(c.Config.Labels) {
+		swarm.Skip("events", c.ID)
+		return nil
+	}
 
 	if c.Config.Labels[CNILabel] != "" || c.Config.Labels[RancherDNS] == "true" ||
 		c.Config.Labels[RancherNetwork] == "true" || c.Config.Labels[RancherIP] != "" {
-		log.Infof("Setting up resolv.conf for ContainerId [%s]", event.ID)
-		return setupResolvConf(c)
+		log.WithField(logging.ContainerIDKey, event.ID).Infof("Setting up resolv.conf for ContainerId [%s]", event.ID)
+		var files resolvConfFiles = hostFiles{}
+		if h.Archive != nil {
+			files = archiveFiles{h.Archive}
+		}
+		return setupResolvConf(c, files)
 	}
 
 	return nil
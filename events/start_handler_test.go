@@ -0,0 +1,64 @@
+package events
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// fakeArchive is a container filesystem holding only /etc/resolv.conf
+type fakeArchive struct {
+	resolvConf []byte
+}
+
+func (f *fakeArchive) DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error {
+	w := tar.NewWriter(opts.OutputStream)
+	w.WriteHeader(&tar.Header{Name: "resolv.conf", Mode: 0644, Size: int64(len(f.resolvConf))})
+	w.Write(f.resolvConf)
+	return w.Close()
+}
+
+func (f *fakeArchive) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	r := tar.NewReader(opts.InputStream)
+	header, err := r.Next()
+	if err != nil {
+		return err
+	}
+	if opts.Path+"/"+header.Name != "/etc/resolv.conf" {
+		return nil
+	}
+	f.resolvConf, err = ioutil.ReadAll(r)
+	return err
+}
+
+func TestRemoteResolvConf(t *testing.T) {
+	archive := &fakeArchive{resolvConf: []byte("nameserver 8.8.8.8\nsearch example.com\n")}
+	container := &docker.Container{
+		ID:             "web",
+		ResolvConfPath: "/var/lib/docker/containers/web/resolv.conf",
+		Config:         &docker.Config{},
+		HostConfig:     &docker.HostConfig{},
+	}
+
+	if err := setupResolvConf(container, archiveFiles{archive}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"# nameserver 8.8.8.8", "search example.com " + RancherDomain, "nameserver " + RancherNameserver}
+	got := strings.Split(strings.TrimSpace(string(archive.resolvConf)), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Rewriting it again changes nothing
+	before := append([]byte(nil), archive.resolvConf...)
+	if err := setupResolvConf(container, archiveFiles{archive}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, archive.resolvConf) {
+		t.Errorf("second pass changed %q to %q", before, archive.resolvConf)
+	}
+}
@@ -0,0 +1,62 @@
+// Package exitcode classifies the errors plugin-manager exits on by whether
+// a restart can fix them, so a supervisor can tell a host that needs
+// attention from one that only needs another try
+package exitcode
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Exit codes, anything not classified exits Failed
+const (
+	Failed = 1
+	// Config is a bad flag, environment variable or config file, restarting
+	// won't help until it's fixed
+	Config = 2
+	// Prerequisite is something missing from the host, such as a kernel
+	// module or tool
+	Prerequisite = 3
+	// Unavailable is Docker or metadata still unreachable after retrying, a
+	// restart may find it back
+	Unavailable = 4
+	// Locked is another instance holding the host lock
+	Locked = 5
+	// Fatal is a subsystem hitting an error it can't recover from while
+	// running, restarting clears it
+	Fatal = 6
+)
+
+// Error is an error with the code to exit with. It doesn't implement
+// Cause, so errors.Wrap around it keeps the code.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ExitCode lets urfave/cli exit with the code
+func (e *Error) ExitCode() int {
+	return e.Code
+}
+
+// New classifies err, nil stays nil
+func New(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Of returns the code err should exit with, 0 for nil
+func Of(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Code
+	}
+	return Failed
+}
@@ -0,0 +1,38 @@
+package exitcode
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"unclassified", fmt.Errorf("boom"), Failed},
+		{"classified", New(Config, fmt.Errorf("bad flag")), Config},
+		{"wrapped", errors.Wrap(New(Locked, fmt.Errorf("held")), "Taking the host lock"), Locked},
+		{"wrapped twice", errors.Wrap(errors.Wrap(New(Unavailable, fmt.Errorf("down")), "inner"), "outer"), Unavailable},
+		{"classified nil", New(Fatal, nil), 0},
+	}
+	for _, test := range tests {
+		if got := Of(test.err); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	err := New(Prerequisite, fmt.Errorf("missing vxlan"))
+	if err.Error() != "missing vxlan" {
+		t.Errorf("got message %q, want the wrapped error's", err.Error())
+	}
+	if code := err.(*Error).ExitCode(); code != Prerequisite {
+		t.Errorf("got exit code %d, want %d", code, Prerequisite)
+	}
+}
@@ -0,0 +1,236 @@
+// Package features turns experimental behaviors on and off across an
+// environment or on single hosts from metadata, so they can be rolled out
+// gradually
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/source"
+)
+
+var log = logging.Subsystem("features")
+
+const (
+	// LabelPrefix followed by a flag's name is the host label setting the
+	// flag on that host, e.g. io.rancher.network.feature.nftables=true
+	LabelPrefix = "io.rancher.network.feature."
+	// metadataKey in the default network's metadata holds the environment's
+	// flags, an object of names to booleans
+	metadataKey = "features"
+)
+
+// Where a flag's value came from, later ones win
+const (
+	FromDefault     = "default"
+	FromFlag        = "flag"
+	FromEnvironment = "environment"
+	FromHost        = "host"
+)
+
+var enabledGauge = metrics.NewGauge("plugin_manager_feature_enabled",
+	"1 while a feature flag is on for this host, by feature", "feature")
+
+// Flag is one experimental behavior
+type Flag struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+// State is a flag's value on this host and where it came from
+type State struct {
+	Enabled     bool   `json:"enabled"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+var (
+	lock   sync.Mutex
+	flags  = map[string]*Flag{}
+	local  = map[string]bool{}
+	states = map[string]State{}
+	// env and onHost are the metadata layers last read by update
+	env    map[string]bool
+	onHost map[string]bool
+)
+
+// Register adds a flag, off or on by default, for code to check with
+// Enabled
+func Register(name, description string, def bool) *Flag {
+	lock.Lock()
+	defer lock.Unlock()
+	f := &Flag{Name: name, Description: description, Default: def}
+	flags[name] = f
+	states[name] = f.state(env, onHost)
+	return f
+}
+
+// Enabled reports whether the behavior is on for this host
+func (f *Flag) Enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return states[f.Name].Enabled
+}
+
+// state layers the default, --feature, the environment's flags and the
+// host's labels
+func (f *Flag) state(env map[string]bool, host map[string]bool) State {
+	s := State{Enabled: f.Default, Source: FromDefault, Description: f.Description}
+	for _, layer := range []struct {
+		values map[string]bool
+		source string
+	}{{local, FromFlag}, {env, FromEnvironment}, {host, FromHost}} {
+		if v, ok := layer.values[f.Name]; ok {
+			s.Enabled, s.Source = v, layer.source
+		}
+	}
+	return s
+}
+
+// SetLocal applies --feature values, name=true or name=false, over the
+// defaults. Metadata still overrides them.
+func SetLocal(values []string) error {
+	parsed := map[string]bool{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid feature %q, expected name=true or name=false", value)
+		}
+		enabled, err := strconv.ParseBool(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid feature %q: %v", value, err)
+		}
+		parsed[parts[0]] = enabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for name := range parsed {
+		if _, ok := flags[name]; !ok && len(flags) == 0 {
+			return fmt.Errorf("unknown feature %q, no feature flags are defined", name)
+		} else if !ok {
+			return fmt.Errorf("unknown feature %q, expected one of %s", name, strings.Join(names(), ", "))
+		}
+	}
+	local = parsed
+	for name, f := range flags {
+		states[name] = f.state(env, onHost)
+	}
+	return nil
+}
+
+// Watch evaluates the flags against the current metadata, so subsystems
+// started afterwards see them, and again whenever it changes
+func Watch(c source.MetadataSource) {
+	if err := update(c); err != nil {
+		log.WithError(err).Error("Failed to read feature flags from metadata")
+	}
+	go c.OnChange(source.IntervalSeconds, func(string) {
+		if err := update(c); err != nil {
+			log.WithError(err).Error("Failed to read feature flags from metadata")
+		}
+	})
+}
+
+func update(c source.MetadataSource) error {
+	host, err := c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+	networks, err := c.GetNetworks()
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	env = environmentFlags(networks)
+	onHost = hostFlags(host)
+	for name, f := range flags {
+		s := f.state(env, onHost)
+		if old := states[name]; old.Enabled != s.Enabled {
+			log.Infof("Feature %s is now %s, set by %s", name, onOff(s.Enabled), s.Source)
+		}
+		states[name] = s
+		if s.Enabled {
+			enabledGauge.Set(1, name)
+		} else {
+			enabledGauge.Set(0, name)
+		}
+	}
+	for name := range env {
+		if _, ok := flags[name]; !ok {
+			log.Debugf("Ignoring unknown feature %s in network metadata", name)
+		}
+	}
+	return nil
+}
+
+func environmentFlags(networks []metadata.Network) map[string]bool {
+	result := map[string]bool{}
+	for _, network := range networks {
+		if !network.Default {
+			continue
+		}
+		values, _ := network.Metadata[metadataKey].(map[string]interface{})
+		for name, value := range values {
+			enabled, ok := value.(bool)
+			if !ok {
+				log.Errorf("Ignoring invalid feature %s=%v in network %s metadata, expected a boolean", name, value, network.Name)
+				continue
+			}
+			result[name] = enabled
+		}
+	}
+	return result
+}
+
+func hostFlags(host metadata.Host) map[string]bool {
+	result := map[string]bool{}
+	for label, value := range host.Labels {
+		if !strings.HasPrefix(label, LabelPrefix) {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Errorf("Ignoring invalid %s=%q on host %s: %v", label, value, host.UUID, err)
+			continue
+		}
+		result[strings.TrimPrefix(label, LabelPrefix)] = enabled
+	}
+	return result
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// States returns every flag's state by name
+func States() map[string]State {
+	lock.Lock()
+	defer lock.Unlock()
+	result := map[string]State{}
+	for name, s := range states {
+		result[name] = s
+	}
+	return result
+}
+
+func names() []string {
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
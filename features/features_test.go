@@ -0,0 +1,76 @@
+package features
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+func TestLayers(t *testing.T) {
+	flagged := Register("test-flagged", "Set by --feature only", false)
+	environment := Register("test-environment", "Set for the environment", false)
+	onHost := Register("test-host", "Set by the host label over the environment", true)
+
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host-uuid", Labels: map[string]string{
+			LabelPrefix + "test-host": "false",
+			LabelPrefix + "bogus":     "yes please",
+		}},
+		Networks: []metadata.Network{
+			{Name: "other", Metadata: map[string]interface{}{metadataKey: map[string]interface{}{"test-flagged": false}}},
+			{Name: "default", Default: true, Metadata: map[string]interface{}{metadataKey: map[string]interface{}{
+				"test-environment": true,
+				"test-host":        true,
+				"unknown":          true,
+			}}},
+		},
+	})
+	defer server.Close()
+
+	if err := update(server.Source(source.RancherOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLocal([]string{"test-flagged=true", "test-environment=false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flag    *Flag
+		enabled bool
+		source  string
+	}{
+		{flagged, true, FromFlag},
+		{environment, true, FromEnvironment},
+		{onHost, false, FromHost},
+	}
+	states := States()
+	for _, test := range tests {
+		if test.flag.Enabled() != test.enabled {
+			t.Errorf("%s: got enabled %v, want %v", test.flag.Name, test.flag.Enabled(), test.enabled)
+		}
+		if s := states[test.flag.Name]; s.Source != test.source {
+			t.Errorf("%s: set by %s, want %s", test.flag.Name, s.Source, test.source)
+		}
+	}
+}
+
+func TestSetLocal(t *testing.T) {
+	Register("test-local", "Checked by SetLocal", false)
+	tests := []struct {
+		values []string
+		err    bool
+	}{
+		{[]string{"test-local=true"}, false},
+		{[]string{"test-local=0"}, false},
+		{[]string{"test-local"}, true},
+		{[]string{"test-local=maybe"}, true},
+		{[]string{"missing=true"}, true},
+	}
+	for _, test := range tests {
+		if err := SetLocal(test.values); (err != nil) != test.err {
+			t.Errorf("%v: got %v, want an error %v", test.values, err, test.err)
+		}
+	}
+}
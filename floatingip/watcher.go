@@ -0,0 +1,332 @@
+package floatingip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var log = logging.Subsystem("floatingip")
+
+var (
+	// ReapplyEvery is how often secondary IPs are applied again when nothing
+	// changed
+	ReapplyEvery      = config.NewDuration(5 * time.Minute)
+	secondaryIPsLabel = "io.rancher.container.secondary_ips"
+	floatingIPsKey    = "floatingIps"
+	ifName            = "eth0"
+)
+
+// Watch is used to look for changes in metadata and assign secondary and
+// floating IPs to the containers on this host
+func Watch(c store.Store) error {
+	w := newWatcher(c)
+	health.Register("floatingip")
+	handoff.RegisterStop("floatingip", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("floatingip", func() error { return w.reconcile("", true) })
+	admin.RegisterState("floatingip", w.state)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	return nil
+}
+
+func newWatcher(c store.Store) *watcher {
+	return &watcher{
+		c:       c,
+		applied: map[string]Assignment{},
+	}
+}
+
+// Reconcile programs the secondary IPs for the current metadata once, for
+// running without the daemon
+func Reconcile(c store.Store) error {
+	return newWatcher(c).onChange("")
+}
+
+type watcher struct {
+	pass sync.Mutex
+	sync.Mutex
+	c           store.Store
+	applied     map[string]Assignment
+	lastApplied time.Time
+}
+
+// Assignment is an additional address that should be configured on
+// a container's interface
+type Assignment struct {
+	ContainerID string
+	IP          string
+}
+
+func (a Assignment) key() string {
+	return a.ContainerID + "/" + a.IP
+}
+
+func (w *watcher) state() interface{} {
+	w.Lock()
+	defer w.Unlock()
+	return map[string]interface{}{
+		"applied":     w.applied,
+		"lastApplied": w.lastApplied,
+	}
+}
+
+func (w *watcher) onChangeNoError(version string) {
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply secondary IPs")
+	}
+}
+
+// reconcile makes one pass, with force set the secondary IPs are programmed
+// again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("floatingip", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
+func (w *watcher) onChange(version string) error {
+	host, err := w.c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+
+	services, err := w.c.GetServices()
+	if err != nil {
+		return err
+	}
+
+	containers, err := w.c.GetContainers()
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]Assignment{}
+	for _, container := range containers {
+		if container.HostUUID != host.UUID || container.State != "running" || container.ExternalId == "" {
+			continue
+		}
+		for _, ip := range splitIPs(container.Labels[secondaryIPsLabel]) {
+			a := Assignment{ContainerID: container.ExternalId, IP: ip}
+			desired[a.key()] = a
+		}
+	}
+
+	for _, service := range services {
+		ips := floatingIPs(service)
+		if len(ips) == 0 {
+			continue
+		}
+
+		backer, ok := backingContainer(service)
+		if !ok || backer.HostUUID != host.UUID {
+			continue
+		}
+
+		for _, ip := range ips {
+			a := Assignment{ContainerID: backer.ExternalId, IP: ip}
+			desired[a.key()] = a
+		}
+	}
+
+	if !reflect.DeepEqual(w.applied, desired) {
+		log.Infof("Applying new secondary IPs: %v", desired)
+		return w.apply(desired)
+	} else if time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
+		return w.apply(desired)
+	}
+
+	return nil
+}
+
+// backingContainer picks the oldest running container of the service so every
+// host agrees on where a floating IP lives
+func backingContainer(service metadata.Service) (metadata.Container, bool) {
+	var backer metadata.Container
+	found := false
+	for _, container := range service.Containers {
+		if container.State != "running" || container.ExternalId == "" {
+			continue
+		}
+		if !found || container.CreateIndex < backer.CreateIndex {
+			backer = container
+			found = true
+		}
+	}
+	return backer, found
+}
+
+func floatingIPs(service metadata.Service) []string {
+	var result []string
+	switch ips := service.Metadata[floatingIPsKey].(type) {
+	case string:
+		result = splitIPs(ips)
+	case []interface{}:
+		for _, ip := range ips {
+			if s, ok := ip.(string); ok {
+				result = append(result, splitIPs(s)...)
+			}
+		}
+	}
+	return result
+}
+
+func splitIPs(value string) []string {
+	var result []string
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		if !strings.Contains(ip, "/") {
+			ip += "/32"
+		}
+		if _, _, err := net.ParseCIDR(ip); err != nil {
+			log.Errorf("Ignoring invalid secondary IP %q: %v", ip, err)
+			continue
+		}
+		result = append(result, ip)
+	}
+	return result
+}
+
+func (w *watcher) apply(desired map[string]Assignment) error {
+	var lastErr error
+	for key, a := range w.applied {
+		if _, ok := desired[key]; ok || source.IsStale(w.c) {
+			continue
+		}
+		if err := w.configure(a, false); err != nil {
+			log.WithField(logging.ContainerIDKey, a.ContainerID).Errorf("Failed to remove %s from %s: %v", a.IP, a.ContainerID, err)
+		}
+	}
+
+	for _, a := range desired {
+		if err := w.configure(a, true); err != nil {
+			lastErr = errors.Wrapf(err, "adding %s to %s", a.IP, a.ContainerID)
+		}
+	}
+
+	if lastErr == nil {
+		w.Lock()
+		w.applied = desired
+		w.lastApplied = time.Now()
+		w.Unlock()
+	}
+
+	return lastErr
+}
+
+func (w *watcher) configure(a Assignment, add bool) error {
+	inspect, err := w.c.Inspect(a.ContainerID)
+	if client.IsErrContainerNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if inspect.State == nil || inspect.State.Pid == 0 {
+		return nil
+	}
+	pid := inspect.State.Pid
+
+	addr, err := netlink.ParseAddr(a.IP)
+	if err != nil {
+		return err
+	}
+
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := handle.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	present := false
+	for _, existing := range addrs {
+		if existing.IP.Equal(addr.IP) {
+			present = true
+			break
+		}
+	}
+
+	if !add {
+		if !present || audit.Would("floatingip", "addr.del", a.ContainerID+"/"+ifName, a.IP) {
+			return nil
+		}
+		log.WithField(logging.ContainerIDKey, a.ContainerID).Infof("Removing secondary IP %s from %s", a.IP, a.ContainerID)
+		err := handle.AddrDel(link, addr)
+		audit.Record("floatingip", "addr.del", a.ContainerID+"/"+ifName, a.IP, nil, err)
+		return err
+	}
+
+	if !present && audit.Would("floatingip", "addr.add", a.ContainerID+"/"+ifName, a.IP) {
+		return nil
+	}
+	if !present {
+		log.WithField(logging.ContainerIDKey, a.ContainerID).Infof("Adding secondary IP %s to %s", a.IP, a.ContainerID)
+		err := handle.AddrAdd(link, addr)
+		audit.Record("floatingip", "addr.add", a.ContainerID+"/"+ifName, nil, a.IP, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Announce every pass so peers that missed the first announcement
+	// eventually learn where the address lives
+	if audit.DryRun() {
+		return nil
+	}
+	return announce(pid, addr.IP)
+}
+
+// announce sends gratuitous ARP for ip from inside the container's network
+// namespace so neighbors update their caches after an address moves
+func announce(pid int, ip net.IP) error {
+	args := []string{"/usr/bin/nsenter", "-n", "-t", strconv.Itoa(pid), "--",
+		"arping", "-U", "-c", "2", "-I", ifName, ip.String()}
+	log.Debugf("Running %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gratuitous ARP for %s failed: %v", ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Package handoff passes in-memory state from the running instance to the
+// one replacing it over a local socket, so an upgrade starts warm rather
+// than rescanning and reconciling every container
+package handoff
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("handoff")
+
+// format changes whenever message does, a replacement only takes states
+// in the format it knows
+const format = 1
+
+var (
+	lock      sync.Mutex
+	exporters = map[string]func() interface{}{}
+	stoppers  []stopper
+	done      = make(chan struct{})
+)
+
+type stopper struct {
+	name         string
+	stop, resume func()
+}
+
+type request struct {
+	Format  int    `json:"format"`
+	Version string `json:"version"`
+}
+
+type message struct {
+	Format  int                        `json:"format"`
+	Version string                     `json:"version"`
+	States  map[string]json.RawMessage `json:"states"`
+}
+
+// Register adds name's state, as returned by export, to what is handed to
+// a replacement
+func Register(name string, export func() interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+	exporters[name] = export
+}
+
+// RegisterStop has stop keep subsystem name from changing the host or its
+// state before the states are exported, and resume undo it if the handoff
+// fails
+func RegisterStop(name string, stop, resume func()) {
+	lock.Lock()
+	defer lock.Unlock()
+	stoppers = append(stoppers, stopper{name: name, stop: stop, resume: resume})
+}
+
+// Done is closed once the state was handed off, the process should exit 0
+// and leave the host to the replacement
+func Done() <-chan struct{} {
+	return done
+}
+
+// Take asks the instance listening on path to hand over and exit,
+// returning its states by name. Without one listening it returns none.
+func Take(path, version string, timeout time.Duration) (map[string]json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		log.Debugf("No instance to take over from on %s: %v", path, err)
+		return nil, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(request{Format: format, Version: version}); err != nil {
+		return nil, err
+	}
+	var m message
+	if err := json.NewDecoder(conn).Decode(&m); err != nil {
+		return nil, fmt.Errorf("reading state from the running instance: %v", err)
+	}
+	if m.Format != format {
+		log.Warnf("Running instance %s hands off state format %d, want %d, starting cold", m.Version, m.Format, format)
+		return nil, nil
+	}
+	var names []string
+	for name := range m.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Infof("Took over from %s with the state of %v", m.Version, names)
+	return m.States, nil
+}
+
+// Serve listens on path for a replacement. The first to ask has the
+// subsystems stopped and is sent the registered states, then Done is
+// closed, leaving the host as it is for the replacement to carry on from.
+func Serve(path, version string) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.WithError(err).Error("Failed to accept handoff connection")
+				return
+			}
+			if handOff(conn, version) {
+				log.Info("Handed off to the new instance, exiting")
+				l.Close()
+				close(done)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// handOff answers one replacement, reporting whether it was sent the state
+func handOff(conn net.Conn, version string) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.WithError(err).Error("Failed to read handoff request")
+		return false
+	}
+	log.Infof("Instance %s is taking over", req.Version)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, s := range stoppers {
+		log.Infof("Stopping %s", s.name)
+		s.stop()
+	}
+	m := message{Format: format, Version: version, States: map[string]json.RawMessage{}}
+	for name, export := range exporters {
+		state, err := json.Marshal(export())
+		if err != nil {
+			log.WithError(err).Errorf("Failed to encode %s state, the new instance starts it cold", name)
+			continue
+		}
+		m.States[name] = state
+	}
+	if err := json.NewEncoder(conn).Encode(m); err != nil {
+		log.WithError(err).Error("Failed to hand off state, carrying on")
+		for i := len(stoppers) - 1; i >= 0; i-- {
+			stoppers[i].resume()
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WedgedAfter is how long a reconcile may run before the subsystem is
+// considered stuck and liveness fails
+var WedgedAfter = 10 * time.Minute
+
+// missedHeartbeats is how many beats a loop may miss before it's considered
+// dead
+const missedHeartbeats = 3
+
+var errPending = errors.New("not yet reported")
+
+var fatals = make(chan error, 1)
+
+var (
+	lock       sync.Mutex
+	subsystems = map[string]*subsystem{}
+	build      *Build
+)
+
+// Build identifies the running binary and what it was started with
+type Build struct {
+	Version    string   `json:"version"`
+	Commit     string   `json:"commit,omitempty"`
+	GoVersion  string   `json:"goVersion"`
+	Subsystems []string `json:"subsystems"`
+}
+
+// SetBuild reports b alongside the subsystem states
+func SetBuild(b Build) {
+	lock.Lock()
+	defer lock.Unlock()
+	build = &b
+}
+
+type subsystem struct {
+	err           error
+	fatal         bool
+	lastReport    time.Time
+	lastSuccess   time.Time
+	lastReconcile time.Time
+	running       time.Time
+	lastHeartbeat time.Time
+	every         time.Duration
+	goroutine     int
+}
+
+// Status is the reported state of one subsystem
+type Status struct {
+	OK               bool       `json:"ok"`
+	Live             bool       `json:"live"`
+	Error            string     `json:"error,omitempty"`
+	LastReport       *time.Time `json:"lastReport,omitempty"`
+	LastSuccess      *time.Time `json:"lastSuccess,omitempty"`
+	LastReconcile    *time.Time `json:"lastReconcile,omitempty"`
+	ReconcilingSince *time.Time `json:"reconcilingSince,omitempty"`
+	LastHeartbeat    *time.Time `json:"lastHeartbeat,omitempty"`
+}
+
+func get(name string) *subsystem {
+	s, ok := subsystems[name]
+	if !ok {
+		s = &subsystem{err: errPending}
+		subsystems[name] = s
+	}
+	return s
+}
+
+// Register lists a subsystem as not ready until it first reports
+func Register(name string) {
+	lock.Lock()
+	get(name)
+	lock.Unlock()
+}
+
+// Set records the current state of a subsystem, nil meaning healthy
+func Set(name string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	s := get(name)
+	s.err = err
+	s.fatal = false
+	s.lastReport = time.Now()
+	if err == nil {
+		s.lastSuccess = s.lastReport
+	}
+}
+
+// Succeeded returns nil once name has reported success, otherwise its last
+// error, so others can wait for its first good pass
+func Succeeded(name string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	s, ok := subsystems[name]
+	if !ok {
+		return errors.New("not started")
+	}
+	if !s.lastSuccess.IsZero() {
+		return nil
+	}
+	return s.err
+}
+
+// Fatal records an error the subsystem can't recover from without a
+// restart, failing liveness as well as readiness
+func Fatal(name string, err error) {
+	Set(name, err)
+	lock.Lock()
+	get(name).fatal = true
+	lock.Unlock()
+	select {
+	case fatals <- errors.New(name + ": " + err.Error()):
+	default:
+	}
+}
+
+// Fatals receives the first fatal error, for main to exit on
+func Fatals() <-chan error {
+	return fatals
+}
+
+// Begin marks the start of a reconcile. The returned func records its
+// result and must be called once it finishes.
+func Begin(name string) func(error) {
+	lock.Lock()
+	get(name).running = time.Now()
+	lock.Unlock()
+	return func(err error) {
+		Set(name, err)
+		lock.Lock()
+		s := get(name)
+		s.running = time.Time{}
+		s.lastReconcile = s.lastReport
+		lock.Unlock()
+	}
+}
+
+// Heartbeat records that the long-running loop name is still going and
+// expects to be called again within every. A loop that stops beating, say
+// because its goroutine died, fails liveness.
+func Heartbeat(name string, every time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	s, ok := subsystems[name]
+	if !ok {
+		s = &subsystem{}
+		subsystems[name] = s
+	}
+	s.lastHeartbeat = time.Now()
+	s.every = every
+	s.goroutine = goroutineID()
+}
+
+func goroutineID() int {
+	buf := make([]byte, 64)
+	// The trace starts "goroutine 18 [running]:"
+	fields := bytes.Fields(buf[:runtime.Stack(buf, false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.Atoi(string(fields[1]))
+	return id
+}
+
+// Beat is the last heartbeat of a long-running loop
+type Beat struct {
+	Last      time.Time
+	Every     time.Duration
+	Goroutine int
+}
+
+func (s *subsystem) missed(now time.Time) bool {
+	return s.every > 0 && now.Sub(s.lastHeartbeat) > missedHeartbeats*s.every
+}
+
+// Missed returns the loops that stopped beating by name
+func Missed() map[string]Beat {
+	lock.Lock()
+	defer lock.Unlock()
+	now := time.Now()
+	result := map[string]Beat{}
+	for name, s := range subsystems {
+		if s.missed(now) {
+			result[name] = Beat{
+				Last:      s.lastHeartbeat,
+				Every:     s.every,
+				Goroutine: s.goroutine,
+			}
+		}
+	}
+	return result
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *subsystem) status(now time.Time) Status {
+	status := Status{
+		OK:               s.err == nil,
+		Live:             !s.fatal,
+		LastReport:       timePtr(s.lastReport),
+		LastSuccess:      timePtr(s.lastSuccess),
+		LastReconcile:    timePtr(s.lastReconcile),
+		ReconcilingSince: timePtr(s.running),
+		LastHeartbeat:    timePtr(s.lastHeartbeat),
+	}
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+	if !s.running.IsZero() && now.Sub(s.running) > WedgedAfter {
+		status.OK = false
+		status.Live = false
+		if status.Error == "" {
+			status.Error = "reconcile running for " + now.Sub(s.running).String()
+		}
+	}
+	if s.missed(now) {
+		status.OK = false
+		status.Live = false
+		status.Error = "no heartbeat for " + now.Sub(s.lastHeartbeat).String()
+	}
+	return status
+}
+
+// Statuses returns the state of every subsystem by name
+func Statuses() map[string]Status {
+	lock.Lock()
+	defer lock.Unlock()
+	now := time.Now()
+	result := map[string]Status{}
+	for name, s := range subsystems {
+		result[name] = s.status(now)
+	}
+	return result
+}
+
+// Pending lists the registered subsystems that haven't reported yet
+func Pending() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	var pending []string
+	for name, s := range subsystems {
+		if s.err == errPending {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// Failing lists the subsystems that aren't ready, or with live set the ones
+// failing liveness
+func Failing(live bool) []string {
+	var failing []string
+	for name, status := range Statuses() {
+		if live && !status.Live || !live && !status.OK {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+func handler(live bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		failing := Failing(live)
+		lock.Lock()
+		b := build
+		lock.Unlock()
+		content, err := json.MarshalIndent(map[string]interface{}{
+			"ok":         len(failing) == 0,
+			"failing":    failing,
+			"subsystems": Statuses(),
+			"build":      b,
+		}, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if len(failing) > 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		rw.Write(append(content, '\n'))
+	})
+}
+
+// LiveHandler answers 503 when a subsystem is wedged or has failed for good,
+// meaning the process should be restarted
+func LiveHandler() http.Handler {
+	return handler(true)
+}
+
+// ReadyHandler answers 503 until every registered subsystem last reported
+// success
+func ReadyHandler() http.Handler {
+	return handler(false)
+}
@@ -0,0 +1,114 @@
+package hns
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Network is an HNS network, such as the transparent or l2bridge network
+// Docker created on the host
+type Network struct {
+	ID      string   `json:"Id"`
+	Name    string   `json:"Name"`
+	Type    string   `json:"Type"`
+	Subnets []Subnet `json:"Subnets,omitempty"`
+}
+
+// Subnet is one of a network's address ranges
+type Subnet struct {
+	AddressPrefix  string `json:"AddressPrefix"`
+	GatewayAddress string `json:"GatewayAddress,omitempty"`
+}
+
+// Endpoint is a container's interface on an HNS network
+type Endpoint struct {
+	ID             string `json:"Id,omitempty"`
+	Name           string `json:"Name"`
+	VirtualNetwork string `json:"VirtualNetwork"`
+	IPAddress      string `json:"IPAddress,omitempty"`
+	PrefixLength   uint8  `json:"PrefixLength,omitempty"`
+	GatewayAddress string `json:"GatewayAddress,omitempty"`
+	// SharedContainers are the containers the endpoint is attached to
+	SharedContainers []string `json:"SharedContainers,omitempty"`
+}
+
+func (e Endpoint) attachedTo(id string) bool {
+	for _, c := range e.SharedContainers {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+type attachRequest struct {
+	ContainerID string `json:"ContainerId"`
+	SystemType  string `json:"SystemType"`
+}
+
+// response wraps every HNS answer
+type response struct {
+	Success bool
+	Error   string
+	Output  json.RawMessage
+}
+
+// call sends a request to the HNS API and returns its answer, through
+// vmcompute.dll on Windows. Tests replace it.
+var call = hnsCall
+
+// request calls method on path with in as the body and decodes the output
+// into out, either may be nil
+func request(method, path string, in, out interface{}) error {
+	body := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = string(b)
+	}
+	answer, err := call(method, path, body)
+	if err != nil {
+		return fmt.Errorf("HNS %s %s: %v", method, path, err)
+	}
+	var r response
+	if err := json.Unmarshal([]byte(answer), &r); err != nil {
+		return fmt.Errorf("HNS %s %s: reading answer: %v", method, path, err)
+	}
+	if !r.Success {
+		return fmt.Errorf("HNS %s %s: %s", method, path, r.Error)
+	}
+	if out == nil || len(r.Output) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Output, out)
+}
+
+func networks() ([]Network, error) {
+	var result []Network
+	return result, request("GET", "/networks/", nil, &result)
+}
+
+func endpoints() ([]Endpoint, error) {
+	var result []Endpoint
+	return result, request("GET", "/endpoints/", nil, &result)
+}
+
+func createEndpoint(e Endpoint) (Endpoint, error) {
+	var created Endpoint
+	return created, request("POST", "/endpoints/", e, &created)
+}
+
+func deleteEndpoint(id string) error {
+	return request("DELETE", "/endpoints/"+id, nil, nil)
+}
+
+// attach adds the endpoint to the container's network compartment
+func attach(endpointID, containerID string) error {
+	return request("POST", "/endpoints/"+endpointID+"/attach", attachRequest{ContainerID: containerID, SystemType: "Container"}, nil)
+}
+
+func detach(endpointID, containerID string) error {
+	return request("POST", "/endpoints/"+endpointID+"/detach", attachRequest{ContainerID: containerID, SystemType: "Container"}, nil)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package hns
+
+import "errors"
+
+func hnsCall(method, path, request string) (string, error) {
+	return "", errors.New("HNS is only on Windows")
+}
@@ -0,0 +1,51 @@
+package hns
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	modvmcompute      = syscall.NewLazyDLL("vmcompute.dll")
+	modole32          = syscall.NewLazyDLL("ole32.dll")
+	procHNSCall       = modvmcompute.NewProc("HNSCall")
+	procCoTaskMemFree = modole32.NewProc("CoTaskMemFree")
+)
+
+// hnsCall calls vmcompute.dll's HNSCall, whose answer is a UTF-16 string
+// it allocated
+func hnsCall(method, path, request string) (string, error) {
+	if err := procHNSCall.Find(); err != nil {
+		return "", err
+	}
+	m, err := syscall.UTF16PtrFromString(method)
+	if err != nil {
+		return "", err
+	}
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	r, err := syscall.UTF16PtrFromString(request)
+	if err != nil {
+		return "", err
+	}
+	var answer *uint16
+	hr, _, _ := syscall.Syscall6(procHNSCall.Addr(), 4,
+		uintptr(unsafe.Pointer(m)), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(r)), uintptr(unsafe.Pointer(&answer)), 0, 0)
+	if int32(hr) < 0 {
+		return "", fmt.Errorf("HNSCall failed with HRESULT 0x%08x", uint32(hr))
+	}
+	if answer == nil {
+		return "", nil
+	}
+	defer procCoTaskMemFree.Call(uintptr(unsafe.Pointer(answer)))
+	chars := (*[1 << 29]uint16)(unsafe.Pointer(answer))
+	n := 0
+	for chars[n] != 0 {
+		n++
+	}
+	return string(utf16.Decode(chars[:n:n])), nil
+}
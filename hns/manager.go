@@ -0,0 +1,243 @@
+// Package hns networks containers on Windows hosts through the Host
+// Networking Service, where Linux hosts use network's CNI plugins. Each
+// managed container gets an endpoint with its Rancher IP on the host's HNS
+// network, attached when it starts and removed once it's gone.
+package hns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/store"
+)
+
+var log = logging.Subsystem("hns")
+
+// The labels network manages containers by, its package doesn't build on
+// Windows
+const (
+	ipLabel               = "io.rancher.container.ip"
+	legacyManagedNetLabel = "io.rancher.container.network"
+	cniLabel              = "io.rancher.cni.network"
+)
+
+// endpointPrefix names the endpoints plugin-manager created, followed by
+// the container's ID
+const endpointPrefix = "rancher-"
+
+// Manager attaches managed containers to endpoints on one HNS network
+type Manager struct {
+	rt      engine.Runtime
+	store   store.Store
+	network string
+
+	lock sync.Mutex
+	// started is each attached container's start, a restart attaches again
+	started map[string]string
+}
+
+// NewManager networks the containers of rt on the HNS network named
+// network, reading IPs missing from their labels from st
+func NewManager(rt engine.Runtime, st store.Store, network string) *Manager {
+	return &Manager{
+		rt:      rt,
+		store:   st,
+		network: network,
+		started: map[string]string{},
+	}
+}
+
+// Evaluate attaches a running managed container to its endpoint and
+// removes the endpoint of one that stopped or is gone
+func (m *Manager) Evaluate(ctx context.Context, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c, err := m.rt.Inspect(ctx, id)
+	if err == engine.ErrNotFound || err == nil && !c.Running {
+		return m.release(id)
+	} else if err != nil {
+		return err
+	}
+	if !managed(c.Labels) {
+		return nil
+	}
+	if started, ok := m.started[id]; ok && started == c.Started {
+		return nil
+	}
+
+	ip, prefix, err := m.address(c)
+	if err != nil {
+		return err
+	}
+	network, err := m.hnsNetwork()
+	if err != nil {
+		return err
+	}
+	e, err := m.endpoint(id, network, ip, prefix)
+	if err != nil {
+		return err
+	}
+	if !e.attachedTo(id) {
+		if err := attach(e.ID, id); err != nil {
+			return err
+		}
+	}
+	m.started[id] = c.Started
+	log.WithFields(logrus.Fields{
+		logging.ContainerIDKey: id,
+		"endpoint":             e.ID,
+		"ip":                   ip,
+	}).Info("Attached HNS endpoint")
+	return nil
+}
+
+func managed(labels map[string]string) bool {
+	return labels[cniLabel] != "" || labels[legacyManagedNetLabel] == "true" || labels[ipLabel] != ""
+}
+
+// address is the container's IP and prefix length from its label, or its
+// primary IP in metadata on the network's own prefix
+func (m *Manager) address(c engine.Container) (string, uint8, error) {
+	if label := c.Labels[ipLabel]; label != "" {
+		ip, ipNet, err := net.ParseCIDR(label)
+		if err != nil {
+			return "", 0, fmt.Errorf("reading %s %q: %v", ipLabel, label, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		return ip.String(), uint8(ones), nil
+	}
+	containers, err := m.store.GetContainers()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, container := range containers {
+		if container.ExternalId == c.ID && container.PrimaryIp != "" {
+			return container.PrimaryIp, 0, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no IP for %s in metadata yet", c.ID)
+}
+
+func (m *Manager) hnsNetwork() (Network, error) {
+	list, err := networks()
+	if err != nil {
+		return Network{}, err
+	}
+	for _, n := range list {
+		if n.Name == m.network {
+			return n, nil
+		}
+	}
+	return Network{}, fmt.Errorf("no HNS network %q, create it with docker network create -d transparent %s", m.network, m.network)
+}
+
+// endpoint returns the container's endpoint, replacing one left with
+// another IP or on another network
+func (m *Manager) endpoint(id string, network Network, ip string, prefix uint8) (Endpoint, error) {
+	existing, err := endpoints()
+	if err != nil {
+		return Endpoint{}, err
+	}
+	name := endpointPrefix + id
+	for _, e := range existing {
+		if e.Name != name {
+			continue
+		}
+		if e.VirtualNetwork == network.ID && e.IPAddress == ip {
+			return e, nil
+		}
+		if err := m.remove(e, id); err != nil {
+			return Endpoint{}, err
+		}
+	}
+	return createEndpoint(Endpoint{
+		Name:           name,
+		VirtualNetwork: network.ID,
+		IPAddress:      ip,
+		PrefixLength:   prefix,
+	})
+}
+
+// release removes the container's endpoint, if it has one
+func (m *Manager) release(id string) error {
+	existing, err := endpoints()
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.Name == endpointPrefix+id {
+			if err := m.remove(e, id); err != nil {
+				return err
+			}
+		}
+	}
+	delete(m.started, id)
+	return nil
+}
+
+// remove detaches and deletes an endpoint. A container that's gone is
+// already detached.
+func (m *Manager) remove(e Endpoint, id string) error {
+	if e.attachedTo(id) {
+		if err := detach(e.ID, id); err != nil {
+			log.WithField(logging.ContainerIDKey, id).Warnf("Failed to detach HNS endpoint %s, deleting it: %v", e.ID, err)
+		}
+	}
+	if err := deleteEndpoint(e.ID); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		logging.ContainerIDKey: id,
+		"endpoint":             e.ID,
+		"ip":                   e.IPAddress,
+	}).Info("Removed HNS endpoint")
+	return nil
+}
+
+// Reconcile evaluates every running container and removes the endpoints
+// of containers no longer running
+func (m *Manager) Reconcile() error {
+	ctx := context.Background()
+	containers, err := m.rt.List(ctx)
+	if err != nil {
+		return err
+	}
+	running := map[string]bool{}
+	var lastErr error
+	for _, c := range containers {
+		if !c.Running {
+			continue
+		}
+		running[c.ID] = true
+		if err := m.Evaluate(ctx, c.ID); err != nil {
+			log.WithField(logging.ContainerIDKey, c.ID).Errorf("Failed to network %s: %v", c.ID, err)
+			lastErr = err
+		}
+	}
+
+	existing, err := endpoints()
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		id := strings.TrimPrefix(e.Name, endpointPrefix)
+		if id == e.Name || running[id] {
+			continue
+		}
+		m.lock.Lock()
+		err := m.remove(e, id)
+		delete(m.started, id)
+		m.lock.Unlock()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
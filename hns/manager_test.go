@@ -0,0 +1,175 @@
+package hns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+	"github.com/rancher/plugin-manager/store"
+)
+
+// fakeHNS answers the HNS API from memory, a transparent network and the
+// endpoints created on it
+type fakeHNS struct {
+	endpoints map[string]Endpoint
+	next      int
+}
+
+func (f *fakeHNS) call(method, path, request string) (string, error) {
+	var output interface{}
+	switch {
+	case method == "GET" && path == "/networks/":
+		output = []Network{{ID: "net1", Name: "transparent", Type: "Transparent"}}
+	case method == "GET" && path == "/endpoints/":
+		var list []Endpoint
+		for _, e := range f.endpoints {
+			list = append(list, e)
+		}
+		output = list
+	case method == "POST" && path == "/endpoints/":
+		var e Endpoint
+		if err := json.Unmarshal([]byte(request), &e); err != nil {
+			return "", err
+		}
+		f.next++
+		e.ID = fmt.Sprintf("ep%d", f.next)
+		f.endpoints[e.ID] = e
+		output = e
+	case method == "DELETE" && strings.HasPrefix(path, "/endpoints/"):
+		delete(f.endpoints, strings.TrimPrefix(path, "/endpoints/"))
+	case method == "POST" && strings.HasSuffix(path, "/attach"), method == "POST" && strings.HasSuffix(path, "/detach"):
+		var r attachRequest
+		if err := json.Unmarshal([]byte(request), &r); err != nil {
+			return "", err
+		}
+		id := strings.Split(path, "/")[2]
+		e, ok := f.endpoints[id]
+		if !ok {
+			return `{"Success":false,"Error":"Endpoint not found"}`, nil
+		}
+		if strings.HasSuffix(path, "/attach") {
+			e.SharedContainers = append(e.SharedContainers, r.ContainerID)
+		} else {
+			e.SharedContainers = nil
+		}
+		f.endpoints[id] = e
+	default:
+		return "", fmt.Errorf("unexpected %s %s", method, path)
+	}
+	b, err := json.Marshal(output)
+	if err != nil {
+		return "", err
+	}
+	return `{"Success":true,"Output":` + string(b) + `}`, nil
+}
+
+// attached is each endpoint's name, IP and containers
+func (f *fakeHNS) attached() []string {
+	var result []string
+	for _, e := range f.endpoints {
+		result = append(result, fmt.Sprintf("%s %s/%d %v", e.Name, e.IPAddress, e.PrefixLength, e.SharedContainers))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// runtime is an engine.Runtime over a fixed set of containers
+type runtime struct {
+	containers []engine.Container
+}
+
+func (r *runtime) Name() string { return "test" }
+
+func (r *runtime) List(ctx context.Context) ([]engine.Container, error) {
+	return r.containers, nil
+}
+
+func (r *runtime) Inspect(ctx context.Context, id string) (engine.Container, error) {
+	for _, c := range r.containers {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return engine.Container{}, engine.ErrNotFound
+}
+
+func (r *runtime) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	return nil
+}
+
+func (r *runtime) Remove(ctx context.Context, id string) error {
+	return nil
+}
+
+func (r *runtime) Events(ctx context.Context) (<-chan engine.Event, error) {
+	return nil, errors.New("no events")
+}
+
+func TestEvaluate(t *testing.T) {
+	f := &fakeHNS{endpoints: map[string]Endpoint{
+		"old": {ID: "old", Name: "rancher-gone", VirtualNetwork: "net1", IPAddress: "10.42.0.9"},
+		"nat": {ID: "nat", Name: "docker-nat", VirtualNetwork: "nat1"},
+	}}
+	defer func(c func(string, string, string) (string, error)) { call = c }(call)
+	call = f.call
+
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Containers: []metadata.Container{
+			{Name: "db", ExternalId: "db", HostUUID: "host1", State: "running", PrimaryIp: "10.42.0.4"},
+		},
+	})
+	defer server.Close()
+	rt := &runtime{containers: []engine.Container{
+		{ID: "web", Running: true, Started: "1", Labels: map[string]string{cniLabel: "managed", ipLabel: "10.42.0.3/16"}},
+		{ID: "db", Running: true, Started: "1", Labels: map[string]string{legacyManagedNetLabel: "true"}},
+		{ID: "plain", Running: true, Started: "1"},
+	}}
+	m := NewManager(rt, store.New(server.Source(source.RancherOptions{}), nil), "transparent")
+
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"docker-nat /0 []", "rancher-db 10.42.0.4/0 [db]", "rancher-web 10.42.0.3/16 [web]"}
+	if got := f.attached(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reconciled endpoints %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		change func([]engine.Container)
+		want   []string
+	}{
+		{"unchanged", func([]engine.Container) {}, want},
+		{"new IP", func(cs []engine.Container) {
+			cs[0].Labels = map[string]string{ipLabel: "10.42.0.5/16"}
+			cs[0].Started = "2"
+		}, []string{"docker-nat /0 []", "rancher-db 10.42.0.4/0 [db]", "rancher-web 10.42.0.5/16 [web]"}},
+		{"stopped", func(cs []engine.Container) { cs[0].Running = false }, []string{"docker-nat /0 []", "rancher-db 10.42.0.4/0 [db]"}},
+	}
+	for _, test := range tests {
+		test.change(rt.containers)
+		if err := m.Evaluate(context.Background(), "web"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if got := f.attached(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: endpoints %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	m.network = "l2bridge"
+	rt.containers[0].Running = true
+	if err := m.Evaluate(context.Background(), "web"); err == nil {
+		t.Errorf("networked on a missing HNS network")
+	}
+}
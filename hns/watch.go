@@ -0,0 +1,64 @@
+package hns
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+)
+
+// Watch networks the containers of rt on the HNS network as the runtime
+// reports them starting and dying, checking every one when metadata
+// changes. It fails when the network doesn't exist.
+func Watch(rt engine.Runtime, st store.Store, network string) (*Manager, error) {
+	m := NewManager(rt, st, network)
+	if _, err := m.hnsNetwork(); err != nil {
+		return nil, err
+	}
+	health.Register("hns")
+	admin.RegisterReconcile("hns", m.Reconcile)
+	go st.OnChange(source.IntervalSeconds, m.onChange)
+	go m.followEvents()
+	return m, nil
+}
+
+func (m *Manager) onChange(version string) {
+	err := m.Reconcile()
+	if err != nil {
+		log.Errorf("Failed to reconcile HNS endpoints: %v", err)
+	}
+	health.Set("hns", err)
+}
+
+// followEvents evaluates each container the runtime starts or stops
+// straight away. A broken stream is followed again after a backoff.
+func (m *Manager) followEvents() {
+	defer crash.Recover()
+	b := &backoff.Backoff{
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+		Factor: 2,
+	}
+	for {
+		events, err := m.rt.Events(context.Background())
+		if err != nil {
+			log.WithError(err).Errorf("Failed to follow %s events", m.rt.Name())
+		} else {
+			for event := range events {
+				b.Reset()
+				if err := m.Evaluate(context.Background(), event.ID); err != nil {
+					log.WithField(logging.ContainerIDKey, event.ID).Errorf("Failed to network %s after %s: %v", event.ID, event.Status, err)
+				}
+			}
+			log.Warnf("%s event stream closed, following it again", m.rt.Name())
+		}
+		time.Sleep(b.Duration())
+	}
+}
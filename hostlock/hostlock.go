@@ -0,0 +1,80 @@
+// Package hostlock keeps a second plugin-manager on the host, such as one
+// started while an upgrade overlaps the old one, from changing the host
+// alongside the first
+package hostlock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("hostlock")
+
+// retryEvery is how often a held lock is tried again while waiting
+const retryEvery = time.Second
+
+// HeldError is returned by Acquire when another process kept the lock
+type HeldError struct {
+	Path   string
+	Holder string
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("%s is held by %s, refusing to run alongside another plugin-manager", e.Path, e.Holder)
+}
+
+// Acquire takes an advisory lock on path, waiting up to wait for another
+// instance holding it to exit. The lock is released when the process exits.
+func Acquire(path string, wait time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %v", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, &HeldError{Path: path, Holder: holder(path)}
+		}
+		if !logged {
+			log.Warnf("%s is held by %s, waiting up to %v for it to exit", path, holder(path), wait)
+			logged = true
+		}
+		time.Sleep(retryEvery)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// holder names the process holding path by the pid it wrote, which is only
+// meaningful in its own PID namespace, such as inside its container
+func holder(path string) string {
+	if content, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return "pid " + strings.TrimSpace(string(content)) + " in its PID namespace"
+	}
+	return "another process"
+}
@@ -3,36 +3,99 @@ package hostnat
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cleanup"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/iptables"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/watchdog"
 )
 
+var log = logging.Subsystem("hostnat")
+
 var (
-	reapplyEvery = 5 * time.Minute
-	natChain     = "CATTLE_NAT_POSTROUTING"
+	applySeconds = metrics.NewHistogram("plugin_manager_hostnat_apply_seconds",
+		"Time spent programming host NAT iptables rules")
+	applies = metrics.NewCounter("plugin_manager_hostnat_applies_total",
+		"iptables-restore runs for host NAT rules, by result", "result")
+
+	// ReapplyEvery is how often NAT rules are programmed again when nothing
+	// changed
+	ReapplyEvery = config.NewDuration(5 * time.Minute)
+	// DriftCheckEvery is how often the live rules are compared against the
+	// programmed ones
+	DriftCheckEvery = time.Minute
+	natChain        = "CATTLE_NAT_POSTROUTING"
+
+	snatExclusionsKey = "snatExclusions"
 )
 
 // Watch is used to look for changes in metadata and apply hostnat related rules
-func Watch(c metadata.Client) error {
-	w := &watcher{
+func Watch(c source.MetadataSource) error {
+	w := newWatcher(c)
+	health.Register("hostnat")
+	handoff.RegisterStop("hostnat", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("hostnat", func() error { return w.reconcile("", true) })
+	admin.RegisterState("hostnat", w.state)
+	cleanup.Register("hostnat", w.cleanup)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	watchdog.Go("hostnat.drift", func() { w.drift.Watch(DriftCheckEvery) })
+	return nil
+}
+
+// chains are the chains hostnat owns
+var chains = []iptables.Chain{{Table: "nat", Name: natChain, Parent: "POSTROUTING"}}
+
+func newWatcher(c source.MetadataSource) *watcher {
+	return &watcher{
 		c:       c,
 		applied: map[string]MASQRule{},
+		drift: &iptables.Drift{
+			Subsystem: "hostnat",
+			Chains:    chains,
+		},
 	}
-	go c.OnChange(5, w.onChangeNoError)
-	return nil
+}
+
+// cleanup removes the NAT chain, keeping the pass lock so no later pass
+// programs it again
+func (w *watcher) cleanup() error {
+	w.pass.Lock()
+	return w.drift.Remove()
+}
+
+// Reconcile programs the NAT rules for the current metadata once, for
+// running without the daemon
+func Reconcile(c source.MetadataSource) error {
+	return newWatcher(c).onChange("")
 }
 
 type watcher struct {
-	c           metadata.Client
+	pass sync.Mutex
+	sync.Mutex
+	c           source.MetadataSource
 	applied     map[string]MASQRule
 	lastApplied time.Time
+	drift       *iptables.Drift
 }
 
 // MASQRule is used to store the needed information for building
@@ -40,10 +103,16 @@ type watcher struct {
 type MASQRule struct {
 	Subnet string
 	Bridge string
+	// Exclusions are destination CIDRs that should see the container's
+	// real IP instead of being masqueraded
+	Exclusions []string
 }
 
 func (p MASQRule) iptables() []byte {
 	buf := &bytes.Buffer{}
+	for _, cidr := range p.Exclusions {
+		buf.WriteString(fmt.Sprintf("-A %s -s %s -d %s -j RETURN\n", natChain, p.Subnet, cidr))
+	}
 	buf.WriteString(fmt.Sprintf("-A %s -p tcp -s %s ! -o %s -j MASQUERADE --to-ports 1024-65535\n", natChain, p.Subnet, p.Bridge))
 	buf.WriteString(fmt.Sprintf("-A %s -p udp -s %s ! -o %s -j MASQUERADE --to-ports 1024-65535\n", natChain, p.Subnet, p.Bridge))
 	buf.WriteString(fmt.Sprintf("-A %s -s %s ! -o %s -j MASQUERADE\n", natChain, p.Subnet, p.Bridge))
@@ -64,32 +133,71 @@ func (p MASQRule) localRoutingSetting() string {
 
 func (w *watcher) insertBaseRules() error {
 	if w.run("iptables", "-w", "-t", "nat", "-C", "POSTROUTING", "-j", natChain) != nil {
-		return w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", "-j", natChain)
+		return w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", iptables.InsertAt("nat", "POSTROUTING"), "-j", natChain)
 	}
 	return nil
 }
 
 func (w *watcher) run(args ...string) error {
-	logrus.Debugf("Running %s", strings.Join(args, " "))
+	log.Debugf("Running %s", strings.Join(args, " "))
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+func (w *watcher) state() interface{} {
+	w.Lock()
+	defer w.Unlock()
+	return map[string]interface{}{
+		"applied":     w.applied,
+		"lastApplied": w.lastApplied,
+	}
+}
+
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply host rules: %v", err)
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply host rules")
 	}
 }
 
-func (w *watcher) onChange(version string) error {
-	logrus.Debug("Evaluating NAT host rules")
+// reconcile makes one pass, with force set the NAT rules are programmed
+// again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("hostnat", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
+// Plan returns how the live rules differ from those that would be applied
+// for the current metadata, without changing anything on the host
+func Plan(c source.MetadataSource) (string, error) {
+	w := &watcher{c: c}
+	rules, err := w.desiredRules()
+	if err != nil {
+		return "", err
+	}
+	return iptables.PlanDiff(chains, restoreInput(rules).String())
+}
+
+func (w *watcher) desiredRules() (map[string]MASQRule, error) {
 	newRules := map[string]MASQRule{}
 
+	self, err := w.c.GetSelfHost()
+	if err != nil {
+		return nil, err
+	}
+	if !source.Overrides(self).HostNAT {
+		log.Debugf("Host NAT disabled by %s", source.HostNATLabel)
+		return newRules, nil
+	}
+
 	networks, err := w.c.GetNetworks()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, network := range networks {
@@ -99,15 +207,25 @@ func (w *watcher) onChange(version string) error {
 		}
 	}
 
-	logrus.Debugf("New generated nat rules: %v", newRules)
+	return newRules, nil
+}
+
+func (w *watcher) onChange(version string) error {
+	log.Debug("Evaluating NAT host rules")
+	newRules, err := w.desiredRules()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("New generated nat rules: %v", newRules)
 	if !reflect.DeepEqual(w.applied, newRules) {
-		logrus.Infof("Applying new nat rules")
+		log.Infof("Applying new nat rules")
 		return w.apply(newRules)
-	} else if time.Now().Sub(w.lastApplied) > reapplyEvery {
+	} else if time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
 		return w.apply(newRules)
 	}
 
-	logrus.Debugf("No change in applied nat rules")
+	log.Debugf("No change in applied nat rules")
 	return nil
 }
 
@@ -122,8 +240,9 @@ func (w *watcher) networkToRule(network metadata.Network) *MASQRule {
 
 		if hostNat && cniType == "rancher-bridge" && bridge != "" && bridgeSubnet != "" {
 			return &MASQRule{
-				Subnet: bridgeSubnet,
-				Bridge: bridge,
+				Subnet:     bridgeSubnet,
+				Bridge:     bridge,
+				Exclusions: snatExclusions(network, props),
 			}
 		}
 	}
@@ -131,14 +250,55 @@ func (w *watcher) networkToRule(network metadata.Network) *MASQRule {
 	return nil
 }
 
+// snatExclusions reads the CIDRs that bypass masquerading from either the
+// network's metadata or its cni config as a list or comma separated string
+func snatExclusions(network metadata.Network, props map[string]interface{}) []string {
+	var result []string
+	for _, value := range []interface{}{network.Metadata[snatExclusionsKey], props[snatExclusionsKey]} {
+		var cidrs []string
+		switch v := value.(type) {
+		case string:
+			cidrs = strings.Split(v, ",")
+		case []interface{}:
+			for _, cidr := range v {
+				if s, ok := cidr.(string); ok {
+					cidrs = append(cidrs, s)
+				}
+			}
+		}
+
+		for _, cidr := range cidrs {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				log.Errorf("Ignoring invalid SNAT exclusion %q for network %s: %v", cidr, network.Name, err)
+				continue
+			}
+			result = append(result, cidr)
+		}
+	}
+
+	return result
+}
+
 func (w *watcher) enableLocalNetRouting(rules map[string]MASQRule) error {
 	for _, rule := range rules {
 		s := rule.localRoutingSetting()
 		if s != "" {
-			logrus.Debugf("s: %v", s)
+			log.Debugf("s: %v", s)
+			key, value := splitSysctl(s)
+			before := sysctlValue(key)
+			if before != value && audit.Would("hostnat", "sysctl.set", key, value) {
+				continue
+			}
 			err := w.run("sysctl", "-w", s)
+			if before != value {
+				audit.Record("hostnat", "sysctl.set", key, before, value, err)
+			}
 			if err != nil {
-				logrus.Errorf("error enabling local net routing: %v", err)
+				log.WithError(err).Error("error enabling local net routing")
 				return nil
 			}
 		}
@@ -147,11 +307,24 @@ func (w *watcher) enableLocalNetRouting(rules map[string]MASQRule) error {
 	return nil
 }
 
-func (w *watcher) apply(rules map[string]MASQRule) error {
-	if err := w.enableLocalNetRouting(rules); err != nil {
-		return err
+func splitSysctl(setting string) (string, string) {
+	parts := strings.SplitN(setting, "=", 2)
+	if len(parts) != 2 {
+		return setting, ""
 	}
+	return parts[0], parts[1]
+}
+
+// sysctlValue reads a setting from /proc/sys, empty if it can't be read
+func sysctlValue(key string) string {
+	content, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
 
+func restoreInput(rules map[string]MASQRule) *bytes.Buffer {
 	buf := &bytes.Buffer{}
 	buf.WriteString(fmt.Sprintf("*nat\n:%s -\n-F %s\n", natChain, natChain))
 	for _, rule := range rules {
@@ -160,25 +333,57 @@ func (w *watcher) apply(rules map[string]MASQRule) error {
 	}
 
 	buf.WriteString("\nCOMMIT\n")
+	return buf
+}
+
+// apply programs rules and records the result as the drift baseline
+func (w *watcher) apply(rules map[string]MASQRule) error {
+	return w.drift.Apply(func() error { return w.program(rules) })
+}
+
+func (w *watcher) program(rules map[string]MASQRule) error {
+	if err := w.enableLocalNetRouting(rules); err != nil {
+		return err
+	}
+
+	buf := restoreInput(rules)
 
 	if logrus.GetLevel() == logrus.DebugLevel {
 		fmt.Printf("Applying rules\n%s", buf)
 	}
+	if audit.Would("hostnat", "iptables.restore", "rules", "\n"+buf.String()) {
+		w.Lock()
+		w.applied = rules
+		w.lastApplied = time.Now()
+		w.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		applySeconds.Observe(metrics.Since(start))
+	}()
 
 	cmd := exec.Command("iptables-restore", "-n")
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = buf
 	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Failed to apply rules\n%s", buf)
+		applies.Inc("error")
+		alerts.Failed("hostnat", err)
+		log.Errorf("Failed to apply rules\n%s", buf)
 		return err
 	}
+	applies.Inc("ok")
+	alerts.Succeeded("hostnat")
 
 	if err := w.insertBaseRules(); err != nil {
 		return errors.Wrap(err, "Installing base rules")
 	}
 
+	w.Lock()
 	w.applied = rules
 	w.lastApplied = time.Now()
+	w.Unlock()
 	return nil
 }
@@ -6,46 +6,133 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cleanup"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/iptables"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/rootless"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/watchdog"
 )
 
+var log = logging.Subsystem("hostports")
+
 var (
-	reapplyEvery              = 5 * time.Minute
+	applySeconds = metrics.NewHistogram("plugin_manager_hostports_apply_seconds",
+		"Time spent programming host port iptables rules")
+	applies = metrics.NewCounter("plugin_manager_hostports_applies_total",
+		"iptables-restore runs for host port rules, by result", "result")
+
+	// ReapplyEvery is how often host port rules are programmed again when
+	// nothing changed
+	ReapplyEvery = config.NewDuration(5 * time.Minute)
+	// DriftCheckEvery is how often the live rules are compared against the
+	// programmed ones
+	DriftCheckEvery           = time.Minute
 	hostPortsLabel            = "io.rancher.network.host_ports"
 	hostPortsPostRoutingChain = "CATTLE_HOSTPORTS_POSTROUTING"
 )
 
+// PortDriver publishes the host ports instead of iptables when set, under
+// rootless Docker whose containers the host's iptables can't reach
+var PortDriver *rootless.PortDriver
+
 // Watch is used to monitor metadata for changes
-func Watch(c metadata.Client) error {
-	w := &watcher{
+func Watch(c store.Store) error {
+	w := newWatcher(c)
+
+	health.Register("hostports")
+	handoff.RegisterStop("hostports", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("hostports", func() error { return w.reconcile("", true) })
+	admin.RegisterState("hostports", w.state)
+	cleanup.Register("hostports", w.cleanup)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	if PortDriver == nil {
+		watchdog.Go("hostports.drift", func() { w.drift.Watch(DriftCheckEvery) })
+	}
+	return nil
+}
+
+func newWatcher(c store.Store) *watcher {
+	return &watcher{
 		c:       c,
+		docker:  c,
 		applied: map[string]PortRule{},
+		drift: &iptables.Drift{
+			Subsystem: "hostports",
+			Chains:    chains,
+		},
 	}
+}
 
-	go c.OnChange(5, w.onChangeNoError)
-	return nil
+// chains are the chains hostports owns
+var chains = []iptables.Chain{
+	{Table: "nat", Name: "CATTLE_PREROUTING", Parent: "PREROUTING"},
+	{Table: "nat", Name: "CATTLE_OUTPUT", Parent: "OUTPUT"},
+	{Table: "nat", Name: hostPortsPostRoutingChain, Parent: "POSTROUTING"},
+	{Table: "filter", Name: "CATTLE_FORWARD", Parent: "FORWARD"},
+}
+
+// cleanup removes the host port chains, keeping the pass lock so no later
+// pass programs them again
+func (w *watcher) cleanup() error {
+	w.pass.Lock()
+	if PortDriver != nil {
+		return PortDriver.Remove()
+	}
+	err := w.drift.Remove()
+	// Still created for migrations from older versions
+	legacy := &iptables.Drift{
+		Subsystem: "hostports",
+		Chains:    []iptables.Chain{{Table: "nat", Name: "CATTLE_POSTROUTING"}},
+	}
+	if legacyErr := legacy.Remove(); err == nil {
+		err = legacyErr
+	}
+	return err
+}
+
+// Reconcile programs the host port rules for the current metadata
+// once, for running without the daemon
+func Reconcile(c store.Store) error {
+	return newWatcher(c).onChange("")
 }
 
 type watcher struct {
-	c           metadata.Client
+	pass sync.Mutex
+	sync.Mutex
+	c           source.MetadataSource
+	docker      store.Store
 	applied     map[string]PortRule
 	lastApplied time.Time
+	drift       *iptables.Drift
 }
 
 // PortRule is used to store the needed information for building a
 // iptables rule
 type PortRule struct {
-	Bridge     string
-	SourceIP   string
-	SourcePort string
-	TargetIP   string
-	TargetPort string
-	Protocol   string
+	Bridge       string
+	BridgeSubnet string
+	SourceIP     string
+	SourcePort   string
+	TargetIP     string
+	TargetPort   string
+	Protocol     string
 }
 
 func (p PortRule) prefix() []byte {
@@ -73,6 +160,8 @@ func (p PortRule) iptables() []byte {
 	// We use mark 4200.  It is important whatever mark we use that the 0x8000 and 0x4000 bits are unset.
 	// Those bits are used by k8s and will conflict.
 	buf := &bytes.Buffer{}
+	// Bridge traffic is marked before a DNAT rule ends its traversal
+	buf.Write(p.hairpinMark())
 	buf.Write(p.prefix())
 	buf.WriteString(" -j MARK --set-mark 4200\n")
 
@@ -96,61 +185,137 @@ func (p PortRule) iptables() []byte {
 	buf.WriteString(fmt.Sprintf("\n-A %s -s %v -d %v -p %v -m %v --dport %v -j MASQUERADE",
 		hostPortsPostRoutingChain, p.TargetIP, p.TargetIP, p.Protocol, p.Protocol, p.TargetPort))
 
+	buf.Write(p.hairpinMasquerade())
+
 	return buf.Bytes()
 }
 
+// hairpinMark and hairpinMasquerade allow containers on the bridge to reach
+// a sibling through the host IP and published port. Without masquerading,
+// the sibling replies directly over the bridge and the caller drops the
+// reply from an unexpected source. The mark must come ahead of the DNAT
+// rules, which are terminating.
+func (p PortRule) hairpinMark() []byte {
+	if p.Bridge == "" || p.BridgeSubnet == "" {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("-A CATTLE_PREROUTING -i %v -s %v -p %v", p.Bridge, p.BridgeSubnet, p.Protocol))
+	if p.SourceIP != "0.0.0.0" {
+		buf.WriteString(fmt.Sprintf(" -d %v", p.SourceIP))
+	}
+	buf.WriteString(fmt.Sprintf(" --dport %v -j MARK --set-mark 4200\n", p.SourcePort))
+	return buf.Bytes()
+}
+
+func (p PortRule) hairpinMasquerade() []byte {
+	if p.Bridge == "" || p.BridgeSubnet == "" {
+		return nil
+	}
+	return []byte(fmt.Sprintf("\n-A %s -s %v -d %v -p %v -m %v --dport %v -m mark --mark 4200 -j MASQUERADE",
+		hostPortsPostRoutingChain, p.BridgeSubnet, p.TargetIP, p.Protocol, p.Protocol, p.TargetPort))
+}
+
 func (w *watcher) insertBaseRules() error {
 	if w.run("iptables", "-w", "-t", "nat", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING") != nil {
-		return w.run("iptables", "-w", "-t", "nat", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING")
+		return w.run("iptables", "-w", "-t", "nat", "-I", "PREROUTING", iptables.InsertAt("nat", "PREROUTING"), "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING")
 	}
 	if w.run("iptables", "-w", "-C", "FORWARD", "-j", "CATTLE_FORWARD") != nil {
-		return w.run("iptables", "-w", "-I", "FORWARD", "-j", "CATTLE_FORWARD")
+		return w.run("iptables", "-w", "-I", "FORWARD", iptables.InsertAt("filter", "FORWARD"), "-j", "CATTLE_FORWARD")
 	}
 	if w.run("iptables", "-w", "-t", "nat", "-C", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT") != nil {
-		return w.run("iptables", "-w", "-t", "nat", "-I", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT")
+		return w.run("iptables", "-w", "-t", "nat", "-I", "OUTPUT", iptables.InsertAt("nat", "OUTPUT"), "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT")
 	}
 	if w.run("iptables", "-w", "-t", "nat", "-C", "POSTROUTING", "-j", hostPortsPostRoutingChain) != nil {
-		return w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", "-j", hostPortsPostRoutingChain)
+		return w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", iptables.InsertAt("nat", "POSTROUTING"), "-j", hostPortsPostRoutingChain)
 	}
 	return nil
 }
 
 func (w *watcher) run(args ...string) error {
-	logrus.Debugf("Running %s", strings.Join(args, " "))
+	log.Debugf("Running %s", strings.Join(args, " "))
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+func (w *watcher) state() interface{} {
+	w.Lock()
+	defer w.Unlock()
+	return map[string]interface{}{
+		"applied":     w.applied,
+		"lastApplied": w.lastApplied,
+	}
+}
+
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply host rules: %v", err)
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply host rules")
 	}
 }
 
+// reconcile makes one pass, with force set the host port rules are
+// programmed again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("hostports", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
+// Plan returns how the live rules differ from those that would be applied
+// for the current metadata, without changing anything on the host
+func Plan(c source.MetadataSource) (string, error) {
+	w := &watcher{c: c}
+	rules, err := w.desiredRules()
+	if err != nil {
+		return "", err
+	}
+	return iptables.PlanDiff(chains, restoreInput(rules).String())
+}
+
 func (w *watcher) onChange(version string) error {
-	logrus.Debug("Creating rule set")
+	log.Debug("Creating rule set")
+	newPortRules, err := w.desiredRules()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("New generated rules: %v", newPortRules)
+	if !reflect.DeepEqual(w.applied, newPortRules) {
+		log.Infof("Applying new port rules")
+		return w.apply(newPortRules)
+	} else if time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
+		return w.apply(newPortRules)
+	}
+
+	log.Debugf("No change in applied rules")
+	return nil
+}
+
+func (w *watcher) desiredRules() (map[string]PortRule, error) {
 	newPortRules := map[string]PortRule{}
 
 	host, err := w.c.GetSelfHost()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	networks, err := networksByUUID(w.c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	containers, err := w.c.GetContainers()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, container := range containers {
 		network := networks[container.NetworkUUID]
-		bridge := ""
 
 		if container.State != "running" {
 			continue
@@ -162,40 +327,57 @@ func (w *watcher) onChange(version string) error {
 			continue
 		}
 
-		conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
-		for _, file := range conf {
-			props, _ := file.(map[string]interface{})
-			cniType, _ := props["type"].(string)
-			checkBridge, _ := props["bridge"].(string)
+		bridge, bridgeSubnet := networkBridge(network)
 
-			if cniType == "rancher-bridge" && checkBridge != "" {
-				bridge = checkBridge
+		targetIP := container.PrimaryIp
+		if PortDriver != nil {
+			if targetIP = w.rootlessIP(container); targetIP == "" {
+				continue
 			}
 		}
 
 		for _, port := range container.Ports {
-			rule, ok := parsePortRule(bridge, host.AgentIP, container.PrimaryIp, port)
+			rule, ok := parsePortRule(bridge, host.AgentIP, targetIP, port)
 			if !ok {
 				continue
 			}
+			rule.BridgeSubnet = bridgeSubnet
 
 			newPortRules[container.ExternalId+"/"+port] = rule
 		}
 	}
 
-	logrus.Debugf("New generated rules: %v", newPortRules)
-	if !reflect.DeepEqual(w.applied, newPortRules) {
-		logrus.Infof("Applying new port rules")
-		return w.apply(newPortRules)
-	} else if time.Now().Sub(w.lastApplied) > reapplyEvery {
-		return w.apply(newPortRules)
-	}
+	return newPortRules, nil
+}
 
-	logrus.Debugf("No change in applied rules")
-	return nil
+// rootlessIP is the container's address in rootlesskit's namespace, where
+// Docker networked it. network doesn't run under rootless Docker, so the
+// IP metadata assigned the container never exists.
+func (w *watcher) rootlessIP(container metadata.Container) string {
+	if w.docker == nil {
+		return ""
+	}
+	inspect, err := w.docker.Inspect(container.ExternalId)
+	if err != nil {
+		log.WithField(logging.ContainerIDKey, container.ExternalId).Errorf("Not forwarding the ports of %s, inspecting it failed: %v", container.Name, err)
+		return ""
+	}
+	if inspect.NetworkSettings == nil {
+		return ""
+	}
+	if ip := inspect.NetworkSettings.IPAddress; ip != "" {
+		return ip
+	}
+	for _, endpoint := range inspect.NetworkSettings.Networks {
+		if endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress
+		}
+	}
+	log.WithField(logging.ContainerIDKey, container.ExternalId).Warnf("Not forwarding the ports of %s, Docker gave it no IP", container.Name)
+	return ""
 }
 
-func (w *watcher) apply(rules map[string]PortRule) error {
+func restoreInput(rules map[string]PortRule) *bytes.Buffer {
 	buf := &bytes.Buffer{}
 	// NOTE: We don't use CATTLE_POSTROUTING, but for migration we just wipe it out
 	buf.WriteString("*nat\n")
@@ -217,26 +399,97 @@ func (w *watcher) apply(rules map[string]PortRule) error {
 	buf.WriteString("-A CATTLE_FORWARD -m mark --mark 4200 -j ACCEPT\n")
 
 	buf.WriteString("\nCOMMIT\n")
+	return buf
+}
+
+// apply programs rules and records the result as the drift baseline
+func (w *watcher) apply(rules map[string]PortRule) error {
+	if PortDriver != nil {
+		return w.forward(rules)
+	}
+	return w.drift.Apply(func() error { return w.program(rules) })
+}
+
+// forward has rootlesskit forward each rule's host port to the container
+func (w *watcher) forward(rules map[string]PortRule) error {
+	var ports []rootless.Port
+	for _, rule := range rules {
+		sourcePort, err := strconv.Atoi(rule.SourcePort)
+		if err != nil {
+			continue
+		}
+		targetPort, err := strconv.Atoi(rule.TargetPort)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, rootless.Port{
+			Proto:      rule.Protocol,
+			ParentIP:   rule.SourceIP,
+			ParentPort: sourcePort,
+			ChildIP:    rule.TargetIP,
+			ChildPort:  targetPort,
+		})
+	}
+	if !audit.Would("hostports", "rootlesskit.ports", "ports", ports) {
+		start := time.Now()
+		err := PortDriver.Sync(ports)
+		applySeconds.Observe(metrics.Since(start))
+		if err != nil {
+			applies.Inc("error")
+			alerts.Failed("hostports", err)
+			return err
+		}
+		applies.Inc("ok")
+		alerts.Succeeded("hostports")
+	}
+
+	w.Lock()
+	w.applied = rules
+	w.lastApplied = time.Now()
+	w.Unlock()
+	return nil
+}
+
+func (w *watcher) program(rules map[string]PortRule) error {
+	buf := restoreInput(rules)
 
 	if logrus.GetLevel() == logrus.DebugLevel {
 		fmt.Printf("Applying rules\n%s", buf)
 	}
+	if audit.Would("hostports", "iptables.restore", "rules", "\n"+buf.String()) {
+		w.Lock()
+		w.applied = rules
+		w.lastApplied = time.Now()
+		w.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		applySeconds.Observe(metrics.Since(start))
+	}()
 
 	cmd := exec.Command("iptables-restore", "-n")
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = buf
 	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Failed to apply port rules\n%s", buf)
+		applies.Inc("error")
+		alerts.Failed("hostports", err)
+		log.Errorf("Failed to apply port rules\n%s", buf)
 		return err
 	}
+	applies.Inc("ok")
+	alerts.Succeeded("hostports")
 
 	if err := w.insertBaseRules(); err != nil {
 		return errors.Wrap(err, "Applying port base iptables rules")
 	}
 
+	w.Lock()
 	w.applied = rules
 	w.lastApplied = time.Now()
+	w.Unlock()
 	return nil
 }
 
@@ -265,7 +518,7 @@ func parsePortRule(bridge, hostIP, targetIP, portDef string) (PortRule, bool) {
 	}, true
 }
 
-func networksByUUID(c metadata.Client) (map[string]metadata.Network, error) {
+func networksByUUID(c source.MetadataSource) (map[string]metadata.Network, error) {
 	networkByUUID := map[string]metadata.Network{}
 	networks, err := c.GetNetworks()
 	if err != nil {
@@ -278,3 +531,38 @@ func networksByUUID(c metadata.Client) (map[string]metadata.Network, error) {
 
 	return networkByUUID, nil
 }
+
+// networkBridge returns the network's rancher-bridge and its subnet, empty
+// if it has none
+func networkBridge(network metadata.Network) (string, string) {
+	bridge, bridgeSubnet := "", ""
+	conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
+	for _, file := range conf {
+		props, _ := file.(map[string]interface{})
+		cniType, _ := props["type"].(string)
+		checkBridge, _ := props["bridge"].(string)
+		checkSubnet, _ := props["bridgeSubnet"].(string)
+
+		if cniType == "rancher-bridge" && checkBridge != "" {
+			bridge = checkBridge
+			bridgeSubnet = checkSubnet
+		}
+	}
+	return bridge, bridgeSubnet
+}
+
+// Hairpins reports whether a rancher-bridge network has a bridgeSubnet, so
+// its containers reaching ports published on their own host are hairpin
+// NATed. Without metadata it assumes one does.
+func Hairpins(c source.MetadataSource) bool {
+	networks, err := c.GetNetworks()
+	if err != nil {
+		return true
+	}
+	for _, network := range networks {
+		if bridge, bridgeSubnet := networkBridge(network); bridge != "" && bridgeSubnet != "" {
+			return true
+		}
+	}
+	return false
+}
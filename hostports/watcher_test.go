@@ -0,0 +1,79 @@
+package hostports
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePortRule(t *testing.T) {
+	tests := []struct {
+		portDef string
+		want    PortRule
+		ok      bool
+	}{
+		{"0.0.0.0:8080:80", PortRule{Bridge: "docker0", SourceIP: "0.0.0.0", SourcePort: "8080", TargetIP: "10.42.0.5", TargetPort: "80", Protocol: "tcp"}, true},
+		{"192.168.1.5:53:53/udp", PortRule{Bridge: "docker0", SourceIP: "192.168.1.5", SourcePort: "53", TargetIP: "10.42.0.5", TargetPort: "53", Protocol: "udp"}, true},
+		{"8080:80", PortRule{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parsePortRule("docker0", "192.168.1.5", "10.42.0.5", test.portDef)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", test.portDef, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestIptables(t *testing.T) {
+	tests := []struct {
+		name string
+		rule PortRule
+		want []string
+	}{
+		{
+			name: "hairpin around the DNAT rules",
+			rule: PortRule{Bridge: "docker0", BridgeSubnet: "10.42.0.0/16", SourceIP: "0.0.0.0", SourcePort: "8080",
+				TargetIP: "10.42.0.5", TargetPort: "80", Protocol: "tcp"},
+			want: []string{
+				"-A CATTLE_PREROUTING -i docker0 -s 10.42.0.0/16 -p tcp --dport 8080 -j MARK --set-mark 4200",
+				"-A CATTLE_PREROUTING ! -i docker0 -p tcp --dport 8080 -j MARK --set-mark 4200",
+				"-A CATTLE_PREROUTING ! -i docker0 -p tcp --dport 8080 -j DNAT --to 10.42.0.5:80",
+				"-A CATTLE_PREROUTING -p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:80",
+				"-A CATTLE_OUTPUT -p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:80",
+				"-A " + hostPortsPostRoutingChain + " -s 10.42.0.5 -d 10.42.0.5 -p tcp -m tcp --dport 80 -j MASQUERADE",
+				"-A " + hostPortsPostRoutingChain + " -s 10.42.0.0/16 -d 10.42.0.5 -p tcp -m tcp --dport 80 -m mark --mark 4200 -j MASQUERADE",
+			},
+		},
+		{
+			name: "hairpin to a host IP",
+			rule: PortRule{Bridge: "docker0", BridgeSubnet: "10.42.0.0/16", SourceIP: "192.168.1.5", SourcePort: "53",
+				TargetIP: "10.42.0.5", TargetPort: "53", Protocol: "udp"},
+			want: []string{
+				"-A CATTLE_PREROUTING -i docker0 -s 10.42.0.0/16 -p udp -d 192.168.1.5 --dport 53 -j MARK --set-mark 4200",
+				"-A CATTLE_PREROUTING ! -i docker0 -p udp -d 192.168.1.5 --dport 53 -j MARK --set-mark 4200",
+				"-A CATTLE_PREROUTING ! -i docker0 -p udp -d 192.168.1.5 --dport 53 -j DNAT --to 10.42.0.5:53",
+				"-A CATTLE_PREROUTING -p udp -m udp --dport 53 -d 192.168.1.5 -j DNAT --to-destination 10.42.0.5:53",
+				"-A CATTLE_OUTPUT -p udp -m udp --dport 53 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:53",
+				"-A " + hostPortsPostRoutingChain + " -s 10.42.0.5 -d 10.42.0.5 -p udp -m udp --dport 53 -j MASQUERADE",
+				"-A " + hostPortsPostRoutingChain + " -s 10.42.0.0/16 -d 10.42.0.5 -p udp -m udp --dport 53 -m mark --mark 4200 -j MASQUERADE",
+			},
+		},
+		{
+			name: "no hairpin without a bridge subnet",
+			rule: PortRule{Bridge: "docker0", SourceIP: "0.0.0.0", SourcePort: "8080", TargetIP: "10.42.0.5", TargetPort: "80", Protocol: "tcp"},
+			want: []string{
+				"-A CATTLE_PREROUTING ! -i docker0 -p tcp --dport 8080 -j MARK --set-mark 4200",
+				"-A CATTLE_PREROUTING ! -i docker0 -p tcp --dport 8080 -j DNAT --to 10.42.0.5:80",
+				"-A CATTLE_PREROUTING -p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:80",
+				"-A CATTLE_OUTPUT -p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:80",
+				"-A " + hostPortsPostRoutingChain + " -s 10.42.0.5 -d 10.42.0.5 -p tcp -m tcp --dport 80 -j MASQUERADE",
+			},
+		},
+	}
+	for _, test := range tests {
+		got := strings.Split(string(test.rule.iptables()), "\n")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package hostroutes
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	overlayKey   = "overlay"
+	greKeyKey    = "greKey"
+	subnetsKey   = "subnets"
+	greOverlay   = "gre"
+	tunnelPrefix = "rgre"
+)
+
+// Tunnel is a point to point GRE tunnel to a remote host, used where VXLAN's
+// UDP traffic is blocked but GRE is permitted
+type Tunnel struct {
+	Name   string
+	Local  string
+	Remote string
+	Key    int
+}
+
+func tunnelName(networkUUID, hostUUID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(networkUUID + "/" + hostUUID))
+	return fmt.Sprintf("%s%08x", tunnelPrefix, h.Sum32())
+}
+
+// greNetworks returns the networks using the GRE overlay, with the network
+// routes should use first: the default network if it is GRE, then by name
+func greNetworks(networks []metadata.Network) []metadata.Network {
+	var result []metadata.Network
+	for _, network := range networks {
+		if overlay, _ := network.Metadata[overlayKey].(string); overlay == greOverlay {
+			result = append(result, network)
+		}
+	}
+	sort.Sort(byRoutePreference(result))
+	return result
+}
+
+type byRoutePreference []metadata.Network
+
+func (b byRoutePreference) Len() int      { return len(b) }
+func (b byRoutePreference) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRoutePreference) Less(i, j int) bool {
+	if b[i].Default != b[j].Default {
+		return b[i].Default
+	}
+	return b[i].Name < b[j].Name
+}
+
+func greKey(network metadata.Network) int {
+	switch v := network.Metadata[greKeyKey].(type) {
+	case float64:
+		return int(v)
+	case string:
+		key, _ := strconv.Atoi(v)
+		return key
+	}
+	return 0
+}
+
+// desiredTunnels builds a tunnel per GRE network to every remote host
+func desiredTunnels(self metadata.Host, hosts []metadata.Host, networks []metadata.Network) map[string]Tunnel {
+	tunnels := map[string]Tunnel{}
+	for _, network := range greNetworks(networks) {
+		for _, host := range hosts {
+			if host.UUID == self.UUID || host.AgentIP == "" {
+				continue
+			}
+			t := Tunnel{
+				Name:   tunnelName(network.UUID, host.UUID),
+				Local:  self.AgentIP,
+				Remote: host.AgentIP,
+				Key:    greKey(network),
+			}
+			tunnels[t.Name] = t
+		}
+	}
+	return tunnels
+}
+
+// greSubnet is the host's subnet on the GRE network, from the network's
+// subnets by host UUID or else hostname
+func greSubnet(network metadata.Network, host metadata.Host) string {
+	subnets, _ := network.Metadata[subnetsKey].(map[string]interface{})
+	subnet, _ := subnets[host.UUID].(string)
+	if subnet == "" {
+		subnet, _ = subnets[host.Hostname].(string)
+	}
+	return subnet
+}
+
+func (w *watcher) applyTunnels(desired map[string]Tunnel) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !strings.HasPrefix(name, tunnelPrefix) {
+			continue
+		}
+		// Tunnels found at startup are kept since we can't tell how they
+		// were configured, later changes are applied by recreating them
+		t, ok := desired[name]
+		if prev, seen := w.appliedTunnels[name]; ok && (!seen || prev == t) {
+			existing[name] = true
+			continue
+		}
+		if audit.Would("hostroutes", "link.del", name, w.appliedTunnels[name]) {
+			continue
+		}
+		log.Infof("Removing GRE tunnel %s", name)
+		err := netlink.LinkDel(link)
+		audit.Record("hostroutes", "link.del", name, w.appliedTunnels[name], nil, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lastErr error
+	for name, t := range desired {
+		if existing[name] || audit.Would("hostroutes", "link.add", name, t) {
+			continue
+		}
+		log.Infof("Adding GRE tunnel %s to %s with key %d", name, t.Remote, t.Key)
+		args := []string{"ip", "tunnel", "add", name, "mode", "gre", "local", t.Local, "remote", t.Remote, "ttl", "64"}
+		if t.Key > 0 {
+			args = append(args, "key", strconv.Itoa(t.Key))
+		}
+		err := w.run(args...)
+		if err == nil {
+			err = w.run("ip", "link", "set", name, "up")
+		}
+		audit.Record("hostroutes", "link.add", name, nil, t, err)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		w.appliedTunnels = desired
+	}
+	return lastErr
+}
+
+func (w *watcher) run(args ...string) error {
+	log.Debugf("Running %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,67 @@
+package hostroutes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestDesiredRoutes(t *testing.T) {
+	self := metadata.Host{UUID: "self", AgentIP: "10.0.0.1"}
+	remote := metadata.Host{
+		UUID:     "remote",
+		Hostname: "node2",
+		AgentIP:  "10.0.0.2",
+		Labels:   map[string]string{hostSubnetLabel: "10.42.2.0/24"},
+	}
+	gre := func(uuid, name string, isDefault bool, subnets map[string]interface{}) metadata.Network {
+		return metadata.Network{
+			UUID:     uuid,
+			Name:     name,
+			Default:  isDefault,
+			Metadata: map[string]interface{}{overlayKey: greOverlay, subnetsKey: subnets},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		networks []metadata.Network
+		want     map[string]Route
+	}{
+		{
+			name: "no GRE network",
+			want: map[string]Route{
+				"remote": {HostUUID: "remote", Subnet: "10.42.2.0/24", Gateway: "10.0.0.2"},
+			},
+		},
+		{
+			name: "every GRE network",
+			networks: []metadata.Network{
+				gre("b", "beta", false, map[string]interface{}{"node2": "10.44.2.0/24"}),
+				gre("a", "alpha", false, map[string]interface{}{"remote": "10.43.2.0/24"}),
+			},
+			want: map[string]Route{
+				"remote":   {HostUUID: "remote", Subnet: "10.42.2.0/24", Gateway: "10.0.0.2", Device: tunnelName("a", "remote")},
+				"remote/a": {HostUUID: "remote", Subnet: "10.43.2.0/24", Gateway: "10.0.0.2", Device: tunnelName("a", "remote")},
+				"remote/b": {HostUUID: "remote", Subnet: "10.44.2.0/24", Gateway: "10.0.0.2", Device: tunnelName("b", "remote")},
+			},
+		},
+		{
+			name: "default network first and subnets routed once",
+			networks: []metadata.Network{
+				gre("a", "alpha", false, map[string]interface{}{"remote": "10.42.2.0/24"}),
+				gre("z", "zeta", true, nil),
+			},
+			want: map[string]Route{
+				"remote": {HostUUID: "remote", Subnet: "10.42.2.0/24", Gateway: "10.0.0.2", Device: tunnelName("z", "remote")},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := desiredRoutes(self, []metadata.Host{self, remote}, test.networks)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
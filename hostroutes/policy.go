@@ -0,0 +1,196 @@
+package hostroutes
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	egressInterfaceLabel = "io.rancher.network.egress_interface"
+	egressGatewayLabel   = "io.rancher.network.egress_gateway"
+
+	policyTable = 117
+	// Container traffic first consults the main table for anything more
+	// specific than a default route, then falls through to the egress table
+	mainRulePriority   = 1170
+	policyRulePriority = 1171
+)
+
+// Policy sends container traffic that would leave via the default route out a
+// specific interface instead, for hosts with separate management and data NICs
+type Policy struct {
+	Interface string
+	Gateway   string
+	Subnets   []string
+}
+
+func (w *watcher) desiredPolicy(self metadata.Host) (Policy, error) {
+	iface := self.Labels[egressInterfaceLabel]
+	if iface == "" {
+		return Policy{}, nil
+	}
+
+	networks, err := w.c.GetNetworks()
+	if err != nil {
+		return Policy{}, err
+	}
+
+	policy := Policy{
+		Interface: iface,
+		Gateway:   self.Labels[egressGatewayLabel],
+	}
+	for _, network := range networks {
+		conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
+		for _, file := range conf {
+			props, _ := file.(map[string]interface{})
+			if subnet, _ := props["bridgeSubnet"].(string); subnet != "" {
+				if _, _, err := net.ParseCIDR(subnet); err == nil {
+					policy.Subnets = append(policy.Subnets, subnet)
+				}
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+func (w *watcher) applyPolicy(policy Policy) error {
+	if err := w.clearRules(); err != nil {
+		return err
+	}
+
+	if policy.Interface == "" {
+		return w.flushPolicyTable()
+	}
+
+	link, err := netlink.LinkByName(policy.Interface)
+	if err != nil {
+		return errors.Wrapf(err, "finding egress interface %s", policy.Interface)
+	}
+
+	gw, err := policyGateway(link, policy.Gateway)
+	if err != nil {
+		return err
+	}
+
+	if err := w.flushPolicyTable(); err != nil {
+		return err
+	}
+
+	if audit.Would("hostroutes", "route.add", "default table "+strconv.Itoa(policyTable), fmt.Sprintf("via %s dev %s", gw, policy.Interface)) {
+		for _, subnet := range policy.Subnets {
+			audit.Would("hostroutes", "rule.add", subnet, fmt.Sprintf("from %s lookup main suppress_prefixlength 0, from %s lookup %d", subnet, subnet, policyTable))
+		}
+		return nil
+	}
+	log.Infof("Routing container egress via %s on %s for %v", gw, policy.Interface, policy.Subnets)
+	err = netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        gw,
+		Table:     policyTable,
+		Protocol:  routeProtocol,
+	})
+	audit.Record("hostroutes", "route.add", "default table "+strconv.Itoa(policyTable), nil, fmt.Sprintf("via %s dev %s", gw, policy.Interface), err)
+	if err != nil {
+		return errors.Wrap(err, "adding egress default route")
+	}
+
+	for _, subnet := range policy.Subnets {
+		_, src, _ := net.ParseCIDR(subnet)
+
+		main := netlink.NewRule()
+		main.Src = src
+		main.Table = 254
+		main.Priority = mainRulePriority
+		main.SuppressPrefixlen = 0
+		err := netlink.RuleAdd(main)
+		audit.Record("hostroutes", "rule.add", subnet, nil, main.String(), err)
+		if err != nil {
+			return errors.Wrapf(err, "adding main table rule for %s", subnet)
+		}
+
+		egress := netlink.NewRule()
+		egress.Src = src
+		egress.Table = policyTable
+		egress.Priority = policyRulePriority
+		err = netlink.RuleAdd(egress)
+		audit.Record("hostroutes", "rule.add", subnet, nil, egress.String(), err)
+		if err != nil {
+			return errors.Wrapf(err, "adding egress rule for %s", subnet)
+		}
+	}
+
+	return nil
+}
+
+func policyGateway(link netlink.Link, gateway string) (net.IP, error) {
+	if gateway != "" {
+		gw := net.ParseIP(gateway)
+		if gw == nil {
+			return nil, errors.Errorf("invalid egress gateway %q", gateway)
+		}
+		return gw, nil
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route.Gw, nil
+		}
+	}
+	return nil, errors.Errorf("no default gateway found on %s, set %s", link.Attrs().Name, egressGatewayLabel)
+}
+
+func (w *watcher) clearRules() error {
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if rule.Priority != mainRulePriority && rule.Priority != policyRulePriority {
+			continue
+		}
+		r := rule
+		if audit.Would("hostroutes", "rule.del", fmt.Sprint(r.Src), r.String()) {
+			continue
+		}
+		err := netlink.RuleDel(&r)
+		audit.Record("hostroutes", "rule.del", fmt.Sprint(r.Src), r.String(), nil, err)
+		if err != nil {
+			return errors.Wrapf(err, "removing rule %v", rule)
+		}
+	}
+	return nil
+}
+
+func (w *watcher) flushPolicyTable() error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: policyTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		r := route
+		if audit.Would("hostroutes", "route.del", fmt.Sprint(r.Dst)+" table "+strconv.Itoa(policyTable), routeKey(r)) {
+			continue
+		}
+		err := netlink.RouteDel(&r)
+		if isNotExist(err) {
+			continue
+		}
+		audit.Record("hostroutes", "route.del", fmt.Sprint(r.Dst)+" table "+strconv.Itoa(policyTable), routeKey(r), nil, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package hostroutes
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cleanup"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/vishvananda/netlink"
+)
+
+var log = logging.Subsystem("hostroutes")
+
+var (
+	// ReapplyEvery is how often host routes are programmed again when nothing
+	// changed
+	ReapplyEvery    = config.NewDuration(5 * time.Minute)
+	hostSubnetLabel = "io.rancher.network.host_subnet"
+
+	// routeProtocol marks the routes plugin-manager owns so cleanup never
+	// touches routes created by operators or other daemons
+	routeProtocol = 117
+)
+
+// Watch is used to look for changes in host membership and route each remote
+// host's container subnet to that host
+func Watch(c source.MetadataSource) error {
+	w := newWatcher(c)
+	health.Register("hostroutes")
+	handoff.RegisterStop("hostroutes", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("hostroutes", func() error { return w.reconcile("", true) })
+	cleanup.Register("hostroutes", w.cleanup)
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	return nil
+}
+
+func newWatcher(c source.MetadataSource) *watcher {
+	return &watcher{
+		c:              c,
+		applied:        map[string]Route{},
+		appliedTunnels: map[string]Tunnel{},
+	}
+}
+
+// cleanup removes every owned route, the egress policy and the tunnels,
+// keeping the pass lock so no later pass programs them again
+func (w *watcher) cleanup() error {
+	w.pass.Lock()
+	var lastErr error
+	for _, remove := range []func() error{
+		func() error { return w.removeStale(map[string]Route{}) },
+		w.clearRules,
+		w.flushPolicyTable,
+		func() error { return w.applyTunnels(map[string]Tunnel{}) },
+	} {
+		if err := remove(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Reconcile programs the host routes and tunnels for the current metadata
+// once, for running without the daemon
+func Reconcile(c source.MetadataSource) error {
+	return newWatcher(c).onChange("")
+}
+
+type watcher struct {
+	pass           sync.Mutex
+	c              source.MetadataSource
+	applied        map[string]Route
+	appliedPolicy  Policy
+	appliedTunnels map[string]Tunnel
+	lastApplied    time.Time
+}
+
+// Route sends the container subnet of a remote host to that host's agent IP,
+// or through a tunnel device when the host is reached over an overlay
+type Route struct {
+	HostUUID string
+	Subnet   string
+	Gateway  string
+	Device   string
+}
+
+func (r Route) netlinkRoute() (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if r.Device != "" {
+		link, err := netlink.LinkByName(r.Device)
+		if err != nil {
+			return nil, err
+		}
+		return &netlink.Route{
+			Dst:       dst,
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  routeProtocol,
+		}, nil
+	}
+	gw := net.ParseIP(r.Gateway)
+	if gw == nil {
+		return nil, errors.Errorf("invalid gateway %q for host %s", r.Gateway, r.HostUUID)
+	}
+	return &netlink.Route{
+		Dst:      dst,
+		Gw:       gw,
+		Protocol: routeProtocol,
+	}, nil
+}
+
+// routeKey identifies a route by destination and next hop
+func routeKey(r netlink.Route) string {
+	if r.Gw != nil {
+		return fmt.Sprintf("%s via %s", r.Dst, r.Gw)
+	}
+	return fmt.Sprintf("%s dev %d", r.Dst, r.LinkIndex)
+}
+
+func (w *watcher) onChangeNoError(version string) {
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply host routes")
+	}
+}
+
+// reconcile makes one pass, with force set the host routes and tunnels are
+// programmed again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("hostroutes", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
+func (w *watcher) onChange(version string) error {
+	self, err := w.c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+
+	policy, err := w.desiredPolicy(self)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(w.appliedPolicy, policy) || time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
+		if err := w.applyPolicy(policy); err != nil {
+			log.WithError(err).Error("Failed to apply egress policy routing")
+		} else {
+			w.appliedPolicy = policy
+		}
+	}
+
+	hosts, err := w.c.GetHosts()
+	if err != nil {
+		return err
+	}
+
+	networks, err := w.c.GetNetworks()
+	if err != nil {
+		return err
+	}
+
+	if err := w.applyTunnels(desiredTunnels(self, hosts, networks)); err != nil {
+		return errors.Wrap(err, "applying GRE tunnels")
+	}
+
+	desired := desiredRoutes(self, hosts, networks)
+
+	if added, removed := membershipChanges(w.applied, desired); len(added) > 0 || len(removed) > 0 {
+		log.Infof("Host membership changed, added: %v removed: %v", added, removed)
+		return w.apply(desired)
+	} else if !reflect.DeepEqual(w.applied, desired) {
+		log.Infof("Applying new host routes")
+		return w.apply(desired)
+	} else if time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
+		return w.apply(desired)
+	}
+
+	return nil
+}
+
+// desiredRoutes routes each remote host's subnet label to it, through the
+// preferred GRE network's tunnel if there is one, and the host's subnet on
+// every GRE network through that network's tunnel. A subnet already routed
+// is skipped.
+func desiredRoutes(self metadata.Host, hosts []metadata.Host, networks []metadata.Network) map[string]Route {
+	desired := map[string]Route{}
+	gre := greNetworks(networks)
+	for _, host := range hosts {
+		if host.UUID == self.UUID || host.AgentIP == "" {
+			continue
+		}
+		routed := map[string]bool{}
+		add := func(key, subnet, device string) {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				log.Errorf("Ignoring invalid subnet %q for host %s: %v", subnet, host.UUID, err)
+				return
+			}
+			if routed[subnet] {
+				return
+			}
+			routed[subnet] = true
+			desired[key] = Route{
+				HostUUID: host.UUID,
+				Subnet:   subnet,
+				Gateway:  host.AgentIP,
+				Device:   device,
+			}
+		}
+
+		if subnet := host.Labels[hostSubnetLabel]; subnet != "" {
+			device := ""
+			if len(gre) > 0 {
+				device = tunnelName(gre[0].UUID, host.UUID)
+			}
+			add(host.UUID, subnet, device)
+		}
+		for _, network := range gre {
+			if subnet := greSubnet(network, host); subnet != "" {
+				add(host.UUID+"/"+network.UUID, subnet, tunnelName(network.UUID, host.UUID))
+			}
+		}
+	}
+
+	return desired
+}
+
+func membershipChanges(applied, desired map[string]Route) ([]string, []string) {
+	appliedHosts, desiredHosts := routedHosts(applied), routedHosts(desired)
+	var added, removed []string
+	for uuid := range desiredHosts {
+		if !appliedHosts[uuid] {
+			added = append(added, uuid)
+		}
+	}
+	for uuid := range appliedHosts {
+		if !desiredHosts[uuid] {
+			removed = append(removed, uuid)
+		}
+	}
+	return added, removed
+}
+
+func routedHosts(routes map[string]Route) map[string]bool {
+	hosts := map[string]bool{}
+	for _, route := range routes {
+		hosts[route.HostUUID] = true
+	}
+	return hosts
+}
+
+func (w *watcher) apply(desired map[string]Route) error {
+	var lastErr error
+	stale := source.IsStale(w.c)
+	for key, route := range w.applied {
+		if newRoute, ok := desired[key]; ok && newRoute == route || stale {
+			continue
+		}
+		if err := w.remove(route); err != nil {
+			log.Errorf("Failed to remove route for host %s: %v", route.HostUUID, err)
+		}
+	}
+
+	for _, route := range desired {
+		if err := w.ensure(route); err != nil {
+			lastErr = errors.Wrapf(err, "routing %s via %s", route.Subnet, route.Gateway)
+		}
+	}
+
+	if stale {
+		// Cached answers may be missing hosts that joined since, so leave
+		// routes we can't account for alone
+		log.Debugf("Not removing routes against cached metadata")
+	} else if err := w.removeStale(desired); err != nil {
+		lastErr = errors.Wrap(err, "removing stale routes")
+	}
+
+	if lastErr == nil {
+		w.applied = desired
+		w.lastApplied = time.Now()
+	}
+
+	return lastErr
+}
+
+func (w *watcher) ensure(route Route) error {
+	nlRoute, err := route.netlinkRoute()
+	if err != nil {
+		return err
+	}
+
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: nlRoute.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range existing {
+		if r.Protocol != routeProtocol {
+			return errors.Errorf("existing route %v was not created by plugin-manager, leaving it in place", r)
+		}
+		if routeKey(r) == routeKey(*nlRoute) && r.Type != syscall.RTN_BLACKHOLE {
+			return nil
+		}
+		if audit.Would("hostroutes", "route.del", route.Subnet, routeKey(r)) {
+			continue
+		}
+		log.Infof("Replacing route %v for host %s", r, route.HostUUID)
+		err := netlink.RouteDel(&r)
+		audit.Record("hostroutes", "route.del", route.Subnet, routeKey(r), nil, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if audit.Would("hostroutes", "route.add", route.Subnet, routeKey(*nlRoute)) {
+		return nil
+	}
+	log.Infof("Adding route %s via %s for host %s", route.Subnet, route.Gateway, route.HostUUID)
+	err = netlink.RouteAdd(nlRoute)
+	audit.Record("hostroutes", "route.add", route.Subnet, nil, routeKey(*nlRoute), err)
+	return err
+}
+
+func (w *watcher) remove(route Route) error {
+	nlRoute, err := route.netlinkRoute()
+	if err != nil {
+		return err
+	}
+	if audit.Would("hostroutes", "route.del", route.Subnet, routeKey(*nlRoute)) {
+		return nil
+	}
+	log.Infof("Removing route %s via %s for host %s", route.Subnet, route.Gateway, route.HostUUID)
+	err = netlink.RouteDel(nlRoute)
+	if isNotExist(err) {
+		return nil
+	}
+	audit.Record("hostroutes", "route.del", route.Subnet, routeKey(*nlRoute), nil, err)
+	return err
+}
+
+// removeStale deletes routes carrying our marker that don't correspond to a
+// current host, including blackhole routes left behind by failed updates
+func (w *watcher) removeStale(desired map[string]Route) error {
+	owned, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, route := range desired {
+		if nlRoute, err := route.netlinkRoute(); err == nil {
+			wanted[routeKey(*nlRoute)] = true
+		}
+	}
+
+	var lastErr error
+	for _, r := range owned {
+		if r.Dst != nil && r.Type != syscall.RTN_BLACKHOLE && wanted[routeKey(r)] {
+			continue
+		}
+		if audit.Would("hostroutes", "route.del", fmt.Sprint(r.Dst), routeKey(r)) {
+			continue
+		}
+		log.Infof("Removing stale route %v", r)
+		err := netlink.RouteDel(&r)
+		if isNotExist(err) {
+			continue
+		}
+		audit.Record("hostroutes", "route.del", fmt.Sprint(r.Dst), routeKey(r), nil, err)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func isNotExist(err error) bool {
+	return err == syscall.ESRCH
+}
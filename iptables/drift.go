@@ -0,0 +1,348 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("iptables")
+
+var (
+	driftFound = metrics.NewCounter("plugin_manager_iptables_drift_total",
+		"Differences found between programmed and live iptables rules, by subsystem and kind", "subsystem", "kind")
+	drifted = metrics.NewGauge("plugin_manager_iptables_drifted",
+		"1 while the live rules of a subsystem differ from what it programmed", "subsystem")
+)
+
+// Chain is a chain a subsystem owns, and the built-in chain that jumps to it
+type Chain struct {
+	Table  string
+	Name   string
+	Parent string
+}
+
+// Snapshot is what iptables-save reports for the owned chains, and where
+// each jump into them sits in its parent
+type Snapshot struct {
+	Rules map[string][]string
+	Jumps map[string]Jump
+}
+
+// Jump is the rule sending a parent chain's packets to an owned chain
+type Jump struct {
+	Present bool
+	// Ahead are the rules evaluated before the jump, leaving out
+	// plugin-manager's own jumps that are reinserted independently
+	Ahead []string
+}
+
+// Difference is one way the live rules no longer match the snapshot taken
+// after they were programmed
+type Difference struct {
+	Chain string
+	// Kind is removed, added or reordered
+	Kind string
+	Rule string
+}
+
+func (d Difference) String() string {
+	if d.Rule == "" {
+		return fmt.Sprintf("%s %s", d.Chain, d.Kind)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Chain, d.Kind, d.Rule)
+}
+
+// Drift compares the rules a subsystem programmed against the live tables
+type Drift struct {
+	Subsystem string
+	Chains    []Chain
+
+	lock     sync.Mutex
+	baseline *Snapshot
+}
+
+// Apply runs apply and, when it succeeds, records the resulting rules as
+// the baseline. Checks wait for it so a half-applied table is never
+// reported as drift.
+func (d *Drift) Apply(apply func() error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	auditing := audit.Enabled()
+	var before *Snapshot
+	if auditing {
+		if snap, err := Capture(d.Chains); err == nil {
+			before = &snap
+		}
+	}
+
+	err := apply()
+	var after *Snapshot
+	if err == nil || auditing {
+		snap, captureErr := Capture(d.Chains)
+		if captureErr != nil {
+			log.WithError(captureErr).Errorf("Failed to record %s rules for drift detection", d.Subsystem)
+		} else {
+			after = &snap
+		}
+	}
+	if auditing {
+		audit.Record(d.Subsystem, "iptables.restore", d.chainNames(), before, after, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.baseline = after
+	return nil
+}
+
+func (d *Drift) chainNames() string {
+	var names []string
+	for _, chain := range d.Chains {
+		names = append(names, chain.Table+"/"+chain.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Check compares the live rules against the baseline, logging and counting
+// every difference
+func (d *Drift) Check() ([]Difference, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.baseline == nil {
+		return nil, nil
+	}
+	current, err := Capture(d.Chains)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := Compare(*d.baseline, current)
+	for _, diff := range diffs {
+		log.Warnf("%s rules changed outside plugin-manager, %s", d.Subsystem, diff)
+		driftFound.Inc(d.Subsystem, diff.Kind)
+	}
+	if len(diffs) > 0 {
+		drifted.Set(1, d.Subsystem)
+		alerts.Failed(d.Subsystem+".drift", fmt.Errorf("%d iptables rules changed externally, first %s", len(diffs), diffs[0]))
+	} else {
+		drifted.Set(0, d.Subsystem)
+		alerts.Succeeded(d.Subsystem + ".drift")
+	}
+	return diffs, nil
+}
+
+// Watch checks for drift every interval until the process exits
+func (d *Drift) Watch(every time.Duration) {
+	for range time.Tick(every) {
+		health.Heartbeat(d.Subsystem+".drift", every)
+		if _, err := d.Check(); err != nil {
+			log.WithError(err).Errorf("Failed to check %s rules for drift", d.Subsystem)
+		}
+	}
+}
+
+// Capture reads the owned chains from iptables-save
+func Capture(chains []Chain) (Snapshot, error) {
+	snap := Snapshot{
+		Rules: map[string][]string{},
+		Jumps: map[string]Jump{},
+	}
+	tables := map[string][]string{}
+	for _, chain := range chains {
+		if _, ok := tables[chain.Table]; ok {
+			continue
+		}
+		output, err := exec.Command("iptables-save", "-t", chain.Table).Output()
+		if err != nil {
+			return snap, fmt.Errorf("iptables-save -t %s: %v", chain.Table, err)
+		}
+		tables[chain.Table] = parseSave(output)
+	}
+
+	for _, chain := range chains {
+		key := chain.Table + "/" + chain.Name
+		var parentRules []string
+		for _, rule := range tables[chain.Table] {
+			switch ruleChain(rule) {
+			case chain.Name:
+				snap.Rules[key] = append(snap.Rules[key], rule)
+			case chain.Parent:
+				parentRules = append(parentRules, rule)
+			}
+		}
+		if chain.Parent != "" {
+			snap.Jumps[chain.Table+"/"+chain.Parent+" -> "+chain.Name] = findJump(parentRules, chain.Name)
+		}
+	}
+	return snap, nil
+}
+
+func parseSave(output []byte) []string {
+	var rules []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+func ruleChain(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func ruleTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-j" || fields[i] == "-g" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+func findJump(rules []string, target string) Jump {
+	var ahead []string
+	for _, rule := range rules {
+		t := ruleTarget(rule)
+		if t == target {
+			return Jump{Present: true, Ahead: ahead}
+		}
+		if !strings.HasPrefix(t, "CATTLE_") && !yieldTo[t] {
+			ahead = append(ahead, rule)
+		}
+	}
+	return Jump{}
+}
+
+// Compare lists how current differs from baseline. A jump that a foreign
+// rule was inserted ahead of counts as reordered.
+func Compare(baseline, current Snapshot) []Difference {
+	var diffs []Difference
+	for _, chain := range sortedKeys(baseline.Rules, current.Rules) {
+		want, got := baseline.Rules[chain], current.Rules[chain]
+		removed, added := multisetDiff(want, got), multisetDiff(got, want)
+		for _, rule := range removed {
+			diffs = append(diffs, Difference{Chain: chain, Kind: "removed", Rule: rule})
+		}
+		for _, rule := range added {
+			diffs = append(diffs, Difference{Chain: chain, Kind: "added", Rule: rule})
+		}
+		if len(removed) == 0 && len(added) == 0 && !reflect.DeepEqual(want, got) {
+			diffs = append(diffs, Difference{Chain: chain, Kind: "reordered"})
+		}
+	}
+
+	var jumps []string
+	for jump := range baseline.Jumps {
+		jumps = append(jumps, jump)
+	}
+	sort.Strings(jumps)
+	for _, jump := range jumps {
+		was, now := baseline.Jumps[jump], current.Jumps[jump]
+		if !was.Present {
+			continue
+		}
+		if !now.Present {
+			diffs = append(diffs, Difference{Chain: jump, Kind: "removed"})
+		} else if inserted := multisetDiff(now.Ahead, was.Ahead); len(inserted) > 0 {
+			diffs = append(diffs, Difference{Chain: jump, Kind: "reordered", Rule: inserted[0]})
+		}
+	}
+	return diffs
+}
+
+// multisetDiff returns the rules in a missing from b, counting duplicates
+func multisetDiff(a, b []string) []string {
+	counts := map[string]int{}
+	for _, rule := range b {
+		counts[rule]++
+	}
+	var result []string
+	for _, rule := range a {
+		if counts[rule] > 0 {
+			counts[rule]--
+			continue
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
+func sortedKeys(maps ...map[string][]string) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RulesMentioning lists the rules in any table that match on or translate
+// to ip, each prefixed with its table
+func RulesMentioning(ip string) ([]string, error) {
+	output, err := exec.Command("iptables-save").Output()
+	if err != nil {
+		return nil, fmt.Errorf("iptables-save: %v", err)
+	}
+
+	var rules []string
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+		} else if strings.HasPrefix(line, "-A ") && mentions(line, ip) {
+			rules = append(rules, table+": "+line)
+		}
+	}
+	return rules, nil
+}
+
+// mentions reports whether ip appears in rule as a whole address, so
+// 10.42.0.1 doesn't match 10.42.0.12
+func mentions(rule, ip string) bool {
+	for i := strings.Index(rule, ip); i >= 0; {
+		end := i + len(ip)
+		if (i == 0 || !isAddrChar(rule[i-1])) && (end == len(rule) || !isAddrChar(rule[end])) {
+			return true
+		}
+		next := strings.Index(rule[i+1:], ip)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+func isAddrChar(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.'
+}
@@ -0,0 +1,93 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		rule string
+		ip   string
+		want bool
+	}{
+		{"-A CATTLE_PREROUTING -d 10.42.0.1/32 -j DNAT", "10.42.0.1", true},
+		{"-A CATTLE_PREROUTING -j DNAT --to-destination 10.42.0.1:80", "10.42.0.1", true},
+		{"-A CATTLE_PREROUTING -d 10.42.0.12/32 -j DNAT", "10.42.0.1", false},
+		{"-A CATTLE_PREROUTING -d 110.42.0.1/32 -j DNAT", "10.42.0.1", false},
+		{"-A CATTLE_PREROUTING -d 10.42.0.12/32 -j DNAT --to-destination 10.42.0.1", "10.42.0.1", true},
+		{"10.42.0.1", "10.42.0.1", true},
+		{"-A CATTLE_PREROUTING -j RETURN", "10.42.0.1", false},
+	}
+	for _, test := range tests {
+		if got := mentions(test.rule, test.ip); got != test.want {
+			t.Errorf("mentions(%q, %q) = %v, want %v", test.rule, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestParseSave(t *testing.T) {
+	output := []byte(`-P PREROUTING ACCEPT
+-N CATTLE_PREROUTING
+-A PREROUTING -j DOCKER-INGRESS
+-A PREROUTING -m addrtype --dst-type LOCAL -j CATTLE_PREROUTING
+`)
+	want := []string{
+		"-A PREROUTING -j DOCKER-INGRESS",
+		"-A PREROUTING -m addrtype --dst-type LOCAL -j CATTLE_PREROUTING",
+	}
+	if got := parseSave(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := Snapshot{
+		Rules: map[string][]string{"CATTLE_NAT": {"-A CATTLE_NAT -s 10.42.0.0/16 -j MASQUERADE", "-A CATTLE_NAT -j RETURN"}},
+		Jumps: map[string]Jump{"CATTLE_NAT": {Present: true}},
+	}
+	tests := []struct {
+		name    string
+		current Snapshot
+		want    []Difference
+	}{
+		{"unchanged", baseline, nil},
+		{
+			name: "rule removed",
+			current: Snapshot{
+				Rules: map[string][]string{"CATTLE_NAT": {"-A CATTLE_NAT -j RETURN"}},
+				Jumps: baseline.Jumps,
+			},
+			want: []Difference{{Chain: "CATTLE_NAT", Kind: "removed", Rule: "-A CATTLE_NAT -s 10.42.0.0/16 -j MASQUERADE"}},
+		},
+		{
+			name: "rules reordered",
+			current: Snapshot{
+				Rules: map[string][]string{"CATTLE_NAT": {"-A CATTLE_NAT -j RETURN", "-A CATTLE_NAT -s 10.42.0.0/16 -j MASQUERADE"}},
+				Jumps: baseline.Jumps,
+			},
+			want: []Difference{{Chain: "CATTLE_NAT", Kind: "reordered"}},
+		},
+		{
+			name: "jump removed",
+			current: Snapshot{
+				Rules: baseline.Rules,
+				Jumps: map[string]Jump{},
+			},
+			want: []Difference{{Chain: "CATTLE_NAT", Kind: "removed"}},
+		},
+		{
+			name: "foreign rule ahead of the jump",
+			current: Snapshot{
+				Rules: baseline.Rules,
+				Jumps: map[string]Jump{"CATTLE_NAT": {Present: true, Ahead: []string{"-A POSTROUTING -j KUBE-POSTROUTING"}}},
+			},
+			want: []Difference{{Chain: "CATTLE_NAT", Kind: "reordered", Rule: "-A POSTROUTING -j KUBE-POSTROUTING"}},
+		},
+	}
+	for _, test := range tests {
+		if got := Compare(baseline, test.current); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
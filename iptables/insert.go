@@ -0,0 +1,36 @@
+package iptables
+
+import (
+	"os/exec"
+	"strconv"
+
+	"github.com/rancher/plugin-manager/swarm"
+)
+
+// yieldTo are the foreign chains whose jumps stay ahead of plugin-manager's,
+// Swarm's ingress DNATs its published ports before anything else
+var yieldTo = map[string]bool{
+	swarm.IngressChain: true,
+}
+
+// InsertAt is the rule number for iptables -I to put a jump into parent at,
+// behind any jump to a chain yielded to and otherwise first
+func InsertAt(table, parent string) string {
+	output, err := exec.Command("iptables", "-w", "-t", table, "-S", parent).Output()
+	if err != nil {
+		log.WithError(err).Warnf("Failed to list %s %s, inserting first", table, parent)
+		return "1"
+	}
+	return insertAt(parseSave(output))
+}
+
+// insertAt is InsertAt's rule number among the parent chain's rules
+func insertAt(rules []string) string {
+	at := 1
+	for i, rule := range rules {
+		if yieldTo[ruleTarget(rule)] {
+			at = i + 2
+		}
+	}
+	return strconv.Itoa(at)
+}
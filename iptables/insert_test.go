@@ -0,0 +1,21 @@
+package iptables
+
+import "testing"
+
+func TestInsertAt(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		want  string
+	}{
+		{"empty chain", nil, "1"},
+		{"foreign jumps only", []string{"-A PREROUTING -j DOCKER"}, "1"},
+		{"behind ingress", []string{"-A PREROUTING -j DOCKER-INGRESS", "-A PREROUTING -j DOCKER"}, "2"},
+		{"behind a later ingress", []string{"-A PREROUTING -j DOCKER", "-A PREROUTING -j KUBE", "-A PREROUTING -g DOCKER-INGRESS"}, "4"},
+	}
+	for _, test := range tests {
+		if got := insertAt(test.rules); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
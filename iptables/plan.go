@@ -0,0 +1,65 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netns"
+)
+
+// PlanDiff lists how the live rules of chains differ from what the
+// iptables-restore input would program, + for rules it would add, - for
+// ones it would remove. It is empty when nothing would change.
+func PlanDiff(chains []Chain, input string) (string, error) {
+	want, err := canonical(chains, input)
+	if err != nil {
+		return "", err
+	}
+	got, err := Capture(chains)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, d := range Compare(want, got) {
+		switch d.Kind {
+		case "removed":
+			fmt.Fprintf(buf, "+ %s: %s\n", d.Chain, d.Rule)
+		case "added":
+			fmt.Fprintf(buf, "- %s: %s\n", d.Chain, d.Rule)
+		default:
+			fmt.Fprintf(buf, "~ %s reordered\n", d.Chain)
+		}
+	}
+	return buf.String(), nil
+}
+
+// canonical programs input into a scratch network namespace and reads the
+// chains back, so its rules are spelled the way iptables-save spells the
+// live ones
+func canonical(chains []Chain, input string) (Snapshot, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer orig.Close()
+	scratch, err := netns.New()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("creating a scratch network namespace: %v", err)
+	}
+	defer scratch.Close()
+	defer netns.Set(orig)
+
+	cmd := exec.Command("iptables-restore")
+	cmd.Stdin = strings.NewReader(input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return Snapshot{}, fmt.Errorf("iptables-restore: %v: %s", err, output)
+	}
+	return Capture(chains)
+}
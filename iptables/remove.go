@@ -0,0 +1,74 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/rancher/plugin-manager/audit"
+)
+
+// Remove deletes the jumps into the owned chains and the chains themselves
+// and stops reporting drift, for cleaning up on exit
+func (d *Drift) Remove() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.baseline = nil
+
+	var lastErr error
+	for _, chain := range d.Chains {
+		if err := d.removeChain(chain); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (d *Drift) removeChain(chain Chain) error {
+	output, err := exec.Command("iptables-save", "-t", chain.Table).Output()
+	if err != nil {
+		return fmt.Errorf("iptables-save -t %s: %v", chain.Table, err)
+	}
+
+	for _, rule := range parseSave(output) {
+		if ruleChain(rule) == chain.Parent && ruleTarget(rule) == chain.Name {
+			// Deleting takes the same spec the rule was appended with
+			args := append([]string{"-w", "-t", chain.Table, "-D"}, strings.Fields(rule)[1:]...)
+			if err := d.removeRule(chain.Table+"/"+chain.Parent, rule, args); err != nil {
+				return err
+			}
+		}
+	}
+	if !strings.Contains(string(output), "\n:"+chain.Name+" ") {
+		return nil
+	}
+
+	key := chain.Table + "/" + chain.Name
+	if audit.Would(d.Subsystem, "iptables.remove", key, nil) {
+		return nil
+	}
+	log.Infof("Removing %s chain %s", d.Subsystem, key)
+	err = runIptables("-w", "-t", chain.Table, "-F", chain.Name)
+	if err == nil {
+		err = runIptables("-w", "-t", chain.Table, "-X", chain.Name)
+	}
+	audit.Record(d.Subsystem, "iptables.remove", key, nil, nil, err)
+	return err
+}
+
+func (d *Drift) removeRule(chain, rule string, args []string) error {
+	if audit.Would(d.Subsystem, "iptables.remove", chain, rule) {
+		return nil
+	}
+	err := runIptables(args...)
+	audit.Record(d.Subsystem, "iptables.remove", chain, rule, nil, err)
+	return err
+}
+
+func runIptables(args ...string) error {
+	log.Debugf("Running iptables %s", strings.Join(args, " "))
+	if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
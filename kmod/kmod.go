@@ -0,0 +1,107 @@
+// Package kmod loads the kernel modules the subsystems need, using the
+// host's modules when run in a container, so minimal OS images fail with
+// the missing modules named rather than with cryptic CNI errors
+package kmod
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("kmod")
+
+// MissingError lists the modules that couldn't be loaded and why
+type MissingError map[string]string
+
+func (e MissingError) Error() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var missing []string
+	for _, name := range names {
+		missing = append(missing, fmt.Sprintf("%s (%s)", name, e[name]))
+	}
+	return "missing kernel modules: " + strings.Join(missing, ", ")
+}
+
+// Loaded reports whether the module is loaded or built into the kernel.
+// Built in modules without parameters are only listed in modules.builtin.
+func Loaded(name string) bool {
+	if _, err := os.Stat(filepath.Join("/sys/module", name)); err == nil {
+		return true
+	}
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	release := ""
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release += string(rune(c))
+	}
+	builtin, _ := ioutil.ReadFile(filepath.Join("/lib/modules", release, "modules.builtin"))
+	return strings.Contains(string(builtin), "/"+name+".ko\n")
+}
+
+// Load runs modprobe, in PID 1's mount namespace when it isn't ours so the
+// host's modules are found from inside a container
+func Load(name string) error {
+	args := []string{"modprobe", name}
+	if self, err := os.Readlink("/proc/self/ns/mnt"); err == nil {
+		if host, err := os.Readlink("/proc/1/ns/mnt"); err == nil && host != self {
+			args = append([]string{"nsenter", "--mount=/proc/1/ns/mnt", "--"}, args...)
+		}
+	}
+	log.Debugf("Running %s", strings.Join(args, " "))
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// Ensure loads the modules that aren't already, unless load is false, and
+// returns a MissingError naming those still missing
+func Ensure(names []string, load bool) error {
+	missing := MissingError{}
+	for _, name := range names {
+		if Loaded(name) {
+			continue
+		}
+		if !load {
+			missing[name] = "not loaded"
+			continue
+		}
+		if audit.Would("kmod", "module.load", name, nil) {
+			continue
+		}
+		log.Infof("Loading kernel module %s", name)
+		err := Load(name)
+		audit.Record("kmod", "module.load", name, nil, nil, err)
+		if err != nil {
+			missing[name] = err.Error()
+		} else if !Loaded(name) {
+			missing[name] = "still not loaded after modprobe"
+		}
+	}
+	if len(missing) > 0 {
+		return missing
+	}
+	return nil
+}
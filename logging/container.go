@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// containerHook adds the Rancher UUID to entries about a container, so they
+// can be matched to what the Rancher UI shows
+type containerHook struct {
+	sync.RWMutex
+	uuids map[string]string
+}
+
+var containers = &containerHook{uuids: map[string]string{}}
+
+func (h *containerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *containerHook) Fire(entry *logrus.Entry) error {
+	id, ok := entry.Data[ContainerIDKey].(string)
+	if !ok {
+		return nil
+	}
+	if _, ok := entry.Data[ContainerUUIDKey]; ok {
+		return nil
+	}
+	h.RLock()
+	uuid := h.uuids[id]
+	h.RUnlock()
+	if uuid == "" {
+		return nil
+	}
+	// Copied for the same reason as in hostHook
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data[ContainerUUIDKey] = uuid
+	entry.Data = data
+	return nil
+}
+
+func init() {
+	logrus.AddHook(containers)
+}
+
+// SetContainerUUIDs replaces the Rancher UUIDs of containers by Docker ID,
+// from a full metadata version
+func SetContainerUUIDs(uuids map[string]string) {
+	containers.Lock()
+	defer containers.Unlock()
+	containers.uuids = uuids
+}
+
+// SetContainerUUID records the Rancher UUID of one container, for those
+// seen in Docker before metadata lists them
+func SetContainerUUID(id, uuid string) {
+	if id == "" || uuid == "" {
+		return
+	}
+	containers.Lock()
+	defer containers.Unlock()
+	containers.uuids[id] = uuid
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	levelLock sync.Mutex
+	// baseLevel is the level SIGUSR1 toggles back to from debug
+	baseLevel = logrus.InfoLevel
+)
+
+// SetLevel changes the log level and makes it the one SIGUSR1 returns to
+func SetLevel(level logrus.Level) {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	setLevel(level)
+	if level != logrus.DebugLevel {
+		baseLevel = level
+	}
+}
+
+func setLevel(level logrus.Level) {
+	if logrus.GetLevel() != level {
+		logrus.Infof("Changing log level from %s to %s", logrus.GetLevel(), level)
+	}
+	logrus.SetLevel(level)
+}
+
+// LevelHandler reports the log level on GET and changes it to the level
+// in the body or ?level= on PUT or POST
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "PUT", "POST":
+			value := req.URL.Query().Get("level")
+			if value == "" {
+				body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 64))
+				if err != nil {
+					http.Error(rw, err.Error(), http.StatusBadRequest)
+					return
+				}
+				value = strings.TrimSpace(string(body))
+			}
+			level, err := logrus.ParseLevel(value)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			levelLock.Lock()
+			setLevel(level)
+			levelLock.Unlock()
+		default:
+			http.Error(rw, "use GET, PUT or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(rw, logrus.GetLevel())
+	})
+}
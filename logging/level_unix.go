@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// WatchSignals toggles between debug and the configured level on SIGUSR1
+func WatchSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			levelLock.Lock()
+			if logrus.GetLevel() == logrus.DebugLevel {
+				setLevel(baseLevel)
+			} else {
+				setLevel(logrus.DebugLevel)
+			}
+			levelLock.Unlock()
+		}
+	}()
+}
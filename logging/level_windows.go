@@ -0,0 +1,6 @@
+package logging
+
+// WatchSignals does nothing, Windows has no SIGUSR1 and the level is only
+// changed through LevelHandler
+func WatchSignals() {
+}
@@ -0,0 +1,80 @@
+// Package logging sets up the log output format and the fields every
+// subsystem's entries carry, so aggregation pipelines can index them
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Field names used consistently across subsystems
+const (
+	SubsystemKey   = "subsystem"
+	ContainerIDKey = "container_id"
+	HostUUIDKey    = "host_uuid"
+	// ContainerUUIDKey is added to every entry with a ContainerIDKey once
+	// the container's Rancher UUID is known
+	ContainerUUIDKey = "container_uuid"
+)
+
+// Subsystem returns the logger for a subsystem, its entries are tagged with
+// the subsystem name
+func Subsystem(name string) *logrus.Entry {
+	return logrus.WithField(SubsystemKey, name)
+}
+
+// SetFormat switches the output between the default text and JSON
+func SetFormat(format string) error {
+	switch format {
+	case "", "text":
+		repeats.Formatter = &logrus.TextFormatter{}
+	case "json":
+		repeats.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	logrus.SetFormatter(repeats)
+	return nil
+}
+
+// hostHook adds the host UUID to every entry once it is known
+type hostHook struct {
+	sync.Mutex
+	uuid string
+}
+
+var host = &hostHook{}
+
+func (h *hostHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *hostHook) Fire(entry *logrus.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.uuid == "" {
+		return nil
+	}
+	// Data can be shared with the Entry the caller logged through, so it's
+	// copied rather than written to
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data[HostUUIDKey] = h.uuid
+	entry.Data = data
+	return nil
+}
+
+func init() {
+	logrus.AddHook(host)
+}
+
+// SetHostUUID tags every following entry with the host's UUID
+func SetHostUUID(uuid string) {
+	host.Lock()
+	defer host.Unlock()
+	host.uuid = uuid
+}
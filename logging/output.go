@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	syslogSocket  = "/dev/log"
+	journalSocket = "/run/systemd/journal/socket"
+	// syslogDaemon is the syslog facility entries are logged under
+	syslogDaemon = 3
+)
+
+// SetOutput sends entries to stderr, syslog or the systemd journal. It
+// replaces the format set by SetFormat for the latter two.
+func SetOutput(output string) error {
+	switch output {
+	case "", "stderr":
+		logrus.SetOutput(os.Stderr)
+		return nil
+	case "syslog":
+		repeats.Formatter = &syslogFormatter{tag: identifier()}
+		logrus.SetOutput(&socketWriter{addr: syslogSocket, networks: []string{"unixgram", "unix"}})
+	case "journald":
+		repeats.Formatter = &journalFormatter{tag: identifier()}
+		logrus.SetOutput(&socketWriter{addr: journalSocket, networks: []string{"unixgram"}})
+	default:
+		return fmt.Errorf("unknown log output %q, expected stderr, syslog or journald", output)
+	}
+	logrus.SetFormatter(repeats)
+	return nil
+}
+
+func identifier() string {
+	return filepath.Base(os.Args[0])
+}
+
+// priority maps logrus levels to syslog severities
+func priority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func sortedFields(data logrus.Fields) []string {
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syslogFormatter writes RFC 3164 messages for the local syslog socket,
+// with the fields appended as key=value
+type syslogFormatter struct {
+	tag string
+}
+
+func (f *syslogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<%d>%s %s[%d]: %s", syslogDaemon*8+priority(entry.Level), entry.Time.Format(time.Stamp), f.tag, os.Getpid(), entry.Message)
+	for _, k := range sortedFields(entry.Data) {
+		fmt.Fprintf(buf, " %s=%q", k, fmt.Sprint(entry.Data[k]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// journalFormatter writes the journal's native protocol, every field
+// becoming an upper case journal field
+type journalFormatter struct {
+	tag string
+}
+
+func (f *journalFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", entry.Message)
+	writeJournalField(buf, "PRIORITY", fmt.Sprint(priority(entry.Level)))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", f.tag)
+	for _, k := range sortedFields(entry.Data) {
+		if name := journalFieldName(k); name != "" {
+			writeJournalField(buf, name, fmt.Sprint(entry.Data[k]))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// journalFieldName makes k a valid journal field, upper case letters,
+// digits and underscores not starting with an underscore
+func journalFieldName(k string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// Values with newlines are sent as the name, a little endian length and
+	// the raw value
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// socketWriter sends each formatted entry to a local socket, dialling it
+// again after a failed write
+type socketWriter struct {
+	sync.Mutex
+	addr     string
+	networks []string
+	conn     net.Conn
+}
+
+func (w *socketWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			conn, err := w.dial()
+			if err != nil {
+				return 0, err
+			}
+			w.conn = conn
+		}
+		n, err := w.conn.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, fmt.Errorf("failed to write to %s", w.addr)
+}
+
+func (w *socketWriter) dial() (net.Conn, error) {
+	var lastErr error
+	for _, network := range w.networks {
+		conn, err := net.Dial(network, w.addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
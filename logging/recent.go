@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// recentEntries is how many of the latest log lines are kept in memory for
+// crash reports
+const recentEntries = 500
+
+// recentHook keeps the latest log lines formatted as text
+type recentHook struct {
+	sync.Mutex
+	formatter logrus.Formatter
+	lines     []string
+	next      int
+}
+
+var recent = &recentHook{
+	formatter: &logrus.TextFormatter{DisableColors: true},
+}
+
+func (h *recentHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recentHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	if len(h.lines) < recentEntries {
+		h.lines = append(h.lines, string(line))
+	} else {
+		h.lines[h.next] = string(line)
+	}
+	h.next = (h.next + 1) % recentEntries
+	return nil
+}
+
+func init() {
+	logrus.AddHook(recent)
+}
+
+// Recent returns the latest log lines, oldest first
+func Recent() []string {
+	recent.Lock()
+	defer recent.Unlock()
+	if len(recent.lines) < recentEntries {
+		return append([]string{}, recent.lines...)
+	}
+	return append(append([]string{}, recent.lines[recent.next:]...), recent.lines[:recent.next]...)
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RepeatedKey counts the identical entries a summary stands in for
+const RepeatedKey = "repeated"
+
+// maxTrackedRepeats bounds the distinct lines remembered, past it new lines
+// are logged without suppression
+const maxTrackedRepeats = 1000
+
+// repeatFormatter drops warnings and errors identical to one logged within
+// the window and summarises how many were dropped once it expires
+type repeatFormatter struct {
+	logrus.Formatter
+
+	lock    sync.Mutex
+	window  time.Duration
+	seen    map[string]*repeat
+	started bool
+}
+
+type repeat struct {
+	first      time.Time
+	suppressed int
+	entry      logrus.Entry
+}
+
+var repeats = &repeatFormatter{seen: map[string]*repeat{}}
+
+// SetRepeatWindow suppresses warnings and errors identical to one logged
+// less than window ago, zero logs every line
+func SetRepeatWindow(window time.Duration) {
+	repeats.lock.Lock()
+	start := !repeats.started && window > 0
+	repeats.started = repeats.started || start
+	repeats.window = window
+	repeats.lock.Unlock()
+	if start {
+		go repeats.flushEvery(window)
+	}
+}
+
+func repeatKey(entry *logrus.Entry) string {
+	var keys []string
+	for k := range entry.Data {
+		if k != HostUUIDKey && k != ContainerUUIDKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s|%s", entry.Level, entry.Message)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "|%s=%v", k, entry.Data[k])
+	}
+	return buf.String()
+}
+
+func (f *repeatFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > logrus.WarnLevel || entry.Level < logrus.ErrorLevel {
+		return f.Formatter.Format(entry)
+	}
+	if _, ok := entry.Data[RepeatedKey]; ok {
+		return f.Formatter.Format(entry)
+	}
+
+	key := repeatKey(entry)
+	f.lock.Lock()
+	if f.window == 0 {
+		f.lock.Unlock()
+		return f.Formatter.Format(entry)
+	}
+	r, ok := f.seen[key]
+	if ok && entry.Time.Sub(r.first) < f.window {
+		r.suppressed++
+		f.lock.Unlock()
+		return nil, nil
+	}
+	var summary *logrus.Entry
+	if ok && r.suppressed > 0 {
+		summary = r.summary(f.window)
+	}
+	if ok || len(f.seen) < maxTrackedRepeats {
+		f.seen[key] = &repeat{first: entry.Time, entry: *entry}
+	}
+	f.lock.Unlock()
+
+	var out []byte
+	if summary != nil {
+		line, err := f.Formatter.Format(summary)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, line...)
+	}
+	line, err := f.Formatter.Format(entry)
+	return append(out, line...), err
+}
+
+func (r *repeat) summary(window time.Duration) *logrus.Entry {
+	data := logrus.Fields{RepeatedKey: r.suppressed}
+	for k, v := range r.entry.Data {
+		data[k] = v
+	}
+	return &logrus.Entry{
+		Logger:  r.entry.Logger,
+		Data:    data,
+		Time:    time.Now(),
+		Level:   r.entry.Level,
+		Message: fmt.Sprintf("%s (repeated %d times in %v)", r.entry.Message, r.suppressed, window),
+	}
+}
+
+// flushEvery logs the summaries of lines that stopped repeating, so counts
+// aren't held back until the line next appears
+func (f *repeatFormatter) flushEvery(window time.Duration) {
+	for range time.Tick(window) {
+		f.lock.Lock()
+		if f.window == 0 {
+			f.seen = map[string]*repeat{}
+		}
+		var summaries []*logrus.Entry
+		now := time.Now()
+		for key, r := range f.seen {
+			if now.Sub(r.first) < f.window {
+				continue
+			}
+			if r.suppressed > 0 {
+				summaries = append(summaries, r.summary(f.window))
+			}
+			delete(f.seen, key)
+		}
+		f.lock.Unlock()
+
+		for _, summary := range summaries {
+			entry := logrus.WithFields(summary.Data)
+			if summary.Level == logrus.ErrorLevel {
+				entry.Error(summary.Message)
+			} else {
+				entry.Warn(summary.Message)
+			}
+		}
+	}
+}
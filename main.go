@@ -1,23 +1,68 @@
+//go:build !windows
+// +build !windows
+
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 	"github.com/pkg/errors"
-	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/audit"
 	"github.com/rancher/plugin-manager/binexec"
+	"github.com/rancher/plugin-manager/cleanup"
 	"github.com/rancher/plugin-manager/cniconf"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/dockerapi"
+	"github.com/rancher/plugin-manager/engine"
 	"github.com/rancher/plugin-manager/events"
+	"github.com/rancher/plugin-manager/exitcode"
+	"github.com/rancher/plugin-manager/features"
+	"github.com/rancher/plugin-manager/floatingip"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/hostlock"
 	"github.com/rancher/plugin-manager/hostnat"
 	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/hostroutes"
+	"github.com/rancher/plugin-manager/kmod"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/rancher/plugin-manager/reaper"
+	"github.com/rancher/plugin-manager/rootless"
+	"github.com/rancher/plugin-manager/shaping"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/startup"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+	"github.com/rancher/plugin-manager/sysctls"
+	"github.com/rancher/plugin-manager/systemd"
+	"github.com/rancher/plugin-manager/tracing"
+	"github.com/rancher/plugin-manager/watchdog"
 	"github.com/urfave/cli"
 )
 
-var VERSION = "v0.0.0-dev"
+var (
+	VERSION = "v0.0.0-dev"
+	COMMIT  = ""
+)
+
+var buildInfo = metrics.NewGauge("plugin_manager_build_info",
+	"Always 1, labelled with the running version, git commit and Go version", "version", "commit", "go_version")
 
 func main() {
 	app := cli.NewApp()
@@ -25,63 +70,1341 @@ func main() {
 	app.Version = VERSION
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "metadata-url",
-			Value: "http://rancher-metadata/2016-07-29",
+			Name:   "config",
+			EnvVar: "PM_CONFIG,PLUGIN_MANAGER_CONFIG",
+			Usage:  "JSON, YAML or TOML file of flag names to values, read by its extension. Flags and environment variables override it.",
+		},
+		cli.StringFlag{
+			Name:   "config-dir",
+			EnvVar: "PM_CONFIG_DIR,PLUGIN_MANAGER_CONFIG_DIR",
+			Usage:  "Directory of .json, .yaml, .yml or .toml fragments merged over --config in lexical order",
+		},
+		cli.StringFlag{
+			Name:   "runtime",
+			EnvVar: "PM_RUNTIME,PLUGIN_MANAGER_RUNTIME",
+			Value:  "docker",
+			Usage:  "Container runtime to manage, docker, podman, containerd or cri. Under containerd and cri only the subsystems not needing the Docker API start.",
+		},
+		cli.StringFlag{
+			Name:   "docker-host",
+			EnvVar: "PM_DOCKER_HOST,PLUGIN_MANAGER_DOCKER_HOST",
+			Usage:  "Docker daemon to manage instead of DOCKER_HOST's. A tcp:// daemon is taken to be on another host, reached over TLS, and only the reaper starts.",
+		},
+		cli.StringFlag{
+			Name:   "docker-tls-ca",
+			EnvVar: "PM_DOCKER_TLS_CA,PLUGIN_MANAGER_DOCKER_TLS_CA",
+			Usage:  "CA bundle used to verify a tcp:// --docker-host instead of the system roots",
+		},
+		cli.StringFlag{
+			Name:   "docker-tls-cert",
+			EnvVar: "PM_DOCKER_TLS_CERT,PLUGIN_MANAGER_DOCKER_TLS_CERT",
+			Usage:  "Client certificate presented to a tcp:// --docker-host",
+		},
+		cli.StringFlag{
+			Name:   "docker-tls-key",
+			EnvVar: "PM_DOCKER_TLS_KEY,PLUGIN_MANAGER_DOCKER_TLS_KEY",
+			Usage:  "Key for --docker-tls-cert",
+		},
+		cli.StringFlag{
+			Name:   "containerd-address",
+			EnvVar: "PM_CONTAINERD_ADDRESS,PLUGIN_MANAGER_CONTAINERD_ADDRESS",
+			Usage:  "containerd socket for --runtime containerd, empty for unix:///run/containerd/containerd.sock",
+		},
+		cli.StringFlag{
+			Name:   "cri-endpoint",
+			EnvVar: "PM_CRI_ENDPOINT,PLUGIN_MANAGER_CRI_ENDPOINT",
+			Usage:  "CRI runtime socket for --runtime cri, such as unix:///var/run/crio/crio.sock, empty for the first of containerd's, CRI-O's and cri-dockerd's sockets that exists",
+		},
+		cli.StringFlag{
+			Name:   "containerd-namespace",
+			EnvVar: "PM_CONTAINERD_NAMESPACE,PLUGIN_MANAGER_CONTAINERD_NAMESPACE",
+			Value:  "default",
+			Usage:  "containerd namespace holding the containers to manage",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			EnvVar: "PM_PROFILE,PLUGIN_MANAGER_PROFILE",
+			Usage:  "Start the subsystems of a deployment profile: full, network-only, reaper-only or k8s-compat. --disable drops some from it.",
+		},
+		cli.StringSliceFlag{
+			Name:   "enable",
+			EnvVar: "PM_ENABLE,PLUGIN_MANAGER_ENABLE",
+			Usage:  "Start only these subsystems, by default all of them. May be repeated, see --disable for the names. Conflicts with --profile.",
+		},
+		cli.StringSliceFlag{
+			Name:   "disable",
+			EnvVar: "PM_DISABLE,PLUGIN_MANAGER_DISABLE",
+			Usage:  "Subsystem not to start, one of network, events, binexec, reaper, hostports, hostnat, hostroutes, shaping, cniconf, floatingip or sysctls. May be repeated.",
+		},
+		cli.IntFlag{
+			Name:   "event-workers",
+			EnvVar: "PM_EVENT_WORKERS,PLUGIN_MANAGER_EVENT_WORKERS",
+			Value:  100,
+			Usage:  "Docker events handled at once, also how many may be queued",
+		},
+		cli.IntFlag{
+			Name:   "metadata-interval",
+			EnvVar: "PM_METADATA_INTERVAL,PLUGIN_MANAGER_METADATA_INTERVAL",
+			Value:  source.IntervalSeconds,
+			Usage:  "Seconds between metadata checks when not long-polling, and after errors",
+		},
+		cli.DurationFlag{
+			Name:   "reapply-interval",
+			EnvVar: "PM_REAPPLY_INTERVAL,PLUGIN_MANAGER_REAPPLY_INTERVAL",
+			Value:  5 * time.Minute,
+			Usage:  "How often rules, routes and configs are programmed again when nothing changed",
+		},
+		cli.DurationFlag{
+			Name:   "drift-check-interval",
+			EnvVar: "PM_DRIFT_CHECK_INTERVAL,PLUGIN_MANAGER_DRIFT_CHECK_INTERVAL",
+			Value:  hostports.DriftCheckEvery,
+			Usage:  "How often programmed iptables rules are compared against the live ones",
+		},
+		cli.BoolTFlag{
+			Name:   "load-modules",
+			EnvVar: "PM_LOAD_MODULES,PLUGIN_MANAGER_LOAD_MODULES",
+			Usage:  "modprobe the kernel modules the enabled subsystems need, in the host's mount namespace when run in a container. With false they are only checked.",
+		},
+		cli.StringSliceFlag{
+			Name:   "sysctl",
+			EnvVar: "PM_SYSCTL,PLUGIN_MANAGER_SYSCTL",
+			Usage:  "Kernel setting to enforce as key=value, on top of net.ipv4.ip_forward=1. A * in the key matches every interface. May be repeated.",
+		},
+		cli.DurationFlag{
+			Name:   "sysctl-interval",
+			EnvVar: "PM_SYSCTL_INTERVAL,PLUGIN_MANAGER_SYSCTL_INTERVAL",
+			Value:  sysctls.EnforceEvery,
+			Usage:  "How often the --sysctl settings are checked and set back when something changed them",
+		},
+		cli.StringFlag{
+			Name:   "cni-conf-dir",
+			EnvVar: "PM_CNI_CONF_DIR,PLUGIN_MANAGER_CNI_CONF_DIR",
+			Value:  "/etc/cni",
+			Usage:  "Directory holding the <network>.d CNI config directories",
+		},
+		cli.StringFlag{
+			Name:   "kubelet-cni-dir",
+			EnvVar: "PM_KUBELET_CNI_DIR,PLUGIN_MANAGER_KUBELET_CNI_DIR",
+			Usage:  "Kubelet CNI config directory, such as /etc/cni/net.d, to also write the default network's config to as a conflist, empty not to",
+		},
+		cli.IntFlag{
+			Name:   "kubelet-cni-priority",
+			EnvVar: "PM_KUBELET_CNI_PRIORITY,PLUGIN_MANAGER_KUBELET_CNI_PRIORITY",
+			Value:  10,
+			Usage:  "Number from 0 to 99 prefixing the kubelet conflist's name, the kubelet using the config first in name order",
+		},
+		cli.StringFlag{
+			Name:   "metadata-url",
+			EnvVar: "PM_METADATA_URL,PLUGIN_MANAGER_METADATA_URL",
+			Value:  "http://rancher-metadata/2016-07-29",
+			Usage:  "Comma separated rancher-metadata endpoints, later ones are used when earlier ones fail",
+		},
+		cli.StringFlag{
+			Name:   "metadata-file",
+			EnvVar: "PM_METADATA_FILE,PLUGIN_MANAGER_METADATA_FILE",
+			Usage:  "Read metadata from this JSON or YAML file instead of rancher-metadata, reloaded when it changes",
 		},
 		cli.BoolFlag{
-			Name:  "debug",
-			Usage: "Turn on debug logging",
+			Name:   "kubernetes",
+			EnvVar: "PM_KUBERNETES,PLUGIN_MANAGER_KUBERNETES",
+			Usage:  "Read metadata from the Kubernetes API instead of rancher-metadata",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-api",
+			EnvVar: "PM_KUBERNETES_API,PLUGIN_MANAGER_KUBERNETES_API",
+			Usage:  "Kubernetes API server URL, defaults to the in-cluster service",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-node",
+			EnvVar: "PM_KUBERNETES_NODE,PLUGIN_MANAGER_KUBERNETES_NODE,NODE_NAME",
+			Usage:  "Name of the node plugin-manager runs on, defaults to the hostname",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-networks",
+			EnvVar: "PM_KUBERNETES_NETWORKS,PLUGIN_MANAGER_KUBERNETES_NETWORKS",
+			Value:  "kube-system/rancher-networks",
+			Usage:  "ConfigMap, as namespace/name, holding the networks JSON under the networks key",
+		},
+		cli.DurationFlag{
+			Name:   "metadata-connect-timeout",
+			EnvVar: "PM_METADATA_CONNECT_TIMEOUT,PLUGIN_MANAGER_METADATA_CONNECT_TIMEOUT",
+			Value:  5 * time.Second,
+			Usage:  "How long to wait for a connection to rancher-metadata",
+		},
+		cli.DurationFlag{
+			Name:   "metadata-read-timeout",
+			EnvVar: "PM_METADATA_READ_TIMEOUT,PLUGIN_MANAGER_METADATA_READ_TIMEOUT",
+			Value:  10 * time.Second,
+			Usage:  "How long to wait for a rancher-metadata response, on top of any long-poll wait",
+		},
+		cli.IntFlag{
+			Name:   "metadata-retries",
+			EnvVar: "PM_METADATA_RETRIES,PLUGIN_MANAGER_METADATA_RETRIES",
+			Value:  3,
+			Usage:  "How many times to retry a failed rancher-metadata call",
+		},
+		cli.DurationFlag{
+			Name:   "metadata-retry-backoff",
+			EnvVar: "PM_METADATA_RETRY_BACKOFF,PLUGIN_MANAGER_METADATA_RETRY_BACKOFF",
+			Value:  500 * time.Millisecond,
+			Usage:  "Initial delay between rancher-metadata retries, doubling each attempt",
+		},
+		cli.StringFlag{
+			Name:   "metadata-ca",
+			EnvVar: "PM_METADATA_CA,PLUGIN_MANAGER_METADATA_CA",
+			Usage:  "CA bundle used to verify https rancher-metadata endpoints instead of the system roots",
+		},
+		cli.StringFlag{
+			Name:   "metadata-cert",
+			EnvVar: "PM_METADATA_CERT,PLUGIN_MANAGER_METADATA_CERT",
+			Usage:  "Client certificate presented to https rancher-metadata endpoints",
+		},
+		cli.StringFlag{
+			Name:   "metadata-key",
+			EnvVar: "PM_METADATA_KEY,PLUGIN_MANAGER_METADATA_KEY",
+			Usage:  "Key for --metadata-cert",
+		},
+		cli.StringFlag{
+			Name:   "metadata-token-file",
+			EnvVar: "PM_METADATA_TOKEN_FILE,PLUGIN_MANAGER_METADATA_TOKEN_FILE",
+			Usage:  "File holding a bearer token sent with every rancher-metadata request",
+		},
+		cli.StringFlag{
+			Name:   "metadata-cache",
+			EnvVar: "PM_METADATA_CACHE,PLUGIN_MANAGER_METADATA_CACHE",
+			Value:  "/var/lib/rancher/plugin-manager/metadata-cache.json",
+			Usage:  "Save the last good metadata here and fall back to it when metadata is unreachable at startup, empty to disable",
+		},
+		cli.DurationFlag{
+			Name:   "metadata-long-poll",
+			EnvVar: "PM_METADATA_LONG_POLL,PLUGIN_MANAGER_METADATA_LONG_POLL",
+			Usage:  "How long rancher-metadata may hold a change subscription open, 0 polls every 5s",
+		},
+		cli.BoolFlag{
+			Name:   "debug",
+			EnvVar: "PM_DEBUG,PLUGIN_MANAGER_DEBUG",
+			Usage:  "Turn on debug logging",
+		},
+		cli.DurationFlag{
+			Name:   "log-repeat-window",
+			EnvVar: "PM_LOG_REPEAT_WINDOW,PLUGIN_MANAGER_LOG_REPEAT_WINDOW",
+			Value:  time.Minute,
+			Usage:  "Suppress warnings and errors identical to one logged within this long, then log how often they repeated, 0 logs every line",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "PM_LOG_FORMAT,PLUGIN_MANAGER_LOG_FORMAT",
+			Value:  "text",
+			Usage:  "Log output format, text or json",
+		},
+		cli.StringFlag{
+			Name:   "log-output",
+			EnvVar: "PM_LOG_OUTPUT,PLUGIN_MANAGER_LOG_OUTPUT",
+			Value:  "stderr",
+			Usage:  "Where logs are written, stderr, syslog or journald. The latter two ignore --log-format.",
+		},
+		cli.StringSliceFlag{
+			Name:   "feature",
+			EnvVar: "PM_FEATURE,PLUGIN_MANAGER_FEATURE",
+			Usage:  "Turn an experimental feature on or off on this host as name=true or name=false, metadata overrides it. May be repeated.",
+		},
+		cli.DurationFlag{
+			Name:   "ip-reuse-quiet-period",
+			EnvVar: "PM_IP_REUSE_QUIET_PERIOD,PLUGIN_MANAGER_IP_REUSE_QUIET_PERIOD",
+			Value:  30 * time.Second,
+			Usage:  "How long to withhold a released IP whose flows could not be flushed",
+		},
+		cli.StringFlag{
+			Name:   "binexec-trusted-keys",
+			EnvVar: "PM_BINEXEC_TRUSTED_KEYS,PLUGIN_MANAGER_BINEXEC_TRUSTED_KEYS",
+			Usage:  "Directory of PEM public keys plugin binary signatures must match",
+		},
+		cli.BoolFlag{
+			Name:   "binexec-require-signature",
+			EnvVar: "PM_BINEXEC_REQUIRE_SIGNATURE,PLUGIN_MANAGER_BINEXEC_REQUIRE_SIGNATURE",
+			Usage:  "Refuse unsigned plugin binaries when trusted keys are configured",
+		},
+		cli.IntFlag{
+			Name:   "binexec-keep-versions",
+			EnvVar: "PM_BINEXEC_KEEP_VERSIONS,PLUGIN_MANAGER_BINEXEC_KEEP_VERSIONS",
+			Usage:  "Number of versions of each plugin binary kept for rollback",
+			Value:  3,
+		},
+		cli.DurationFlag{
+			Name:   "binexec-timeout",
+			EnvVar: "PM_BINEXEC_TIMEOUT,PLUGIN_MANAGER_BINEXEC_TIMEOUT",
+			Usage:  "Kill plugin binary invocations that run longer than this, 0 disables",
+			Value:  2 * time.Minute,
+		},
+		cli.Int64Flag{
+			Name:   "binexec-memory-limit",
+			EnvVar: "PM_BINEXEC_MEMORY_LIMIT,PLUGIN_MANAGER_BINEXEC_MEMORY_LIMIT",
+			Usage:  "Memory limit in bytes for each plugin binary invocation, 0 disables",
 		},
+		cli.IntFlag{
+			Name:   "binexec-cpu-quota",
+			EnvVar: "PM_BINEXEC_CPU_QUOTA,PLUGIN_MANAGER_BINEXEC_CPU_QUOTA",
+			Usage:  "CPU limit in percent of one CPU for each plugin binary invocation, 0 disables",
+		},
+		cli.StringFlag{
+			Name:   "binexec-output-dir",
+			EnvVar: "PM_BINEXEC_OUTPUT_DIR,PLUGIN_MANAGER_BINEXEC_OUTPUT_DIR",
+			Usage:  "Directory plugin binary output is captured in before being logged, disabled if empty",
+			Value:  "/var/run/rancher-cni-output",
+		},
+		cli.DurationFlag{
+			Name:   "binexec-verify-interval",
+			EnvVar: "PM_BINEXEC_VERIFY_INTERVAL,PLUGIN_MANAGER_BINEXEC_VERIFY_INTERVAL",
+			Usage:  "How often installed plugin binaries are re-hashed and repaired, 0 disables",
+			Value:  10 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:   "binexec-workers",
+			EnvVar: "PM_BINEXEC_WORKERS,PLUGIN_MANAGER_BINEXEC_WORKERS",
+			Usage:  "Number of plugin containers whose binaries are processed in parallel",
+			Value:  4,
+		},
+		cli.BoolFlag{
+			Name:   "binexec-sandbox",
+			EnvVar: "PM_BINEXEC_SANDBOX,PLUGIN_MANAGER_BINEXEC_SANDBOX",
+			Usage:  "Run plugin binaries with no_new_privs, a seccomp filter and reduced capabilities unless the plugin opts out",
+		},
+		cli.StringFlag{
+			Name:   "binexec-sandbox-capabilities",
+			EnvVar: "PM_BINEXEC_SANDBOX_CAPABILITIES,PLUGIN_MANAGER_BINEXEC_SANDBOX_CAPABILITIES",
+			Usage:  "Capabilities sandboxed plugin binaries keep unless the plugin declares its own",
+			Value:  "NET_ADMIN,NET_RAW,SYS_ADMIN",
+		},
+		cli.StringFlag{
+			Name:   "binexec-user",
+			EnvVar: "PM_BINEXEC_USER,PLUGIN_MANAGER_BINEXEC_USER",
+			Usage:  "Numeric uid[:gid] plugin binaries and downloaded daemons run as, keeping only the sandbox capabilities, root if empty",
+		},
+		cli.DurationFlag{
+			Name:   "binexec-health-interval",
+			EnvVar: "PM_BINEXEC_HEALTH_INTERVAL,PLUGIN_MANAGER_BINEXEC_HEALTH_INTERVAL",
+			Usage:  "How often plugin binary health checks run, 0 disables",
+			Value:  time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "binexec-retention",
+			EnvVar: "PM_BINEXEC_RETENTION,PLUGIN_MANAGER_BINEXEC_RETENTION",
+			Usage:  "Remove plugin binaries whose source is gone after they go unused this long, 0 disables",
+			Value:  7 * 24 * time.Hour,
+		},
+		cli.IntFlag{
+			Name:   "binexec-retries",
+			EnvVar: "PM_BINEXEC_RETRIES,PLUGIN_MANAGER_BINEXEC_RETRIES",
+			Usage:  "How many times a failed plugin binary DEL or CHECK is retried, ADD never is",
+		},
+		cli.DurationFlag{
+			Name:   "binexec-retry-backoff",
+			EnvVar: "PM_BINEXEC_RETRY_BACKOFF,PLUGIN_MANAGER_BINEXEC_RETRY_BACKOFF",
+			Usage:  "Wait before the first retry of a failed plugin binary invocation, doubling each retry",
+			Value:  time.Second,
+		},
+		cli.StringFlag{
+			Name:   "metrics-listen",
+			EnvVar: "PM_METRICS_LISTEN,PLUGIN_MANAGER_METRICS_LISTEN",
+			Usage:  "Address to serve Prometheus metrics on, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:   "admin-listen",
+			EnvVar: "PM_ADMIN_LISTEN,PLUGIN_MANAGER_ADMIN_LISTEN",
+			Usage:  "Address to serve debug endpoints on, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			EnvVar: "PM_OTLP_ENDPOINT,PLUGIN_MANAGER_OTLP_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT",
+			Usage:  "OpenTelemetry collector to export container event traces to over OTLP/HTTP, e.g. http://localhost:4318",
+		},
+		cli.StringFlag{
+			Name:   "cattle-url",
+			EnvVar: "PM_CATTLE_URL,PLUGIN_MANAGER_CATTLE_URL,CATTLE_URL",
+			Usage:  "Rancher API to raise host alerts on when a subsystem keeps failing, alerts are only logged if empty",
+		},
+		cli.StringFlag{
+			Name:   "cattle-access-key",
+			EnvVar: "PM_CATTLE_ACCESS_KEY,PLUGIN_MANAGER_CATTLE_ACCESS_KEY,CATTLE_ACCESS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "cattle-secret-key",
+			EnvVar: "PM_CATTLE_SECRET_KEY,PLUGIN_MANAGER_CATTLE_SECRET_KEY,CATTLE_SECRET_KEY",
+		},
+		cli.IntFlag{
+			Name:   "alert-threshold",
+			EnvVar: "PM_ALERT_THRESHOLD,PLUGIN_MANAGER_ALERT_THRESHOLD",
+			Value:  3,
+			Usage:  "Failures in a row before a subsystem raises a host alert",
+		},
+		cli.StringFlag{
+			Name:   "state-dump-dir",
+			EnvVar: "PM_STATE_DUMP_DIR,PLUGIN_MANAGER_STATE_DUMP_DIR",
+			Value:  "/var/lib/rancher/plugin-manager/dumps",
+			Usage:  "Directory state dumps are written to on SIGQUIT or a POST to /debug/state",
+		},
+		cli.DurationFlag{
+			Name:   "watchdog-interval",
+			EnvVar: "PM_WATCHDOG_INTERVAL,PLUGIN_MANAGER_WATCHDOG_INTERVAL",
+			Value:  30 * time.Second,
+			Usage:  "How often to check for loops that stopped sending heartbeats, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:   "watchdog-restart",
+			EnvVar: "PM_WATCHDOG_RESTART,PLUGIN_MANAGER_WATCHDOG_RESTART",
+			Usage:  "Start stalled loops again in a new goroutine once the old one returned, at most 5 times each",
+		},
+		cli.StringFlag{
+			Name:   "crash-dir",
+			EnvVar: "PM_CRASH_DIR,PLUGIN_MANAGER_CRASH_DIR",
+			Value:  "/var/lib/rancher/plugin-manager/crashes",
+			Usage:  "Directory stack traces and recent logs are written to on a panic or fatal error, empty to disable",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			EnvVar: "PM_AUDIT_LOG,PLUGIN_MANAGER_AUDIT_LOG",
+			Usage:  "File every change made to the host is appended to as JSON lines, empty to disable",
+		},
+		cli.StringFlag{
+			Name:   "host-lock",
+			EnvVar: "PM_HOST_LOCK,PLUGIN_MANAGER_HOST_LOCK",
+			Value:  defaultHostLock,
+			Usage:  "File locked while subsystems that change the host run, so a second plugin-manager on the host refuses to start them, empty to disable",
+		},
+		cli.StringFlag{
+			Name:   "handoff-socket",
+			EnvVar: "PM_HANDOFF_SOCKET,PLUGIN_MANAGER_HANDOFF_SOCKET",
+			Value:  defaultHandoffSocket,
+			Usage:  "Socket a new plugin-manager on the host uses to take over this one's state and have it exit, empty to always start cold",
+		},
+		cli.DurationFlag{
+			Name:   "host-lock-wait",
+			EnvVar: "PM_HOST_LOCK_WAIT,PLUGIN_MANAGER_HOST_LOCK_WAIT",
+			Value:  30 * time.Second,
+			Usage:  "How long to wait for another plugin-manager holding --host-lock to exit before refusing to start",
+		},
+		cli.DurationFlag{
+			Name:   "startup-timeout",
+			EnvVar: "PM_STARTUP_TIMEOUT,PLUGIN_MANAGER_STARTUP_TIMEOUT",
+			Value:  2 * time.Minute,
+			Usage:  "How long a subsystem waits for the ones it depends on to be ready before starting anyway",
+		},
+		cli.BoolFlag{
+			Name:   "cleanup-on-exit",
+			EnvVar: "PM_CLEANUP_ON_EXIT,PLUGIN_MANAGER_CLEANUP_ON_EXIT",
+			Usage:  "On SIGTERM or SIGINT remove the iptables chains, routes, tunnels and CNI configs plugin-manager owns before exiting, rather than leave them in place",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Work out every change to the host and log it prefixed WOULD, without making any",
+			EnvVar: "PM_DRY_RUN,PLUGIN_MANAGER_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "pprof",
+			EnvVar: "PM_PPROF,PLUGIN_MANAGER_PPROF",
+			Usage:  "Serve /debug/pprof on the admin listener, which defaults to 127.0.0.1:6060 when this is set",
+		},
+		cli.BoolFlag{
+			Name:   "pprof-allow-remote",
+			EnvVar: "PM_PPROF_ALLOW_REMOTE,PLUGIN_MANAGER_PPROF_ALLOW_REMOTE",
+			Usage:  "Answer profiling requests from non-loopback clients",
+		},
+	}
+	app.Commands = []cli.Command{
+		planCommand(),
+		sandboxCommand(),
+		validateConfigCommand(),
+		reconcileCommand(),
+		doctorCommand(),
+	}
+	app.Action = func(c *cli.Context) error {
+		err := run(c)
+		if code := exitcode.Of(err); code != 0 {
+			return cli.NewExitError(err.Error(), code)
+		}
+		return nil
 	}
-	app.Action = run
 	app.Run(os.Args)
 }
 
 func run(c *cli.Context) error {
+	var reloader *config.Reloader
+	if p, dir := c.String("config"), c.String("config-dir"); p != "" || dir != "" {
+		r, err := config.Apply(c, p, dir)
+		if err != nil {
+			return exitcode.New(exitcode.Config, err)
+		}
+		reloader = r
+		reloader.WatchSignal()
+	}
+	crash.Configure(c.String("crash-dir"))
+	if p := c.Int("kubelet-cni-priority"); p < 0 || p > 99 {
+		return exitcode.New(exitcode.Config, fmt.Errorf("--kubelet-cni-priority must be from 0 to 99, got %d", p))
+	}
+	configureIntervals(c)
+	settings, err := sysctls.Parse(c.StringSlice("sysctl"))
+	if err != nil {
+		return exitcode.New(exitcode.Config, errors.Wrap(err, "Parsing --sysctl"))
+	}
+	sysctls.Settings = settings
+	defer crash.Recover()
 	if c.Bool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
+		logging.SetLevel(logrus.DebugLevel)
+	}
+	logging.WatchSignals()
+	systemd.Start()
+	if c.Bool("cleanup-on-exit") {
+		cleanup.OnSignal()
+	}
+	admin.WatchDumpSignal(c.String("state-dump-dir"))
+	tracing.Configure(c.String("otlp-endpoint"), "plugin-manager")
+	if err := logging.SetFormat(c.String("log-format")); err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	if err := logging.SetOutput(c.String("log-output")); err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	logging.SetRepeatWindow(c.Duration("log-repeat-window"))
+	if p := c.String("audit-log"); p != "" {
+		if err := audit.Open(p); err != nil {
+			return exitcode.New(exitcode.Config, errors.Wrap(err, "Opening audit log"))
+		}
+	}
+	if c.Bool("dry-run") {
+		audit.SetDryRun(true)
+		logrus.Warn("Dry run, changes to the host are logged prefixed WOULD and not made")
 	}
 
-	dClient, err := client.NewEnvClient()
-	if err != nil {
-		return err
+	if addr := c.String("metrics-listen"); addr != "" {
+		metrics.Listen(addr)
 	}
 
-	reaper.CheckMetadata(dClient, true)
+	disabled, err := disabledSubsystems(c)
+	if err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
 
-	logrus.Infof("Waiting for metadata")
-	mClient, err := metadata.NewClientAndWait(c.String("metadata-url"))
+	if err := runtimeEnv(c); err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	dClient, err := dockerapi.NewEnvClient()
 	if err != nil {
-		return errors.Wrap(err, "Creating metadata client")
+		return exitcode.New(exitcode.Config, errors.Wrap(err, "Configuring the Docker client"))
+	}
+	rt, err := containerRuntime(c, dClient)
+	if err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	if !dockerAPI(rt.Name()) {
+		logrus.Infof("Managing %s containers, %s need Docker and don't start", rt.Name(), strings.Join(dockerSubsystems, ", "))
+	} else if users := dockerUsers(disabled); len(users) > 0 {
+		if err := negotiateDocker(dClient, users); err != nil {
+			return err
+		}
+	}
+	if dockerAPI(rt.Name()) && !remoteDocker(c) {
+		if err := adaptRootless(c, dClient, disabled); err != nil {
+			return err
+		}
+	}
+	if dockerAPI(rt.Name()) {
+		logSwarm(dClient)
 	}
 
-	manager, err := network.NewManager(dClient)
+	opts, err := metadataOptions(c)
+	if err != nil {
+		return exitcode.New(exitcode.Config, errors.Wrap(err, "Configuring metadata client"))
+	}
+	mClient, err := cachedMetadataSource(c, opts, false)
 	if err != nil {
 		return err
 	}
 
-	if err := reaper.Watch(dClient, mClient); err != nil {
+	build := health.Build{
+		Version:   VERSION,
+		Commit:    COMMIT,
+		GoVersion: runtime.Version(),
+	}
+	buildInfo.Set(1, build.Version, build.Commit, build.GoVersion)
+	health.SetBuild(build)
+	enable := func(subsystem string) {
+		build.Subsystems = append(build.Subsystems, subsystem)
+		health.SetBuild(build)
+	}
+
+	st := runtimeStore(mClient, dClient, rt)
+	if self, err := st.GetSelfHost(); err == nil {
+		logging.SetHostUUID(self.UUID)
+	}
+	if err := features.SetLocal(c.StringSlice("feature")); err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	features.Watch(st)
+	admin.HandleJSON("/features", func() interface{} { return features.States() })
+	admin.RegisterState("features", func() interface{} { return features.States() })
+
+	if interval := c.Duration("watchdog-interval"); interval > 0 {
+		watchdog.Start(interval, c.Bool("watchdog-restart"))
+		enable("watchdog")
+	}
+
+	alerts.SetThreshold(c.Int("alert-threshold"))
+	if url := c.String("cattle-url"); url != "" {
+		alerts.Start(alerts.NewCattleReporter(url, c.String("cattle-access-key"), c.String("cattle-secret-key"), st), 30*time.Second)
+		enable("alerts")
+	}
+
+	if err := ensureModules(c, disabled, st); err != nil {
+		return exitcode.New(exitcode.Prerequisite, err)
+	}
+
+	// Take over from the instance being upgraded, so it exits and frees the
+	// host lock and this one doesn't start cold
+	handoffSocket := c.String("handoff-socket")
+	if c.Bool("dry-run") || len(disabled) == len(toggleable) {
+		handoffSocket = ""
+	}
+	var handed map[string]json.RawMessage
+	if handoffSocket != "" {
+		handed, err = handoff.Take(handoffSocket, VERSION, 30*time.Second)
+		if err != nil {
+			logrus.Errorf("Failed to take over from the running instance, starting cold: %v", err)
+		}
+	}
+
+	// A dry run changes nothing so it can run next to the real instance
+	if p := c.String("host-lock"); p != "" && !c.Bool("dry-run") && len(disabled) < len(toggleable) {
+		lock, err := hostlock.Acquire(p, c.Duration("host-lock-wait"))
+		if _, held := err.(*hostlock.HeldError); held {
+			// The holder changes the host, this instance only leaves it alone
+			var stopped []string
+			for _, name := range hostChanging {
+				if !disabled[name] {
+					disabled[name] = true
+					stopped = append(stopped, name)
+				}
+			}
+			logrus.Warnf("%v, not starting %s", err, strings.Join(stopped, ", "))
+			// The holder listens for its replacement
+			handoffSocket = ""
+		} else if err != nil {
+			return exitcode.New(exitcode.Locked, errors.Wrap(err, "Taking the host lock"))
+		} else {
+			defer lock.Close()
+		}
+	}
+
+	// Only the lock holder removes duplicate metadata and dns containers,
+	// and only when it runs the reaper
+	if !disabled["reaper"] {
+		reaper.CheckMetadata(rt, true)
+	}
+
+	var manager *network.Manager
+	if disabled["network"] {
+		logrus.Infof("Not starting network, disabled")
+	} else {
+		manager, err = network.NewManagerFromHandoff(rt, st, handed["network"])
+		if err != nil {
+			return err
+		}
+		handoff.Register("network", manager.Handoff)
+		handoff.RegisterStop("network", manager.Pause, manager.Resume)
+		manager.IPQuietPeriod.Set(c.Duration("ip-reuse-quiet-period"))
+		manager.WatchReleases()
+		admin.RegisterState("network", manager.State)
+		admin.Handle("/network/containers/", manager.InspectHandler())
+		enable("network")
+	}
+	if reloader != nil {
+		liveSettings(reloader, manager)
+		admin.Handle("/config/reload", reloader.Handler())
+	}
+	if disabled["reaper"] {
+		logrus.Infof("Not starting reaper, disabled")
+	} else if err := reaper.Watch(rt, st); err != nil {
 		logrus.Errorf("Failed to start unmanaged container reaper: %v", err)
+	} else {
+		enable("reaper")
 	}
 
-	if err := hostports.Watch(mClient); err != nil {
+	if disabled["hostports"] {
+		logrus.Infof("Not starting hostports, disabled")
+	} else if err := hostports.Watch(st); err != nil {
 		logrus.Errorf("Failed to start host ports configuration: %v", err)
+	} else {
+		enable("hostports")
 	}
 
-	if err := hostnat.Watch(mClient); err != nil {
+	if disabled["hostnat"] {
+		logrus.Infof("Not starting hostnat, disabled")
+	} else if err := hostnat.Watch(st); err != nil {
 		logrus.Errorf("Failed to start host nat configuration: %v", err)
+	} else {
+		enable("hostnat")
 	}
 
-	if err := cniconf.Watch(mClient); err != nil {
+	if disabled["hostroutes"] {
+		logrus.Infof("Not starting hostroutes, disabled")
+	} else if err := hostroutes.Watch(st); err != nil {
+		logrus.Errorf("Failed to start host routes configuration: %v", err)
+	} else {
+		enable("hostroutes")
+	}
+
+	if disabled["shaping"] {
+		logrus.Infof("Not starting shaping, disabled")
+	} else if err := shaping.Watch(st); err != nil {
+		logrus.Errorf("Failed to start egress traffic shaping: %v", err)
+	} else {
+		enable("shaping")
+	}
+
+	if disabled["cniconf"] {
+		logrus.Infof("Not starting cniconf, disabled")
+	} else if err := cniconf.Watch(st); err != nil {
 		logrus.Errorf("Failed to start cni config: %v", err)
+	} else {
+		enable("cniconf")
+	}
+
+	if disabled["floatingip"] {
+		logrus.Infof("Not starting floatingip, disabled")
+	} else if err := floatingip.Watch(st); err != nil {
+		logrus.Errorf("Failed to start secondary IP configuration: %v", err)
+	} else {
+		enable("floatingip")
 	}
 
-	binWatcher := binexec.Watch(mClient, dClient)
+	if disabled["sysctls"] {
+		logrus.Infof("Not starting sysctls, disabled")
+	} else if err := sysctls.Watch(); err != nil {
+		logrus.Errorf("Failed to start sysctl enforcement: %v", err)
+	} else {
+		enable("sysctls")
+	}
+
+	var binWatcher *binexec.Watcher
+	if disabled["binexec"] {
+		logrus.Infof("Not starting binexec, disabled")
+	} else {
+		binWatcher, err = binexec.Watch(st, binexec.Options{
+			TrustedKeysDir:   c.String("binexec-trusted-keys"),
+			RequireSignature: c.Bool("binexec-require-signature"),
+			KeepVersions:     c.Int("binexec-keep-versions"),
+			Timeout:          c.Duration("binexec-timeout"),
+			MemoryLimit:      c.Int64("binexec-memory-limit"),
+			CPUQuota:         c.Int("binexec-cpu-quota"),
+			OutputDir:        c.String("binexec-output-dir"),
+			VerifyInterval:   c.Duration("binexec-verify-interval"),
+			Workers:          c.Int("binexec-workers"),
+			Sandbox:          c.Bool("binexec-sandbox"),
+			Capabilities:     c.String("binexec-sandbox-capabilities"),
+			User:             c.String("binexec-user"),
+			HealthInterval:   c.Duration("binexec-health-interval"),
+			Retention:        c.Duration("binexec-retention"),
+			Retries:          c.Int("binexec-retries"),
+			RetryBackoff:     c.Duration("binexec-retry-backoff"),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Starting plugin binary management")
+		}
+		admin.HandleJSON("/binexec/binaries", func() interface{} { return binWatcher.Binaries() })
+		admin.RegisterState("binexec", func() interface{} { return binWatcher.Binaries() })
+		admin.HandleJSON("/binexec/output", func() interface{} { return binWatcher.Output() })
+		enable("binexec")
+	}
+
+	admin.Handle("/healthz", health.LiveHandler())
+	admin.Handle("/readyz", health.ReadyHandler())
+	admin.Handle("/log/level", logging.LevelHandler())
+	admin.RegisterState("health", func() interface{} { return health.Statuses() })
+	admin.RegisterState("alerts", func() interface{} { return alerts.Active() })
+	admin.Handle("/debug/state", admin.StateHandler(c.String("state-dump-dir")))
+	admin.Handle("/reconcile", admin.ReconcileHandler())
+	admin.Handle("/reconcile/", admin.ReconcileHandler())
+	addr := c.String("admin-listen")
+	if c.Bool("pprof") {
+		admin.EnablePprof(c.Bool("pprof-allow-remote"))
+		if addr == "" {
+			addr = "127.0.0.1:6060"
+		}
+	}
+	if addr != "" {
+		admin.Listen(addr)
+	}
+
+	ready := map[string]func() error{
+		"metadata": func() error {
+			if source.IsStale(mClient) {
+				return fmt.Errorf("answering from the cached copy")
+			}
+			_, err := mClient.GetSelfHost()
+			return err
+		},
+	}
+	if disabled["events"] {
+		logrus.Infof("Not starting events, disabled")
+	} else {
+		awaitDependencies(c, "events", disabled, ready)
+		if dockerAPI(rt.Name()) {
+			err = events.Watch(c.Int("event-workers"), manager, binWatcher)
+		} else {
+			err = events.WatchRuntime(rt, c.Int("event-workers"), manager, binWatcher)
+		}
+		if err != nil {
+			return exitcode.New(exitcode.Unavailable, errors.Wrapf(err, "Starting %s event handling", rt.Name()))
+		}
+		enable("events")
+	}
+	systemd.Started()
+	if handoffSocket != "" {
+		if err := handoff.Serve(handoffSocket, VERSION); err != nil {
+			logrus.Errorf("Failed to listen for a replacement on %s, it will start cold: %v", handoffSocket, err)
+		}
+	}
+
+	// Subsystems retry what they can recover from themselves, a fatal error
+	// exits so the supervisor restarts plugin-manager. After a handoff it
+	// exits 0, which on-failure restart policies leave stopped.
+	select {
+	case err = <-health.Fatals():
+		return exitcode.New(exitcode.Fatal, err)
+	case <-handoff.Done():
+		return nil
+	}
+}
 
-	if err := events.Watch(100, manager, binWatcher); err != nil {
+// startupDependencies are what each subsystem waits for before starting.
+// events replays the running containers' starts, which needs their plugin
+// binaries and CNI configs installed and metadata answering.
+var startupDependencies = map[string][]string{
+	"events": {"metadata", "binexec", "cniconf"},
+}
+
+// awaitDependencies blocks until the enabled dependencies of subsystem are
+// ready, those in ready by their own check and subsystems by their first
+// good pass. Past --startup-timeout it starts anyway, as it did before
+// waiting.
+func awaitDependencies(c *cli.Context, subsystem string, disabled map[string]bool, ready map[string]func() error) {
+	var deps []startup.Dependency
+	for _, name := range startupDependencies[subsystem] {
+		name := name
+		if check, ok := ready[name]; ok {
+			deps = append(deps, startup.Dependency{Name: name, Ready: check})
+		} else if !disabled[name] {
+			deps = append(deps, startup.Dependency{Name: name, Ready: func() error { return health.Succeeded(name) }})
+		}
+	}
+	if err := startup.Wait(subsystem, deps, c.Duration("startup-timeout")); err != nil {
+		logrus.Errorf("Starting %s after %v, dependencies %v", subsystem, c.Duration("startup-timeout"), err)
+	}
+}
+
+// ensureModules loads the kernel modules the enabled subsystems need before
+// any of them start. In a dry run missing ones are only logged.
+func ensureModules(c *cli.Context, disabled map[string]bool, st source.MetadataSource) error {
+	modules, neededBy := moduleUsers(disabled, st)
+	err := kmod.Ensure(modules, c.Bool("load-modules"))
+	missing, ok := err.(kmod.MissingError)
+	if !ok {
 		return err
 	}
+	var problems []string
+	for _, name := range modules {
+		if reason, ok := missing[name]; ok {
+			problems = append(problems, fmt.Sprintf("%s (%s), needed by %s", name, reason, strings.Join(neededBy[name], ", ")))
+		}
+	}
+	msg := "Missing kernel modules: " + strings.Join(problems, "; ")
+	if c.Bool("dry-run") {
+		logrus.Warn(msg)
+		return nil
+	}
+	return fmt.Errorf("%s. Load them on the host or --disable the subsystems needing them", msg)
+}
+
+func metadataOptions(c *cli.Context) (source.RancherOptions, error) {
+	tlsConfig, err := source.LoadTLSConfig(c.GlobalString("metadata-ca"), c.GlobalString("metadata-cert"), c.GlobalString("metadata-key"))
+	if err != nil {
+		return source.RancherOptions{}, err
+	}
+	token, err := source.LoadToken(c.GlobalString("metadata-token-file"))
+	if err != nil {
+		return source.RancherOptions{}, err
+	}
+
+	return source.RancherOptions{
+		ConnectTimeout: c.GlobalDuration("metadata-connect-timeout"),
+		ReadTimeout:    c.GlobalDuration("metadata-read-timeout"),
+		Retries:        c.GlobalInt("metadata-retries"),
+		RetryBackoff:   c.GlobalDuration("metadata-retry-backoff"),
+		LongPoll:       c.GlobalDuration("metadata-long-poll"),
+		TLS:            tlsConfig,
+		Token:          token,
+	}, nil
+}
+
+// cachedMetadataSource wraps the metadata source in the snapshot cache, so
+// the subsystems only act on validated answers, falling back to the last
+// good snapshot on disk when metadata is unreachable. With once the answers
+// are fetched straight away for a single pass.
+func cachedMetadataSource(c *cli.Context, opts source.RancherOptions, once bool) (source.MetadataSource, error) {
+	cachePath := c.GlobalString("metadata-cache")
+	if c.GlobalString("metadata-file") != "" || c.GlobalBool("kubernetes") {
+		cachePath = ""
+	}
+	mClient, err := metadataSource(c, opts, !once)
+	if err == nil && once {
+		mClient, err = source.NewSnapshotCacheNow(mClient, cachePath)
+	} else if err == nil {
+		mClient = source.NewSnapshotCache(mClient, cachePath)
+	}
+	if err != nil && cachePath != "" {
+		logrus.Errorf("Metadata is unreachable: %v", err)
+		mClient, err = source.NewStaleSnapshotCache(source.NewRancherMetadataNoWait(c.GlobalString("metadata-url"), opts), cachePath)
+	}
+	if err != nil && c.GlobalString("metadata-file") != "" {
+		return nil, exitcode.New(exitcode.Config, errors.Wrap(err, "Reading --metadata-file"))
+	} else if err != nil {
+		return nil, exitcode.New(exitcode.Unavailable, errors.Wrap(err, "Creating metadata client"))
+	}
+	return mClient, nil
+}
+
+// metadataSource picks the metadata backend from the flags. wait blocks
+// until rancher-metadata answers.
+func metadataSource(c *cli.Context, opts source.RancherOptions, wait bool) (source.MetadataSource, error) {
+	if file := c.GlobalString("metadata-file"); file != "" {
+		logrus.Infof("Reading metadata from %s", file)
+		return source.NewFile(file)
+	}
+	if c.GlobalBool("kubernetes") {
+		logrus.Infof("Reading metadata from Kubernetes")
+		return source.NewKubernetes(source.KubernetesOptions{
+			APIServer:         c.GlobalString("kubernetes-api"),
+			NodeName:          c.GlobalString("kubernetes-node"),
+			NetworksConfigMap: c.GlobalString("kubernetes-networks"),
+		})
+	}
+	if !wait {
+		return source.NewRancherMetadataNoWait(c.GlobalString("metadata-url"), opts), nil
+	}
+	logrus.Infof("Waiting for metadata")
+	return source.NewRancherMetadata(c.GlobalString("metadata-url"), opts)
+}
+
+// requiredModules are the kernel modules each subsystem needs loaded
+var requiredModules = map[string][]string{
+	"network":   {"bridge", "vxlan", "xt_conntrack"},
+	"hostports": {"br_netfilter", "xt_addrtype", "xt_mark"},
+	"hostnat":   {"xt_addrtype"},
+	"shaping":   {"sch_ingress", "cls_u32", "act_police"},
+}
+
+// neededWhen are the modules only needed for some metadata
+var neededWhen = map[string]func(source.MetadataSource) bool{
+	// Hairpin NAT only sees bridged traffic with br_netfilter
+	"br_netfilter": hostports.Hairpins,
+}
+
+// moduleUsers returns the modules the subsystems not in disabled need for
+// the metadata in c, or every one without it, sorted, and which of the
+// subsystems need each one
+func moduleUsers(disabled map[string]bool, c source.MetadataSource) ([]string, map[string][]string) {
+	neededBy := map[string][]string{}
+	for _, subsystem := range toggleable {
+		// rootlesskit publishes the ports instead of iptables
+		if disabled[subsystem] || subsystem == "hostports" && hostports.PortDriver != nil {
+			continue
+		}
+		for _, name := range requiredModules[subsystem] {
+			if when, ok := neededWhen[name]; ok && c != nil && !when(c) {
+				continue
+			}
+			neededBy[name] = append(neededBy[name], subsystem)
+		}
+	}
+	var names []string
+	for name := range neededBy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, neededBy
+}
+
+// toggleable are the subsystems --enable and --disable accept
+var toggleable = []string{"network", "events", "binexec", "reaper", "hostports", "hostnat", "hostroutes", "shaping", "cniconf", "floatingip", "sysctls"}
+
+// hostChanging are the subsystems that would fight another instance over
+// the host, they don't start while it holds the host lock. events only fills
+// in the resolv.conf of containers that start.
+var hostChanging = []string{"network", "binexec", "reaper", "hostports", "hostnat", "hostroutes", "shaping", "cniconf", "floatingip", "sysctls"}
+
+// profiles are the subsystem sets of the ways plugin-manager is deployed
+var profiles = map[string][]string{
+	"full": toggleable,
+	// Everything but stopping containers, for hosts another agent cleans up
+	"network-only": {"network", "events", "binexec", "hostports", "hostnat", "hostroutes", "shaping", "cniconf", "floatingip", "sysctls"},
+	"reaper-only":  {"reaper"},
+	// The kubelet networks pods itself, plugin-manager only keeps the CNI
+	// config, the plugin binaries and the host's NAT and routes in sync
+	"k8s-compat": {"binexec", "cniconf", "hostnat", "hostroutes", "sysctls"},
+}
+
+func profileNames() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// disabledSubsystems returns the subsystems not to start, those missing
+// from --profile or --enable when either is given and those in --disable
+func disabledSubsystems(c *cli.Context) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, name := range toggleable {
+		known[name] = true
+	}
+	check := func(flag string) error {
+		for _, name := range c.StringSlice(flag) {
+			if !known[name] {
+				return fmt.Errorf("Unknown subsystem %q in --%s, expected one of %s", name, flag, strings.Join(toggleable, ", "))
+			}
+		}
+		return nil
+	}
+	if err := check("enable"); err != nil {
+		return nil, err
+	}
+	if err := check("disable"); err != nil {
+		return nil, err
+	}
 
-	<-make(chan struct{})
+	enabled := c.StringSlice("enable")
+	if name := c.String("profile"); name != "" {
+		profile, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown profile %q, expected one of %s", name, strings.Join(profileNames(), ", "))
+		}
+		if len(enabled) > 0 {
+			return nil, fmt.Errorf("--profile and --enable both choose the subsystems to start, use --disable to leave some of a profile out")
+		}
+		enabled = profile
+	}
+
+	disabled := map[string]bool{}
+	if len(enabled) > 0 {
+		for _, name := range toggleable {
+			disabled[name] = true
+		}
+		for _, name := range enabled {
+			delete(disabled, name)
+		}
+	}
+	for _, name := range c.StringSlice("disable") {
+		disabled[name] = true
+	}
+	if runtime := c.String("runtime"); !dockerAPI(runtime) {
+		for _, name := range dockerSubsystems {
+			if enabledExplicitly(c, name) {
+				return nil, fmt.Errorf("%s needs the Docker API and can't run under --runtime %s", name, runtime)
+			}
+			disabled[name] = true
+		}
+	}
+	if remoteDocker(c) {
+		for _, name := range toggleable {
+			if remoteSubsystems[name] {
+				continue
+			}
+			if enabledExplicitly(c, name) {
+				return nil, fmt.Errorf("%s changes the host it runs on and can't manage the remote --docker-host %s", name, c.String("docker-host"))
+			}
+			disabled[name] = true
+		}
+	}
+	return disabled, nil
+}
+
+func enabledExplicitly(c *cli.Context, name string) bool {
+	for _, e := range c.StringSlice("enable") {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteDocker reports whether --docker-host is a daemon on another host,
+// whose containers only remoteSubsystems can manage
+func remoteDocker(c *cli.Context) bool {
+	return strings.HasPrefix(c.GlobalString("docker-host"), "tcp://")
+}
+
+// remoteSubsystems change nothing but what the Docker API reaches, the
+// events subsystem writing resolv.conf through the daemon's archive API
+var remoteSubsystems = map[string]bool{"reaper": true, "events": true}
+
+// dockerSubsystems still inspect containers through the Docker API, so don't
+// run under containerd or CRI
+var dockerSubsystems = []string{"shaping", "floatingip"}
+
+// runtimeSubsystems inspect containers and follow their events through the
+// runtime, for Docker and Podman their API
+var runtimeSubsystems = []string{"network", "events", "binexec"}
+
+// runtimeStore inspects containers through the Docker API under Docker and
+// Podman and through rt otherwise
+func runtimeStore(mClient source.MetadataSource, dClient *client.Client, rt engine.Runtime) store.Store {
+	if dockerAPI(rt.Name()) {
+		return store.New(mClient, dClient)
+	}
+	return store.NewRuntime(mClient, rt)
+}
+
+// dockerUsers are the subsystems not in disabled that talk to the Docker
+// API when it's the runtime's
+func dockerUsers(disabled map[string]bool) []string {
+	var users []string
+	for _, name := range append(append([]string{"reaper"}, runtimeSubsystems...), dockerSubsystems...) {
+		if !disabled[name] {
+			users = append(users, name)
+		}
+	}
+	return users
+}
+
+// negotiateDocker agrees the Docker API version before the subsystems in
+// users start, failing when the daemon is too old for them
+func negotiateDocker(dClient *client.Client, users []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	v, err := dockerapi.Negotiate(ctx, dClient)
+	if err != nil {
+		return exitcode.New(exitcode.Unavailable, errors.Wrap(err, "Negotiating the Docker API version"))
+	}
+	if old := dockerapi.TooOld(v.Server, users); len(old) > 0 {
+		return exitcode.New(exitcode.Prerequisite, fmt.Errorf("Docker API %s is too old, %s, upgrade Docker or disable them",
+			v.Server, strings.Join(old, ", ")))
+	}
+	logrus.Infof("Using Docker API %s, the daemon supports up to %s", v.Version, v.Server)
 	return nil
 }
+
+// dockerAPI reports whether the runtime serves the Docker API
+func dockerAPI(runtime string) bool {
+	return runtime == "" || runtime == "docker" || runtime == "podman"
+}
+
+// podmanSocket is where rootful Podman serves its Docker compatible API
+const podmanSocket = "unix:///run/podman/podman.sock"
+
+// runtimeEnv points the Docker clients at --docker-host over TLS, at the
+// user's rootless Docker when not run as root, or at Podman for --runtime
+// podman, unless DOCKER_HOST and DOCKER_API_VERSION are already set. Podman
+// refuses API versions older than 1.24.
+func runtimeEnv(c *cli.Context) error {
+	if host := c.GlobalString("docker-host"); host != "" {
+		os.Setenv("DOCKER_HOST", host)
+	}
+	tlsConfig, err := source.LoadTLSConfig(c.GlobalString("docker-tls-ca"), c.GlobalString("docker-tls-cert"), c.GlobalString("docker-tls-key"))
+	if err != nil {
+		return errors.Wrap(err, "Loading the Docker TLS certificates")
+	}
+	// Anyone reaching a plain TCP daemon can run anything on its host
+	if remoteDocker(c) && tlsConfig == nil {
+		return fmt.Errorf("--docker-host %s is reached over TLS, give --docker-tls-ca or --docker-tls-cert and --docker-tls-key", c.GlobalString("docker-host"))
+	}
+	dockerapi.SetTLS(tlsConfig)
+
+	if c.GlobalString("runtime") != "podman" {
+		if socket := rootless.Socket(); socket != "" && os.Getenv("DOCKER_HOST") == "" {
+			os.Setenv("DOCKER_HOST", socket)
+		}
+		return nil
+	}
+	if os.Getenv("DOCKER_HOST") == "" {
+		os.Setenv("DOCKER_HOST", podmanSocket)
+	}
+	if os.Getenv("DOCKER_API_VERSION") == "" {
+		os.Setenv("DOCKER_API_VERSION", "1.24")
+	}
+	return nil
+}
+
+const (
+	defaultHostLock      = "/var/run/rancher-plugin-manager.lock"
+	defaultHandoffSocket = "/var/run/rancher-plugin-manager.sock"
+)
+
+// rootlessLimits are why the subsystems changing the host can't run under
+// rootless Docker, whose containers live in rootlesskit's namespaces
+var rootlessLimits = map[string]string{
+	"network":    "rootlesskit networks the containers in its own namespaces, which plugin-manager can't enter",
+	"hostports":  "iptables needs root, and rootlessctl or rootlesskit's API socket to publish the ports through is missing",
+	"hostroutes": "changing the host's routes needs root",
+	"shaping":    "shaping traffic needs root in the containers' network namespaces",
+	"floatingip": "announcing floating IPs needs root",
+	"sysctls":    "setting the host's sysctls needs root",
+}
+
+// adaptRootless checks whether Docker is rootless and if so disables the
+// subsystems it leaves unable to run, hands host ports and NAT to
+// rootlesskit and slirp4netns or pasta, and moves the host lock and handoff
+// socket into the user's runtime directory
+func adaptRootless(c *cli.Context, dClient *client.Client, disabled map[string]bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	isRootless, err := rootless.Docker(ctx, dClient)
+	if err != nil {
+		logrus.Warnf("Failed to check whether Docker is rootless, assuming not: %v", err)
+		return nil
+	} else if !isRootless {
+		return nil
+	}
+	admin.RegisterState("rootless", rootless.State)
+
+	for _, name := range toggleable {
+		if disabled[name] {
+			continue
+		}
+		if name == "hostnat" {
+			disabled[name] = true
+			rootless.Delegate(name, "is left to slirp4netns or pasta, which masquerade the containers' traffic")
+			continue
+		}
+		reason, ok := rootlessLimits[name]
+		if !ok {
+			continue
+		}
+		if socket := rootless.PortSocket(); name == "hostports" && socket != "" && onPath("rootlessctl") == nil {
+			hostports.PortDriver = rootless.NewPortDriver(socket)
+			rootless.Delegate(name, "publishes host ports through rootlesskit")
+			continue
+		}
+		if enabledExplicitly(c, name) {
+			return exitcode.New(exitcode.Prerequisite, fmt.Errorf("%s can't run under rootless Docker, %s", name, reason))
+		}
+		disabled[name] = true
+		rootless.Degrade(name, reason)
+	}
+
+	// /var/run is root's
+	if c.GlobalString("host-lock") == defaultHostLock {
+		c.GlobalSet("host-lock", filepath.Join(rootless.RuntimeDir(), filepath.Base(defaultHostLock)))
+	}
+	if c.GlobalString("handoff-socket") == defaultHandoffSocket {
+		c.GlobalSet("handoff-socket", filepath.Join(rootless.RuntimeDir(), filepath.Base(defaultHandoffSocket)))
+	}
+	return nil
+}
+
+// logSwarm notes when the host is in a swarm, whose tasks, ingress network
+// and iptables chains the subsystems leave alone either way
+func logSwarm(dClient *client.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if active, err := swarm.Active(ctx, dClient); err != nil {
+		logrus.Debugf("Failed to check whether Docker is in a swarm: %v", err)
+	} else if active {
+		logrus.Infof("Docker is in a swarm, leaving its tasks, the %s network and the %s chain alone", swarm.IngressNetwork, swarm.IngressChain)
+	}
+}
+
+// containerRuntime is the runtime --runtime names, sharing dClient for
+// Docker and Podman
+func containerRuntime(c *cli.Context, dClient *client.Client) (engine.Runtime, error) {
+	switch c.GlobalString("runtime") {
+	case "", "docker":
+		return engine.NewDockerClient(dClient), nil
+	case "podman":
+		return engine.NewPodmanClient(dClient), nil
+	case "containerd":
+		return engine.NewContainerd(c.GlobalString("containerd-address"), c.GlobalString("containerd-namespace")), nil
+	case "cri":
+		return engine.NewCRI(c.GlobalString("cri-endpoint")), nil
+	}
+	return nil, fmt.Errorf("Unknown --runtime %q, expected docker, podman, containerd or cri", c.GlobalString("runtime"))
+}
+
+// configureIntervals applies the interval and directory flags to the
+// subsystems before they start
+func configureIntervals(c *cli.Context) {
+	source.IntervalSeconds = c.Int("metadata-interval")
+	setReapplyInterval(c.Duration("reapply-interval"))
+	hostnat.DriftCheckEvery = c.Duration("drift-check-interval")
+	hostports.DriftCheckEvery = c.Duration("drift-check-interval")
+	cniconf.SetConfDir(c.String("cni-conf-dir"))
+	cniconf.SetKubeletDir(c.String("kubelet-cni-dir"), c.Int("kubelet-cni-priority"))
+	sysctls.EnforceEvery = c.Duration("sysctl-interval")
+}
+
+func setReapplyInterval(interval time.Duration) {
+	for _, every := range []*config.Duration{
+		binexec.ReapplyEvery,
+		cniconf.ReapplyEvery,
+		floatingip.ReapplyEvery,
+		hostnat.ReapplyEvery,
+		hostports.ReapplyEvery,
+		hostroutes.ReapplyEvery,
+		shaping.ReapplyEvery,
+	} {
+		every.Set(interval)
+	}
+}
+
+// liveSettings registers the settings a config reload can change without
+// a restart, every other changed setting is reported as needing one.
+// manager is nil when the network subsystem is disabled.
+func liveSettings(r *config.Reloader, manager *network.Manager) {
+	r.Live("debug", func(value string) error {
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if debug {
+			logging.SetLevel(logrus.DebugLevel)
+		} else {
+			logging.SetLevel(logrus.InfoLevel)
+		}
+		return nil
+	})
+	r.Live("log-repeat-window", func(value string) error {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		logging.SetRepeatWindow(window)
+		return nil
+	})
+	r.Live("reapply-interval", func(value string) error {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		setReapplyInterval(interval)
+		return nil
+	})
+	r.Live("alert-threshold", func(value string) error {
+		threshold, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		alerts.SetThreshold(threshold)
+		return nil
+	})
+	if manager == nil {
+		return
+	}
+	r.Live("ip-reuse-quiet-period", func(value string) error {
+		period, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		manager.IPQuietPeriod.Set(period)
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/dockerapi"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/exitcode"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/hns"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/reaper"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/urfave/cli"
+)
+
+var (
+	VERSION = "v0.0.0-dev"
+	COMMIT  = ""
+)
+
+// On Windows only the reaper and HNS networking run, the other subsystems
+// program Linux networking
+func main() {
+	app := cli.NewApp()
+	app.Name = "plugin-manager"
+	app.Version = VERSION
+	app.Usage = "Windows hosts: reap orphaned containers and network managed ones through HNS"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "metadata-url",
+			EnvVar: "PM_METADATA_URL,PLUGIN_MANAGER_METADATA_URL",
+			Value:  "http://rancher-metadata/2016-07-29",
+			Usage:  "Comma separated rancher-metadata endpoints, later ones are used when earlier ones fail",
+		},
+		cli.IntFlag{
+			Name:   "metadata-interval",
+			EnvVar: "PM_METADATA_INTERVAL,PLUGIN_MANAGER_METADATA_INTERVAL",
+			Value:  source.IntervalSeconds,
+			Usage:  "Seconds between metadata checks when not long-polling, and after errors",
+		},
+		cli.StringFlag{
+			Name:   "hns-network",
+			EnvVar: "PM_HNS_NETWORK,PLUGIN_MANAGER_HNS_NETWORK",
+			Value:  "transparent",
+			Usage:  "HNS network managed containers get their endpoints on, such as one made with docker network create -d transparent",
+		},
+		cli.StringSliceFlag{
+			Name:   "disable",
+			EnvVar: "PM_DISABLE,PLUGIN_MANAGER_DISABLE",
+			Usage:  "Subsystem not to start, reaper or hns. May be repeated.",
+		},
+		cli.BoolFlag{
+			Name:   "debug",
+			EnvVar: "PM_DEBUG,PLUGIN_MANAGER_DEBUG",
+			Usage:  "Turn on debug logging",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "PM_LOG_FORMAT,PLUGIN_MANAGER_LOG_FORMAT",
+			Value:  "text",
+			Usage:  "Log output format, text or json",
+		},
+		cli.StringFlag{
+			Name:   "admin-listen",
+			EnvVar: "PM_ADMIN_LISTEN,PLUGIN_MANAGER_ADMIN_LISTEN",
+			Usage:  "Address to serve debug endpoints on, disabled if empty",
+		},
+	}
+	app.Action = func(c *cli.Context) error {
+		err := run(c)
+		if code := exitcode.Of(err); code != 0 {
+			return cli.NewExitError(err.Error(), code)
+		}
+		return nil
+	}
+	app.Run(os.Args)
+}
+
+func run(c *cli.Context) error {
+	source.IntervalSeconds = c.Int("metadata-interval")
+	if c.Bool("debug") {
+		logging.SetLevel(logrus.DebugLevel)
+	}
+	if err := logging.SetFormat(c.String("log-format")); err != nil {
+		return exitcode.New(exitcode.Config, err)
+	}
+	disabled := map[string]bool{}
+	for _, name := range c.StringSlice("disable") {
+		if name != "reaper" && name != "hns" {
+			return exitcode.New(exitcode.Config, errors.Errorf("Unknown --disable %s, expected reaper or hns", name))
+		}
+		disabled[name] = true
+	}
+
+	dClient, err := dockerapi.NewEnvClient()
+	if err != nil {
+		return exitcode.New(exitcode.Config, errors.Wrap(err, "Configuring the Docker client"))
+	}
+	rt := engine.NewDockerClient(dClient)
+	logrus.Infof("Waiting for metadata")
+	mClient, err := source.NewRancherMetadata(c.String("metadata-url"), source.RancherOptions{})
+	if err != nil {
+		return exitcode.New(exitcode.Unavailable, errors.Wrap(err, "Creating metadata client"))
+	}
+	st := store.New(mClient, dClient)
+	health.SetBuild(health.Build{Version: VERSION, Commit: COMMIT, GoVersion: runtime.Version()})
+
+	if disabled["reaper"] {
+		logrus.Infof("Not starting reaper, disabled")
+	} else if err := reaper.Watch(rt, st); err != nil {
+		return errors.Wrap(err, "Starting unmanaged container reaper")
+	}
+	if disabled["hns"] {
+		logrus.Infof("Not starting hns, disabled")
+	} else if _, err := hns.Watch(rt, st, c.String("hns-network")); err != nil {
+		return exitcode.New(exitcode.Prerequisite, errors.Wrap(err, "Starting HNS networking"))
+	}
+
+	admin.Handle("/healthz", health.LiveHandler())
+	admin.Handle("/readyz", health.ReadyHandler())
+	admin.Handle("/log/level", logging.LevelHandler())
+	admin.Handle("/reconcile/", admin.ReconcileHandler())
+	if addr := c.String("admin-listen"); addr != "" {
+		admin.Listen(addr)
+	}
+
+	return exitcode.New(exitcode.Fatal, <-health.Fatals())
+}
@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("metrics")
+
+// DefaultBuckets are the histogram buckets, in seconds, used when none are given
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+type collector interface {
+	write(buf *bytes.Buffer)
+}
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, c)
+}
+
+// Write renders all registered metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	registryLock.Lock()
+	collectors := append([]collector{}, registry...)
+	registryLock.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Handler serves the registered metrics over HTTP
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := Write(rw); err != nil {
+			log.WithError(err).Error("Failed to write metrics")
+		}
+	})
+}
+
+// Listen serves the metrics on addr in the background
+func Listen(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		log.Infof("Listening for metrics requests on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Failed to serve metrics on %s: %v", addr, err)
+		}
+	}()
+}
+
+// Since returns the seconds elapsed since start, suitable for Observe
+func Since(start time.Time) float64 {
+	return time.Now().Sub(start).Seconds()
+}
+
+type vec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		log.Errorf("Metric %s expects labels %v, got %v", v.name, v.labels, values)
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) header(buf *bytes.Buffer, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+}
+
+func (v *vec) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(v.labels) {
+				pairs = append(pairs, v.labels[i]+"="+strconv.Quote(value))
+			}
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value partitioned by labels
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		vec:    vec{name: name, help: help, labels: labels},
+		values: map[string]float64{},
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta to the counter for the given label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[c.key(labelValues)] += delta
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(buf, "counter")
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, c.labelString(k), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge is a value that can go up and down partitioned by labels
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		vec:    vec{name: name, help: help, labels: labels},
+		values: map[string]float64{},
+	}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+// Add adds delta to the gauge for the given label values
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[g.key(labelValues)] += delta
+}
+
+func (g *Gauge) write(buf *bytes.Buffer) {
+	g.Lock()
+	defer g.Unlock()
+	g.header(buf, "gauge")
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", g.name, g.labelString(k), formatFloat(g.values[k]))
+	}
+}
+
+// Histogram tracks the distribution of observed values partitioned by labels
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+// NewHistogram creates and registers a histogram using DefaultBuckets
+func NewHistogram(name, help string, labels ...string) *Histogram {
+	h := &Histogram{
+		vec:     vec{name: name, help: help, labels: labels},
+		buckets: DefaultBuckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+	}
+	register(h)
+	return h
+}
+
+// Observe records value for the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := h.key(labelValues)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[key] = counts
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[key] += value
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(buf, "histogram")
+	for _, k := range sortedKeys(h.sums) {
+		counts := h.counts[k]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", formatFloat(bound)), counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", "+Inf"), counts[len(h.buckets)])
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, h.labelString(k), formatFloat(h.sums[k]))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, h.labelString(k), counts[len(h.buckets)])
+	}
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	glue "github.com/rancher/cniglue"
+)
+
+// cniAdd is glue.CNIAdd with support for passing additional CNI_ARGS to the
+// plugins, such as a requested IP address.
+func cniAdd(state *glue.DockerPluginState, extraArgs [][2]string) (*cniTypes.Result, error) {
+	if len(extraArgs) == 0 {
+		return glue.CNIAdd(state)
+	}
+
+	if state.HostConfig.NetworkMode.IsContainer() ||
+		state.HostConfig.NetworkMode.IsHost() ||
+		state.HostConfig.NetworkMode.IsNone() {
+		return nil, nil
+	}
+
+	confs, err := loadConfs(state)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := runtimeConf(state, extraArgs)
+	cninet := libcni.CNIConfig{
+		Path: glue.CniPath,
+	}
+
+	var result *cniTypes.Result
+	for _, conf := range confs {
+		pluginResult, err := cninet.AddNetwork(conf, rt)
+		if err != nil {
+			return nil, err
+		}
+		if pluginResult.IP4 != nil {
+			result = pluginResult
+		}
+	}
+
+	return result, nil
+}
+
+func runtimeConf(state *glue.DockerPluginState, extraArgs [][2]string) *libcni.RuntimeConf {
+	rt := &libcni.RuntimeConf{
+		ContainerID: state.ContainerID,
+		NetNS:       fmt.Sprintf("/proc/%d/ns/net", state.Pid),
+		IfName:      "eth0",
+		Args: [][2]string{
+			{"IgnoreUnknown", "1"},
+			{"DOCKER", "true"},
+		},
+	}
+
+	if uuid, ok := state.Config.Labels["io.rancher.container.uuid"]; ok {
+		rt.Args = append(rt.Args, [2]string{"RancherContainerUUID", uuid})
+	}
+
+	if linkMTUOverhead, ok := state.Config.Labels["io.rancher.cni.link_mtu_overhead"]; ok {
+		rt.Args = append(rt.Args, [2]string{"LinkMTUOverhead", linkMTUOverhead})
+	}
+
+	rt.Args = append(rt.Args, extraArgs...)
+	return rt
+}
+
+func loadConfs(state *glue.DockerPluginState) ([]*libcni.NetworkConfig, error) {
+	network := state.HostConfig.NetworkMode.NetworkName()
+	if network == "" {
+		network = "default"
+	}
+
+	files, err := libcni.ConfFiles(fmt.Sprintf(glue.CniDir, network))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	os.Setenv("PATH", strings.Join(glue.CniPath, ":"))
+
+	var confs []*libcni.NetworkConfig
+	for _, file := range files {
+		netConf, err := libcni.ConfFromFile(file)
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, netConf)
+	}
+
+	return confs, nil
+}
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// flushFlows removes conntrack and neighbor entries that still reference a
+// released IP so a container that is handed the same address doesn't inherit
+// the previous owner's flows.
+func flushFlows(ip string) error {
+	var lastErr error
+	for _, args := range [][]string{
+		{"conntrack", "-D", "-s", ip},
+		{"conntrack", "-D", "-d", ip},
+	} {
+		if err := runFlush(args); err != nil {
+			lastErr = err
+		}
+	}
+
+	if err := runFlush([]string{"ip", "neigh", "flush", "to", ip}); err != nil {
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+func runFlush(args []string) error {
+	log.Debugf("Running %s", strings.Join(args, " "))
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil && args[0] == "conntrack" && strings.Contains(string(output), "0 flow entries") {
+		// conntrack exits non-zero when there was nothing to delete
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "%s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (s *state) Released(ip string, flushed bool) {
+	s.Lock()
+	defer s.Unlock()
+	if flushed {
+		delete(s.released, ip)
+	} else {
+		s.released[ip] = time.Now()
+	}
+}
+
+// ReuseBlocked returns the reason an IP can't be handed to container id yet,
+// or the empty string if it is safe to use.
+func (s *state) ReuseBlocked(id, ip string, quietPeriod time.Duration) string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if owner := s.owner(id, ip); owner != "" {
+		return "still assigned to " + owner
+	}
+
+	if releasedAt, ok := s.released[ip]; ok && time.Now().Sub(releasedAt) < quietPeriod {
+		return "released " + time.Now().Sub(releasedAt).String() + " ago without a clean flush"
+	}
+
+	return ""
+}
+
+// Owner returns the container other than id that holds ip, if any
+func (s *state) Owner(id, ip string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.owner(id, ip)
+}
+
+func (s *state) owner(id, ip string) string {
+	for owner, ownerIP := range s.ips {
+		if owner != id && ownerIP == ip {
+			return owner
+		}
+	}
+	return ""
+}
+
+func stripMask(ip string) string {
+	return strings.SplitN(ip, "/", 2)[0]
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+)
+
+// handoffState is what the manager passes to the instance replacing it
+type handoffState struct {
+	StartTimes map[string]string           `json:"startTimes"`
+	IPs        map[string]string           `json:"ips"`
+	Released   map[string]time.Time        `json:"released"`
+	Results    map[string]*cniTypes.Result `json:"results"`
+	Outcomes   map[string][]Outcome        `json:"outcomes"`
+	Retries    map[string]int              `json:"retries"`
+}
+
+// Handoff copies the tracked containers, quarantined IPs and pending
+// retries for a replacement to start from
+func (n *Manager) Handoff() interface{} {
+	n.s.RLock()
+	h := handoffState{
+		StartTimes: map[string]string{},
+		IPs:        map[string]string{},
+		Released:   map[string]time.Time{},
+		Results:    map[string]*cniTypes.Result{},
+		Outcomes:   map[string][]Outcome{},
+		Retries:    map[string]int{},
+	}
+	for id, t := range n.s.startTimes {
+		h.StartTimes[id] = t
+	}
+	for id, ip := range n.s.ips {
+		h.IPs[id] = ip
+	}
+	for ip, t := range n.s.released {
+		h.Released[ip] = t
+	}
+	for id, result := range n.s.results {
+		h.Results[id] = result
+	}
+	for id, outcomes := range n.s.outcomes {
+		h.Outcomes[id] = append([]Outcome(nil), outcomes...)
+	}
+	n.s.RUnlock()
+
+	n.retryLock.Lock()
+	for id, count := range n.retries {
+		h.Retries[id] = count
+	}
+	n.retryLock.Unlock()
+	return h
+}
+
+// NewManagerFromHandoff is NewManager starting from the state the previous
+// instance handed over rather than inspecting every container. Only the
+// container list is read, to leave out swarm tasks and label log lines with
+// the containers' UUIDs. Containers that stopped since are found when their
+// start is replayed. Without a usable state it starts cold.
+func NewManagerFromHandoff(rt engine.Runtime, st store.Store, handed json.RawMessage) (*Manager, error) {
+	var h handoffState
+	if len(handed) == 0 {
+		return NewManager(rt, st)
+	}
+	if err := json.Unmarshal(handed, &h); err != nil {
+		log.WithError(err).Error("Failed to read the handed off network state, inspecting every container")
+		return NewManager(rt, st)
+	}
+	cs, err := rt.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	s := emptyState()
+	for ip, t := range h.Released {
+		s.released[ip] = t
+	}
+	labels := map[string]map[string]string{}
+	for _, container := range cs {
+		labels[container.ID] = container.Labels
+	}
+	for id, startTime := range h.StartTimes {
+		if swarm.Task(labels[id]) {
+			continue
+		}
+		logging.SetContainerUUID(id, labels[id][store.UUIDLabel])
+		s.startTimes[id] = startTime
+		if ip, ok := h.IPs[id]; ok {
+			s.ips[id] = ip
+		}
+		if result, ok := h.Results[id]; ok {
+			s.results[id] = result
+		}
+		if outcomes, ok := h.Outcomes[id]; ok {
+			s.outcomes[id] = outcomes
+		}
+	}
+
+	n := newManager(rt, st, s)
+	log.Infof("Starting from handed off state of %d containers", len(s.startTimes))
+	for id, count := range h.Retries {
+		log.WithField(logging.ContainerIDKey, id).Infof("Resuming retry %d", count)
+		go n.retry(context.Background(), id, count)
+	}
+	return n, nil
+}
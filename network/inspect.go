@@ -0,0 +1,174 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/plugin-manager/iptables"
+	"github.com/rancher/plugin-manager/store"
+)
+
+const (
+	// maxOutcomes is how many results are kept per container
+	maxOutcomes = 10
+	// outcomeRetention is how long the results of a container that is no
+	// longer running are kept
+	outcomeRetention = time.Hour
+)
+
+// Outcome is the result of one attempt to change a container's networking
+type Outcome struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// ContainerInfo is everything known about the networking of one container
+type ContainerInfo struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name,omitempty"`
+	Running     bool             `json:"running"`
+	Managed     bool             `json:"managed"`
+	NetworkMode string           `json:"networkMode,omitempty"`
+	StartedAt   string           `json:"startedAt,omitempty"`
+	IP          string           `json:"ip,omitempty"`
+	CNIResult   *cniTypes.Result `json:"cniResult,omitempty"`
+	IPTables    []string         `json:"iptables,omitempty"`
+	Outcomes    []Outcome        `json:"outcomes"`
+	Errors      []string         `json:"errors,omitempty"`
+}
+
+func (s *state) SetResult(id string, result *cniTypes.Result) {
+	s.Lock()
+	defer s.Unlock()
+	s.results[id] = result
+}
+
+// Outcome records the result of action on container id, forgetting
+// containers that stopped longer than outcomeRetention ago
+func (s *state) Outcome(id, action string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	outcome := Outcome{
+		Time:   time.Now(),
+		Action: action,
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	outcomes := append(s.outcomes[id], outcome)
+	if len(outcomes) > maxOutcomes {
+		outcomes = outcomes[len(outcomes)-maxOutcomes:]
+	}
+	s.outcomes[id] = outcomes
+
+	for other, outcomes := range s.outcomes {
+		if _, running := s.startTimes[other]; !running && outcome.Time.Sub(outcomes[len(outcomes)-1].Time) > outcomeRetention {
+			delete(s.outcomes, other)
+		}
+	}
+}
+
+// resolve finds the one tracked container whose ID starts with key
+func (s *state) resolve(key string) string {
+	s.RLock()
+	defer s.RUnlock()
+	matches := map[string]bool{}
+	for id := range s.startTimes {
+		if strings.HasPrefix(id, key) {
+			matches[id] = true
+		}
+	}
+	for id := range s.outcomes {
+		if strings.HasPrefix(id, key) {
+			matches[id] = true
+		}
+	}
+	if len(matches) != 1 {
+		return ""
+	}
+	for id := range matches {
+		return id
+	}
+	return ""
+}
+
+func (s *state) info(id string) ContainerInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return ContainerInfo{
+		ID:        id,
+		StartedAt: s.startTimes[id],
+		IP:        s.ips[id],
+		CNIResult: s.results[id],
+		Outcomes:  append([]Outcome{}, s.outcomes[id]...),
+	}
+}
+
+// recordOutcome records the result of action and returns it
+func (n *Manager) recordOutcome(id, action string, err error) error {
+	n.s.Outcome(id, action, err)
+	return err
+}
+
+// Inspect reports the networking of the container key names, accepting
+// anything Docker does as well as prefixes of containers that are gone
+func (n *Manager) Inspect(key string) (ContainerInfo, bool) {
+	var info ContainerInfo
+	n.store.Invalidate(key)
+	inspect, err := n.store.Inspect(key)
+	if err == nil {
+		info = n.s.info(inspect.ID)
+		info.Name = strings.TrimPrefix(inspect.Name, "/")
+		info.Running = inspect.State.Running
+		info.Managed = configureNetwork(&inspect)
+		if info.Managed {
+			info.NetworkMode = string(inspect.HostConfig.NetworkMode)
+		}
+	} else if store.IsNotFound(err) {
+		id := n.s.resolve(key)
+		if id == "" {
+			return info, false
+		}
+		info = n.s.info(id)
+	} else {
+		info = n.s.info(key)
+		info.Errors = append(info.Errors, "inspecting container: "+err.Error())
+	}
+
+	if info.IP != "" {
+		rules, err := iptables.RulesMentioning(info.IP)
+		if err != nil {
+			info.Errors = append(info.Errors, err.Error())
+		}
+		info.IPTables = rules
+	}
+	return info, true
+}
+
+// InspectHandler serves Inspect for the container named by the last path
+// element
+func (n *Manager) InspectHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		if key == "" {
+			http.Error(rw, "container ID or name required", http.StatusBadRequest)
+			return
+		}
+		info, ok := n.Inspect(key)
+		if !ok {
+			http.Error(rw, "no such container "+key, http.StatusNotFound)
+			return
+		}
+		content, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(append(content, '\n'))
+	})
+}
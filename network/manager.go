@@ -4,127 +4,314 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	cniTypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/docker/docker/pkg/locker"
-	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/pkg/errors"
 	glue "github.com/rancher/cniglue"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+	"github.com/rancher/plugin-manager/tracing"
 )
 
+var log = logging.Subsystem("network")
+
 const (
 	maxRetries            = 60
 	IPLabel               = "io.rancher.container.ip"
+	RequestedIPLabel      = "io.rancher.container.requested_ip"
 	LegacyManagedNetLabel = "io.rancher.container.network"
 	CNILabel              = "io.rancher.cni.network"
 )
 
+var (
+	setupSeconds = metrics.NewHistogram("plugin_manager_network_setup_seconds",
+		"Time spent in each stage of bringing up container networking", "stage")
+	readySeconds = metrics.NewHistogram("plugin_manager_network_ready_seconds",
+		"Time from receiving a container's start event to its gateway answering, by result", "result")
+)
+
 type Manager struct {
-	c     *client.Client
+	// IPQuietPeriod is how long a released IP that could not be cleanly
+	// flushed is withheld from new containers
+	IPQuietPeriod *config.Duration
+
+	rt    engine.Runtime
+	store store.Store
 	s     *state
 	locks *locker.Locker
+	// paused is held for writing while a handoff stops the manager
+	paused sync.RWMutex
+
+	retryLock sync.Mutex
+	retries   map[string]int
+
+	// flush removes the flows to a released IP, flushFlows but in tests
+	flush func(ip string) error
+	// held are the IPs of containers on other hosts by IP, to find the
+	// ones they release
+	held map[string]string
 }
 
-func NewManager(c *client.Client) (*Manager, error) {
-	s, err := newState(c)
+// NewManager networks the containers of rt, inspected through st
+func NewManager(rt engine.Runtime, st store.Store) (*Manager, error) {
+	s, err := newState(rt)
 	if err != nil {
 		return nil, err
 	}
+	return newManager(rt, st, s), nil
+}
+
+func newManager(rt engine.Runtime, st store.Store, s *state) *Manager {
 	return &Manager{
-		c:     c,
-		s:     s,
-		locks: locker.New(),
-	}, nil
+		rt:      rt,
+		store:   st,
+		s:       s,
+		locks:   locker.New(),
+		retries: map[string]int{},
+		flush:   flushFlows,
+
+		IPQuietPeriod: config.NewDuration(30 * time.Second),
+	}
+}
+
+// Pause waits for the evaluations in progress and holds back new ones until
+// Resume
+func (n *Manager) Pause() {
+	n.paused.Lock()
 }
 
-// Evaluate checks the state and enableds networking if needed
-func (n *Manager) Evaluate(id string) error {
-	return n.evaluate(id, 0)
+// Resume lets evaluations run again after Pause
+func (n *Manager) Resume() {
+	n.paused.Unlock()
 }
 
-func (n *Manager) evaluate(id string, retryCount int) error {
+// Evaluate checks the state and enableds networking if needed. Each stage
+// is traced as a child of the span in ctx.
+func (n *Manager) Evaluate(ctx context.Context, id string) error {
+	return n.evaluate(ctx, id, 0)
+}
+
+func (n *Manager) evaluate(ctx context.Context, id string, retryCount int) error {
+	n.paused.RLock()
+	defer n.paused.RUnlock()
 	n.locks.Lock(id)
 	defer n.locks.Unlock(id)
 
+	inspectStart := time.Now()
 	wasTime := n.s.StartTime(id)
 	wasRunning := wasTime != ""
 	running := false
 	time := ""
 
-	inspect, err := n.c.ContainerInspect(context.Background(), id)
-	if client.IsErrContainerNotFound(err) {
+	// Evaluate runs because Docker reported a change, so what other
+	// subsystems have cached for the container is out of date
+	span, _ := tracing.Start(ctx, "inspect", tracing.ContainerIDKey, id)
+	n.store.Invalidate(id)
+	inspect, err := n.store.Inspect(id)
+	span.End(err)
+	setupSeconds.Observe(metrics.Since(inspectStart), "inspect")
+	if store.IsNotFound(err) {
 		running = false
 		time = ""
 	} else if err != nil {
 		return err
 	} else {
 		if !configureNetwork(&inspect) {
+			if swarmManaged(inspect) {
+				swarm.Skip("network", id)
+			}
 			return nil
 		}
 		running = inspect.State.Running
 		time = inspect.State.StartedAt
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"wasTime":    wasTime,
-		"wasRunning": wasRunning,
-		"running":    running,
-		"time":       time,
-		"cid":        id,
+	log.WithFields(logrus.Fields{
+		"wasTime":              wasTime,
+		"wasRunning":           wasRunning,
+		"running":              running,
+		"time":                 time,
+		logging.ContainerIDKey: id,
 	}).Debugf("Evaluating networking start")
 
 	if wasRunning {
 		if running && wasTime != time {
-			return n.networkUp(id, inspect, retryCount)
+			return n.recordOutcome(id, "up", n.networkUp(ctx, id, inspect, retryCount))
 		} else if !running {
-			return n.networkDown(id, inspect)
+			return n.recordOutcome(id, "down", n.networkDown(ctx, id, inspect))
 		}
 	} else if running {
-		return n.networkUp(id, inspect, retryCount)
+		return n.recordOutcome(id, "up", n.networkUp(ctx, id, inspect, retryCount))
 	}
 
 	return nil
 }
 
-func (n *Manager) retry(id string, retryCount int) {
+// State reports the IPs the manager is tracking and the containers
+// waiting on a retry
+func (n *Manager) State() interface{} {
+	state := n.s.dump()
+	n.retryLock.Lock()
+	retries := map[string]int{}
+	for id, count := range n.retries {
+		retries[id] = count
+	}
+	n.retryLock.Unlock()
+	state["retries"] = retries
+	return state
+}
+
+func (n *Manager) retry(parent context.Context, id string, retryCount int) {
+	defer crash.Recover()
+	n.retryLock.Lock()
+	n.retries[id] = retryCount
+	n.retryLock.Unlock()
 	time.Sleep(2 * time.Second)
-	logrus.WithField("cid", id).Infof("Evaluating state from retry")
-	if err := n.evaluate(id, retryCount); err != nil {
-		logrus.Errorf("Failed to evaluate networking: %v", err)
+	n.retryLock.Lock()
+	if n.retries[id] == retryCount {
+		delete(n.retries, id)
+	}
+	n.retryLock.Unlock()
+	log.WithField(logging.ContainerIDKey, id).Infof("Evaluating state from retry")
+	ctx := context.Background()
+	if received, ok := EventReceived(parent); ok {
+		ctx = WithEventReceived(ctx, received)
+	}
+	span, ctx := tracing.Start(ctx, "retry", tracing.ContainerIDKey, id, "retry", strconv.Itoa(retryCount))
+	err := n.evaluate(ctx, id, retryCount)
+	span.End(err)
+	if err != nil {
+		log.WithError(err).Error("Failed to evaluate networking")
 	}
 }
 
-func (n *Manager) networkUp(id string, inspect types.ContainerJSON, retryCount int) error {
-	logrus.WithFields(logrus.Fields{"networkMode": inspect.HostConfig.NetworkMode, "cid": inspect.ID}).Infof("CNI up")
+func (n *Manager) networkUp(ctx context.Context, id string, inspect types.ContainerJSON, retryCount int) error {
+	extraArgs, requestedIP, err := requestedIPArgs(inspect)
+	if err != nil {
+		return err
+	}
+	if requestedIP != "" {
+		if owner := n.s.Owner(id, requestedIP); owner != "" {
+			return fmt.Errorf("Requested IP %s is already in use by container %s", requestedIP, owner)
+		}
+	}
+
+	ip := requestedIP
+	if ip == "" {
+		ip = stripMask(inspect.Config.Labels[IPLabel])
+	}
+	if ip != "" {
+		if reason := n.s.ReuseBlocked(id, ip, n.IPQuietPeriod.Get()); reason != "" {
+			if retryCount < maxRetries {
+				go n.retry(ctx, id, retryCount+1)
+			}
+			return fmt.Errorf("Delaying networking, IP %s is %s", ip, reason)
+		}
+	}
+
+	if audit.Would("network", "cni.add", id, inspect.HostConfig.NetworkMode) {
+		return nil
+	}
+	log.WithFields(logrus.Fields{"networkMode": inspect.HostConfig.NetworkMode, logging.ContainerIDKey: inspect.ID}).Infof("CNI up")
+	start := time.Now()
 	pluginState, err := glue.LookupPluginState(inspect)
 	if err != nil {
 		return errors.Wrap(err, "Finding plugin state")
 	}
-	result, err := glue.CNIAdd(pluginState)
+	span, _ := tracing.Start(ctx, "cni_add", tracing.ContainerIDKey, id)
+	result, err := cniAdd(pluginState, extraArgs)
+	span.End(err)
+	cniTime := time.Now().Sub(start)
+	setupSeconds.Observe(cniTime.Seconds(), "cni_add")
 	if err != nil {
 		if retryCount < maxRetries {
-			go n.retry(id, retryCount+1)
+			go n.retry(ctx, id, retryCount+1)
+		}
+		if requestedIP != "" {
+			return errors.Wrapf(err, "Bringing up networking with requested IP %s", requestedIP)
 		}
 		return errors.Wrap(err, "Bringing up networking")
 	}
-	logrus.WithFields(logrus.Fields{
-		"networkMode": inspect.HostConfig.NetworkMode,
-		"cid":         inspect.ID,
-		"result":      result,
+	if requestedIP != "" && (result == nil || result.IP4 == nil || !result.IP4.IP.IP.Equal(net.ParseIP(requestedIP))) {
+		if err := glue.CNIDel(pluginState); err != nil {
+			log.WithField(logging.ContainerIDKey, id).Errorf("Failed to release unrequested IP: %v", err)
+		}
+		return fmt.Errorf("IPAM did not assign requested IP %s, got %v", requestedIP, result)
+	}
+	log.WithFields(logrus.Fields{
+		"networkMode":          inspect.HostConfig.NetworkMode,
+		logging.ContainerIDKey: inspect.ID,
+		"result":               result,
+		"cniTime":              cniTime,
 	}).Infof("CNI up done")
-	if err := n.setupHosts(inspect, result); err != nil {
+	hostsStart := time.Now()
+	span, _ = tracing.Start(ctx, "hosts_file", tracing.ContainerIDKey, id)
+	err = n.setupHosts(inspect, result)
+	span.End(err)
+	if err != nil {
 		return err
 	}
+	setupSeconds.Observe(metrics.Since(hostsStart), "hosts_file")
+	setupSeconds.Observe(metrics.Since(start), "total")
 	n.s.Started(id, inspect.State.StartedAt)
+	if result != nil && result.IP4 != nil {
+		n.s.SetIP(id, result.IP4.IP.IP.String())
+	}
+	n.s.SetResult(id, result)
+	go n.verify(ctx, id, inspect.State.Pid, result)
 	return nil
 }
 
+// verify checks the container can reach its gateway and observes how long
+// it took since the start event. Failures are only logged, the plugins
+// reported success and retrying wouldn't change their answer. It runs on its
+// own so the ping doesn't hold the container's lock.
+func (n *Manager) verify(ctx context.Context, id string, pid int, result *cniTypes.Result) {
+	defer crash.Recover()
+	start := time.Now()
+	span, _ := tracing.Start(ctx, "verify", tracing.ContainerIDKey, id)
+	err := verifyReachable(pid, result)
+	span.End(err)
+	setupSeconds.Observe(metrics.Since(start), "verify")
+	n.s.Outcome(id, "verify", err)
+
+	status := "reachable"
+	if err != nil {
+		log.WithField(logging.ContainerIDKey, id).WithError(err).Warn("Container networking is up but not reachable")
+		status = "unreachable"
+	}
+	if received, ok := EventReceived(ctx); ok {
+		readySeconds.Observe(metrics.Since(received), status)
+	}
+}
+
+func requestedIPArgs(inspect types.ContainerJSON) ([][2]string, string, error) {
+	requestedIP := stripMask(inspect.Config.Labels[RequestedIPLabel])
+	if requestedIP == "" {
+		return nil, "", nil
+	}
+	if net.ParseIP(requestedIP) == nil {
+		return nil, "", fmt.Errorf("Invalid IP %q in label %s", requestedIP, RequestedIPLabel)
+	}
+	return [][2]string{{"IP", requestedIP}}, requestedIP, nil
+}
+
 func (n *Manager) setupHosts(inspect types.ContainerJSON, result *cniTypes.Result) error {
 	if inspect.Config == nil || inspect.Config.Hostname == "" || inspect.HostsPath == "" ||
 		result == nil || result.IP4.IP.String() == "" {
@@ -146,23 +333,78 @@ func (n *Manager) setupHosts(inspect types.ContainerJSON, result *cniTypes.Resul
 	}
 
 	updatedHosts := hostsString + line
-	return ioutil.WriteFile(inspect.HostsPath, []byte(updatedHosts), 0644)
+	return audit.File("network", "file.write", inspect.HostsPath, func() error {
+		return ioutil.WriteFile(inspect.HostsPath, []byte(updatedHosts), 0644)
+	})
 }
 
-func (n *Manager) networkDown(id string, inspect types.ContainerJSON) error {
+func (n *Manager) networkDown(ctx context.Context, id string, inspect types.ContainerJSON) error {
+	// Deferred calls run last first, the IP is released before Stopped
+	// forgets it
 	defer n.s.Stopped(id)
+	defer n.releaseIP(id)
 	if inspect.ContainerJSONBase == nil || inspect.HostConfig == nil {
 		return nil
 	}
-	logrus.WithFields(logrus.Fields{"networkMode": inspect.HostConfig.NetworkMode, "cid": inspect.ID}).Infof("CNI down")
+	if audit.Would("network", "cni.del", id, inspect.HostConfig.NetworkMode) {
+		return nil
+	}
+	log.WithFields(logrus.Fields{"networkMode": inspect.HostConfig.NetworkMode, logging.ContainerIDKey: inspect.ID}).Infof("CNI down")
 	pluginState, err := glue.LookupPluginState(inspect)
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrap(err, "Finding plugin state on down")
 	}
-	return glue.CNIDel(pluginState)
+	start := time.Now()
+	span, _ := tracing.Start(ctx, "cni_del", tracing.ContainerIDKey, id)
+	err = glue.CNIDel(pluginState)
+	span.End(err)
+	setupSeconds.Observe(metrics.Since(start), "cni_del")
+	return err
+}
+
+func (n *Manager) releaseIP(id string) {
+	ip := n.s.IP(id)
+	if ip == "" {
+		return
+	}
+	n.flushReleased(ip, logrus.Fields{logging.ContainerIDKey: id, "ip": ip})
+}
+
+// flushReleased removes the flows to a released IP, withholding it from new
+// containers for the quiet period when that fails
+func (n *Manager) flushReleased(ip string, fields logrus.Fields) {
+	if audit.Would("network", "flows.flush", ip, nil) {
+		n.s.Released(ip, true)
+		return
+	}
+	if err := n.flush(ip); err != nil {
+		log.WithFields(fields).Errorf("Failed to flush flows for released IP: %v", err)
+		n.s.Released(ip, false)
+		return
+	}
+	n.s.Released(ip, true)
+}
+
+// swarmManaged reports whether Swarm networks the container, a task on its
+// own overlays or anything attached to its ingress network
+func swarmManaged(inspect types.ContainerJSON) bool {
+	if inspect.Config != nil && swarm.Task(inspect.Config.Labels) {
+		return true
+	}
+	if inspect.HostConfig != nil && string(inspect.HostConfig.NetworkMode) == swarm.IngressNetwork {
+		return true
+	}
+	if inspect.NetworkSettings != nil {
+		_, ok := inspect.NetworkSettings.Networks[swarm.IngressNetwork]
+		return ok
+	}
+	return false
 }
 
 func configureNetwork(inspect *types.ContainerJSON) bool {
+	if swarmManaged(*inspect) {
+		return false
+	}
 	net, ok := inspect.Config.Labels[CNILabel]
 	if !ok && (inspect.Config.Labels[LegacyManagedNetLabel] == "true" || inspect.Config.Labels[IPLabel] != "") {
 		net = "managed"
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	glue "github.com/rancher/cniglue"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+)
+
+// testManager is a manager over the Docker and metadata of server
+func testManager(t *testing.T, server *metadatatest.Server) *Manager {
+	dc, err := client.NewClient(server.URL, "v1.22", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewManager(engine.NewDockerClient(dc), store.New(server.Source(source.RancherOptions{}), dc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func running(id string, labels map[string]string) metadata.Container {
+	return metadata.Container{Name: id, ExternalId: id, HostUUID: "host1", State: "running", StartCount: 1, Labels: labels}
+}
+
+// Each case is refused or skipped before any CNI plugin would run
+func TestEvaluateWithoutCNI(t *testing.T) {
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Containers: []metadata.Container{
+			running("plain", nil),
+			running("task", map[string]string{swarm.TaskIDLabel: "t1", IPLabel: "10.42.0.3/16"}),
+			running("holder", map[string]string{IPLabel: "10.42.0.9/16"}),
+			running("wants", map[string]string{CNILabel: "managed", RequestedIPLabel: "10.42.0.9"}),
+			running("reused", map[string]string{IPLabel: "10.42.0.7/16"}),
+		},
+	})
+	defer server.Close()
+
+	n := testManager(t, server)
+	n.s.Started("holder", "earlier")
+	n.s.SetIP("holder", "10.42.0.9")
+	n.s.Released("10.42.0.7", false)
+
+	tests := []struct {
+		name string
+		id   string
+		err  string
+	}{
+		{"unmanaged", "plain", ""},
+		{"swarm task", "task", ""},
+		{"requested IP in use", "wants", "already in use by container holder"},
+		{"IP released without a flush", "reused", "Delaying networking"},
+	}
+	for _, test := range tests {
+		// At the last retry, so nothing is retried once the test is done
+		err := n.evaluate(context.Background(), test.id, maxRetries)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+		if n.s.StartTime(test.id) != "" {
+			t.Errorf("%s: tracked as networked", test.name)
+		}
+	}
+}
+
+func TestStoppedIPFlushed(t *testing.T) {
+	// No CNI configuration, the plugins have nothing to run
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(cniDir string) { glue.CniDir = cniDir }(glue.CniDir)
+	glue.CniDir = filepath.Join(dir, "%s.d")
+
+	tests := []struct {
+		name        string
+		stop        func(*metadatatest.Answers)
+		flushErr    error
+		quarantined bool
+	}{
+		{"stopped", func(a *metadatatest.Answers) { a.Containers[0].State = "stopped" }, nil, false},
+		{"removed", func(a *metadatatest.Answers) { a.Containers = nil }, nil, false},
+		{"flush failed", func(a *metadatatest.Answers) { a.Containers[0].State = "stopped" }, errors.New("conntrack: not found"), true},
+	}
+	for _, test := range tests {
+		server := metadatatest.NewServer(metadatatest.Answers{
+			SelfHost:   metadata.Host{UUID: "host1"},
+			Containers: []metadata.Container{running("web", map[string]string{IPLabel: "10.42.0.5/16"})},
+		})
+		n := testManager(t, server)
+		n.s.Started("web", "earlier")
+		n.s.SetIP("web", "10.42.0.5")
+		flushed := []string{}
+		n.flush = func(ip string) error {
+			flushed = append(flushed, ip)
+			return test.flushErr
+		}
+
+		server.Update(test.stop)
+		if err := n.Evaluate(context.Background(), "web"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(flushed, []string{"10.42.0.5"}) {
+			t.Errorf("%s: flushed %v, want the container's IP", test.name, flushed)
+		}
+		if n.s.IP("web") != "" || n.s.StartTime("web") != "" {
+			t.Errorf("%s: container still tracked", test.name)
+		}
+		reason := n.s.ReuseBlocked("next", "10.42.0.5", time.Minute)
+		if quarantined := reason != ""; quarantined != test.quarantined {
+			t.Errorf("%s: got quarantine %q, want quarantined %v", test.name, reason, test.quarantined)
+		}
+		server.Close()
+	}
+}
+
+func TestReleasedOnOtherHosts(t *testing.T) {
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Containers: []metadata.Container{
+			{Name: "web", UUID: "web-uuid", HostUUID: "host2", PrimaryIp: "10.42.0.5"},
+			{Name: "db", UUID: "db-uuid", HostUUID: "host3", PrimaryIp: "10.42.0.6"},
+			{Name: "api", UUID: "api-uuid", HostUUID: "host2", PrimaryIp: "10.42.0.7"},
+			{Name: "local", UUID: "local-uuid", HostUUID: "host1", PrimaryIp: "10.42.0.8"},
+		},
+	})
+	defer server.Close()
+	n := testManager(t, server)
+	flushed := []string{}
+	n.flush = func(ip string) error {
+		flushed = append(flushed, ip)
+		if ip == "10.42.0.6" {
+			return errors.New("conntrack: not found")
+		}
+		return nil
+	}
+
+	n.onReleases(server.Version())
+	if len(flushed) != 0 {
+		t.Fatalf("flushed %v before anything was released", flushed)
+	}
+
+	// web is removed, db is removed with a failed flush, api's IP goes to
+	// a new container and the local container is flushed as it stops
+	server.Update(func(a *metadatatest.Answers) {
+		a.Containers = []metadata.Container{
+			{Name: "api", UUID: "api2-uuid", HostUUID: "host3", PrimaryIp: "10.42.0.7"},
+		}
+	})
+	n.onReleases(server.Version())
+	sort.Strings(flushed)
+	if want := []string{"10.42.0.5", "10.42.0.6", "10.42.0.7"}; !reflect.DeepEqual(flushed, want) {
+		t.Errorf("flushed %v, want %v", flushed, want)
+	}
+	for _, ip := range []string{"10.42.0.5", "10.42.0.7"} {
+		if reason := n.s.ReuseBlocked("next", ip, time.Minute); reason != "" {
+			t.Errorf("%s: quarantined after a clean flush: %s", ip, reason)
+		}
+	}
+	if reason := n.s.ReuseBlocked("next", "10.42.0.6", time.Minute); reason == "" {
+		t.Errorf("10.42.0.6 not quarantined after its flush failed")
+	}
+}
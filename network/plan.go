@@ -0,0 +1,76 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/docker/engine-api/client"
+	glue "github.com/rancher/cniglue"
+)
+
+// Plan describes the CNI configuration and arguments that would be used to
+// bring up networking for a container without invoking any plugins
+func Plan(c *client.Client, id string) (string, error) {
+	inspect, err := c.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if !configureNetwork(&inspect) {
+		fmt.Fprintf(buf, "Container %s does not use managed networking\n", inspect.ID)
+		return buf.String(), nil
+	}
+
+	extraArgs, _, err := requestedIPArgs(inspect)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := glue.LookupPluginState(inspect)
+	if err != nil {
+		return "", err
+	}
+
+	network := state.HostConfig.NetworkMode.NetworkName()
+	fmt.Fprintf(buf, "Container: %s\nNetwork: %s\n", inspect.ID, network)
+	if state.HostConfig.NetworkMode.IsContainer() ||
+		state.HostConfig.NetworkMode.IsHost() ||
+		state.HostConfig.NetworkMode.IsNone() {
+		fmt.Fprintf(buf, "No CNI plugins would be run for network mode %s\n", state.HostConfig.NetworkMode)
+		return buf.String(), nil
+	}
+
+	rt := runtimeConf(state, extraArgs)
+	var args []string
+	for _, arg := range rt.Args {
+		args = append(args, arg[0]+"="+arg[1])
+	}
+	fmt.Fprintf(buf, "NetNS: %s\nIfName: %s\nCNI_ARGS: %s\n", rt.NetNS, rt.IfName, strings.Join(args, ";"))
+
+	if network == "" {
+		network = "default"
+	}
+	files, err := libcni.ConfFiles(fmt.Sprintf(glue.CniDir, network))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	if len(files) == 0 {
+		fmt.Fprintf(buf, "No CNI config files found in %s\n", fmt.Sprintf(glue.CniDir, network))
+	}
+	for _, file := range files {
+		conf, err := libcni.ConfFromFile(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, "\n# ADD %s (%s)\n%s\n", file, conf.Network.Type, conf.Bytes)
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/plugin-manager/source"
+)
+
+// WatchReleases flushes the flows to IPs that containers on other hosts
+// release. Every host flushing its own conntrack and neighbor entries purges
+// the IP cluster wide before IPAM hands it to a new container, which may be
+// on any host.
+func (n *Manager) WatchReleases() {
+	go n.store.OnChange(source.IntervalSeconds, n.onReleases)
+}
+
+// onReleases flushes the IPs held at the last change that metadata no longer
+// has a container on another host holding. The first change only records
+// what's held.
+func (n *Manager) onReleases(version string) {
+	n.paused.RLock()
+	defer n.paused.RUnlock()
+	if source.IsStale(n.store) {
+		log.Debugf("Not looking for released IPs in cached metadata")
+		return
+	}
+	host, err := n.store.GetSelfHost()
+	if err != nil {
+		log.WithError(err).Error("Failed to look for released IPs")
+		return
+	}
+	containers, err := n.store.GetContainers()
+	if err != nil {
+		log.WithError(err).Error("Failed to look for released IPs")
+		return
+	}
+
+	// This host's containers are flushed as they stop
+	held := map[string]string{}
+	for _, container := range containers {
+		if container.HostUUID != host.UUID && container.PrimaryIp != "" {
+			held[container.PrimaryIp] = container.UUID
+		}
+	}
+	if n.held != nil {
+		for ip, uuid := range n.held {
+			if held[ip] == uuid {
+				continue
+			}
+			log.WithFields(logrus.Fields{"ip": ip, "uuid": uuid}).Infof("Flushing flows for IP %s released on another host", ip)
+			n.flushReleased(ip, logrus.Fields{"ip": ip, "uuid": uuid})
+		}
+	}
+	n.held = held
+}
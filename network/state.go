@@ -3,57 +3,77 @@ package network
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
 )
 
 type state struct {
 	sync.RWMutex
 	startTimes map[string]string
-	c          *client.Client
+	ips        map[string]string
+	released   map[string]time.Time
+	results    map[string]*cniTypes.Result
+	outcomes   map[string][]Outcome
 }
 
-func newState(c *client.Client) (*state, error) {
-	s := &state{
+func emptyState() *state {
+	return &state{
 		startTimes: map[string]string{},
-		c:          c,
+		ips:        map[string]string{},
+		released:   map[string]time.Time{},
+		results:    map[string]*cniTypes.Result{},
+		outcomes:   map[string][]Outcome{},
 	}
-	cs, err := c.ContainerList(context.Background(), types.ContainerListOptions{
-		All: true,
-	})
+}
+
+func newState(rt engine.Runtime) (*state, error) {
+	s := emptyState()
+	cs, err := rt.List(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
 	for _, container := range cs {
-		inspect, err := c.ContainerInspect(context.Background(), container.ID)
-		if client.IsErrContainerNotFound(err) {
+		inspect, err := rt.Inspect(context.Background(), container.ID)
+		if err == engine.ErrNotFound {
 			continue
 		} else if err != nil {
 			return nil, err
 		}
-		logrus.WithFields(logrus.Fields{
-			"cid":       container.ID,
-			"running":   inspect.State.Running,
-			"startedAt": inspect.State.StartedAt,
+		labels := inspect.Labels
+		if swarm.Task(labels) {
+			continue
+		}
+		logging.SetContainerUUID(inspect.ID, labels[store.UUIDLabel])
+		log.WithFields(logrus.Fields{
+			logging.ContainerIDKey: container.ID,
+			"running":              inspect.Running,
+			"startedAt":            inspect.Started,
 		}).Infof("Inspecting on start")
-		if inspect.State.Running {
-			hasIface, err := s.hasNetwork(inspect.State.Pid)
+		if inspect.Running {
+			hasIface, err := s.hasNetwork(inspect.Pid)
 			if err != nil {
-				logrus.WithField("cid", inspect.ID).Errorf("Failed to inspect interfaces")
+				log.WithField(logging.ContainerIDKey, inspect.ID).Errorf("Failed to inspect interfaces")
 				continue
 			}
 			if hasIface {
-				logrus.WithFields(logrus.Fields{
-					"cid":       container.ID,
-					"startedAt": inspect.State.StartedAt,
+				log.WithFields(logrus.Fields{
+					logging.ContainerIDKey: container.ID,
+					"startedAt":            inspect.Started,
 				}).Info("Recording previously started")
-				s.startTimes[container.ID] = inspect.State.StartedAt
+				s.startTimes[container.ID] = inspect.Started
+				if ip := labels[IPLabel]; ip != "" {
+					s.ips[container.ID] = stripMask(ip)
+				}
 			} else {
-				logrus.WithFields(logrus.Fields{
-					"cid": container.ID,
+				log.WithFields(logrus.Fields{
+					logging.ContainerIDKey: container.ID,
 				}).Info("Still needs networking")
 			}
 		}
@@ -78,4 +98,41 @@ func (s *state) Stopped(id string) {
 	s.Lock()
 	defer s.Unlock()
 	delete(s.startTimes, id)
+	delete(s.ips, id)
+	delete(s.results, id)
+}
+
+func (s *state) IP(id string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ips[id]
+}
+
+func (s *state) SetIP(id, ip string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ips[id] = ip
+}
+
+// dump copies the tracked start times, IPs and quarantined releases
+func (s *state) dump() map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+	startTimes := map[string]string{}
+	for id, t := range s.startTimes {
+		startTimes[id] = t
+	}
+	ips := map[string]string{}
+	for id, ip := range s.ips {
+		ips[id] = ip
+	}
+	released := map[string]time.Time{}
+	for ip, t := range s.released {
+		released[ip] = t
+	}
+	return map[string]interface{}{
+		"startTimes": startTimes,
+		"ips":        ips,
+		"released":   released,
+	}
 }
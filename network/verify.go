@@ -0,0 +1,144 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// verifyTimeout bounds how long a new container's gateway gets to answer
+var verifyTimeout = 2 * time.Second
+
+type receivedKey struct{}
+
+// WithEventReceived records when the Docker event that led to an Evaluate
+// was received, so the time until the container is reachable is measured
+// from there
+func WithEventReceived(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, receivedKey{}, t)
+}
+
+// EventReceived returns when the event that led to the Evaluate in ctx was
+// received
+func EventReceived(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(receivedKey{}).(time.Time)
+	return t, ok
+}
+
+// verifyReachable checks eth0 in the container's namespace is up with the
+// assigned address, then pings the gateway from inside it
+func verifyReachable(pid int, result *cniTypes.Result) error {
+	if result == nil || result.IP4 == nil {
+		return nil
+	}
+
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName("eth0")
+	if err != nil {
+		return err
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("eth0 is down")
+	}
+
+	addrs, err := handle.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.Equal(result.IP4.IP.IP) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("eth0 does not have %s", result.IP4.IP.IP)
+	}
+
+	if result.IP4.Gateway == nil {
+		return nil
+	}
+	return pingIn(ns, result.IP4.Gateway, verifyTimeout)
+}
+
+// pingIn sends an ICMP echo to ip from inside ns and waits for the reply
+func pingIn(ns netns.NsHandle, ip net.IP, timeout time.Duration) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	if err := netns.Set(ns); err != nil {
+		return err
+	}
+	defer netns.Set(orig)
+
+	conn, err := net.DialTimeout("ip4:icmp", ip.String(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(os.Getpid())
+	if _, err := conn.Write(echoRequest(id, 1)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("no reply from gateway %s: %v", ip, err)
+		}
+		reply := buf[:n]
+		// Raw reads may include the IPv4 header depending on the Go version
+		if len(reply) > 0 && reply[0]>>4 == 4 && len(reply) >= int(reply[0]&0x0f)*4 {
+			reply = reply[int(reply[0]&0x0f)*4:]
+		}
+		// Type 0 is an echo reply
+		if len(reply) >= 8 && reply[0] == 0 && binary.BigEndian.Uint16(reply[4:6]) == id {
+			return nil
+		}
+	}
+}
+
+func echoRequest(id, seq uint16) []byte {
+	msg := make([]byte, 16)
+	msg[0] = 8
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	copy(msg[8:], "plugmgr!")
+
+	var sum uint32
+	for i := 0; i < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum += sum >> 16
+	binary.BigEndian.PutUint16(msg[2:4], ^uint16(sum))
+	return msg
+}
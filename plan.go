@@ -0,0 +1,148 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/rancher/plugin-manager/cniconf"
+	"github.com/rancher/plugin-manager/hostnat"
+	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/urfave/cli"
+)
+
+func planCommand() cli.Command {
+	return cli.Command{
+		Name:  "plan",
+		Usage: "Print how the CNI configs and iptables rules would change without changing them",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "container",
+				Usage: "Also show how networking would be set up for this container ID",
+			},
+		},
+		Action: plan,
+	}
+}
+
+func plan(c *cli.Context) error {
+	opts, err := metadataOptions(c)
+	if err != nil {
+		return err
+	}
+	mClient, err := metadataSource(c, opts, false)
+	if err != nil {
+		return err
+	}
+
+	confs, err := cniconf.Plan(mClient)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for p := range confs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		current, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("### CNI config %s\n%s\n", p, orUnchanged(diffLines(string(current), string(confs[p]))))
+	}
+
+	ports, err := hostports.Plan(mClient)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("### Host ports iptables rules\n%s\n", orUnchanged(ports))
+
+	nat, err := hostnat.Plan(mClient)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("### Host NAT iptables rules\n%s\n", orUnchanged(nat))
+
+	if id := c.String("container"); id != "" {
+		dClient, err := client.NewEnvClient()
+		if err != nil {
+			return err
+		}
+		out, err := network.Plan(dClient, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("### Container networking\n%s", out)
+	}
+
+	return nil
+}
+
+func orUnchanged(diff string) string {
+	if diff == "" {
+		return "unchanged\n"
+	}
+	return diff
+}
+
+// diffLines prints the lines of want prefixed + where they aren't in
+// current, and the lines of current only there prefixed -, empty when they
+// are the same
+func diffLines(current, want string) string {
+	if current == want {
+		return ""
+	}
+	a, b := splitLines(current), splitLines(want)
+	// common[i][j] is the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(buf, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			fmt.Fprintf(buf, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(buf, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return buf.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "testing"
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		want    string
+		diff    string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", ""},
+		{"new file", "", "a\nb\n", "+ a\n+ b\n"},
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", "  a\n- b\n+ B\n  c\n"},
+		{"removed line", "a\nb\nc\n", "a\nc\n", "  a\n- b\n  c\n"},
+	}
+	for _, test := range tests {
+		if got := diffLines(test.current, test.want); got != test.diff {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.diff)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package reaper
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/features"
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var checkStarts = features.Register("reaper-events",
+	"The reaper checks each container as the runtime reports it starting, not only on metadata changes", true)
+
+// followEvents checks each container the runtime starts straight away,
+// rather than at the next metadata change. A broken stream is followed
+// again after a backoff.
+func (w *watcher) followEvents() {
+	defer crash.Recover()
+	b := &backoff.Backoff{
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+		Factor: 2,
+	}
+	for {
+		events, err := w.rt.Events(context.Background())
+		if err != nil {
+			log.WithError(err).Errorf("Failed to follow %s events", w.rt.Name())
+		} else {
+			for event := range events {
+				b.Reset()
+				if event.Status == "start" && checkStarts.Enabled() {
+					w.onStart(event.ID)
+				}
+			}
+			log.Warnf("%s event stream closed, following it again", w.rt.Name())
+		}
+		time.Sleep(b.Duration())
+	}
+}
+
+// onStart looks for duplicates when a metadata or DNS service starts, and
+// stops the container if metadata already says it's orphaned
+func (w *watcher) onStart(id string) {
+	w.pass.Lock()
+	defer w.pass.Unlock()
+	container, err := w.rt.Inspect(context.Background(), id)
+	if err == engine.ErrNotFound {
+		return
+	} else if err != nil {
+		log.WithField(logging.ContainerIDKey, id).WithError(err).Error("Failed to inspect started container")
+		return
+	}
+	if service := container.Labels[serviceNameLabel]; service == metadataService || service == dnsService {
+		if err := CheckMetadata(w.rt, false); err != nil {
+			log.WithError(err).Error("Failed to check for bad metadata")
+		}
+	}
+
+	host, err := w.c.GetSelfHost()
+	if err != nil {
+		log.WithError(err).Error("Failed to watch for orphan containers")
+		return
+	}
+	containers, err := w.c.GetContainers()
+	if err != nil {
+		log.WithError(err).Error("Failed to watch for orphan containers")
+		return
+	}
+	for _, c := range containers {
+		if c.ExternalId == id {
+			w.check(host, []metadata.Container{c})
+		}
+	}
+}
@@ -2,60 +2,160 @@ package reaper
 
 import (
 	"context"
+	"sync"
 	"time"
 
-	"github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
 	"github.com/jpillora/backoff"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/alerts"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/features"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+	"github.com/rancher/plugin-manager/watchdog"
 )
 
+var log = logging.Subsystem("reaper")
+
 var (
+	removals = metrics.NewCounter("plugin_manager_reaper_removals_total",
+		"Containers stopped as orphans or removed as duplicate metadata/dns services", "reason")
+
 	uuidLabel        = "io.rancher.container.uuid"
 	serviceNameLabel = "io.rancher.stack_service.name"
 	metadataService  = "network-services/metadata"
 	dnsService       = "network-services/metadata/dns"
 
+	// recheckEvery is how often every container is checked when only
+	// deltas arrive, catching what a failed stop left running
 	recheckEvery = 5 * time.Minute
+
+	checkDeltas = features.Register("reaper-deltas",
+		"The reaper checks only the containers metadata reports changed, not every container on each change", true)
 )
 
-func Watch(dockerClient *client.Client, c metadata.Client) error {
+func Watch(rt engine.Runtime, c store.Store) error {
 	w := &watcher{
-		dc: dockerClient,
-		c:  c,
+		rt:     rt,
+		c:      c,
+		failed: map[string]metadata.Container{},
 	}
-	go c.OnChange(5, w.onChangeNoError)
-	go watchMetadata(dockerClient)
+	// Only containers that changed need checking when the source can say
+	// which ones did
+	health.Register("reaper")
+	handoff.RegisterStop("reaper", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("reaper", func() error { return w.reconcile("") })
+	if ds, ok := c.(source.DeltaSource); ok {
+		go ds.OnContainerDelta(source.IntervalSeconds, w.onDelta)
+		watchdog.Go("reaper.recheck", w.recheck)
+	} else {
+		go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	}
+	watchdog.Go("reaper.metadata", func() { watchMetadata(rt) })
+	go w.followEvents()
 	return nil
 }
 
-func watchMetadata(dockerClient *client.Client) {
+// Reconcile stops the orphaned containers in the current metadata once, for
+// running without the daemon
+func Reconcile(rt engine.Runtime, c store.Store) error {
+	w := &watcher{
+		rt:     rt,
+		c:      c,
+		failed: map[string]metadata.Container{},
+	}
+	return w.onChange("")
+}
+
+func watchMetadata(rt engine.Runtime) {
 	b := &backoff.Backoff{
 		Min:    1 * time.Second,
 		Max:    5 * time.Minute,
 		Factor: 1.5,
 	}
 	for {
-		err := CheckMetadata(dockerClient, false)
+		health.Heartbeat("reaper.metadata", b.Max)
+		err := CheckMetadata(rt, false)
 		if err != nil {
-			logrus.Errorf("Failed to check for bad metadata: %v", err)
+			log.WithError(err).Error("Failed to check for bad metadata")
 		}
 		time.Sleep(b.Duration())
 	}
 }
 
 type watcher struct {
-	dc *client.Client
-	c  metadata.Client
+	pass sync.Mutex
+	rt   engine.Runtime
+	c    store.Store
+	// failed are the orphans whose stop failed, by container ID, checked
+	// again with every delta until they stop or metadata changes them
+	failed map[string]metadata.Container
+}
+
+// recheck checks every container each recheckEvery
+func (w *watcher) recheck() {
+	for {
+		health.Heartbeat("reaper.recheck", 2*recheckEvery)
+		time.Sleep(recheckEvery)
+		if err := w.reconcile(""); err != nil {
+			log.WithError(err).Error("Failed to recheck for orphan containers")
+		}
+	}
+}
+
+func (w *watcher) onDelta(delta source.ContainerDelta) {
+	if !checkDeltas.Enabled() {
+		w.onChangeNoError("")
+		return
+	}
+	w.pass.Lock()
+	defer w.pass.Unlock()
+	done := health.Begin("reaper")
+	host, err := w.c.GetSelfHost()
+	if err != nil {
+		done(err)
+		log.WithError(err).Error("Failed to watch for orphan containers")
+		return
+	}
+
+	// Failed stops are retried unless the delta has a newer version of
+	// the container
+	retry := w.failed
+	w.failed = map[string]metadata.Container{}
+	if delta.Full {
+		retry = nil
+	}
+	for _, changes := range [][]metadata.Container{delta.Added, delta.Changed, delta.Removed} {
+		for _, container := range changes {
+			delete(retry, container.ExternalId)
+		}
+	}
+	w.check(host, delta.Added)
+	w.check(host, delta.Changed)
+	for _, container := range retry {
+		w.check(host, []metadata.Container{container})
+	}
+	done(nil)
 }
 
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to watch for orphan containers: %v", err)
+	if err := w.reconcile(version); err != nil {
+		log.WithError(err).Error("Failed to watch for orphan containers")
 	}
 }
 
+// reconcile checks every container once
+func (w *watcher) reconcile(version string) error {
+	return admin.Pass("reaper", &w.pass, func() error { return w.onChange(version) })
+}
+
 func (w *watcher) onChange(version string) error {
 	host, err := w.c.GetSelfHost()
 	if err != nil {
@@ -67,6 +167,20 @@ func (w *watcher) onChange(version string) error {
 		return err
 	}
 
+	w.failed = map[string]metadata.Container{}
+	w.check(host, containers)
+	return nil
+}
+
+func (w *watcher) check(host metadata.Host, containers []metadata.Container) {
+	if !source.Overrides(host).Reaper {
+		log.Debugf("Orphan container reaping disabled by %s", source.ReaperLabel)
+		return
+	}
+	if source.IsStale(w.c) {
+		log.Debugf("Not reaping containers against cached metadata")
+		return
+	}
 	for _, container := range containers {
 		if container.HostUUID != host.UUID {
 			continue
@@ -75,19 +189,20 @@ func (w *watcher) onChange(version string) error {
 		if !ok {
 			continue
 		}
+		// Swarm reschedules its own tasks
+		if swarm.Task(container.Labels) {
+			swarm.Skip("reaper", container.ExternalId)
+			continue
+		}
 
 		if container.State == "running" && container.UUID != uuid {
 			w.stopContainer(container)
 		}
 	}
-
-	return nil
 }
 
-func CheckMetadata(dockerClient *client.Client, first bool) error {
-	containers, err := dockerClient.ContainerList(context.Background(), types.ContainerListOptions{
-		All: true,
-	})
+func CheckMetadata(rt engine.Runtime, first bool) error {
+	containers, err := rt.List(context.Background())
 	if err != nil {
 		return err
 	}
@@ -95,6 +210,9 @@ func CheckMetadata(dockerClient *client.Client, first bool) error {
 	metadataIds := []string{}
 	dnsIds := []string{}
 	for _, container := range containers {
+		if swarm.Task(container.Labels) {
+			continue
+		}
 		if container.Labels[uuidLabel] != "" && container.Labels[serviceNameLabel] == metadataService {
 			metadataIds = append(metadataIds, container.ID)
 		}
@@ -111,25 +229,31 @@ func CheckMetadata(dockerClient *client.Client, first bool) error {
 	} else if len(dnsIds) > 1 {
 		toDelete = append(toDelete, dnsIds...)
 	} else if first && len(dnsIds) == 1 {
-		dnsContainer, err := dockerClient.ContainerInspect(context.Background(), dnsIds[0])
+		dnsContainer, err := rt.Inspect(context.Background(), dnsIds[0])
 		if err != nil {
 			return err
 		}
-		id := dnsContainer.HostConfig.NetworkMode.ConnectedContainer()
-		_, err = dockerClient.ContainerInspect(context.Background(), id)
-		if client.IsErrContainerNotFound(err) {
-			logrus.Errorf("Failed to find network container [%s] for DNS %s", id, dnsIds[0])
-			toDelete = append(toDelete, dnsIds...)
+		// DNS shares the network of the metadata container, and is only
+		// useful while that is still around
+		if id := dnsContainer.NetworkContainer; id != "" {
+			if _, err := rt.Inspect(context.Background(), id); err == engine.ErrNotFound {
+				log.WithField(logging.ContainerIDKey, dnsIds[0]).Errorf("Failed to find network container [%s] for DNS %s", id, dnsIds[0])
+				toDelete = append(toDelete, dnsIds...)
+			}
 		}
 	}
 
 	for _, id := range toDelete {
-		logrus.Infof("Deleting duplicate metadata/dns service: %s", id)
-		err := dockerClient.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{
-			Force: true,
-		})
+		if audit.Would("reaper", "container.remove", id, "duplicate metadata/dns service") {
+			continue
+		}
+		log.WithField(logging.ContainerIDKey, id).Infof("Deleting duplicate metadata/dns service: %s", id)
+		err := rt.Remove(context.Background(), id)
+		audit.Record("reaper", "container.remove", id, "duplicate metadata/dns service", nil, err)
 		if err != nil {
-			logrus.Errorf("Failed to remove duplicate metadata/dns service: %s", id)
+			log.WithField(logging.ContainerIDKey, id).Errorf("Failed to remove duplicate metadata/dns service: %s", id)
+		} else {
+			removals.Inc("duplicate")
 		}
 	}
 
@@ -137,10 +261,22 @@ func CheckMetadata(dockerClient *client.Client, first bool) error {
 }
 
 func (w *watcher) stopContainer(container metadata.Container) {
-	logrus.Infof("Stopping unmanaged container %s %s", container.Name, container.ExternalId)
-	timeout := time.Duration(0)
-	err := w.dc.ContainerStop(context.Background(), container.ExternalId, &timeout)
+	if audit.Would("reaper", "container.stop", container.ExternalId, "unmanaged container "+container.Name) {
+		return
+	}
+	log.WithField(logging.ContainerIDKey, container.ExternalId).Infof("Stopping unmanaged container %s %s", container.Name, container.ExternalId)
+	err := w.rt.Stop(context.Background(), container.ExternalId, 0)
+	audit.Record("reaper", "container.stop", container.ExternalId, map[string]string{
+		"name":          container.Name,
+		"uuid":          container.UUID,
+		uuidLabel:       container.Labels[uuidLabel],
+		"metadataState": container.State,
+	}, nil, err)
+	alerts.Record("reaper", err)
 	if err != nil {
-		logrus.Errorf("Stop failed: %v", err)
+		log.WithField(logging.ContainerIDKey, container.ExternalId).WithError(err).Error("Stop failed, retrying with the next change")
+		w.failed[container.ExternalId] = container
+	} else {
+		removals.Inc("orphaned")
 	}
 }
@@ -0,0 +1,188 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/swarm"
+)
+
+// runtime is an engine.Runtime over a fixed set of containers that records
+// what was stopped and removed
+type runtime struct {
+	lock       sync.Mutex
+	containers []engine.Container
+	stopErr    error
+	stopped    []string
+	removed    []string
+}
+
+func (r *runtime) Name() string { return "test" }
+
+func (r *runtime) List(ctx context.Context) ([]engine.Container, error) {
+	return r.containers, nil
+}
+
+func (r *runtime) Inspect(ctx context.Context, id string) (engine.Container, error) {
+	for _, c := range r.containers {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return engine.Container{}, engine.ErrNotFound
+}
+
+func (r *runtime) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopErr != nil {
+		return r.stopErr
+	}
+	r.stopped = append(r.stopped, id)
+	return nil
+}
+
+func (r *runtime) Remove(ctx context.Context, id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removed = append(r.removed, id)
+	sort.Strings(r.removed)
+	return nil
+}
+
+func (r *runtime) Events(ctx context.Context) (<-chan engine.Event, error) {
+	return nil, errors.New("no events")
+}
+
+// managed is a container metadata knows as uuid, created by Rancher as
+// label
+func managed(id, uuid, label, hostUUID, state string) metadata.Container {
+	return metadata.Container{
+		Name:       id,
+		ExternalId: id,
+		UUID:       uuid,
+		HostUUID:   hostUUID,
+		State:      state,
+		Labels:     map[string]string{uuidLabel: label},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	self := metadata.Host{UUID: "host1"}
+	task := managed("task", "old", "new", self.UUID, "running")
+	task.Labels[swarm.TaskIDLabel] = "t1"
+	tests := []struct {
+		name       string
+		host       metadata.Host
+		containers []metadata.Container
+		stopped    []string
+	}{
+		{
+			name: "orphan stopped",
+			host: self,
+			containers: []metadata.Container{
+				managed("web", "web-uuid", "web-uuid", self.UUID, "running"),
+				managed("orphan", "new-uuid", "old-uuid", self.UUID, "running"),
+			},
+			stopped: []string{"orphan"},
+		},
+		{
+			name: "only running containers on this host",
+			host: self,
+			containers: []metadata.Container{
+				managed("stopped", "new-uuid", "old-uuid", self.UUID, "stopped"),
+				managed("elsewhere", "new-uuid", "old-uuid", "host2", "running"),
+				{Name: "unlabeled", ExternalId: "unlabeled", UUID: "x", HostUUID: self.UUID, State: "running"},
+			},
+		},
+		{
+			name:       "swarm tasks left alone",
+			host:       self,
+			containers: []metadata.Container{task},
+		},
+		{
+			name: "disabled by the host label",
+			host: metadata.Host{UUID: self.UUID, Labels: map[string]string{source.ReaperLabel: "false"}},
+			containers: []metadata.Container{
+				managed("orphan", "new-uuid", "old-uuid", self.UUID, "running"),
+			},
+		},
+	}
+	for _, test := range tests {
+		server := metadatatest.NewServer(metadatatest.Answers{SelfHost: test.host, Containers: test.containers})
+		rt := &runtime{}
+		if err := Reconcile(rt, store.New(server.Source(source.RancherOptions{}), nil)); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(rt.stopped, test.stopped) {
+			t.Errorf("%s: stopped %v, want %v", test.name, rt.stopped, test.stopped)
+		}
+		server.Close()
+	}
+}
+
+func TestFailedStopRetried(t *testing.T) {
+	self := metadata.Host{UUID: "host1"}
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost:   self,
+		Containers: []metadata.Container{managed("orphan", "new-uuid", "old-uuid", self.UUID, "running")},
+	})
+	defer server.Close()
+
+	rt := &runtime{stopErr: errors.New("daemon busy")}
+	w := &watcher{rt: rt, c: store.New(server.Source(source.RancherOptions{}), nil), failed: map[string]metadata.Container{}}
+	if err := w.onChange(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.failed["orphan"]; !ok {
+		t.Fatalf("failed stop not kept for a retry, have %v", w.failed)
+	}
+
+	// A delta that doesn't touch the orphan still retries it
+	rt.stopErr = nil
+	w.onDelta(source.ContainerDelta{})
+	if !reflect.DeepEqual(rt.stopped, []string{"orphan"}) || len(w.failed) != 0 {
+		t.Errorf("stopped %v with %v still failed, want the orphan retried", rt.stopped, w.failed)
+	}
+}
+
+func TestCheckMetadata(t *testing.T) {
+	service := func(id, name string) engine.Container {
+		return engine.Container{ID: id, Labels: map[string]string{uuidLabel: id, serviceNameLabel: name}}
+	}
+	dns := service("dns", dnsService)
+	dns.NetworkContainer = "gone"
+	tests := []struct {
+		name       string
+		containers []engine.Container
+		first      bool
+		removed    []string
+	}{
+		{"one of each", []engine.Container{service("md", metadataService), service("dns", dnsService)}, true, nil},
+		{"duplicate metadata takes dns too",
+			[]engine.Container{service("md1", metadataService), service("md2", metadataService), service("dns", dnsService)},
+			false, []string{"dns", "md1", "md2"}},
+		{"duplicate dns", []engine.Container{service("dns1", dnsService), service("dns2", dnsService)}, false, []string{"dns1", "dns2"}},
+		{"dns without its network container at startup", []engine.Container{dns}, true, []string{"dns"}},
+		{"dns without its network container later", []engine.Container{dns}, false, nil},
+	}
+	for _, test := range tests {
+		rt := &runtime{containers: test.containers}
+		if err := CheckMetadata(rt, test.first); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(rt.removed, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.name, rt.removed, test.removed)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/cniconf"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/dockerapi"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/exitcode"
+	"github.com/rancher/plugin-manager/floatingip"
+	"github.com/rancher/plugin-manager/hostlock"
+	"github.com/rancher/plugin-manager/hostnat"
+	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/hostroutes"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/reaper"
+	"github.com/rancher/plugin-manager/shaping"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/rancher/plugin-manager/sysctls"
+	"github.com/urfave/cli"
+)
+
+// reconciler runs one subsystem on its own, a single pass or its usual loop
+type reconciler struct {
+	once  func(rt engine.Runtime, st store.Store) error
+	watch func(rt engine.Runtime, st store.Store) error
+}
+
+var reconcilers = map[string]reconciler{
+	"hostports": {
+		once:  func(_ engine.Runtime, st store.Store) error { return hostports.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return hostports.Watch(st) },
+	},
+	"hostnat": {
+		once:  func(_ engine.Runtime, st store.Store) error { return hostnat.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return hostnat.Watch(st) },
+	},
+	"hostroutes": {
+		once:  func(_ engine.Runtime, st store.Store) error { return hostroutes.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return hostroutes.Watch(st) },
+	},
+	"shaping": {
+		once:  func(_ engine.Runtime, st store.Store) error { return shaping.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return shaping.Watch(st) },
+	},
+	"cniconf": {
+		once:  func(_ engine.Runtime, st store.Store) error { return cniconf.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return cniconf.Watch(st) },
+	},
+	"floatingip": {
+		once:  func(_ engine.Runtime, st store.Store) error { return floatingip.Reconcile(st) },
+		watch: func(_ engine.Runtime, st store.Store) error { return floatingip.Watch(st) },
+	},
+	"sysctls": {
+		once:  func(engine.Runtime, store.Store) error { return sysctls.Reconcile() },
+		watch: func(engine.Runtime, store.Store) error { return sysctls.Watch() },
+	},
+	"reaper": {
+		once:  reaper.Reconcile,
+		watch: reaper.Watch,
+	},
+}
+
+func reconcileCommand() cli.Command {
+	return cli.Command{
+		Name:      "reconcile",
+		Usage:     "Run one subsystem against the current metadata without the rest of the daemon",
+		ArgsUsage: "SUBSYSTEM",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "once",
+				Usage: "Make a single pass and exit, non-zero if it failed, rather than keep reconciling",
+			},
+			cli.BoolFlag{
+				Name:  "daemon",
+				Usage: "Have the daemon on --admin-listen make a full pass of SUBSYSTEM, or all of them, right away",
+			},
+		},
+		Action: reconcile,
+	}
+}
+
+func reconcile(c *cli.Context) error {
+	g := c.Parent()
+	if p, dir := g.String("config"), g.String("config-dir"); p != "" || dir != "" {
+		if _, err := config.Apply(g, p, dir); err != nil {
+			return cli.NewExitError(err.Error(), exitcode.Config)
+		}
+	}
+	if c.Bool("daemon") {
+		return reconcileDaemon(c)
+	}
+
+	var names []string
+	for name := range reconcilers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	name := c.Args().First()
+	r, ok := reconcilers[name]
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("Unknown subsystem %q, expected one of %s", name, strings.Join(names, ", ")), exitcode.Config)
+	}
+
+	configureIntervals(g)
+	settings, err := sysctls.Parse(g.StringSlice("sysctl"))
+	if err != nil {
+		return cli.NewExitError(errors.Wrap(err, "Parsing --sysctl").Error(), exitcode.Config)
+	}
+	sysctls.Settings = settings
+	if g.Bool("debug") {
+		logging.SetLevel(logrus.DebugLevel)
+	}
+	if p := g.String("audit-log"); p != "" {
+		if err := audit.Open(p); err != nil {
+			return cli.NewExitError(errors.Wrap(err, "Opening audit log").Error(), exitcode.Config)
+		}
+	}
+	audit.SetDryRun(g.Bool("dry-run"))
+
+	if err := runtimeEnv(g); err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Config)
+	}
+	dClient, err := dockerapi.NewEnvClient()
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Config)
+	}
+	opts, err := metadataOptions(c)
+	if err != nil {
+		return cli.NewExitError(errors.Wrap(err, "Configuring metadata client").Error(), exitcode.Config)
+	}
+	mClient, err := cachedMetadataSource(c, opts, c.Bool("once"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Of(err))
+	}
+	rt, err := containerRuntime(g, dClient)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitcode.Config)
+	}
+	st := runtimeStore(mClient, dClient, rt)
+	for _, docker := range dockerSubsystems {
+		if name == docker && !dockerAPI(rt.Name()) {
+			return cli.NewExitError(fmt.Sprintf("%s needs the Docker API and can't run under --runtime %s", name, rt.Name()), exitcode.Config)
+		}
+	}
+	if !remoteSubsystems[name] && remoteDocker(g) {
+		return cli.NewExitError(fmt.Sprintf("%s changes the host it runs on and can't manage the remote --docker-host %s", name, g.String("docker-host")), exitcode.Config)
+	}
+	for _, user := range dockerUsers(nil) {
+		if name == user && dockerAPI(rt.Name()) {
+			if err := negotiateDocker(dClient, []string{name}); err != nil {
+				return cli.NewExitError(err.Error(), exitcode.Of(err))
+			}
+		}
+	}
+
+	if dockerAPI(rt.Name()) && !remoteDocker(g) {
+		others := map[string]bool{}
+		for _, other := range toggleable {
+			others[other] = other != name
+		}
+		if err := adaptRootless(g, dClient, others); err != nil {
+			return cli.NewExitError(err.Error(), exitcode.Of(err))
+		}
+		if others[name] {
+			return cli.NewExitError(fmt.Sprintf("%s doesn't run under rootless Docker", name), exitcode.Prerequisite)
+		}
+	}
+
+	// Running next to the daemon would have both change the host
+	if p := g.String("host-lock"); p != "" && !g.Bool("dry-run") {
+		lock, err := hostlock.Acquire(p, 0)
+		if err != nil {
+			return cli.NewExitError(errors.Wrap(err, "Taking the host lock, use --daemon to reconcile through the running daemon").Error(), exitcode.Locked)
+		}
+		defer lock.Close()
+	}
+
+	if c.Bool("once") {
+		if err := r.once(rt, st); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to reconcile %s: %v", name, err), 1)
+		}
+		logrus.Infof("Reconciled %s", name)
+		return nil
+	}
+	if err := r.watch(rt, st); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to start %s: %v", name, err), 1)
+	}
+	<-make(chan struct{})
+	return nil
+}
+
+// reconcileDaemon asks the running daemon for a pass through the admin
+// listener and prints its answer
+func reconcileDaemon(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		name = "all"
+	}
+	addr := c.GlobalString("admin-listen")
+	if addr == "" {
+		if !c.GlobalBool("pprof") {
+			return cli.NewExitError("--daemon needs the daemon's --admin-listen address", exitcode.Config)
+		}
+		addr = "127.0.0.1:6060"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return cli.NewExitError(errors.Wrap(err, "Parsing --admin-listen").Error(), exitcode.Config)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/reconcile/%s", net.JoinHostPort(host, port), name), "", nil)
+	if err != nil {
+		return cli.NewExitError(errors.Wrap(err, "Asking the daemon to reconcile").Error(), exitcode.Unavailable)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	os.Stdout.Write(body)
+	if resp.StatusCode != http.StatusOK {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
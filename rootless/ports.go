@@ -0,0 +1,121 @@
+package rootless
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Port is a host port rootlesskit forwards into its network namespace, to
+// a container's IP
+type Port struct {
+	Proto      string `json:"proto"`
+	ParentIP   string `json:"parentIP"`
+	ParentPort int    `json:"parentPort"`
+	ChildIP    string `json:"childIP"`
+	ChildPort  int    `json:"childPort"`
+}
+
+// spec is the port as rootlessctl add-ports takes it
+func (p Port) spec() string {
+	return fmt.Sprintf("%s:%d:%s:%d/%s", p.ParentIP, p.ParentPort, p.ChildIP, p.ChildPort, p.Proto)
+}
+
+// PortDriver publishes host ports through rootlesskit's port driver with
+// rootlessctl, as slirp4netns and pasta leave published ports to it. It
+// only removes the ports it added, Docker adds its own for -p.
+type PortDriver struct {
+	socket string
+
+	lock  sync.Mutex
+	owned map[Port]bool
+}
+
+// NewPortDriver drives rootlesskit through its API socket
+func NewPortDriver(socket string) *PortDriver {
+	return &PortDriver{socket: socket, owned: map[Port]bool{}}
+}
+
+func (d *PortDriver) rootlessctl(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("rootlessctl", append([]string{"--socket", d.socket}, args...)...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("rootlessctl %s: %s", strings.Join(args, " "), msg)
+		}
+		return nil, fmt.Errorf("rootlessctl %s: %v", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
+
+// list returns rootlesskit's ports by their ID
+func (d *PortDriver) list() (map[Port]int, error) {
+	output, err := d.rootlessctl("list-ports", "--json")
+	if err != nil {
+		return nil, err
+	}
+	ports := map[Port]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var status struct {
+			ID   int  `json:"id"`
+			Spec Port `json:"spec"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &status); err != nil {
+			return nil, fmt.Errorf("reading rootlessctl list-ports: %v", err)
+		}
+		ports[status.Spec] = status.ID
+	}
+	return ports, nil
+}
+
+// Sync adds the wanted ports rootlesskit doesn't forward yet and removes
+// those added before that aren't wanted anymore
+func (d *PortDriver) Sync(wanted []Port) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	current, err := d.list()
+	if err != nil {
+		return err
+	}
+	want := map[Port]bool{}
+	for _, p := range wanted {
+		want[p] = true
+		// Left by an earlier instance, or added here before
+		if _, ok := current[p]; ok {
+			d.owned[p] = true
+			continue
+		}
+		if _, err := d.rootlessctl("add-ports", p.spec()); err != nil {
+			return err
+		}
+		d.owned[p] = true
+	}
+	for p := range d.owned {
+		if want[p] {
+			continue
+		}
+		if id, ok := current[p]; ok {
+			if _, err := d.rootlessctl("remove-ports", strconv.Itoa(id)); err != nil {
+				return err
+			}
+		}
+		delete(d.owned, p)
+	}
+	return nil
+}
+
+// Remove removes every port added, for cleanup on exit
+func (d *PortDriver) Remove() error {
+	return d.Sync(nil)
+}
@@ -0,0 +1,109 @@
+// Package rootless finds and detects rootless Docker and reports the
+// subsystems that can't run under it, or run through rootlesskit instead
+package rootless
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/docker/engine-api/client"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("rootless")
+
+var degradedGauge = metrics.NewGauge("plugin_manager_rootless_degraded",
+	"1 for each subsystem that doesn't start, or runs through rootlesskit, because Docker is rootless", "subsystem", "mode")
+
+var (
+	lock      sync.Mutex
+	degraded  = map[string]string{}
+	delegated = map[string]string{}
+)
+
+// RuntimeDir is the user's XDG_RUNTIME_DIR, /run/user/<uid> when unset,
+// where rootless Docker keeps its sockets
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("/run/user", strconv.Itoa(os.Geteuid()))
+}
+
+// Socket is the user's rootless Docker socket, empty when plugin-manager runs
+// as root or the socket doesn't exist
+func Socket() string {
+	if os.Geteuid() == 0 {
+		return ""
+	}
+	p := filepath.Join(RuntimeDir(), "docker.sock")
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return "unix://" + p
+}
+
+// PortSocket is rootlesskit's API socket for the rootless daemon, empty when
+// it doesn't exist
+func PortSocket() string {
+	p := filepath.Join(RuntimeDir(), "dockerd-rootless", "api.sock")
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// Docker reports whether the daemon c talks to runs rootless, as it
+// lists among its security options
+func Docker(ctx context.Context, c *client.Client) (bool, error) {
+	info, err := c.Info(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, option := range info.SecurityOptions {
+		if option == "name=rootless" || option == "rootless" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Degrade records that subsystem doesn't start under rootless Docker, and why
+func Degrade(subsystem, reason string) {
+	lock.Lock()
+	degraded[subsystem] = reason
+	lock.Unlock()
+	degradedGauge.Set(1, subsystem, "disabled")
+	log.Warnf("Not starting %s, Docker is rootless: %s", subsystem, reason)
+}
+
+// Delegate records that subsystem runs through rootlesskit rather than
+// changing the host itself
+func Delegate(subsystem, how string) {
+	lock.Lock()
+	delegated[subsystem] = how
+	lock.Unlock()
+	degradedGauge.Set(1, subsystem, "delegated")
+	log.Infof("Docker is rootless, %s %s", subsystem, how)
+}
+
+// State is the degraded and delegated subsystems, for the admin listener
+func State() interface{} {
+	lock.Lock()
+	defer lock.Unlock()
+	state := struct {
+		Degraded  map[string]string `json:"degraded"`
+		Delegated map[string]string `json:"delegated"`
+	}{map[string]string{}, map[string]string{}}
+	for name, reason := range degraded {
+		state.Degraded[name] = reason
+	}
+	for name, how := range delegated {
+		state.Delegated[name] = how
+	}
+	return state
+}
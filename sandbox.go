@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/rancher/plugin-manager/sandbox"
+	"github.com/urfave/cli"
+)
+
+// sandboxCommand is run by binexec shims inside the plugin container's
+// namespaces to confine the plugin binary before exec'ing it
+func sandboxCommand() cli.Command {
+	return cli.Command{
+		Name:   "sandbox",
+		Usage:  "Run a plugin binary with reduced privileges",
+		Hidden: true,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "capabilities",
+				Usage: "Comma separated capabilities to keep, all others are dropped",
+			},
+			cli.BoolFlag{
+				Name:  "no-new-privs",
+				Usage: "Set no_new_privs so setuid binaries and file capabilities are ignored",
+			},
+			cli.BoolFlag{
+				Name:  "seccomp",
+				Usage: "Deny syscalls plugin binaries never need",
+			},
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "Numeric uid[:gid] to run as, keeping only the listed capabilities",
+			},
+			cli.IntFlag{
+				Name:  "close-fd",
+				Usage: "File descriptor this command was exec'd from, closed before running the plugin",
+				Value: -1,
+			},
+		},
+		Action: runSandbox,
+	}
+}
+
+func runSandbox(c *cli.Context) error {
+	caps, err := sandbox.ParseCapabilities(c.String("capabilities"))
+	if err != nil {
+		return err
+	}
+
+	uid, gid := -1, -1
+	if user := c.String("user"); user != "" {
+		if uid, gid, err = sandbox.ParseUser(user); err != nil {
+			return err
+		}
+	}
+
+	if fd := c.Int("close-fd"); fd >= 0 {
+		syscall.CloseOnExec(fd)
+	}
+
+	err = sandbox.Exec(sandbox.Config{
+		Capabilities: caps,
+		NoNewPrivs:   c.Bool("no-new-privs"),
+		Seccomp:      c.Bool("seccomp"),
+		UID:          uid,
+		GID:          gid,
+	}, c.Args(), os.Environ())
+	return cli.NewExitError("sandbox: "+err.Error(), 126)
+}
@@ -0,0 +1,76 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mfdAllowSealing = 0x2
+	mfdExec         = 0x10
+
+	fAddSeals   = 1033
+	fSealSeal   = 0x1
+	fSealShrink = 0x2
+	fSealGrow   = 0x4
+	fSealWrite  = 0x8
+)
+
+// sealedCopy copies the binary at p into a sealed memfd and returns the path
+// it is exec'd by. Installed binaries stay root's with mode 0700, the copy
+// is what a binary run as another user execs and nobody can change it.
+func sealedCopy(p string) (string, error) {
+	if sysMemfdCreate == 0 {
+		return "", fmt.Errorf("running as another user isn't supported on %s", runtime.GOARCH)
+	}
+
+	in, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	name := []byte("plugin\x00")
+	fd, _, errno := syscall.RawSyscall(sysMemfdCreate, uintptr(unsafe.Pointer(&name[0])), mfdAllowSealing|mfdExec, 0)
+	if errno == syscall.EINVAL {
+		// Kernels before 6.3 don't know MFD_EXEC, their memfds are always
+		// executable
+		fd, _, errno = syscall.RawSyscall(sysMemfdCreate, uintptr(unsafe.Pointer(&name[0])), mfdAllowSealing, 0)
+	}
+	if errno != 0 {
+		return "", errors.Wrap(errno, "creating memfd")
+	}
+
+	// Not wrapped in an os.File, its finalizer would close the fd before
+	// it's exec'd
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := in.Read(buf)
+		for written := 0; written < n; {
+			m, err := syscall.Write(int(fd), buf[written:n])
+			if err != nil {
+				syscall.Close(int(fd))
+				return "", errors.Wrapf(err, "copying %s", p)
+			}
+			written += m
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			syscall.Close(int(fd))
+			return "", errors.Wrapf(err, "reading %s", p)
+		}
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, fSealSeal|fSealShrink|fSealGrow|fSealWrite); errno != 0 {
+		syscall.Close(int(fd))
+		return "", errors.Wrap(errno, "sealing memfd")
+	}
+	return fmt.Sprintf("/proc/self/fd/%d", fd), nil
+}
@@ -0,0 +1,248 @@
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	prSetKeepCaps     = 8
+	prSetNoNewPrivs   = 38
+	prCapBSetDrop     = 24
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// Config is how a plugin binary is confined before it is exec'd
+type Config struct {
+	// Capabilities are kept, every other capability is dropped
+	Capabilities []string
+	NoNewPrivs   bool
+	Seccomp      bool
+	// UID and GID to run as, the current user is kept if UID is negative.
+	// The kept capabilities are raised as ambient capabilities so a non
+	// root user still gets them.
+	UID int
+	GID int
+}
+
+// ParseUser parses "uid[:gid]" with numeric IDs, the GID defaults to the UID
+func ParseUser(value string) (int, int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid user %q, expected a numeric uid[:gid]", value)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("invalid group in %q", value)
+		}
+	}
+	return uid, gid, nil
+}
+
+var capabilities = map[string]uint{
+	"CHOWN":            0,
+	"DAC_OVERRIDE":     1,
+	"DAC_READ_SEARCH":  2,
+	"FOWNER":           3,
+	"FSETID":           4,
+	"KILL":             5,
+	"SETGID":           6,
+	"SETUID":           7,
+	"SETPCAP":          8,
+	"LINUX_IMMUTABLE":  9,
+	"NET_BIND_SERVICE": 10,
+	"NET_BROADCAST":    11,
+	"NET_ADMIN":        12,
+	"NET_RAW":          13,
+	"IPC_LOCK":         14,
+	"IPC_OWNER":        15,
+	"SYS_MODULE":       16,
+	"SYS_RAWIO":        17,
+	"SYS_CHROOT":       18,
+	"SYS_PTRACE":       19,
+	"SYS_PACCT":        20,
+	"SYS_ADMIN":        21,
+	"SYS_BOOT":         22,
+	"SYS_NICE":         23,
+	"SYS_RESOURCE":     24,
+	"SYS_TIME":         25,
+	"SYS_TTY_CONFIG":   26,
+	"MKNOD":            27,
+	"LEASE":            28,
+	"AUDIT_WRITE":      29,
+	"AUDIT_CONTROL":    30,
+	"SETFCAP":          31,
+	"MAC_OVERRIDE":     32,
+	"MAC_ADMIN":        33,
+	"SYSLOG":           34,
+	"WAKE_ALARM":       35,
+	"BLOCK_SUSPEND":    36,
+	"AUDIT_READ":       37,
+}
+
+// ParseCapabilities parses a comma separated list such as "NET_ADMIN,CAP_NET_RAW"
+func ParseCapabilities(value string) ([]string, error) {
+	var result []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "CAP_")
+		if name == "" {
+			continue
+		}
+		if _, ok := capabilities[name]; !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// Exec confines the current process according to config and execs argv. It
+// only returns on error.
+func Exec(config Config, argv []string, env []string) error {
+	if len(argv) == 0 {
+		return fmt.Errorf("no command to run")
+	}
+
+	// Capabilities, no_new_privs and seccomp filters are per thread, they
+	// have to be set on the thread that calls execve
+	runtime.LockOSThread()
+
+	path := argv[0]
+	if config.UID >= 0 {
+		// The binary is root's and only root can exec it, so a sealed copy
+		// is made while still root
+		var err error
+		if path, err = sealedCopy(path); err != nil {
+			return errors.Wrap(err, "copying binary")
+		}
+	}
+
+	if err := dropCapabilities(config.Capabilities); err != nil {
+		return errors.Wrap(err, "dropping capabilities")
+	}
+
+	if config.UID >= 0 {
+		if err := switchUser(config.UID, config.GID, config.Capabilities); err != nil {
+			return errors.Wrapf(err, "switching to user %d:%d", config.UID, config.GID)
+		}
+	}
+
+	if config.NoNewPrivs || config.Seccomp {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			return errors.Wrap(errno, "setting no_new_privs")
+		}
+	}
+
+	if config.Seccomp {
+		if err := loadSeccomp(); err != nil {
+			return errors.Wrap(err, "loading seccomp filter")
+		}
+	}
+
+	return syscall.Exec(path, argv, env)
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+func lastCap() uint {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 37
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 37
+	}
+	return uint(n)
+}
+
+// dropCapabilities removes everything but keep from the bounding and
+// inheritable sets, so a root owned binary exec'd next only gets keep
+func dropCapabilities(keep []string) error {
+	keepMask := capMask(keep)
+
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	data[0].inheritable &= uint32(keepMask)
+	data[1].inheritable &= uint32(keepMask >> 32)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+
+	for c := uint(0); c <= lastCap(); c++ {
+		if keepMask&(1<<c) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(c), 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+			return errors.Wrapf(errno, "dropping capability %d", c)
+		}
+	}
+	return nil
+}
+
+func capMask(caps []string) uint64 {
+	var mask uint64
+	for _, name := range caps {
+		mask |= 1 << capabilities[name]
+	}
+	return mask
+}
+
+// switchUser changes to uid and gid on this thread while keeping caps
+func switchUser(uid, gid int, caps []string) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0, 0, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "setting keepcaps")
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "clearing groups")
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESGID, uintptr(gid), uintptr(gid), uintptr(gid)); errno != 0 {
+		return errors.Wrap(errno, "setting gid")
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, uintptr(uid), uintptr(uid), uintptr(uid)); errno != 0 {
+		return errors.Wrap(errno, "setting uid")
+	}
+
+	mask := capMask(caps)
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	for i := range data {
+		word := uint32(mask >> (32 * uint(i)))
+		data[i] = capData{effective: word, permitted: word, inheritable: word}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errors.Wrap(errno, "setting capabilities")
+	}
+
+	for _, name := range caps {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, uintptr(capabilities[name]), 0, 0, 0); errno != 0 {
+			return errors.Wrapf(errno, "raising ambient capability %s", name)
+		}
+	}
+	return nil
+}
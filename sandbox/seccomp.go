@@ -0,0 +1,79 @@
+package sandbox
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	bpfLd  = 0x00
+	bpfW   = 0x00
+	bpfAbs = 0x20
+	bpfJmp = 0x05
+	bpfJeq = 0x10
+	bpfJge = 0x30
+	bpfK   = 0x00
+	bpfRet = 0x06
+
+	// offsets into struct seccomp_data
+	offsetNr   = 0
+	offsetArch = 4
+
+	// x32 syscalls share the x86_64 audit arch and set this bit in nr
+	x32SyscallBit = 0x40000000
+)
+
+func stmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// filter builds a BPF program that fails the denied syscalls with EPERM and
+// kills the process if it uses another syscall ABI to get around the list
+func filter() ([]syscall.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, fmt.Errorf("seccomp filtering is not supported on this architecture")
+	}
+
+	prog := []syscall.SockFilter{
+		stmt(bpfLd|bpfW|bpfAbs, offsetArch),
+		jump(bpfJmp|bpfJeq|bpfK, auditArch, 1, 0),
+		stmt(bpfRet|bpfK, seccompRetKill),
+		stmt(bpfLd|bpfW|bpfAbs, offsetNr),
+		jump(bpfJmp|bpfJge|bpfK, x32SyscallBit, 0, 1),
+		stmt(bpfRet|bpfK, seccompRetKill),
+	}
+	for _, nr := range deniedSyscalls {
+		prog = append(prog,
+			jump(bpfJmp|bpfJeq|bpfK, nr, 0, 1),
+			stmt(bpfRet|bpfK, seccompRetErrno|uint32(syscall.EPERM)))
+	}
+	return append(prog, stmt(bpfRet|bpfK, seccompRetAllow)), nil
+}
+
+func loadSeccomp() error {
+	prog, err := filter()
+	if err != nil {
+		return err
+	}
+
+	fprog := syscall.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&fprog)), 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package sandbox
+
+const (
+	auditArch      = 0xc000003e
+	sysMemfdCreate = 319
+)
+
+// deniedSyscalls are syscalls a CNI plugin has no business making: loading
+// kernel code, rebooting, tracing other processes, changing the clock and
+// reworking mounts
+var deniedSyscalls = []uint32{
+	101, // ptrace
+	155, // pivot_root
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	172, // iopl
+	173, // ioperm
+	175, // init_module
+	176, // delete_module
+	227, // clock_settime
+	246, // kexec_load
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	298, // perf_event_open
+	304, // open_by_handle_at
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+}
@@ -0,0 +1,36 @@
+package sandbox
+
+const (
+	auditArch      = 0xc00000b7
+	sysMemfdCreate = 279
+)
+
+// deniedSyscalls are syscalls a CNI plugin has no business making: loading
+// kernel code, rebooting, tracing other processes, changing the clock and
+// reworking mounts
+var deniedSyscalls = []uint32{
+	39,  // umount2
+	40,  // mount
+	41,  // pivot_root
+	89,  // acct
+	104, // kexec_load
+	105, // init_module
+	106, // delete_module
+	112, // clock_settime
+	117, // ptrace
+	142, // reboot
+	170, // settimeofday
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	224, // swapon
+	225, // swapoff
+	241, // perf_event_open
+	265, // open_by_handle_at
+	270, // process_vm_readv
+	271, // process_vm_writev
+	273, // finit_module
+	280, // bpf
+	282, // userfaultfd
+	294, // kexec_file_load
+}
@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package sandbox
+
+const (
+	auditArch      = 0
+	sysMemfdCreate = 0
+)
+
+var deniedSyscalls []uint32
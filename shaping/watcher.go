@@ -0,0 +1,252 @@
+package shaping
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/store"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var log = logging.Subsystem("shaping")
+
+var (
+	// ReapplyEvery is how often egress limits are applied again when nothing
+	// changed
+	ReapplyEvery    = config.NewDuration(5 * time.Minute)
+	egressRateLabel = "io.rancher.network.egress_rate"
+	egressRateKey   = "egressRate"
+	defaultBurst    = "32kbit"
+)
+
+// Watch is used to look for changes in metadata and apply service egress
+// rate limits to the containers on this host
+func Watch(c store.Store) error {
+	w := newWatcher(c)
+	health.Register("shaping")
+	handoff.RegisterStop("shaping", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("shaping", func() error { return w.reconcile("", true) })
+	go c.OnChange(source.IntervalSeconds, w.onChangeNoError)
+	return nil
+}
+
+func newWatcher(c store.Store) *watcher {
+	return &watcher{
+		c:       c,
+		applied: map[string]Limit{},
+	}
+}
+
+// Reconcile programs the egress limits for the current metadata once, for
+// running without the daemon
+func Reconcile(c store.Store) error {
+	return newWatcher(c).onChange("")
+}
+
+type watcher struct {
+	pass        sync.Mutex
+	c           store.Store
+	applied     map[string]Limit
+	lastApplied time.Time
+}
+
+// Limit is the egress rate, in tc units such as 10mbit, for a container
+type Limit struct {
+	ContainerID string
+	Rate        string
+	Burst       string
+}
+
+func (w *watcher) onChangeNoError(version string) {
+	if err := w.reconcile(version, false); err != nil {
+		log.WithError(err).Error("Failed to apply egress limits")
+	}
+}
+
+// reconcile makes one pass, with force set the egress limits are programmed
+// again even if nothing changed
+func (w *watcher) reconcile(version string, force bool) error {
+	return admin.Pass("shaping", &w.pass, func() error {
+		if force {
+			w.lastApplied = time.Time{}
+		}
+		return w.onChange(version)
+	})
+}
+
+func (w *watcher) onChange(version string) error {
+	host, err := w.c.GetSelfHost()
+	if err != nil {
+		return err
+	}
+
+	services, err := w.c.GetServices()
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]Limit{}
+	for _, service := range services {
+		rate, burst := serviceRate(service)
+		if rate == "" {
+			continue
+		}
+
+		for _, container := range service.Containers {
+			if container.HostUUID != host.UUID || container.State != "running" || container.ExternalId == "" {
+				continue
+			}
+			desired[container.ExternalId] = Limit{
+				ContainerID: container.ExternalId,
+				Rate:        rate,
+				Burst:       burst,
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(w.applied, desired) {
+		log.Infof("Applying new egress limits: %v", desired)
+		return w.apply(desired)
+	} else if time.Now().Sub(w.lastApplied) > ReapplyEvery.Get() {
+		return w.apply(desired)
+	}
+
+	return nil
+}
+
+func serviceRate(service metadata.Service) (string, string) {
+	rate := service.Labels[egressRateLabel]
+	if rate == "" {
+		rate, _ = service.Metadata[egressRateKey].(string)
+	}
+	if rate == "" {
+		return "", ""
+	}
+
+	burst := defaultBurst
+	if parts := strings.SplitN(rate, "/", 2); len(parts) == 2 {
+		rate, burst = parts[0], parts[1]
+	}
+	return strings.TrimSpace(rate), strings.TrimSpace(burst)
+}
+
+func (w *watcher) apply(desired map[string]Limit) error {
+	for id := range w.applied {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		veth, err := w.hostVeth(id)
+		if err != nil || veth == "" {
+			continue
+		}
+		if audit.Would("shaping", "tc.del", veth, nil) {
+			continue
+		}
+		log.WithField(logging.ContainerIDKey, id).Infof("Removing egress limit from %s on %s", id, veth)
+		err = w.run("tc", "qdisc", "del", "dev", veth, "ingress")
+		audit.Record("shaping", "tc.del", veth, w.applied[id], nil, err)
+		if err != nil {
+			log.WithField(logging.ContainerIDKey, id).Errorf("Failed to remove egress limit from %s: %v", id, err)
+		}
+	}
+
+	var lastErr error
+	for id, limit := range desired {
+		veth, err := w.hostVeth(id)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "finding host interface for %s", id)
+			continue
+		} else if veth == "" {
+			continue
+		}
+
+		// Traffic the container sends is received by the host side of the
+		// veth pair, so egress is policed on that interface's ingress.
+		// The delete fails harmlessly when no limit was applied yet.
+		if audit.Would("shaping", "tc.add", veth, limit) {
+			continue
+		}
+		exec.Command("tc", "qdisc", "del", "dev", veth, "ingress").Run()
+		err = w.run("tc", "qdisc", "add", "dev", veth, "handle", "ffff:", "ingress")
+		if err == nil {
+			err = w.run("tc", "filter", "add", "dev", veth, "parent", "ffff:", "protocol", "all",
+				"u32", "match", "u32", "0", "0", "police", "rate", limit.Rate, "burst", limit.Burst, "drop")
+		}
+		audit.Record("shaping", "tc.add", veth, w.applied[id], limit, err)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		w.applied = desired
+		w.lastApplied = time.Now()
+	}
+
+	return lastErr
+}
+
+// hostVeth returns the name of the host side of the container's eth0 veth
+func (w *watcher) hostVeth(id string) (string, error) {
+	inspect, err := w.c.Inspect(id)
+	if client.IsErrContainerNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if inspect.State == nil || inspect.State.Pid == 0 {
+		return "", nil
+	}
+
+	ns, err := netns.GetFromPid(inspect.State.Pid)
+	if err != nil {
+		return "", err
+	}
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName("eth0")
+	if err != nil {
+		return "", err
+	}
+
+	peerIndex := link.Attrs().ParentIndex
+	if peerIndex == 0 {
+		return "", fmt.Errorf("eth0 of %s is not a veth", id)
+	}
+
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return "", err
+	}
+	return peer.Attrs().Name, nil
+}
+
+func (w *watcher) run(args ...string) error {
+	log.Debugf("Running %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,91 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/plugin-manager/atomicfile"
+)
+
+// cachedVersion is the version reported for a snapshot loaded from disk
+const cachedVersion = "cached"
+
+// saveSnapshot writes snap in the answers layout, so the cache can also be
+// fed back with --metadata-file
+func saveSnapshot(path string, snap *snapshot) error {
+	var a answers
+	a.Self.Host = snap.selfHost
+	a.Hosts = snap.hosts
+	a.Containers = snap.containers
+	a.Services = snap.services
+	a.Networks = snap.networks
+
+	content, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, content, 0600)
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var a answers
+	if err := json.Unmarshal(content, &a); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	snap := &snapshot{
+		version:    cachedVersion,
+		stale:      true,
+		selfHost:   a.Self.Host,
+		hosts:      a.Hosts,
+		containers: a.Containers,
+		services:   a.Services,
+		networks:   a.Networks,
+	}
+	if err := validateSnapshot(snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return snap, nil
+}
+
+// NewStaleSnapshotCache is NewSnapshotCache starting from the last good
+// snapshot saved at cachePath, for when src can't be reached at startup.
+// Until src answers, IsStale reports true and subsystems avoid anything
+// destructive.
+func NewStaleSnapshotCache(src MetadataSource, cachePath string) (MetadataSource, error) {
+	snap, err := loadSnapshot(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	log.Warnf("Reconciling against metadata cached at %s until metadata is reachable", cachePath)
+	stale.Set(1)
+	return &snapshotSource{src: src, cachePath: cachePath, current: snap}, nil
+}
+
+// IsStale reports whether c is answering from a cached copy of metadata
+// that may be out of date. Removing state the answers don't mention isn't
+// safe while it is.
+func IsStale(c MetadataSource) bool {
+	s, ok := c.(interface {
+		Stale() bool
+	})
+	return ok && s.Stale()
+}
+
+// Stale reports whether the snapshot was loaded from the on-disk cache and
+// the source hasn't answered since
+func (s *snapshotSource) Stale() bool {
+	snap := s.snapshot()
+	return snap != nil && snap.stale
+}
@@ -0,0 +1,75 @@
+package source_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+func TestLastGoodCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "metadata.json")
+
+	answers := metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Hosts:    []metadata.Host{{UUID: "host1"}},
+	}
+	first := metadatatest.NewServer(answers)
+	src := source.NewSnapshotCache(first.Source(source.RancherOptions{LongPoll: time.Second}), cachePath)
+	versions := make(chan string, 10)
+	go src.OnChange(1, func(version string) { versions <- version })
+	<-versions
+	first.Close()
+
+	// Metadata is down at startup, the cache is used until it answers
+	answers.Hosts = append(answers.Hosts, metadata.Host{UUID: "host2"})
+	second := metadatatest.NewServer(answers)
+	defer second.Close()
+	second.FailRequests(1 << 20)
+
+	cached, err := source.NewStaleSnapshotCache(second.Source(source.RancherOptions{LongPoll: time.Second, Retries: 0}), cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !source.IsStale(cached) {
+		t.Errorf("expected the cached snapshot to be stale")
+	}
+	if hosts, _ := cached.GetHosts(); len(hosts) != 1 {
+		t.Errorf("got hosts %+v, want the cached host1", hosts)
+	}
+
+	go cached.OnChange(1, func(version string) { versions <- version })
+	if version := <-versions; version != "cached" {
+		t.Errorf("got first version %s, want the cached one", version)
+	}
+	second.FailRequests(0)
+	select {
+	case <-versions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metadata answering again not seen after 5s")
+	}
+	if source.IsStale(cached) {
+		t.Errorf("still stale once metadata answers")
+	}
+	if hosts, _ := cached.GetHosts(); len(hosts) != 2 {
+		t.Errorf("got hosts %+v, want the live answers", hosts)
+	}
+
+	// A cache that doesn't hold valid answers isn't used
+	if err := ioutil.WriteFile(cachePath, []byte(`{"self": {"host": {}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.NewStaleSnapshotCache(second.Source(source.RancherOptions{}), cachePath); err == nil {
+		t.Errorf("expected a cache without a self host UUID to be refused")
+	}
+}
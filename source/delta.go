@@ -0,0 +1,59 @@
+package source
+
+import (
+	"reflect"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// ContainerDelta is how the containers changed from one metadata version to
+// the next. Full is set when there is no previous version to compare with,
+// then every container is in Added.
+type ContainerDelta struct {
+	Version string
+	Full    bool
+	Added   []metadata.Container
+	Removed []metadata.Container
+	Changed []metadata.Container
+}
+
+// DeltaSource is implemented by sources that can hand subsystems only the
+// containers that changed instead of the whole list on every version
+type DeltaSource interface {
+	OnContainerDelta(intervalSeconds int, do func(ContainerDelta))
+}
+
+func fullDelta(s *snapshot) ContainerDelta {
+	return ContainerDelta{
+		Version: s.version,
+		Full:    true,
+		Added:   s.containers,
+	}
+}
+
+func containerDelta(prev, next *snapshot) ContainerDelta {
+	if prev == nil {
+		return fullDelta(next)
+	}
+
+	delta := ContainerDelta{Version: next.version}
+	before := map[string]metadata.Container{}
+	for _, c := range prev.containers {
+		before[c.UUID] = c
+	}
+
+	for _, c := range next.containers {
+		old, ok := before[c.UUID]
+		if !ok {
+			delta.Added = append(delta.Added, c)
+		} else if !reflect.DeepEqual(old, c) {
+			delta.Changed = append(delta.Changed, c)
+		}
+		delete(before, c.UUID)
+	}
+	for _, c := range before {
+		delta.Removed = append(delta.Removed, c)
+	}
+
+	return delta
+}
@@ -0,0 +1,83 @@
+package source_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+const (
+	webUUID   = "0c6b9c4e-63a1-4a55-9d3a-0f1f5d1f0a01"
+	dbUUID    = "0c6b9c4e-63a1-4a55-9d3a-0f1f5d1f0a02"
+	cacheUUID = "0c6b9c4e-63a1-4a55-9d3a-0f1f5d1f0a03"
+)
+
+func names(containers []metadata.Container) string {
+	var result []string
+	for _, c := range containers {
+		result = append(result, c.Name)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+func TestContainerDeltas(t *testing.T) {
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Containers: []metadata.Container{
+			{Name: "web", UUID: webUUID, State: "running"},
+			{Name: "db", UUID: dbUUID, State: "running"},
+		},
+	})
+	defer server.Close()
+
+	src := source.NewSnapshotCache(server.Source(source.RancherOptions{LongPoll: time.Second}), "")
+	deltas := make(chan source.ContainerDelta, 10)
+	go src.(source.DeltaSource).OnContainerDelta(1, func(delta source.ContainerDelta) { deltas <- delta })
+
+	next := func() source.ContainerDelta {
+		select {
+		case delta := <-deltas:
+			return delta
+		case <-time.After(5 * time.Second):
+			t.Fatal("no delta after 5s")
+		}
+		return source.ContainerDelta{}
+	}
+
+	if delta := next(); !delta.Full || names(delta.Added) != "db,web" {
+		t.Errorf("first delta: got %+v, want a full one adding db and web", delta)
+	}
+
+	server.Update(func(a *metadatatest.Answers) {
+		a.Containers = []metadata.Container{
+			{Name: "web", UUID: webUUID, State: "stopped"},
+			{Name: "cache", UUID: cacheUUID, State: "running"},
+		}
+	})
+	delta := next()
+	if delta.Full {
+		t.Errorf("second delta is a full one")
+	}
+	if delta.Version != server.Version() {
+		t.Errorf("got version %s, want %s", delta.Version, server.Version())
+	}
+	for _, test := range []struct {
+		name string
+		got  []metadata.Container
+		want string
+	}{
+		{"added", delta.Added, "cache"},
+		{"removed", delta.Removed, "db"},
+		{"changed", delta.Changed, "web"},
+	} {
+		if got := names(test.got); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
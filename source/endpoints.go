@@ -0,0 +1,103 @@
+package source
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var (
+	endpointUp = metrics.NewGauge("plugin_manager_metadata_endpoint_up",
+		"Whether a rancher-metadata endpoint is currently considered reachable", "endpoint")
+
+	endpointCooldown    = 10 * time.Second
+	endpointMaxCooldown = 5 * time.Minute
+)
+
+// endpoint is one rancher-metadata URL and its recent health
+type endpoint struct {
+	url       string
+	failures  int
+	downUntil time.Time
+}
+
+// endpoints fails over between rancher-metadata URLs. Requests stick to the
+// current endpoint until it has a connection error, then move to the next
+// one that isn't cooling down.
+type endpoints struct {
+	sync.Mutex
+	list    []*endpoint
+	current int
+}
+
+// newEndpoints splits a comma separated list of URLs
+func newEndpoints(urls string) *endpoints {
+	e := &endpoints{}
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimRight(strings.TrimSpace(url), "/")
+		if url == "" {
+			continue
+		}
+		e.list = append(e.list, &endpoint{url: url})
+		endpointUp.Set(1, url)
+	}
+	if len(e.list) == 0 {
+		e.list = append(e.list, &endpoint{url: urls})
+	}
+	return e
+}
+
+// pick returns the endpoint to use. If every endpoint is cooling down the
+// one that recovers first is tried anyway.
+func (e *endpoints) pick() *endpoint {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	best := e.list[e.current]
+	for i := range e.list {
+		ep := e.list[(e.current+i)%len(e.list)]
+		if !now.Before(ep.downUntil) {
+			return ep
+		}
+		if ep.downUntil.Before(best.downUntil) {
+			best = ep
+		}
+	}
+	return best
+}
+
+// failed marks ep down after a connection error and moves on to the next
+// endpoint. Repeated failures back off up to endpointMaxCooldown.
+func (e *endpoints) failed(ep *endpoint, err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	ep.failures++
+	cooldown := endpointCooldown * time.Duration(1<<uint(ep.failures-1))
+	if cooldown > endpointMaxCooldown || cooldown <= 0 {
+		cooldown = endpointMaxCooldown
+	}
+	ep.downUntil = time.Now().Add(cooldown)
+	endpointUp.Set(0, ep.url)
+
+	if len(e.list) > 1 && e.list[e.current] == ep {
+		e.current = (e.current + 1) % len(e.list)
+		log.Warnf("rancher-metadata at %s failed, switching to %s for %v: %v", ep.url, e.list[e.current].url, cooldown, err)
+	}
+}
+
+// ok clears ep's failures after a successful request
+func (e *endpoints) ok(ep *endpoint) {
+	e.Lock()
+	defer e.Unlock()
+
+	if ep.failures > 0 {
+		log.Infof("rancher-metadata at %s is reachable again", ep.url)
+	}
+	ep.failures = 0
+	ep.downUntil = time.Time{}
+	endpointUp.Set(1, ep.url)
+}
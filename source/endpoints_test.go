@@ -0,0 +1,128 @@
+package source_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+// flakyEndpoint fronts a mock metadata server, dropping connections while
+// it's down so clients see connection errors rather than error responses
+type flakyEndpoint struct {
+	*httptest.Server
+	server *metadatatest.Server
+
+	lock     sync.Mutex
+	down     bool
+	requests int
+}
+
+func newFlakyEndpoint(answers metadatatest.Answers) *flakyEndpoint {
+	f := &flakyEndpoint{server: metadatatest.NewServer(answers)}
+	target, _ := url.Parse(f.server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.lock.Lock()
+		f.requests++
+		down := f.down
+		f.lock.Unlock()
+		if down {
+			conn, _, _ := rw.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		proxy.ServeHTTP(rw, req)
+	}))
+	// A dropped connection the client reused would be retried by the
+	// transport, each request gets its own
+	f.Server.Config.SetKeepAlivesEnabled(false)
+	f.Server.Start()
+	return f
+}
+
+func (f *flakyEndpoint) setDown(down bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.down = down
+}
+
+func (f *flakyEndpoint) count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *flakyEndpoint) Close() {
+	f.Server.Close()
+	f.server.Close()
+}
+
+func TestEndpointFailover(t *testing.T) {
+	defer source.SetEndpointCooldown(100 * time.Millisecond)()
+
+	answers := metadatatest.Answers{Hosts: []metadata.Host{{UUID: "host1"}}}
+	a, b := newFlakyEndpoint(answers), newFlakyEndpoint(answers)
+	defer a.Close()
+	defer b.Close()
+	src := source.NewRancherMetadataNoWait(a.URL+","+b.URL, source.RancherOptions{})
+
+	steps := []struct {
+		name   string
+		aDown  bool
+		bDown  bool
+		sleep  time.Duration
+		err    bool
+		aCount int
+		bCount int
+	}{
+		{name: "first endpoint down", aDown: true, err: true, aCount: 1},
+		{name: "failed over", aDown: true, aCount: 1, bCount: 1},
+		{name: "sticks to the second once the first is back", aCount: 1, bCount: 2},
+		{name: "second endpoint down", bDown: true, err: true, aCount: 1, bCount: 3},
+		{name: "back to the first after its cooldown", bDown: true, sleep: 150 * time.Millisecond, aCount: 2, bCount: 3},
+	}
+	for _, step := range steps {
+		a.setDown(step.aDown)
+		b.setDown(step.bDown)
+		time.Sleep(step.sleep)
+		_, err := src.GetHosts()
+		if (err != nil) != step.err {
+			t.Errorf("%s: got error %v, want an error %v", step.name, err, step.err)
+		}
+		if a.count() != step.aCount || b.count() != step.bCount {
+			t.Errorf("%s: got %d and %d requests, want %d and %d", step.name, a.count(), b.count(), step.aCount, step.bCount)
+		}
+	}
+}
+
+func TestEndpointsAllCoolingDown(t *testing.T) {
+	defer source.SetEndpointCooldown(time.Hour)()
+
+	answers := metadatatest.Answers{Hosts: []metadata.Host{{UUID: "host1"}}}
+	a, b := newFlakyEndpoint(answers), newFlakyEndpoint(answers)
+	defer a.Close()
+	defer b.Close()
+	src := source.NewRancherMetadataNoWait(a.URL+","+b.URL, source.RancherOptions{})
+
+	a.setDown(true)
+	b.setDown(true)
+	src.GetHosts()
+	src.GetHosts()
+
+	// Both are cooling down for an hour, the first to recover is tried
+	a.setDown(false)
+	if _, err := src.GetHosts(); err != nil {
+		t.Errorf("expected the first endpoint to be tried anyway: %v", err)
+	}
+	if a.count() != 2 || b.count() != 1 {
+		t.Errorf("got %d and %d requests, want 2 and 1", a.count(), b.count())
+	}
+}
@@ -0,0 +1,11 @@
+package source
+
+import "time"
+
+// SetEndpointCooldown shortens how long a failed endpoint is skipped for,
+// returning a func that restores it
+func SetEndpointCooldown(d time.Duration) func() {
+	old := endpointCooldown
+	endpointCooldown = d
+	return func() { endpointCooldown = old }
+}
@@ -0,0 +1,136 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/crash"
+)
+
+// answers is the layout of a metadata file, the same as rancher-metadata's
+// own answers so a dump of a real environment can be used as is
+type answers struct {
+	Self struct {
+		Host metadata.Host `json:"host"`
+	} `json:"self"`
+	Hosts      []metadata.Host      `json:"hosts"`
+	Containers []metadata.Container `json:"containers"`
+	Services   []metadata.Service   `json:"services"`
+	Networks   []metadata.Network   `json:"networks"`
+}
+
+type fileSource struct {
+	sync.Mutex
+	path    string
+	version string
+	answers answers
+}
+
+// NewFile reads metadata from a local JSON file, or YAML when it's named
+// .yaml or .yml, for running without a rancher-metadata service. The file is
+// reloaded whenever it changes.
+func NewFile(path string) (MetadataSource, error) {
+	f := &fileSource{path: path}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load rereads the file and returns its version, the hash of its content. A
+// file that fails to parse leaves the previous answers in place.
+func (f *fileSource) load() (string, error) {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	version := hex.EncodeToString(sum[:])
+
+	f.Lock()
+	defer f.Unlock()
+
+	if version == f.version {
+		return version, nil
+	}
+
+	var a answers
+	// YAML keys are the JSON ones, so a dump converts as is
+	content, err = config.ToJSON(f.path, content)
+	if err == nil {
+		err = json.Unmarshal(content, &a)
+	}
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %v", f.path, err)
+	}
+	f.answers = a
+	f.version = version
+	return version, nil
+}
+
+func (f *fileSource) OnChange(intervalSeconds int, do func(string)) {
+	defer crash.Recover()
+	interval := time.Duration(intervalSeconds) * time.Second
+	wake, err := watchFile(f.path)
+	if err != nil {
+		log.Errorf("Failed to watch %s, checking for changes every %v: %v", f.path, interval, err)
+	}
+
+	version := ""
+	for {
+		newVersion, err := f.load()
+		if err != nil {
+			log.WithError(err).Error("Error reading metadata file")
+		} else if newVersion != version {
+			log.Debugf("Metadata file has changed. Old version: %s. New version: %s.", version, newVersion)
+			version = newVersion
+			do(newVersion)
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (f *fileSource) GetSelfHost() (metadata.Host, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.answers.Self.Host.UUID == "" {
+		return metadata.Host{}, fmt.Errorf("%s has no self host", f.path)
+	}
+	return f.answers.Self.Host, nil
+}
+
+func (f *fileSource) GetHosts() ([]metadata.Host, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.answers.Hosts, nil
+}
+
+func (f *fileSource) GetContainers() ([]metadata.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.answers.Containers, nil
+}
+
+func (f *fileSource) GetServices() ([]metadata.Service, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.answers.Services, nil
+}
+
+func (f *fileSource) GetNetworks() ([]metadata.Network, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.answers.Networks, nil
+}
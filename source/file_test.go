@@ -0,0 +1,69 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "answers.yaml")
+
+	// Written elsewhere and renamed over the file, as editors do
+	write := func(content string) {
+		tmp := filepath.Join(dir, "answers.tmp")
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("self:\n  host:\n    uuid: host1\n    agent_ip: 10.0.0.1\nhosts:\n  - uuid: host1\n")
+
+	f, err := NewFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := f.GetSelfHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.UUID != "host1" || host.AgentIP != "10.0.0.1" {
+		t.Errorf("unexpected self host %+v", host)
+	}
+
+	versions := make(chan string, 10)
+	// An hour between checks, only the watch picks up changes in time
+	go f.OnChange(3600, func(version string) { versions <- version })
+	first := <-versions
+
+	write("self: [not, a, host]\n")
+	write("self:\n  host:\n    uuid: host1\nhosts:\n  - uuid: host1\n  - uuid: host2\n")
+	select {
+	case version := <-versions:
+		if version == first {
+			t.Errorf("got the first version %s again", version)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change seen after rewriting the file")
+	}
+	hosts, _ := f.GetHosts()
+	if len(hosts) != 2 {
+		t.Errorf("got hosts %+v, want host1 and host2", hosts)
+	}
+
+	// A file that fails to parse keeps the last answers
+	write("hosts: {")
+	time.Sleep(100 * time.Millisecond)
+	if hosts, _ := f.GetHosts(); len(hosts) != 2 {
+		t.Errorf("broken file replaced the answers with %+v", hosts)
+	}
+}
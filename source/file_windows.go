@@ -0,0 +1,9 @@
+package source
+
+import "errors"
+
+// watchFile isn't supported, without inotify the file is checked every
+// interval
+func watchFile(path string) (<-chan struct{}, error) {
+	return nil, errors.New("watching files isn't supported on Windows")
+}
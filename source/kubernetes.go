@@ -0,0 +1,338 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/health"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	networksKey       = "networks"
+)
+
+// KubernetesOptions locates the API server and the node plugin-manager runs
+// on. Empty fields use the in-cluster service account defaults.
+type KubernetesOptions struct {
+	APIServer string
+	TokenFile string
+	CAFile    string
+	NodeName  string
+	// NetworksConfigMap is the namespace/name of a ConfigMap whose networks
+	// key holds the networks as a JSON list in the rancher-metadata layout
+	NetworksConfigMap string
+}
+
+func (o KubernetesOptions) withDefaults() (KubernetesOptions, error) {
+	if o.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return o, fmt.Errorf("no API server given and not running in a cluster")
+		}
+		o.APIServer = "https://" + host + ":" + port
+	}
+	o.APIServer = strings.TrimRight(o.APIServer, "/")
+	if o.TokenFile == "" {
+		o.TokenFile = serviceAccountDir + "/token"
+	}
+	if o.CAFile == "" {
+		o.CAFile = serviceAccountDir + "/ca.crt"
+	}
+	if o.NodeName == "" {
+		o.NodeName = os.Getenv("NODE_NAME")
+	}
+	if o.NodeName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return o, err
+		}
+		o.NodeName = name
+	}
+	if o.NetworksConfigMap == "" {
+		o.NetworksConfigMap = "kube-system/rancher-networks"
+	}
+	return o, nil
+}
+
+// The parts of the Kubernetes objects that map onto metadata
+
+type objectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	UID       string            `json:"uid"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type node struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string `json:"phase"`
+		PodIP             string `json:"podIP"`
+		ContainerStatuses []struct {
+			ContainerID  string `json:"containerID"`
+			RestartCount int    `json:"restartCount"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type kubeService struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP   string   `json:"clusterIP"`
+		ExternalIPs []string `json:"externalIPs"`
+	} `json:"spec"`
+}
+
+type configMap struct {
+	Data map[string]string `json:"data"`
+}
+
+type kubernetesSource struct {
+	opts   KubernetesOptions
+	token  string
+	client *http.Client
+}
+
+// NewKubernetes reads metadata from the Kubernetes API. Nodes are hosts,
+// the pods on this node are containers, services map to services and the
+// networks come from a ConfigMap. Pods on other nodes aren't listed, nothing
+// acts on remote containers.
+func NewKubernetes(opts KubernetesOptions) (MetadataSource, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := LoadTLSConfig(opts.CAFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	token, err := LoadToken(opts.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &kubernetesSource{
+		opts:  opts,
+		token: token,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	if _, err := k.GetSelfHost(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *kubernetesSource) get(path string, query url.Values, v interface{}) error {
+	u := k.opts.APIServer + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+k.token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error %v accessing %v: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// OnChange polls the API every intervalSeconds. The version is a hash of the
+// converted answers, list resource versions move on with every write in the
+// cluster and would wake subscribers constantly.
+func (k *kubernetesSource) OnChange(intervalSeconds int, do func(string)) {
+	defer crash.Recover()
+	interval := time.Duration(intervalSeconds) * time.Second
+	version := ""
+	for {
+		health.Heartbeat("metadata.poll", health.WedgedAfter+interval)
+		newVersion, err := k.version()
+		health.Set("metadata", err)
+		if err != nil {
+			log.WithError(err).Error("Error reading metadata from Kubernetes")
+		} else if newVersion != version {
+			log.Debugf("Metadata Version has been changed. Old version: %s. New version: %s.", version, newVersion)
+			version = newVersion
+			do(newVersion)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (k *kubernetesSource) version() (string, error) {
+	snap, err := fetchSnapshot(k, "")
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal([]interface{}{snap.selfHost, snap.hosts, snap.containers, snap.services, snap.networks})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func toHost(n node) metadata.Host {
+	host := metadata.Host{
+		Name:     n.Metadata.Name,
+		Hostname: n.Metadata.Name,
+		UUID:     n.Metadata.UID,
+		Labels:   n.Metadata.Labels,
+	}
+	for _, addr := range n.Status.Addresses {
+		if addr.Type == "InternalIP" {
+			host.AgentIP = addr.Address
+			break
+		}
+	}
+	return host
+}
+
+func (k *kubernetesSource) GetSelfHost() (metadata.Host, error) {
+	var n node
+	if err := k.get("/api/v1/nodes/"+k.opts.NodeName, nil, &n); err != nil {
+		return metadata.Host{}, err
+	}
+	return toHost(n), nil
+}
+
+func (k *kubernetesSource) GetHosts() ([]metadata.Host, error) {
+	var list struct {
+		Items []node `json:"items"`
+	}
+	if err := k.get("/api/v1/nodes", nil, &list); err != nil {
+		return nil, err
+	}
+
+	var hosts []metadata.Host
+	for _, n := range list.Items {
+		hosts = append(hosts, toHost(n))
+	}
+	return hosts, nil
+}
+
+func (k *kubernetesSource) GetContainers() ([]metadata.Container, error) {
+	self, err := k.GetSelfHost()
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Items []pod `json:"items"`
+	}
+	query := url.Values{"fieldSelector": {"spec.nodeName=" + k.opts.NodeName}}
+	if err := k.get("/api/v1/pods", query, &list); err != nil {
+		return nil, err
+	}
+
+	var containers []metadata.Container
+	for _, p := range list.Items {
+		container := metadata.Container{
+			Name:      p.Metadata.Name,
+			StackName: p.Metadata.Namespace,
+			UUID:      p.Metadata.UID,
+			HostUUID:  self.UUID,
+			Labels:    p.Metadata.Labels,
+			State:     strings.ToLower(p.Status.Phase),
+			PrimaryIp: p.Status.PodIP,
+		}
+		if p.Status.PodIP != "" && !p.Spec.HostNetwork {
+			container.Ips = []string{p.Status.PodIP}
+		}
+		if len(p.Status.ContainerStatuses) > 0 {
+			status := p.Status.ContainerStatuses[0]
+			// containerID is runtime://id
+			if i := strings.Index(status.ContainerID, "://"); i >= 0 {
+				container.ExternalId = status.ContainerID[i+3:]
+			}
+			container.StartCount = status.RestartCount + 1
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+func (k *kubernetesSource) GetServices() ([]metadata.Service, error) {
+	var list struct {
+		Items []kubeService `json:"items"`
+	}
+	if err := k.get("/api/v1/services", nil, &list); err != nil {
+		return nil, err
+	}
+
+	var services []metadata.Service
+	for _, s := range list.Items {
+		services = append(services, metadata.Service{
+			Name:        s.Metadata.Name,
+			StackName:   s.Metadata.Namespace,
+			UUID:        s.Metadata.UID,
+			Kind:        "service",
+			Labels:      s.Metadata.Labels,
+			Vip:         s.Spec.ClusterIP,
+			ExternalIps: s.Spec.ExternalIPs,
+		})
+	}
+	return services, nil
+}
+
+func (k *kubernetesSource) GetNetworks() ([]metadata.Network, error) {
+	parts := strings.SplitN(k.opts.NetworksConfigMap, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("networks ConfigMap %q must be namespace/name", k.opts.NetworksConfigMap)
+	}
+
+	var cm configMap
+	if err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", parts[0], parts[1]), nil, &cm); err != nil {
+		return nil, err
+	}
+
+	var networks []metadata.Network
+	if data := cm.Data[networksKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &networks); err != nil {
+			return nil, fmt.Errorf("parsing %s in ConfigMap %s: %v", networksKey, k.opts.NetworksConfigMap, err)
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,113 @@
+package source_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+// serviceAccount writes the token and CA the in-cluster defaults would
+// point at, the CA only has to parse
+func serviceAccount(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kubernetes"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ca := filepath.Join(dir, "token"), filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return token, ca
+}
+
+func TestKubernetesPolling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token, ca := serviceAccount(t, dir)
+
+	node1 := metadata.Host{UUID: "node1-uid", Hostname: "node1", AgentIP: "10.0.0.1"}
+	node2 := metadata.Host{UUID: "node2-uid", Hostname: "node2", AgentIP: "10.0.0.2"}
+	server := metadatatest.NewServer(metadatatest.Answers{
+		Hosts: []metadata.Host{node1, node2},
+		Containers: []metadata.Container{
+			{Name: "web", StackName: "default", UUID: webUUID, HostUUID: node1.UUID, State: "running", PrimaryIp: "10.42.0.5", ExternalId: "abc", StartCount: 1},
+			{Name: "db", StackName: "default", UUID: dbUUID, HostUUID: node2.UUID, State: "running"},
+		},
+		Networks: []metadata.Network{{Name: "flannel", UUID: "net1"}},
+	})
+	defer server.Close()
+
+	src, err := source.NewKubernetes(source.KubernetesOptions{APIServer: server.URL, TokenFile: token, CAFile: ca, NodeName: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := src.GetSelfHost()
+	if err != nil || self.UUID != node1.UUID || self.AgentIP != node1.AgentIP {
+		t.Errorf("got self host %+v, %v", self, err)
+	}
+	containers, err := src.GetContainers()
+	if err != nil || names(containers) != "web" {
+		t.Fatalf("got containers %+v, %v, want only this node's web", containers, err)
+	}
+	if c := containers[0]; c.ExternalId != "abc" || c.State != "running" || c.HostUUID != node1.UUID || len(c.Ips) != 1 {
+		t.Errorf("unexpected container %+v", c)
+	}
+	if networks, err := src.GetNetworks(); err != nil || len(networks) != 1 || networks[0].Name != "flannel" {
+		t.Errorf("got networks %+v, %v", networks, err)
+	}
+
+	versions := make(chan string, 10)
+	go src.OnChange(1, func(version string) { versions <- version })
+	first := <-versions
+
+	// A pod on another node changes nothing this node sees
+	server.Update(func(a *metadatatest.Answers) { a.Containers[1].State = "stopped" })
+	select {
+	case version := <-versions:
+		t.Errorf("got version %s for a change on another node", version)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	server.Update(func(a *metadatatest.Answers) { a.Containers[0].StartCount = 2 })
+	select {
+	case version := <-versions:
+		if version == first {
+			t.Errorf("got the first version %s again", version)
+		}
+		if containers, _ := src.GetContainers(); len(containers) != 1 || containers[0].StartCount != 2 {
+			t.Errorf("restart not seen in %+v", containers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("restart not seen after 5s")
+	}
+}
@@ -0,0 +1,183 @@
+package metadatatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// apiVersion matches the version clients like engine-api put before paths
+var apiVersion = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// dockerEvent is an event on the Docker events stream
+type dockerEvent struct {
+	Type     string      `json:"Type"`
+	Action   string      `json:"Action"`
+	Actor    dockerActor `json:"Actor"`
+	Status   string      `json:"status"`
+	ID       string      `json:"id"`
+	Time     int64       `json:"time"`
+	TimeNano int64       `json:"timeNano"`
+}
+
+type dockerActor struct {
+	ID string `json:"ID"`
+}
+
+// local is the self host's containers by Docker ID
+func local(answers Answers) map[string]metadata.Container {
+	containers := map[string]metadata.Container{}
+	for _, c := range answers.Containers {
+		if c.HostUUID == answers.SelfHost.UUID && c.ExternalId != "" {
+			containers[c.ExternalId] = c
+		}
+	}
+	return containers
+}
+
+// startedAt changes with every start, so a restart looks like one to
+// clients comparing start times
+func startedAt(c metadata.Container) string {
+	return time.Unix(int64(c.StartCount), 0).UTC().Format(time.RFC3339Nano)
+}
+
+// dockerEvents are the starts and deaths between two sets of answers, in
+// the order of the containers' IDs
+func dockerEvents(before, after Answers) []dockerEvent {
+	was, is := local(before), local(after)
+	ids := []string{}
+	for id := range was {
+		ids = append(ids, id)
+	}
+	for id := range is {
+		if _, ok := was[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	events := []dockerEvent{}
+	for _, id := range ids {
+		prev, cur := was[id], is[id]
+		status := ""
+		if cur.State == "running" && (prev.State != "running" || prev.StartCount != cur.StartCount) {
+			status = "start"
+		} else if prev.State == "running" && cur.State != "running" {
+			status = "die"
+		}
+		if status == "" {
+			continue
+		}
+		events = append(events, dockerEvent{
+			Type:     "container",
+			Action:   status,
+			Actor:    dockerActor{ID: id},
+			Status:   status,
+			ID:       id,
+			Time:     now.Unix(),
+			TimeNano: now.UnixNano(),
+		})
+	}
+	return events
+}
+
+func dockerStatus(c metadata.Container) string {
+	if c.State == "running" {
+		return "running"
+	}
+	return "exited"
+}
+
+func dockerContainer(c metadata.Container) object {
+	status := dockerStatus(c)
+	return object{
+		"Id":   c.ExternalId,
+		"Name": "/" + c.Name,
+		"State": object{
+			"Status":    status,
+			"Running":   status == "running",
+			"StartedAt": startedAt(c),
+		},
+		"Config":     object{"Hostname": c.Name, "Labels": c.Labels},
+		"HostConfig": object{"NetworkMode": "default"},
+	}
+}
+
+// dockerValue answers the Docker API from answers. The self host's
+// containers are Docker's, known by their external IDs and with their
+// metadata labels.
+func dockerValue(req *http.Request, answers Answers) (interface{}, bool) {
+	path := apiVersion.ReplaceAllString(req.URL.Path, "/")
+	containers := local(answers)
+	switch {
+	case path == "/containers/json":
+		all := req.URL.Query().Get("all") == "1"
+		ids := []string{}
+		for id, c := range containers {
+			if all || c.State == "running" {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		list := []object{}
+		for _, id := range ids {
+			c := containers[id]
+			list = append(list, object{
+				"Id":     id,
+				"Names":  []string{"/" + c.Name},
+				"Labels": c.Labels,
+				"State":  dockerStatus(c),
+			})
+		}
+		return list, true
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		c, ok := containers[strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")]
+		if !ok {
+			return nil, false
+		}
+		return dockerContainer(c), true
+	}
+	return nil, false
+}
+
+// streamEvents sends the Docker events from Updates made after the request
+// until the client or the server goes away
+func (s *Server) streamEvents(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	sent := len(s.events)
+	s.lock.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(rw)
+	for {
+		s.lock.Lock()
+		events := s.events[sent:]
+		changed := s.changed
+		s.lock.Unlock()
+
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
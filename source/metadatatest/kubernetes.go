@@ -0,0 +1,88 @@
+package metadatatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+type object map[string]interface{}
+
+func node(host metadata.Host) object {
+	return object{
+		"metadata": object{"name": host.Hostname, "uid": host.UUID, "labels": host.Labels},
+		"status": object{"addresses": []object{
+			{"type": "InternalIP", "address": host.AgentIP},
+		}},
+	}
+}
+
+func pod(container metadata.Container, nodeName string) object {
+	p := object{
+		"metadata": object{"name": container.Name, "namespace": container.StackName, "uid": container.UUID, "labels": container.Labels},
+		"spec":     object{"nodeName": nodeName},
+		"status":   object{"phase": strings.Title(container.State), "podIP": container.PrimaryIp},
+	}
+	if container.ExternalId != "" {
+		p["status"].(object)["containerStatuses"] = []object{
+			{"containerID": "docker://" + container.ExternalId, "restartCount": container.StartCount - 1},
+		}
+	}
+	return p
+}
+
+// kubernetesValue answers the Kubernetes API from answers. Hosts are nodes
+// named by their hostname, pods are the containers on each host and the
+// networks are in the Kubernetes source's default ConfigMap.
+func kubernetesValue(req *http.Request, answers Answers) (interface{}, bool) {
+	hosts := answers.Hosts
+	if len(hosts) == 0 {
+		hosts = []metadata.Host{answers.SelfHost}
+	}
+
+	path := req.URL.Path
+	switch {
+	case path == "/api/v1/nodes":
+		var items []object
+		for _, host := range hosts {
+			items = append(items, node(host))
+		}
+		return object{"items": items}, true
+	case strings.HasPrefix(path, "/api/v1/nodes/"):
+		name := strings.TrimPrefix(path, "/api/v1/nodes/")
+		for _, host := range hosts {
+			if host.Hostname == name {
+				return node(host), true
+			}
+		}
+	case path == "/api/v1/pods":
+		nodeName := strings.TrimPrefix(req.URL.Query().Get("fieldSelector"), "spec.nodeName=")
+		items := []object{}
+		for _, host := range hosts {
+			if host.Hostname != nodeName {
+				continue
+			}
+			for _, container := range answers.Containers {
+				if container.HostUUID == host.UUID {
+					items = append(items, pod(container, nodeName))
+				}
+			}
+		}
+		return object{"items": items}, true
+	case path == "/api/v1/services":
+		var items []object
+		for _, service := range answers.Services {
+			items = append(items, object{
+				"metadata": object{"name": service.Name, "namespace": service.StackName, "uid": service.UUID, "labels": service.Labels},
+				"spec":     object{"clusterIP": service.Vip, "externalIPs": service.ExternalIps},
+			})
+		}
+		return object{"items": items}, true
+	case path == "/api/v1/namespaces/kube-system/configmaps/rancher-networks":
+		networks, _ := json.Marshal(answers.Networks)
+		return object{"data": object{"networks": string(networks)}}, true
+	}
+	return nil, false
+}
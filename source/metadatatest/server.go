@@ -0,0 +1,198 @@
+// Package metadatatest runs an in-process rancher-metadata server with
+// programmable answers, so code built on source.MetadataSource can be
+// exercised without a Rancher environment.
+package metadatatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+)
+
+// Answers is everything the server reports
+type Answers struct {
+	SelfHost   metadata.Host
+	Hosts      []metadata.Host
+	Containers []metadata.Container
+	Services   []metadata.Service
+	Networks   []metadata.Network
+}
+
+// Server answers the rancher-metadata JSON API from Answers, and the parts of
+// the Kubernetes and Docker APIs the sources, network manager and events
+// router read. Every Update bumps the version and wakes long-polling clients.
+type Server struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	answers Answers
+	version int
+	changed chan struct{}
+	fail    int
+	delay   time.Duration
+	noWait  bool
+	counts  map[string]int
+	events  []dockerEvent
+	closed  chan struct{}
+}
+
+// NewServer starts a server with the given answers at version 1
+func NewServer(answers Answers) *Server {
+	s := &Server{
+		answers: answers,
+		version: 1,
+		changed: make(chan struct{}),
+		counts:  map[string]int{},
+		closed:  make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Source returns a rancher-metadata source talking to the server
+func (s *Server) Source(opts source.RancherOptions) source.MetadataSource {
+	return source.NewRancherMetadataNoWait(s.URL, opts)
+}
+
+// Close releases held version requests and shuts the server down
+func (s *Server) Close() {
+	close(s.closed)
+	s.Server.Close()
+}
+
+// Update changes the answers and publishes them as a new version, sending
+// Docker events for the self host's containers it starts and stops
+func (s *Server) Update(update func(*Answers)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	before := s.answers
+	before.Containers = append([]metadata.Container(nil), s.answers.Containers...)
+	update(&s.answers)
+	s.events = append(s.events, dockerEvents(before, s.answers)...)
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Version is the version currently being served
+func (s *Server) Version() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return strconv.Itoa(s.version)
+}
+
+// FailRequests makes the next n requests answer 500, for exercising retries
+func (s *Server) FailRequests(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail = n
+}
+
+// Delay makes every answer wait d first, for exercising timeouts
+func (s *Server) Delay(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delay = d
+}
+
+// IgnoreWait answers version requests straight away, like a server that
+// doesn't support long polling
+func (s *Server) IgnoreWait() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.noWait = true
+}
+
+// Requests is how many requests for path the server has had
+func (s *Server) Requests(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[path]
+}
+
+func (s *Server) serve(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	s.counts[req.URL.Path]++
+	if s.fail > 0 {
+		s.fail--
+		s.lock.Unlock()
+		http.Error(rw, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	if delay := s.delay; delay > 0 {
+		s.lock.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-s.closed:
+		}
+		s.lock.Lock()
+	}
+	answers := s.answers
+	version := strconv.Itoa(s.version)
+	changed := s.changed
+	noWait := s.noWait
+	s.lock.Unlock()
+
+	if req.URL.Path == "/events" {
+		s.streamEvents(rw, req)
+		return
+	}
+
+	var value interface{}
+	switch req.URL.Path {
+	case "/version":
+		value = version
+		if !noWait {
+			value = s.waitVersion(req, version, changed)
+		}
+	case "/self/host":
+		value = answers.SelfHost
+	case "/hosts":
+		value = answers.Hosts
+	case "/containers":
+		value = answers.Containers
+	case "/services":
+		value = answers.Services
+	case "/networks":
+		value = answers.Networks
+	default:
+		var ok bool
+		value, ok = kubernetesValue(req, answers)
+		if !ok {
+			value, ok = dockerValue(req, answers)
+		}
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(value)
+}
+
+// waitVersion holds a ?wait=true request until the version differs from
+// value or maxWait seconds pass, like rancher-metadata does
+func (s *Server) waitVersion(req *http.Request, version string, changed <-chan struct{}) string {
+	q := req.URL.Query()
+	if q.Get("wait") != "true" || q.Get("value") != version {
+		return version
+	}
+
+	maxWait, _ := strconv.Atoi(q.Get("maxWait"))
+	select {
+	case <-changed:
+		return s.Version()
+	case <-time.After(time.Duration(maxWait) * time.Second):
+		return version
+	case <-s.closed:
+		return version
+	}
+}
@@ -0,0 +1,70 @@
+package source
+
+import (
+	"strconv"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// Host labels that tune plugin-manager on a single host
+const (
+	// ReaperLabel set to false stops orphaned containers being stopped
+	ReaperLabel = "io.rancher.network.reaper"
+	// MTULabel sets the MTU of the container interfaces on this host
+	MTULabel = "io.rancher.network.mtu"
+	// HostNATLabel set to false removes and stops programming host NAT rules
+	HostNATLabel = "io.rancher.network.host_nat"
+	// CNIDriverLabel replaces the interface plugin type in the CNI config,
+	// e.g. macvlan instead of rancher-bridge
+	CNIDriverLabel = "io.rancher.network.cni.driver"
+	// CNIMasterLabel sets the host interface macvlan and ipvlan attach to,
+	// which they require
+	CNIMasterLabel = "io.rancher.network.cni.master"
+)
+
+// HostOverrides are the per-host settings read from the host's labels
+type HostOverrides struct {
+	Reaper    bool
+	MTU       int
+	HostNAT   bool
+	CNIDriver string
+	CNIMaster string
+}
+
+// Overrides reads host's override labels. Unset or invalid labels keep the
+// default behavior, invalid ones are logged.
+func Overrides(host metadata.Host) HostOverrides {
+	return HostOverrides{
+		Reaper:    boolLabel(host, ReaperLabel, true),
+		MTU:       mtuLabel(host),
+		HostNAT:   boolLabel(host, HostNATLabel, true),
+		CNIDriver: host.Labels[CNIDriverLabel],
+		CNIMaster: host.Labels[CNIMasterLabel],
+	}
+}
+
+func boolLabel(host metadata.Host, label string, def bool) bool {
+	value, ok := host.Labels[label]
+	if !ok || value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Errorf("Ignoring invalid %s=%q on host %s: %v", label, value, host.UUID, err)
+		return def
+	}
+	return b
+}
+
+func mtuLabel(host metadata.Host) int {
+	value, ok := host.Labels[MTULabel]
+	if !ok || value == "" {
+		return 0
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < 576 || mtu > 65535 {
+		log.Errorf("Ignoring invalid %s=%q on host %s", MTULabel, value, host.UUID)
+		return 0
+	}
+	return mtu
+}
@@ -0,0 +1,263 @@
+package source
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var (
+	requestSeconds = metrics.NewHistogram("plugin_manager_metadata_request_seconds",
+		"Time taken by rancher-metadata requests, excluding long-poll waits", "call")
+	requestErrors = metrics.NewCounter("plugin_manager_metadata_request_errors_total",
+		"rancher-metadata request attempts that failed, including retried ones", "call")
+)
+
+// RancherOptions controls how long a rancher-metadata call may take and how
+// failed calls are retried. Zero durations fall back to the defaults below.
+type RancherOptions struct {
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	Retries        int
+	RetryBackoff   time.Duration
+	// LongPoll is how long rancher-metadata may hold a version request open
+	// waiting for a change. Zero uses the OnChange interval, so an idle
+	// server is asked again every few seconds.
+	LongPoll time.Duration
+	// TLS is used for https endpoints, nil uses the system roots
+	TLS *tls.Config
+	// Token is sent as a bearer token on every request when set, for
+	// proxies that authenticate metadata traffic
+	Token string
+}
+
+var defaultRancherOptions = RancherOptions{
+	ConnectTimeout: 5 * time.Second,
+	ReadTimeout:    10 * time.Second,
+	Retries:        3,
+	RetryBackoff:   500 * time.Millisecond,
+}
+
+func (o RancherOptions) withDefaults() RancherOptions {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = defaultRancherOptions.ConnectTimeout
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = defaultRancherOptions.ReadTimeout
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = defaultRancherOptions.RetryBackoff
+	}
+	return o
+}
+
+// rancherMetadata talks to rancher-metadata over its JSON API with bounded
+// timeouts, unlike the library client which waits forever on a stuck server
+type rancherMetadata struct {
+	endpoints *endpoints
+	opts      RancherOptions
+	client    *http.Client
+}
+
+func newRancherMetadata(url string, opts RancherOptions) *rancherMetadata {
+	opts = opts.withDefaults()
+	return &rancherMetadata{
+		endpoints: newEndpoints(url),
+		opts:      opts,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: opts.TLS,
+				Dial: (&net.Dialer{
+					Timeout:   opts.ConnectTimeout,
+					KeepAlive: 30 * time.Second,
+				}).Dial,
+			},
+		},
+	}
+}
+
+// get fetches path, retrying failures with backoff. timeout bounds each
+// attempt as a whole, including reading the body. call names the request in
+// metrics.
+func (m *rancherMetadata) get(call, path string, timeout time.Duration) ([]byte, error) {
+	b := &backoff.Backoff{
+		Min:    m.opts.RetryBackoff,
+		Max:    10 * m.opts.RetryBackoff,
+		Factor: 2,
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= m.opts.Retries; attempt++ {
+		if attempt > 0 {
+			d := b.Duration()
+			log.Debugf("Retrying metadata %s in %v: %v", path, d, lastErr)
+			time.Sleep(d)
+		}
+		start := time.Now()
+		body, err := m.request(path, timeout)
+		if err == nil {
+			if call != "wait" {
+				requestSeconds.Observe(metrics.Since(start), call)
+			}
+			return body, nil
+		}
+		requestErrors.Inc(call)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (m *rancherMetadata) request(path string, timeout time.Duration) ([]byte, error) {
+	ep := m.endpoints.pick()
+	req, err := http.NewRequest("GET", ep.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if m.opts.Token != "" {
+		req.Header.Add("Authorization", "Bearer "+m.opts.Token)
+	}
+
+	// http.Client.Timeout is shared, so the per-call deadline is applied by
+	// cancelling the request instead
+	cancel := make(chan struct{})
+	req.Cancel = cancel
+	timer := time.AfterFunc(timeout, func() { close(cancel) })
+	defer timer.Stop()
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.endpoints.failed(ep, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	m.endpoints.ok(ep)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error %v accessing %v path", resp.StatusCode, path)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	return body, nil
+}
+
+func (m *rancherMetadata) getJSON(path string, v interface{}) error {
+	body, err := m.get(path, path, m.opts.ReadTimeout)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (m *rancherMetadata) version() (string, error) {
+	body, err := m.get("/version", "/version", m.opts.ReadTimeout)
+	return string(body), err
+}
+
+// waitVersion long-polls for a version other than version. The server holds
+// the request for up to maxWait seconds before answering, so the attempt's
+// timeout is the read timeout on top of that. The transport sets no
+// response header timeout, which would cut every long poll short.
+func (m *rancherMetadata) waitVersion(maxWait int, version string) (string, error) {
+	timeout := time.Duration(maxWait)*time.Second + m.opts.ReadTimeout
+	body, err := m.get("wait", fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d", version, maxWait), timeout)
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(body, &version)
+	return version, err
+}
+
+// OnChange long-polls for new versions. intervalSeconds is the delay after
+// errors and, unless LongPoll is set, also how long each poll waits.
+func (m *rancherMetadata) OnChange(intervalSeconds int, do func(string)) {
+	defer crash.Recover()
+	interval := time.Duration(intervalSeconds) * time.Second
+	maxWait := intervalSeconds
+	if m.opts.LongPoll > 0 {
+		maxWait = int(m.opts.LongPoll / time.Second)
+	}
+	if maxWait < 1 {
+		maxWait = 1
+	}
+	version := "init"
+	waitSupported := true
+	// Each poll may retry every attempt and then sleep before the next one
+	pollEvery := time.Duration(m.opts.Retries+1)*(time.Duration(maxWait)*time.Second+m.opts.ReadTimeout) + interval
+
+	for {
+		health.Heartbeat("metadata.poll", pollEvery)
+		start := time.Now()
+		newVersion, err := m.waitVersion(maxWait, version)
+		health.Set("metadata", err)
+		if err != nil {
+			log.WithError(err).Error("Error reading metadata version")
+			time.Sleep(interval)
+		} else if version == newVersion {
+			log.Debug("No changes in metadata version")
+			// A server that ignores wait answers unchanged versions straight
+			// away, fall back to polling at the interval instead of spinning
+			if time.Since(start) < time.Duration(maxWait)*time.Second/2 {
+				if waitSupported {
+					log.Infof("rancher-metadata does not hold version requests, polling every %v", interval)
+					waitSupported = false
+				}
+				time.Sleep(interval)
+			}
+		} else {
+			log.Debugf("Metadata Version has been changed. Old version: %s. New version: %s.", version, newVersion)
+			version = newVersion
+			// Subscribers that hang are caught by their own reconcile
+			// tracking, only a poll that stops entirely should fail here
+			health.Heartbeat("metadata.poll", health.WedgedAfter)
+			do(newVersion)
+		}
+	}
+}
+
+func (m *rancherMetadata) GetSelfHost() (metadata.Host, error) {
+	var host metadata.Host
+	err := m.getJSON("/self/host", &host)
+	return host, err
+}
+
+func (m *rancherMetadata) GetHosts() ([]metadata.Host, error) {
+	var hosts []metadata.Host
+	err := m.getJSON("/hosts", &hosts)
+	return hosts, err
+}
+
+func (m *rancherMetadata) GetContainers() ([]metadata.Container, error) {
+	var containers []metadata.Container
+	err := m.getJSON("/containers", &containers)
+	return containers, err
+}
+
+func (m *rancherMetadata) GetServices() ([]metadata.Service, error) {
+	var services []metadata.Service
+	err := m.getJSON("/services", &services)
+	return services, err
+}
+
+func (m *rancherMetadata) GetNetworks() ([]metadata.Network, error) {
+	var networks []metadata.Network
+	err := m.getJSON("/networks", &networks)
+	return networks, err
+}
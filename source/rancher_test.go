@@ -0,0 +1,102 @@
+package source_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		retries  int
+		err      bool
+	}{
+		{"no failures", 0, 0, false},
+		{"retried until it answers", 2, 2, false},
+		{"out of retries", 3, 2, true},
+		{"retries disabled", 1, 0, true},
+	}
+	for _, test := range tests {
+		server := metadatatest.NewServer(metadatatest.Answers{Hosts: []metadata.Host{{UUID: "host1"}}})
+		src := server.Source(source.RancherOptions{Retries: test.retries, RetryBackoff: time.Millisecond})
+		server.FailRequests(test.failures)
+		hosts, err := src.GetHosts()
+		server.Close()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, hosts)
+			}
+			continue
+		}
+		if err != nil || len(hosts) != 1 {
+			t.Errorf("%s: got %v, %v", test.name, hosts, err)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server := metadatatest.NewServer(metadatatest.Answers{})
+	defer server.Close()
+	server.Delay(time.Second)
+
+	src := server.Source(source.RancherOptions{ReadTimeout: 50 * time.Millisecond, Retries: 1, RetryBackoff: time.Millisecond})
+	start := time.Now()
+	if _, err := src.GetHosts(); err == nil {
+		t.Errorf("expected a timeout from a server taking a second to answer")
+	}
+	// Two attempts of 50ms each, well short of the server's delay
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("gave up after %v", elapsed)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	tests := []struct {
+		name       string
+		ignoreWait bool
+		// within is how soon a change must be seen
+		within time.Duration
+	}{
+		{"held until it changes", false, 500 * time.Millisecond},
+		{"server without wait", true, 2500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		server := metadatatest.NewServer(metadatatest.Answers{})
+		if test.ignoreWait {
+			server.IgnoreWait()
+		}
+
+		// Long polls of a minute, without wait that would spin
+		src := server.Source(source.RancherOptions{LongPoll: time.Minute})
+		versions := make(chan string, 10)
+		go src.OnChange(1, func(version string) { versions <- version })
+		if version := <-versions; version != "1" {
+			t.Errorf("%s: got first version %s, want 1", test.name, version)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+		if n := server.Requests("/version"); n > 3 {
+			t.Errorf("%s: %d version requests in 1.5s, expected it to wait or poll every second", test.name, n)
+		}
+
+		start := time.Now()
+		server.Update(func(a *metadatatest.Answers) { a.Hosts = []metadata.Host{{UUID: "host1"}} })
+		select {
+		case version := <-versions:
+			if version != "2" {
+				t.Errorf("%s: got version %s, want 2", test.name, version)
+			}
+			if elapsed := time.Since(start); elapsed > test.within {
+				t.Errorf("%s: change seen after %v, want within %v", test.name, elapsed, test.within)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: change not seen after 5s", test.name)
+		}
+		server.Close()
+	}
+}
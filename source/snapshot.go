@@ -0,0 +1,235 @@
+package source
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var (
+	lastProcessed = metrics.NewGauge("plugin_manager_metadata_last_processed_timestamp_seconds",
+		"Unix time every subscriber finished handling the latest metadata version")
+	stale = metrics.NewGauge("plugin_manager_metadata_stale",
+		"1 while reconciling against metadata cached on disk because the source is unreachable")
+	versionsSeen = metrics.NewCounter("plugin_manager_metadata_versions_total",
+		"Metadata versions seen, by whether they were fetched, failed or rejected", "result")
+)
+
+// snapshot is every answer for one metadata version
+type snapshot struct {
+	version    string
+	stale      bool
+	selfHost   metadata.Host
+	hosts      []metadata.Host
+	containers []metadata.Container
+	services   []metadata.Service
+	networks   []metadata.Network
+}
+
+type snapshotSource struct {
+	src       MetadataSource
+	cachePath string
+
+	// dispatch is held while subscribers handle a version so the snapshot
+	// can't change under them
+	dispatch         sync.Mutex
+	subscribers      []func(string)
+	deltaSubscribers []func(ContainerDelta)
+
+	lock    sync.Mutex
+	current *snapshot
+	started bool
+}
+
+// NewSnapshotCache wraps src so all of a version's answers are fetched once
+// and every subsystem handling that version sees the same data. Subscribers
+// run in parallel for a version and the next version isn't applied until
+// they all finish. Each version is saved to cachePath, unless it's empty,
+// for NewStaleSnapshotCache.
+func NewSnapshotCache(src MetadataSource, cachePath string) MetadataSource {
+	return &snapshotSource{src: src, cachePath: cachePath}
+}
+
+// NewSnapshotCacheNow is NewSnapshotCache with the current answers fetched
+// and validated straight away, for a single pass that doesn't wait for a
+// version. Broken answers are refused rather than acted on.
+func NewSnapshotCacheNow(src MetadataSource, cachePath string) (MetadataSource, error) {
+	snap, err := fetchSnapshot(src, "once")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSnapshot(snap); err != nil {
+		return nil, fmt.Errorf("refusing metadata: %v", err)
+	}
+	if cachePath != "" {
+		if err := saveSnapshot(cachePath, snap); err != nil {
+			log.Errorf("Failed to cache metadata: %v", err)
+		}
+	}
+	return &snapshotSource{src: src, cachePath: cachePath, current: snap}, nil
+}
+
+func fetchSnapshot(src MetadataSource, version string) (*snapshot, error) {
+	var (
+		s   = &snapshot{version: version}
+		err error
+	)
+	if s.selfHost, err = src.GetSelfHost(); err != nil {
+		return nil, err
+	}
+	if s.hosts, err = src.GetHosts(); err != nil {
+		return nil, err
+	}
+	if s.containers, err = src.GetContainers(); err != nil {
+		return nil, err
+	}
+	if s.services, err = src.GetServices(); err != nil {
+		return nil, err
+	}
+	if s.networks, err = src.GetNetworks(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *snapshotSource) snapshot() *snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current
+}
+
+func (s *snapshotSource) changed(version string) {
+	snap, err := fetchSnapshot(s.src, version)
+	if err != nil {
+		// The live source's answers were never validated, keep reconciling
+		// against the last good version until one can be read
+		log.Errorf("Failed to read metadata version %s: %v", version, err)
+		versionsSeen.Inc("failed")
+		return
+	} else if err := validateSnapshot(snap); err != nil {
+		// Acting on broken answers could tear down healthy networking, keep
+		// reconciling against the last good version until it's fixed
+		log.Errorf("Refusing metadata version %s: %v", version, err)
+		versionsSeen.Inc("rejected")
+		return
+	} else {
+		versionsSeen.Inc("fetched")
+		if s.cachePath != "" {
+			if err := saveSnapshot(s.cachePath, snap); err != nil {
+				log.Errorf("Failed to cache metadata version %s: %v", version, err)
+			}
+		}
+	}
+
+	s.dispatch.Lock()
+	defer s.dispatch.Unlock()
+
+	s.lock.Lock()
+	prev := s.current
+	s.current = snap
+	s.lock.Unlock()
+	stale.Set(0)
+
+	var wg sync.WaitGroup
+	for _, do := range s.subscribers {
+		wg.Add(1)
+		go func(do func(string)) {
+			defer crash.Recover()
+			defer wg.Done()
+			do(version)
+		}(do)
+	}
+	if len(s.deltaSubscribers) > 0 {
+		delta := containerDelta(prev, snap)
+		for _, do := range s.deltaSubscribers {
+			wg.Add(1)
+			go func(do func(ContainerDelta)) {
+				defer crash.Recover()
+				defer wg.Done()
+				do(delta)
+			}(do)
+		}
+	}
+	wg.Wait()
+	lastProcessed.Set(float64(time.Now().Unix()))
+}
+
+// OnChange subscribes do to new versions. The first subscriber's goroutine
+// polls the source at its interval, every call blocks forever like the
+// source's OnChange.
+func (s *snapshotSource) OnChange(intervalSeconds int, do func(string)) {
+	defer crash.Recover()
+	s.dispatch.Lock()
+	s.subscribers = append(s.subscribers, do)
+	if snap := s.snapshot(); snap != nil {
+		do(snap.version)
+	}
+	s.dispatch.Unlock()
+
+	s.run(intervalSeconds)
+}
+
+// OnContainerDelta subscribes do to the containers that changed in each new
+// version. The first delta is always a full one.
+func (s *snapshotSource) OnContainerDelta(intervalSeconds int, do func(ContainerDelta)) {
+	defer crash.Recover()
+	s.dispatch.Lock()
+	s.deltaSubscribers = append(s.deltaSubscribers, do)
+	if snap := s.snapshot(); snap != nil {
+		do(fullDelta(snap))
+	}
+	s.dispatch.Unlock()
+
+	s.run(intervalSeconds)
+}
+
+func (s *snapshotSource) run(intervalSeconds int) {
+	s.lock.Lock()
+	start := !s.started
+	s.started = true
+	s.lock.Unlock()
+
+	if start {
+		s.src.OnChange(intervalSeconds, s.changed)
+	}
+	select {}
+}
+
+func (s *snapshotSource) GetSelfHost() (metadata.Host, error) {
+	if snap := s.snapshot(); snap != nil {
+		return snap.selfHost, nil
+	}
+	return s.src.GetSelfHost()
+}
+
+func (s *snapshotSource) GetHosts() ([]metadata.Host, error) {
+	if snap := s.snapshot(); snap != nil {
+		return snap.hosts, nil
+	}
+	return s.src.GetHosts()
+}
+
+func (s *snapshotSource) GetContainers() ([]metadata.Container, error) {
+	if snap := s.snapshot(); snap != nil {
+		return snap.containers, nil
+	}
+	return s.src.GetContainers()
+}
+
+func (s *snapshotSource) GetServices() ([]metadata.Service, error) {
+	if snap := s.snapshot(); snap != nil {
+		return snap.services, nil
+	}
+	return s.src.GetServices()
+}
+
+func (s *snapshotSource) GetNetworks() ([]metadata.Network, error) {
+	if snap := s.snapshot(); snap != nil {
+		return snap.networks, nil
+	}
+	return s.src.GetNetworks()
+}
@@ -0,0 +1,50 @@
+package source
+
+import (
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("source")
+
+// IntervalSeconds is what subscribers pass to OnChange, how often sources
+// that don't long-poll check for changes and the delay after errors
+var IntervalSeconds = 5
+
+// MetadataSource is everything plugin-manager needs to know about the
+// cluster. rancher-metadata is the default implementation, other sources
+// implement it by filling in the same metadata types.
+type MetadataSource interface {
+	// OnChange calls do with a version string whenever the data changes,
+	// polling every intervalSeconds. It never returns.
+	OnChange(intervalSeconds int, do func(string))
+	GetSelfHost() (metadata.Host, error)
+	GetHosts() ([]metadata.Host, error)
+	GetContainers() ([]metadata.Container, error)
+	GetServices() ([]metadata.Service, error)
+	GetNetworks() ([]metadata.Network, error)
+}
+
+// NewRancherMetadata connects to rancher-metadata at url, waiting until it
+// answers. url may be a comma separated list of endpoints to fail over
+// between.
+func NewRancherMetadata(url string, opts RancherOptions) (MetadataSource, error) {
+	m := newRancherMetadata(url, opts)
+
+	var err error
+	for wait := 1 * time.Second; wait < 20*time.Second; wait *= 2 {
+		if _, err = m.version(); err == nil {
+			return m, nil
+		}
+		time.Sleep(wait)
+	}
+	return nil, err
+}
+
+// NewRancherMetadataNoWait is NewRancherMetadata without waiting for
+// rancher-metadata to be reachable
+func NewRancherMetadataNoWait(url string, opts RancherOptions) MetadataSource {
+	return newRancherMetadata(url, opts)
+}
@@ -0,0 +1,134 @@
+package source
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	uuidPattern     = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	hostSubnetLabel = "io.rancher.network.host_subnet"
+)
+
+// invariantErrors lists every invariant a snapshot broke
+type invariantErrors []string
+
+func (e invariantErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// subnetOwner is one subnet and where it came from, for overlap checks
+type subnetOwner struct {
+	owner  string
+	subnet *net.IPNet
+}
+
+// validateSnapshot checks the fields the reconcilers trust before anything
+// deletes rules, routes or containers based on them
+func validateSnapshot(s *snapshot) error {
+	var errs invariantErrors
+
+	if s.selfHost.UUID == "" {
+		errs = append(errs, "self host has no UUID")
+	}
+
+	var hostSubnets []subnetOwner
+	for i, host := range s.hosts {
+		if host.UUID == "" {
+			errs = append(errs, fmt.Sprintf("host %d (%s) has no UUID", i, host.Name))
+			continue
+		}
+		if value, ok := host.Labels[hostSubnetLabel]; ok {
+			_, subnet, err := net.ParseCIDR(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("host %s %s %q does not parse: %v", host.UUID, hostSubnetLabel, value, err))
+				continue
+			}
+			hostSubnets = append(hostSubnets, subnetOwner{"host " + host.UUID, subnet})
+		}
+	}
+	errs = append(errs, overlaps(hostSubnets)...)
+
+	for _, container := range s.containers {
+		if !uuidPattern.MatchString(container.UUID) {
+			errs = append(errs, fmt.Sprintf("container %s has malformed UUID %q", container.Name, container.UUID))
+		}
+	}
+
+	var networkSubnets []subnetOwner
+	for _, network := range s.networks {
+		subnets, networkErrs := networkSubnetOwners(network.Name, network.Metadata)
+		errs = append(errs, networkErrs...)
+		networkSubnets = append(networkSubnets, subnets...)
+	}
+	errs = append(errs, overlaps(networkSubnets)...)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// networkSubnetOwners collects the distinct bridge and IPAM subnets in a
+// network's CNI config files
+func networkSubnetOwners(name string, meta map[string]interface{}) ([]subnetOwner, invariantErrors) {
+	var (
+		owners []subnetOwner
+		errs   invariantErrors
+		seen   = map[string]bool{}
+	)
+
+	add := func(file, key, value string) {
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("network %s %s %s %q does not parse: %v", name, file, key, value, err))
+			return
+		}
+		if !seen[subnet.String()] {
+			seen[subnet.String()] = true
+			owners = append(owners, subnetOwner{"network " + name, subnet})
+		}
+	}
+
+	conf, _ := meta["cniConfig"].(map[string]interface{})
+	for file, config := range conf {
+		props, _ := config.(map[string]interface{})
+		if value, ok := props["bridgeSubnet"].(string); ok {
+			add(file, "bridgeSubnet", value)
+		}
+		ipam, _ := props["ipam"].(map[string]interface{})
+		if value, ok := ipam["subnet"].(string); ok {
+			add(file, "ipam subnet", value)
+		}
+	}
+	return owners, errs
+}
+
+// overlaps reports subnets with different owners that share addresses
+func overlaps(subnets []subnetOwner) invariantErrors {
+	var errs invariantErrors
+	for i := range subnets {
+		for j := i + 1; j < len(subnets); j++ {
+			a, b := subnets[i], subnets[j]
+			if a.owner == b.owner {
+				continue
+			}
+			if a.subnet.Contains(b.subnet.IP) || b.subnet.Contains(a.subnet.IP) {
+				errs = append(errs, fmt.Sprintf("%s subnet %s overlaps %s subnet %s", a.owner, a.subnet, b.owner, b.subnet))
+			}
+		}
+	}
+	return errs
+}
+
+// Validate fetches every answer from src once and checks the invariants
+// snapshots must hold before they are acted on
+func Validate(src MetadataSource) error {
+	snap, err := fetchSnapshot(src, "")
+	if err != nil {
+		return err
+	}
+	return validateSnapshot(snap)
+}
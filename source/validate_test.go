@@ -0,0 +1,62 @@
+package source_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/source/metadatatest"
+)
+
+func TestRefuseInvalidVersion(t *testing.T) {
+	server := metadatatest.NewServer(metadatatest.Answers{
+		SelfHost: metadata.Host{UUID: "host1"},
+		Hosts:    []metadata.Host{{UUID: "host1"}},
+	})
+	defer server.Close()
+
+	src := source.NewSnapshotCache(server.Source(source.RancherOptions{LongPoll: time.Second}), "")
+	versions := make(chan string, 10)
+	go src.OnChange(1, func(version string) { versions <- version })
+	<-versions
+
+	server.Update(func(a *metadatatest.Answers) {
+		a.Hosts = []metadata.Host{{UUID: "host1"}, {Name: "broken"}}
+		a.Containers = []metadata.Container{{Name: "web", UUID: "not-a-uuid"}}
+	})
+	broken := server.Version()
+
+	err := source.Validate(server.Source(source.RancherOptions{}))
+	for _, want := range []string{"host 1 (broken) has no UUID", `container web has malformed UUID "not-a-uuid"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want it to name %q", err, want)
+		}
+	}
+
+	select {
+	case version := <-versions:
+		t.Errorf("subscribers were given version %s, broken version %s should be refused", version, broken)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	if hosts, _ := src.GetHosts(); len(hosts) != 1 {
+		t.Errorf("got hosts %+v, want the last good version's", hosts)
+	}
+
+	server.Update(func(a *metadatatest.Answers) {
+		a.Hosts = []metadata.Host{{UUID: "host1"}, {UUID: "host2"}}
+		a.Containers = nil
+	})
+	select {
+	case version := <-versions:
+		if version != server.Version() {
+			t.Errorf("got version %s, want %s", version, server.Version())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fixed version not seen after 5s")
+	}
+	if hosts, _ := src.GetHosts(); len(hosts) != 2 {
+		t.Errorf("got hosts %+v, want the fixed version's", hosts)
+	}
+}
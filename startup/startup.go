@@ -0,0 +1,83 @@
+// Package startup holds a subsystem back until the ones it depends on are
+// ready, so the start order doesn't rest on how long each takes
+package startup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("startup")
+
+// checkEvery is how often unready dependencies are checked again
+var checkEvery = time.Second
+
+var waited = metrics.NewGauge("plugin_manager_startup_wait_seconds",
+	"How long a subsystem waited for its dependencies before starting, by subsystem", "subsystem")
+
+// Dependency is something a subsystem needs before it starts. Ready
+// returns nil once it is.
+type Dependency struct {
+	Name  string
+	Ready func() error
+}
+
+// NotReadyError lists the dependencies still not ready at the timeout and
+// why
+type NotReadyError map[string]string
+
+func (e NotReadyError) Error() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var notReady []string
+	for _, name := range names {
+		notReady = append(notReady, fmt.Sprintf("%s (%s)", name, e[name]))
+	}
+	return "not ready: " + strings.Join(notReady, ", ")
+}
+
+// Wait blocks until every dependency is ready or timeout passes, returning
+// a NotReadyError naming those that weren't. A dependency stays ready once
+// it has been.
+func Wait(subsystem string, deps []Dependency, timeout time.Duration) error {
+	start := time.Now()
+	defer func() { waited.Set(time.Since(start).Seconds(), subsystem) }()
+
+	pending := map[string]Dependency{}
+	for _, dep := range deps {
+		pending[dep.Name] = dep
+	}
+	reasons := map[string]string{}
+	for {
+		for name, dep := range pending {
+			err := dep.Ready()
+			if err == nil {
+				if _, ok := reasons[name]; ok {
+					log.Infof("%s is ready, %s no longer waiting for it", name, subsystem)
+				}
+				delete(pending, name)
+				delete(reasons, name)
+				continue
+			}
+			if reasons[name] != err.Error() {
+				log.Infof("%s waiting for %s: %v", subsystem, name, err)
+			}
+			reasons[name] = err.Error()
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Since(start) >= timeout {
+			return NotReadyError(reasons)
+		}
+		time.Sleep(checkEvery)
+	}
+}
@@ -0,0 +1,192 @@
+// Package store is the read-only view of metadata and Docker that the
+// subsystems share, so a container is inspected once per change instead of
+// once per subsystem.
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/rancher/plugin-manager/engine"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/source"
+)
+
+var log = logging.Subsystem("store")
+
+// UUIDLabel is the label Rancher puts its container UUID in
+const UUIDLabel = "io.rancher.container.uuid"
+
+// maxAge bounds how long an inspect result is shared when nothing
+// invalidates it
+var maxAge = 30 * time.Second
+
+// Store answers metadata from the consistent snapshot and container state
+// from a shared Docker inspect cache
+type Store interface {
+	source.MetadataSource
+
+	// Inspect returns the container's Docker state, or what another
+	// runtime knows of it in the same form. Results are shared until the
+	// container is invalidated or the metadata version changes.
+	Inspect(id string) (types.ContainerJSON, error)
+	// Invalidate drops the cached state for id so the next Inspect asks
+	// Docker, called when Docker reports the container changed
+	Invalidate(id string)
+}
+
+type inspection struct {
+	done    chan struct{}
+	at      time.Time
+	inspect types.ContainerJSON
+	err     error
+}
+
+type store struct {
+	source.MetadataSource
+	inspect func(ctx context.Context, id string) (types.ContainerJSON, error)
+
+	lock     sync.Mutex
+	inspects map[string]*inspection
+}
+
+// New builds a store over the metadata source and Docker client. Cached
+// container state is dropped whenever the metadata version changes.
+func New(c source.MetadataSource, dc *client.Client) Store {
+	return newStore(c, dc.ContainerInspect)
+}
+
+// NewRuntime builds a store over the metadata source and a runtime without
+// the Docker API. Its containers are inspected as Docker would report the
+// runtime's ID, name, image, labels, pid, start and the container whose
+// network it joins.
+func NewRuntime(c source.MetadataSource, rt engine.Runtime) Store {
+	return newStore(c, func(ctx context.Context, id string) (types.ContainerJSON, error) {
+		ec, err := rt.Inspect(ctx, id)
+		if err != nil {
+			return types.ContainerJSON{}, err
+		}
+		status := "exited"
+		if ec.Running {
+			status = "running"
+		}
+		mode := "default"
+		if ec.NetworkContainer != "" {
+			mode = "container:" + ec.NetworkContainer
+		}
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:    ec.ID,
+				Name:  "/" + ec.Name,
+				Image: ec.Image,
+				State: &types.ContainerState{
+					Status:    status,
+					Running:   ec.Running,
+					Pid:       ec.Pid,
+					StartedAt: ec.Started,
+				},
+				HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode(mode)},
+			},
+			Config: &container.Config{Image: ec.Image, Labels: ec.Labels},
+		}, nil
+	})
+}
+
+func newStore(c source.MetadataSource, inspect func(context.Context, string) (types.ContainerJSON, error)) Store {
+	s := &store{
+		MetadataSource: c,
+		inspect:        inspect,
+		inspects:       map[string]*inspection{},
+	}
+	go c.OnChange(source.IntervalSeconds, s.onChange)
+	return s
+}
+
+// IsNotFound reports whether Inspect failed because the container doesn't
+// exist, under Docker or another runtime
+func IsNotFound(err error) bool {
+	return err == engine.ErrNotFound || client.IsErrContainerNotFound(err)
+}
+
+func (s *store) onChange(version string) {
+	s.lock.Lock()
+	s.inspects = map[string]*inspection{}
+	s.lock.Unlock()
+
+	containers, err := s.GetContainers()
+	if err != nil {
+		log.WithError(err).Error("Failed to read containers to correlate log entries")
+		return
+	}
+	uuids := map[string]string{}
+	for _, container := range containers {
+		if container.ExternalId != "" && container.UUID != "" {
+			uuids[container.ExternalId] = container.UUID
+		}
+	}
+	logging.SetContainerUUIDs(uuids)
+}
+
+func (s *store) Inspect(id string) (types.ContainerJSON, error) {
+	s.lock.Lock()
+	i, ok := s.inspects[id]
+	if ok {
+		select {
+		case <-i.done:
+			if i.err != nil || time.Now().Sub(i.at) > maxAge {
+				ok = false
+			}
+		default:
+			// Another subsystem is already asking Docker, share its answer
+		}
+	}
+	if ok {
+		s.lock.Unlock()
+		<-i.done
+		return i.inspect, i.err
+	}
+
+	i = &inspection{done: make(chan struct{})}
+	s.inspects[id] = i
+	s.lock.Unlock()
+
+	i.inspect, i.err = s.inspect(context.Background(), id)
+	if i.err == nil && i.inspect.Config != nil {
+		logging.SetContainerUUID(i.inspect.ID, i.inspect.Config.Labels[UUIDLabel])
+	}
+	i.at = time.Now()
+	close(i.done)
+	return i.inspect, i.err
+}
+
+// Stale passes through source.IsStale for the wrapped source
+func (s *store) Stale() bool {
+	return source.IsStale(s.MetadataSource)
+}
+
+// OnContainerDelta passes deltas through from sources that compute them,
+// others get a full delta every version
+func (s *store) OnContainerDelta(intervalSeconds int, do func(source.ContainerDelta)) {
+	if ds, ok := s.MetadataSource.(source.DeltaSource); ok {
+		ds.OnContainerDelta(intervalSeconds, do)
+		return
+	}
+	s.MetadataSource.OnChange(intervalSeconds, func(version string) {
+		containers, err := s.GetContainers()
+		if err != nil {
+			log.Errorf("Failed to read containers for version %s: %v", version, err)
+			return
+		}
+		do(source.ContainerDelta{Version: version, Full: true, Added: containers})
+	})
+}
+
+func (s *store) Invalidate(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.inspects, id)
+}
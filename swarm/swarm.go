@@ -0,0 +1,49 @@
+// Package swarm recognizes what Docker Swarm manages on the host so
+// plugin-manager leaves its tasks, ingress network and iptables chains alone
+package swarm
+
+import (
+	"context"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("swarm")
+
+const (
+	// TaskIDLabel is set on every container Swarm runs for a service task
+	TaskIDLabel = "com.docker.swarm.task.id"
+	// ServiceIDLabel is set alongside TaskIDLabel
+	ServiceIDLabel = "com.docker.swarm.service.id"
+	// IngressChain is where Swarm DNATs its published ports to the ingress
+	// network, jumped to from nat PREROUTING, nat OUTPUT and filter FORWARD
+	IngressChain = "DOCKER-INGRESS"
+	// IngressNetwork is the overlay network carrying published ports
+	IngressNetwork = "ingress"
+)
+
+var skipped = metrics.NewCounter("plugin_manager_swarm_skipped_total",
+	"Containers left alone because Swarm manages them, by subsystem", "subsystem")
+
+// Task reports whether the container with labels is a Swarm task
+func Task(labels map[string]string) bool {
+	return labels[TaskIDLabel] != "" || labels[ServiceIDLabel] != ""
+}
+
+// Skip counts and logs subsystem leaving the Swarm task id alone
+func Skip(subsystem, id string) {
+	skipped.Inc(subsystem)
+	log.WithField(logging.ContainerIDKey, id).Debugf("%s leaving Swarm task alone", subsystem)
+}
+
+// Active reports whether the daemon c talks to is part of a swarm
+func Active(ctx context.Context, c *client.Client) (bool, error) {
+	info, err := c.Info(ctx)
+	if err != nil {
+		return false, err
+	}
+	return info.Swarm.LocalNodeState == swarm.LocalNodeStateActive, nil
+}
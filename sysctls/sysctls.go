@@ -0,0 +1,214 @@
+// Package sysctls sets the kernel settings container networking needs and
+// puts them back when config management or another agent changes them
+package sysctls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/admin"
+	"github.com/rancher/plugin-manager/audit"
+	"github.com/rancher/plugin-manager/handoff"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/watchdog"
+)
+
+var log = logging.Subsystem("sysctls")
+
+var (
+	// EnforceEvery is how often the settings are checked and set again
+	EnforceEvery = 30 * time.Second
+	// Settings are the values to enforce by key, set from --sysctl
+	Settings = Defaults()
+	procSys  = "/proc/sys"
+)
+
+var restored = metrics.NewCounter("plugin_manager_sysctls_restored_total",
+	"Settings found changed after they were set and set again, by key", "key")
+
+// Defaults are enforced unless --sysctl gives another value
+func Defaults() map[string]string {
+	return map[string]string{"net.ipv4.ip_forward": "1"}
+}
+
+// Parse reads key=value settings over the defaults. A * in a key matches
+// every interface, e.g. net.ipv4.conf.*.rp_filter=2. As with sysctl(8), a
+// key whose first separator is / is the path under /proc/sys as given, so
+// interfaces with dots in their names can be set, e.g.
+// net/ipv4/conf/eth0.100/rp_filter, and in a dotted key / stands for a dot.
+func Parse(values []string) (map[string]string, error) {
+	settings := Defaults()
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid sysctl %q, expected key=value", value)
+		}
+		key := strings.TrimSpace(parts[0])
+		for _, element := range strings.Split(keyPath(key), "/") {
+			if element == "" || element == "." || element == ".." {
+				return nil, fmt.Errorf("invalid sysctl key %q", key)
+			}
+		}
+		settings[key] = strings.TrimSpace(parts[1])
+	}
+	return settings, nil
+}
+
+// keyPath is where key is under /proc/sys
+func keyPath(key string) string {
+	if i := strings.IndexAny(key, "./"); i >= 0 && key[i] == '/' {
+		return key
+	}
+	return swapSeparators(key)
+}
+
+// swapSeparators turns the dots in a key into slashes and the slashes into
+// dots, going between the dotted and path forms
+func swapSeparators(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, key)
+}
+
+// Watch sets Settings and checks them every EnforceEvery
+func Watch() error {
+	w := newWatcher(Settings)
+	health.Register("sysctls")
+	handoff.RegisterStop("sysctls", w.pass.Lock, w.pass.Unlock)
+	admin.RegisterReconcile("sysctls", w.reconcile)
+	admin.RegisterState("sysctls", w.state)
+	watchdog.Go("sysctls.enforce", w.enforce)
+	return nil
+}
+
+func newWatcher(settings map[string]string) *watcher {
+	return &watcher{
+		settings: settings,
+		set:      map[string]bool{},
+	}
+}
+
+// Reconcile sets Settings once, for running without the daemon
+func Reconcile() error {
+	return newWatcher(Settings).apply()
+}
+
+type watcher struct {
+	pass     sync.Mutex
+	settings map[string]string
+
+	sync.Mutex
+	// set holds the paths written or found right, so a later difference
+	// is counted as restored
+	set         map[string]bool
+	lastApplied time.Time
+}
+
+func (w *watcher) state() interface{} {
+	w.Lock()
+	defer w.Unlock()
+	return map[string]interface{}{
+		"settings":    w.settings,
+		"lastApplied": w.lastApplied,
+	}
+}
+
+func (w *watcher) enforce() {
+	w.reconcile()
+	for range time.Tick(EnforceEvery) {
+		health.Heartbeat("sysctls.enforce", EnforceEvery)
+		w.reconcile()
+	}
+}
+
+// reconcile makes one pass, from the timer or admin triggered
+func (w *watcher) reconcile() error {
+	err := admin.Pass("sysctls", &w.pass, w.apply)
+	if err != nil {
+		log.WithError(err).Error("Failed to set sysctls")
+	}
+	return err
+}
+
+func (w *watcher) apply() error {
+	var keys []string
+	for key := range w.settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lastErr error
+	for _, key := range keys {
+		paths, err := filepath.Glob(filepath.Join(procSys, keyPath(key)))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(paths) == 0 && !strings.Contains(key, "*") {
+			lastErr = fmt.Errorf("%s is not available, is its kernel module loaded?", key)
+			continue
+		}
+		for _, p := range paths {
+			if err := w.applyPath(p, w.settings[key]); err != nil {
+				lastErr = err
+			}
+		}
+	}
+
+	w.Lock()
+	w.lastApplied = time.Now()
+	w.Unlock()
+	return lastErr
+}
+
+func (w *watcher) applyPath(p, value string) error {
+	key := swapSeparators(strings.TrimPrefix(p, procSys+"/"))
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	// Multi-value settings such as tcp_rmem are separated by tabs
+	before := strings.Join(strings.Fields(string(content)), " ")
+	if before == strings.Join(strings.Fields(value), " ") {
+		w.Lock()
+		w.set[p] = true
+		w.Unlock()
+		return nil
+	}
+
+	if audit.Would("sysctls", "sysctl.set", key, value) {
+		return nil
+	}
+	w.Lock()
+	wasSet := w.set[p]
+	w.Unlock()
+	if wasSet {
+		log.Warnf("%s was changed to %s outside plugin-manager, setting it back to %s", key, before, value)
+		restored.Inc(key)
+	} else {
+		log.Infof("Setting %s to %s, was %s", key, value, before)
+	}
+
+	err = ioutil.WriteFile(p, []byte(value+"\n"), 0644)
+	audit.Record("sysctls", "sysctl.set", key, before, value, err)
+	if err != nil {
+		return fmt.Errorf("setting %s: %v", key, err)
+	}
+	w.Lock()
+	w.set[p] = true
+	w.Unlock()
+	return nil
+}
@@ -0,0 +1,98 @@
+package sysctls
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   map[string]string
+		err    bool
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"net.ipv4.ip_forward": "1"},
+		},
+		{
+			name:   "added and overridden",
+			values: []string{"net.ipv4.ip_forward=0", " net.ipv4.conf.*.rp_filter = 2 "},
+			want:   map[string]string{"net.ipv4.ip_forward": "0", "net.ipv4.conf.*.rp_filter": "2"},
+		},
+		{
+			name:   "value with an equals sign",
+			values: []string{"kernel.core_pattern=|/bin/x a=b"},
+			want:   map[string]string{"net.ipv4.ip_forward": "1", "kernel.core_pattern": "|/bin/x a=b"},
+		},
+		{
+			name:   "missing value",
+			values: []string{"net.ipv4.ip_forward"},
+			err:    true,
+		},
+		{
+			name:   "missing key",
+			values: []string{"=1"},
+			err:    true,
+		},
+		{
+			name:   "path form with a dotted interface",
+			values: []string{"net/ipv4/conf/eth0.100/rp_filter=2"},
+			want:   map[string]string{"net.ipv4.ip_forward": "1", "net/ipv4/conf/eth0.100/rp_filter": "2"},
+		},
+		{
+			name:   "dotted form with a dotted interface",
+			values: []string{"net.ipv4.conf.eth0/100.rp_filter=2"},
+			want:   map[string]string{"net.ipv4.ip_forward": "1", "net.ipv4.conf.eth0/100.rp_filter": "2"},
+		},
+		{
+			name:   "escaping /proc/sys",
+			values: []string{"net..ipv4=1"},
+			err:    true,
+		},
+		{
+			name:   "escaping /proc/sys in the path form",
+			values: []string{"net/../../etc/passwd=1"},
+			err:    true,
+		},
+		{
+			name:   "absolute path",
+			values: []string{"/etc/passwd=1"},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.values)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"net.ipv4.ip_forward", "net/ipv4/ip_forward"},
+		{"net.ipv4.conf.*.rp_filter", "net/ipv4/conf/*/rp_filter"},
+		{"net/ipv4/conf/eth0.100/rp_filter", "net/ipv4/conf/eth0.100/rp_filter"},
+		{"net.ipv4.conf.eth0/100.rp_filter", "net/ipv4/conf/eth0.100/rp_filter"},
+	}
+	for _, test := range tests {
+		if got := keyPath(test.key); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.key, got, test.want)
+		}
+	}
+}
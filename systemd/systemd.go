@@ -0,0 +1,132 @@
+// Package systemd tells systemd when plugin-manager has finished starting
+// and feeds its watchdog while every subsystem is live, so a wedged process
+// is restarted
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/crash"
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("systemd")
+
+// checkEvery is how often readiness is checked before READY=1 is sent
+const checkEvery = time.Second
+
+var (
+	lock    sync.Mutex
+	started bool
+)
+
+// Notify sends state to the socket systemd names in NOTIFY_SOCKET, it does
+// nothing when not run by systemd
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// Abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogTimeout is WatchdogSec from the unit, 0 when the watchdog is off
+// or meant for another process
+func watchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Started is called once every subsystem has been started, READY=1 is sent
+// when they have all reported
+func Started() {
+	lock.Lock()
+	defer lock.Unlock()
+	started = true
+}
+
+func isStarted() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return started
+}
+
+// Start pings the watchdog at half its timeout while no subsystem fails
+// liveness, and sends READY=1 after Started once every registered
+// subsystem has reported. A loop that stops sending heartbeats or a wedged
+// reconcile stops the pings and systemd restarts the process.
+func Start() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	timeout := watchdogTimeout()
+	tick := checkEvery
+	if timeout > 0 && timeout/2 < tick {
+		tick = timeout / 2
+	}
+	if timeout > 0 {
+		log.Infof("Pinging the systemd watchdog every %v", timeout/2)
+	}
+
+	go func() {
+		defer crash.Recover()
+		ready := false
+		var lastPing time.Time
+		var withheld []string
+		for range time.Tick(tick) {
+			if !ready && isStarted() && len(health.Pending()) == 0 {
+				if err := Notify("READY=1\nSTATUS=Running"); err != nil {
+					log.WithError(err).Error("Failed to notify systemd of readiness")
+				} else {
+					ready = true
+				}
+			}
+			// Half a tick early, so ticks landing just short of the interval
+			// don't delay the ping by a whole tick
+			if timeout == 0 || time.Now().Sub(lastPing) < timeout/2-tick/2 {
+				continue
+			}
+
+			failing := health.Failing(true)
+			if len(failing) > 0 {
+				if strings.Join(failing, ",") != strings.Join(withheld, ",") {
+					log.Errorf("Not pinging the systemd watchdog, not live: %s", strings.Join(failing, ", "))
+					Notify("STATUS=Not live: " + strings.Join(failing, ", "))
+				}
+				withheld = failing
+				continue
+			}
+			if len(withheld) > 0 {
+				Notify("STATUS=Running")
+				withheld = nil
+			}
+			if err := Notify("WATCHDOG=1"); err != nil {
+				log.WithError(err).Error("Failed to ping the systemd watchdog")
+				continue
+			}
+			lastPing = time.Now()
+		}
+	}()
+}
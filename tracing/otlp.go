@@ -0,0 +1,197 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/logging"
+)
+
+var log = logging.Subsystem("tracing")
+
+var (
+	batchSize     = 256
+	queueSize     = 4096
+	flushInterval = 5 * time.Second
+
+	exporterLock sync.Mutex
+	exp          *exporter
+)
+
+type exporter struct {
+	url      string
+	resource []otlpAttribute
+	spans    chan *Span
+	client   *http.Client
+}
+
+func current() *exporter {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	return exp
+}
+
+// Configure starts exporting spans to the collector at endpoint, such as
+// http://localhost:4318. An empty endpoint leaves tracing off.
+func Configure(endpoint, serviceName string) {
+	if endpoint == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	e := &exporter{
+		url: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		resource: []otlpAttribute{
+			attribute("service.name", serviceName),
+			attribute("host.name", hostname),
+		},
+		spans:  make(chan *Span, queueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	exporterLock.Lock()
+	exp = e
+	exporterLock.Unlock()
+
+	log.Infof("Exporting traces to %s", e.url)
+	go e.run()
+}
+
+func (e *exporter) add(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		log.Debugf("Trace queue full, dropping span %s", s.name)
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.export(batch); err != nil {
+			log.WithError(err).Errorf("Failed to export %d spans", len(batch))
+		}
+		batch = nil
+	}
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest. IDs are hex and
+// 64 bit integers are strings, as the protobuf JSON mapping requires.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+func attribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusOK},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		span.Attributes = append(span.Attributes, attribute(k, v))
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+	}
+	return span
+}
+
+func (e *exporter) export(batch []*Span) error {
+	var spans []otlpSpan
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": e.resource},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "plugin-manager"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	content, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
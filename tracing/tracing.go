@@ -0,0 +1,91 @@
+// Package tracing records spans for container event handling and exports
+// them to an OpenTelemetry collector with OTLP over HTTP/JSON. Nothing is
+// recorded until Configure is called with an endpoint.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ContainerIDKey is the attribute carrying the container a span is for
+const ContainerIDKey = "container.id"
+
+type contextKey struct{}
+
+// Span is one timed stage. A nil *Span is valid and does nothing, which is
+// what Start returns while tracing is off.
+type Span struct {
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+
+	lock  sync.Mutex
+	attrs map[string]string
+	err   error
+}
+
+// Start begins a span named name, a child of the span in ctx if any. attrs
+// are key, value pairs. The returned context carries the new span.
+func Start(ctx context.Context, name string, attrs ...string) (*Span, context.Context) {
+	if current() == nil {
+		return nil, ctx
+	}
+
+	s := &Span{
+		name:  name,
+		start: time.Now(),
+		attrs: map[string]string{},
+	}
+	if parent, ok := ctx.Value(contextKey{}).(*Span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	return s, context.WithValue(ctx, contextKey{}, s)
+}
+
+// SetAttribute records a key, value pair on the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs[key] = value
+}
+
+// End finishes the span, marking it failed if err is set, and queues it
+// for export
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.lock.Unlock()
+
+	if e := current(); e != nil {
+		e.add(s)
+	}
+}
+
+// TraceID is the hex trace ID, for correlating logs with traces
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
@@ -0,0 +1,278 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/rancher/plugin-manager/config"
+	"github.com/rancher/plugin-manager/exitcode"
+	"github.com/rancher/plugin-manager/features"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/sandbox"
+	"github.com/rancher/plugin-manager/source"
+	"github.com/rancher/plugin-manager/sysctls"
+	"github.com/urfave/cli"
+)
+
+func validateConfigCommand() cli.Command {
+	return cli.Command{
+		Name:      "validate-config",
+		Usage:     "Check the config file, its fragments and the flags, listing every problem and exiting non-zero if there are any",
+		ArgsUsage: "[config file]",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "metadata",
+				Usage: "Also fetch metadata and check the subnets and other answers the subsystems rely on",
+			},
+		},
+		Action: validateConfig,
+	}
+}
+
+func validateConfig(c *cli.Context) error {
+	g := c.Parent()
+	path := g.String("config")
+	if c.NArg() > 0 {
+		path = c.Args().First()
+	}
+	if dir := g.String("config-dir"); path != "" || dir != "" {
+		if _, err := config.Apply(g, path, dir); err != nil {
+			return cli.NewExitError(err.Error(), exitcode.Config)
+		}
+	}
+
+	v := &validator{c: g}
+	v.check()
+	if c.Bool("metadata") && len(v.problems) == 0 {
+		v.checkMetadata()
+	}
+	if len(v.problems) > 0 {
+		return cli.NewExitError(strings.Join(v.problems, "\n"), exitcode.Config)
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+// validator collects every problem with the flags rather than stopping at
+// the first one
+type validator struct {
+	c        *cli.Context
+	problems []string
+}
+
+func (v *validator) problem(flag, format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf("--%s: %s", flag, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) check() {
+	c := v.c
+	if _, err := disabledSubsystems(c); err != nil {
+		v.problems = append(v.problems, err.Error())
+	}
+	if _, err := containerRuntime(c, nil); err != nil {
+		v.problem("runtime", "%v", err)
+	}
+	if err := features.SetLocal(c.StringSlice("feature")); err != nil {
+		v.problem("feature", "%v", err)
+	}
+	if _, err := sysctls.Parse(c.StringSlice("sysctl")); err != nil {
+		v.problem("sysctl", "%v", err)
+	}
+	if err := logging.SetFormat(c.String("log-format")); err != nil {
+		v.problem("log-format", "%v", err)
+	}
+	switch c.String("log-output") {
+	case "", "stderr", "syslog", "journald":
+	default:
+		v.problem("log-output", "unknown log output %q, expected stderr, syslog or journald", c.String("log-output"))
+	}
+
+	for _, name := range []string{"event-workers", "metadata-interval", "binexec-workers", "alert-threshold"} {
+		if c.Int(name) <= 0 {
+			v.problem(name, "must be more than 0, got %d", c.Int(name))
+		}
+	}
+	for _, name := range []string{"reapply-interval", "drift-check-interval", "sysctl-interval", "startup-timeout", "metadata-connect-timeout", "metadata-read-timeout"} {
+		if c.Duration(name) <= 0 {
+			v.problem(name, "must be more than 0, got %v", c.Duration(name))
+		}
+	}
+
+	// Inputs must already exist, outputs are created but must not be taken
+	// by something of the other kind
+	v.exists("metadata-file", false)
+	before := len(v.problems)
+	v.exists("metadata-ca", false)
+	v.exists("metadata-cert", false)
+	v.exists("metadata-key", false)
+	v.exists("metadata-token-file", false)
+	v.exists("binexec-trusted-keys", true)
+	v.notA("cni-conf-dir", false)
+	v.notA("kubelet-cni-dir", false)
+	v.notA("binexec-output-dir", false)
+	v.notA("state-dump-dir", false)
+	v.notA("crash-dir", false)
+	v.notA("metadata-cache", true)
+	v.notA("audit-log", true)
+	v.notA("host-lock", true)
+	v.notA("handoff-socket", true)
+	if p := c.Int("kubelet-cni-priority"); p < 0 || p > 99 {
+		v.problem("kubelet-cni-priority", "must be from 0 to 99, got %d", p)
+	}
+	if (c.String("metadata-cert") == "") != (c.String("metadata-key") == "") {
+		v.problem("metadata-cert", "--metadata-cert and --metadata-key must be given together")
+	}
+	if len(v.problems) == before {
+		// The files exist, check they hold a usable certificate and token
+		if _, err := metadataOptions(c); err != nil {
+			v.problem("metadata-ca", "%v", err)
+		}
+	}
+
+	before = len(v.problems)
+	v.exists("docker-tls-ca", false)
+	v.exists("docker-tls-cert", false)
+	v.exists("docker-tls-key", false)
+	if (c.String("docker-tls-cert") == "") != (c.String("docker-tls-key") == "") {
+		v.problem("docker-tls-cert", "--docker-tls-cert and --docker-tls-key must be given together")
+	}
+	if host := c.String("docker-host"); host != "" {
+		if _, _, _, err := client.ParseHost(host); err != nil {
+			v.problem("docker-host", "%v", err)
+		}
+	}
+	if len(v.problems) == before {
+		if _, err := source.LoadTLSConfig(c.String("docker-tls-ca"), c.String("docker-tls-cert"), c.String("docker-tls-key")); err != nil {
+			v.problem("docker-tls-ca", "%v", err)
+		} else if remoteDocker(c) && c.String("docker-tls-ca") == "" && c.String("docker-tls-cert") == "" {
+			v.problem("docker-host", "a tcp:// daemon is reached over TLS, give --docker-tls-ca or --docker-tls-cert and --docker-tls-key")
+		}
+	}
+
+	if c.String("metadata-file") != "" && c.Bool("kubernetes") {
+		v.problem("metadata-file", "conflicts with --kubernetes, both choose where metadata comes from")
+	}
+	v.url("metadata-url")
+	v.url("cattle-url")
+	if c.String("cattle-url") != "" && (c.String("cattle-access-key") == "" || c.String("cattle-secret-key") == "") {
+		v.problem("cattle-url", "needs --cattle-access-key and --cattle-secret-key")
+	}
+
+	metricsHost, metricsPort := v.listen("metrics-listen")
+	adminHost, adminPort := v.listen("admin-listen")
+	if adminPort == "" && c.Bool("pprof") {
+		adminHost, adminPort = "127.0.0.1", "6060"
+	}
+	if metricsPort != "" && metricsPort == adminPort &&
+		(metricsHost == adminHost || metricsHost == "" || adminHost == "") {
+		v.problem("metrics-listen", "port %s is also used by the admin listener", metricsPort)
+	}
+
+	if user := c.String("binexec-user"); user != "" && user != "root" {
+		if _, _, err := sandbox.ParseUser(user); err != nil {
+			v.problem("binexec-user", "%v", err)
+		}
+	}
+	if _, err := sandbox.ParseCapabilities(c.String("binexec-sandbox-capabilities")); err != nil {
+		v.problem("binexec-sandbox-capabilities", "%v", err)
+	}
+}
+
+// exists reports a missing input, or one that isn't a directory when dir
+// is set or is one when it isn't
+func (v *validator) exists(flag string, dir bool) {
+	p := v.c.String(flag)
+	if p == "" {
+		return
+	}
+	fi, err := os.Stat(p)
+	switch {
+	case err != nil:
+		v.problem(flag, "%v", err)
+	case dir && !fi.IsDir():
+		v.problem(flag, "%s is not a directory", p)
+	case !dir && fi.IsDir():
+		v.problem(flag, "%s is a directory", p)
+	}
+}
+
+// notA reports an output path that exists as a directory when file is set,
+// or as a file when it isn't, and a parent that can't hold it
+func (v *validator) notA(flag string, file bool) {
+	p := v.c.String(flag)
+	if p == "" {
+		return
+	}
+	if fi, err := os.Stat(p); err == nil {
+		switch {
+		case file && fi.IsDir():
+			v.problem(flag, "%s is a directory", p)
+		case !file && !fi.IsDir():
+			v.problem(flag, "%s is not a directory", p)
+		}
+		return
+	}
+	for parent := filepath.Dir(p); parent != p; p, parent = parent, filepath.Dir(parent) {
+		if fi, err := os.Stat(parent); err == nil {
+			if !fi.IsDir() {
+				v.problem(flag, "%s is not a directory", parent)
+			}
+			return
+		}
+	}
+}
+
+func (v *validator) url(flag string) {
+	value := v.c.String(flag)
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		v.problem(flag, "%v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		v.problem(flag, "%q is not an http or https URL", value)
+	}
+}
+
+// listen checks a listen address and returns its host, empty for every
+// address, and port
+func (v *validator) listen(flag string) (string, string) {
+	addr := v.c.String(flag)
+	if addr == "" {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.problem(flag, "%v", err)
+		return "", ""
+	}
+	if host == "0.0.0.0" || host == "::" {
+		host = ""
+	}
+	return host, port
+}
+
+func (v *validator) checkMetadata() {
+	opts, err := metadataOptions(v.c)
+	if err != nil {
+		v.problems = append(v.problems, err.Error())
+		return
+	}
+	src, err := metadataSource(v.c, opts, false)
+	if err != nil {
+		v.problems = append(v.problems, fmt.Sprintf("metadata: %v", err))
+		return
+	}
+	if err := source.Validate(src); err != nil {
+		v.problems = append(v.problems, fmt.Sprintf("metadata: %v", err))
+	}
+}
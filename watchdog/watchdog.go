@@ -0,0 +1,139 @@
+// Package watchdog notices long-running loops that stopped sending
+// heartbeats, logs where they are stuck and can start them again
+package watchdog
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/plugin-manager/health"
+	"github.com/rancher/plugin-manager/logging"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+var log = logging.Subsystem("watchdog")
+
+// maxRestarts bounds how often one loop is started again
+const maxRestarts = 5
+
+var (
+	stalls = metrics.NewCounter("plugin_manager_watchdog_stalls_total",
+		"Times a long-running loop stopped sending heartbeats, by loop", "loop")
+	restartsDone = metrics.NewCounter("plugin_manager_watchdog_restarts_total",
+		"Times a stalled loop was started again, by loop", "loop")
+)
+
+var (
+	lock     sync.Mutex
+	loops    = map[string]*loop{}
+	restarts = map[string]int{}
+	// reported holds the last heartbeat of each stall that was logged, so
+	// a stall is only logged once
+	reported = map[string]time.Time{}
+)
+
+// loop is a long-running loop started with Go, running while its goroutine
+// hasn't returned
+type loop struct {
+	run     func()
+	running bool
+}
+
+// Go runs loop in a new goroutine. loop must send heartbeats as name, if it
+// stops and its goroutine has returned the watchdog may run it again.
+func Go(name string, run func()) {
+	l := &loop{run: run}
+	lock.Lock()
+	loops[name] = l
+	l.start()
+	lock.Unlock()
+}
+
+// start runs the loop in a new goroutine with the lock held, only while it
+// isn't running so a restart never runs two of it at once
+func (l *loop) start() {
+	l.running = true
+	go func() {
+		defer func() {
+			lock.Lock()
+			l.running = false
+			lock.Unlock()
+		}()
+		l.run()
+	}()
+}
+
+// Start checks for stalled loops every interval. With restart set, the
+// ones started with Go are started again once their goroutine returned.
+func Start(interval time.Duration, restart bool) {
+	go func() {
+		for range time.Tick(interval) {
+			check(restart)
+		}
+	}()
+}
+
+func check(restart bool) {
+	missed := health.Missed()
+	if len(missed) == 0 {
+		return
+	}
+	stacks := goroutines()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for name, beat := range missed {
+		// A stall is logged once, but checked for a restart until its
+		// goroutine returns
+		first := !reported[name].Equal(beat.Last)
+		if first {
+			reported[name] = beat.Last
+			stalls.Inc(name)
+
+			stack, ok := stacks[beat.Goroutine]
+			if !ok {
+				stack = fmt.Sprintf("goroutine %d has exited", beat.Goroutine)
+			}
+			log.Errorf("%s has not sent a heartbeat since %v, expected every %v:\n%s", name, beat.Last, beat.Every, stack)
+		}
+
+		l, ok := loops[name]
+		if !restart || !ok {
+			continue
+		}
+		if l.running {
+			if first {
+				log.Warnf("Not restarting %s until its goroutine returns", name)
+			}
+			continue
+		}
+		if restarts[name] >= maxRestarts {
+			if first {
+				log.Errorf("Not restarting %s, it has already been restarted %d times", name, restarts[name])
+			}
+			continue
+		}
+		restarts[name]++
+		restartsDone.Inc(name)
+		log.Warnf("Restarting %s", name)
+		l.start()
+	}
+}
+
+// goroutines returns the stack of every goroutine by ID
+func goroutines() map[int]string {
+	buf := &bytes.Buffer{}
+	pprof.Lookup("goroutine").WriteTo(buf, 2)
+	stacks := map[int]string{}
+	for _, stack := range strings.Split(buf.String(), "\n\n") {
+		var id int
+		if _, err := fmt.Sscanf(stack, "goroutine %d ", &id); err == nil {
+			stacks[id] = strings.TrimSpace(stack)
+		}
+	}
+	return stacks
+}
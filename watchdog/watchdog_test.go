@@ -0,0 +1,44 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/plugin-manager/health"
+)
+
+func TestRestartAfterReturn(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	health.Heartbeat("watchdog.test", time.Millisecond)
+	Go("watchdog.test", func() {
+		started <- struct{}{}
+		<-release
+	})
+	<-started
+	time.Sleep(10 * time.Millisecond)
+
+	check(true)
+	select {
+	case <-started:
+		t.Fatal("restarted while the stalled goroutine was still running")
+	default:
+	}
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		running := loops["watchdog.test"].running
+		lock.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	check(true)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("not restarted after the stalled goroutine returned")
+	}
+}